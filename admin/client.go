@@ -0,0 +1,276 @@
+package admin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+const (
+	unixScheme = "unix://"
+	tcpScheme  = "tcp://"
+)
+
+// Client talks to the admin API of a running daemon
+type Client struct {
+	http *http.Client
+	base string
+}
+
+// NewClient creates a client for the admin API at the given address, which is either a unix socket
+// (unix:///path or /path) or a TCP address (tcp://host:port), which requires a TLS config
+func NewClient(addr string, config *tls.Config) (*Client, error) {
+	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, unixScheme) {
+		sock := strings.TrimPrefix(addr, unixScheme)
+		transport := &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", sock)
+			},
+		}
+		return &Client{http: &http.Client{Transport: transport}, base: "http://cloudvol"}, nil
+	}
+
+	if config == nil {
+		return nil, fmt.Errorf("the admin API can only be reached on TCP with a client certificate")
+	}
+	transport := &http.Transport{TLSClientConfig: config}
+	return &Client{
+		http: &http.Client{Transport: transport},
+		base: "https://" + strings.TrimPrefix(addr, tcpScheme),
+	}, nil
+}
+
+// List gets all volumes
+func (c *Client) List(ctx context.Context) ([]*Volume, error) {
+	var vols []*Volume
+	err := c.do(ctx, http.MethodGet, "volumes", nil, &vols)
+	return vols, err
+}
+
+// Inspect gets the state of a volume
+func (c *Client) Inspect(ctx context.Context, name string) (*Volume, error) {
+	vol := &Volume{}
+	if err := c.do(ctx, http.MethodGet, volumePath(name), nil, vol); err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// Options gets the volume options accepted by the storage driver
+func (c *Client) Options(ctx context.Context) ([]*Option, error) {
+	var opts []*Option
+	err := c.do(ctx, http.MethodGet, "options", nil, &opts)
+	return opts, err
+}
+
+// Create makes a new volume
+func (c *Client) Create(ctx context.Context, req *CreateRequest) (*Volume, error) {
+	vol := &Volume{}
+	if err := c.do(ctx, http.MethodPost, "volumes", req, vol); err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// Remove deletes a volume
+func (c *Client) Remove(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, volumePath(name), nil, nil)
+}
+
+// Import adopts existing storage as a volume
+func (c *Client) Import(ctx context.Context, name string) (*Volume, error) {
+	vol := &Volume{}
+	if err := c.do(ctx, http.MethodPost, volumePath(name)+"/import", nil, vol); err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// Label changes the labels of a volume
+func (c *Client) Label(ctx context.Context, name string, req *LabelRequest) (*Volume, error) {
+	vol := &Volume{}
+	if err := c.do(ctx, http.MethodPatch, volumePath(name), req, vol); err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// Snapshot starts taking a snapshot of a volume
+func (c *Client) Snapshot(ctx context.Context, name string, req *SnapshotRequest) (*Operation, error) {
+	return c.startOperation(ctx, name, OperationSnapshot, req)
+}
+
+// Resize starts growing a volume
+func (c *Client) Resize(ctx context.Context, name string, req *ResizeRequest) (*Operation, error) {
+	return c.startOperation(ctx, name, OperationResize, req)
+}
+
+// Detach starts detaching a volume
+func (c *Client) Detach(ctx context.Context, name string, req *DetachRequest) (*Operation, error) {
+	return c.startOperation(ctx, name, OperationDetach, req)
+}
+
+// Migrate starts moving a volume to the location of the daemon's instance
+func (c *Client) Migrate(ctx context.Context, name string, req *MigrateRequest) (*Operation, error) {
+	return c.startOperation(ctx, name, OperationMigrate, req)
+}
+
+// Tune starts changing the provisioned performance of a volume
+func (c *Client) Tune(ctx context.Context, name string, req *TuneRequest) (*Operation, error) {
+	return c.startOperation(ctx, name, OperationTune, req)
+}
+
+// Backup starts backing up a volume
+func (c *Client) Backup(ctx context.Context, name string, req *BackupRequest) (*Operation, error) {
+	return c.startOperation(ctx, name, OperationBackup, req)
+}
+
+// Backups gets the backups of a volume, or of every volume if name is empty
+func (c *Client) Backups(ctx context.Context, name string) ([]*Backup, error) {
+	path := "backups"
+	if name != "" {
+		path += "?volume=" + url.QueryEscape(name)
+	}
+
+	var backups []*Backup
+	err := c.do(ctx, http.MethodGet, path, nil, &backups)
+	return backups, err
+}
+
+// Restore starts restoring a backup into a new volume
+func (c *Client) Restore(ctx context.Context, name string, id string, req *RestoreRequest) (*Operation, error) {
+	op := &Operation{}
+	if err := c.do(ctx, http.MethodPost, backupPath(name, id)+"/restore", req, op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// DeleteBackup deletes a backup
+func (c *Client) DeleteBackup(ctx context.Context, name string, id string) error {
+	return c.do(ctx, http.MethodDelete, backupPath(name, id), nil, nil)
+}
+
+// Reconcile repairs inconsistencies between local and cloud state
+func (c *Client) Reconcile(ctx context.Context, req *ReconcileRequest) (*ReconcileResult, error) {
+	result := &ReconcileResult{}
+	if err := c.do(ctx, http.MethodPost, "reconcile", req, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Operation gets the state of an operation
+func (c *Client) Operation(ctx context.Context, id string) (*Operation, error) {
+	op := &Operation{}
+	if err := c.do(ctx, http.MethodGet, "operations/"+url.PathEscape(id), nil, op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// Operations gets the state of all recent operations
+func (c *Client) Operations(ctx context.Context) ([]*Operation, error) {
+	var ops []*Operation
+	err := c.do(ctx, http.MethodGet, "operations", nil, &ops)
+	return ops, err
+}
+
+// startOperation posts an action on a volume
+func (c *Client) startOperation(ctx context.Context, name string, action string, req interface{}) (*Operation, error) {
+	op := &Operation{}
+	if err := c.do(ctx, http.MethodPost, volumePath(name)+"/"+action, req, op); err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// do makes a request to the admin API and decodes the response into result
+func (c *Client) do(ctx context.Context, method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.base+apiPrefix+path, reader)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("error contacting cloudvol daemon: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		apiErr := &Error{}
+		if err = json.NewDecoder(res.Body).Decode(apiErr); err != nil || apiErr.Message == "" {
+			return fmt.Errorf("cloudvol daemon returned %s", res.Status)
+		}
+		switch res.StatusCode {
+		case http.StatusNotImplemented:
+			if apiErr.Message == ErrBackupsNotConfigured.Error() {
+				return ErrBackupsNotConfigured
+			}
+			return ErrNotSupported
+		case http.StatusBadRequest:
+			return &invalidRequestError{apiErr.Message}
+		}
+		return fmt.Errorf("%s", apiErr.Message)
+	}
+
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// volumePath gets the API path of a volume
+func volumePath(name string) string {
+	return "volumes/" + url.PathEscape(name)
+}
+
+// backupPath gets the API path of a backup
+func backupPath(name string, id string) string {
+	return "backups/" + url.PathEscape(name) + "/" + url.PathEscape(id)
+}
+
+// Wait polls an operation until it is no longer running or the context is done
+func Wait(ctx context.Context, api API, op *Operation, interval time.Duration) (*Operation, error) {
+	for op.State == OperationRunning {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		var err error
+		if op, err = api.Operation(ctx, op.ID); err != nil {
+			return nil, err
+		}
+	}
+	return op, nil
+}
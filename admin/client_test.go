@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestClientDecodesErrors(t *testing.T) {
+	tests := []struct {
+		code     int
+		body     string
+		expected string
+	}{
+		{http.StatusNotImplemented, `{"message": "` + ErrBackupsNotConfigured.Error() + `"}`, ErrBackupsNotConfigured.Error()},
+		{http.StatusNotImplemented, `{"message": "other"}`, ErrNotSupported.Error()},
+		{http.StatusBadRequest, `{"message": "bad"}`, "bad"},
+		{http.StatusForbidden, `{"message": "not allowed"}`, "not allowed"},
+		{http.StatusInternalServerError, `not json`, "cloudvol daemon returned 500 Internal Server Error"},
+		{http.StatusBadGateway, `{}`, "cloudvol daemon returned 502 Bad Gateway"},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.code)
+			w.Write([]byte(test.body))
+		}))
+		c := &Client{http: http.DefaultClient, base: server.URL}
+
+		_, err := c.List(context.Background())
+		if err == nil || err.Error() != test.expected {
+			t.Errorf("%d %s: expected '%s', got %v", test.code, test.body, test.expected, err)
+		}
+		server.Close()
+	}
+}
+
+func TestClientPaths(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.RequestURI())
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	c := &Client{http: http.DefaultClient, base: server.URL}
+	ctx := context.Background()
+
+	c.Inspect(ctx, "a/b")
+	c.Import(ctx, "data")
+	c.Tune(ctx, "data", &TuneRequest{Iops: 1})
+	c.Backups(ctx, "a b")
+	c.Restore(ctx, "data", "2017 1", &RestoreRequest{})
+	c.DeleteBackup(ctx, "data", "id")
+	c.Reconcile(ctx, &ReconcileRequest{DryRun: true})
+
+	expected := []string{
+		"GET /v1/volumes/a%2Fb",
+		"POST /v1/volumes/data/import",
+		"POST /v1/volumes/data/tune",
+		"GET /v1/backups?volume=a+b",
+		"POST /v1/backups/data/2017%201/restore",
+		"DELETE /v1/backups/data/id",
+		"POST /v1/reconcile",
+	}
+	if strings.Join(paths, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected requests\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(paths, "\n"))
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	c := &Client{http: http.DefaultClient, base: server.URL}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.List(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the request to time out, got %v", err)
+	}
+}
+
+func TestWaitCancel(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	d.block = make(chan struct{})
+	defer close(d.block)
+	s := NewService(d, nil)
+
+	op, err := s.Snapshot(context.Background(), "data", &SnapshotRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = Wait(ctx, s, op, time.Hour); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait to time out, got %v", err)
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	for _, addr := range []string{"/run/cloudvol/admin.sock", "unix:///run/cloudvol/admin.sock"} {
+		c, err := NewClient(addr, nil)
+		if err != nil || c.base != "http://cloudvol" {
+			t.Errorf("%s: unexpected result %v (%v)", addr, c, err)
+		}
+	}
+	if _, err := NewClient("tcp://host:1234", nil); err == nil {
+		t.Errorf("expected TCP without TLS to be refused")
+	}
+}
@@ -0,0 +1,348 @@
+package admin
+
+// openAPISpec describes the admin API
+const openAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "cloudvol admin API",
+    "description": "Operations on cloudvol volumes which docker's volume plugin protocol can't express",
+    "version": "1"
+  },
+  "paths": {
+    "/v1/options": {
+      "get": {
+        "summary": "List the volume options accepted by the storage driver",
+        "responses": {
+          "200": {"description": "options", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Option"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/volumes": {
+      "get": {
+        "summary": "List volumes",
+        "responses": {
+          "200": {"description": "volumes", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Volume"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a volume",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateRequest"}}}},
+        "responses": {
+          "201": {"description": "volume", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Volume"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/volumes/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "get": {
+        "summary": "Inspect the state of a volume",
+        "responses": {
+          "200": {"description": "volume", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Volume"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "patch": {
+        "summary": "Change the labels of a volume",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/LabelRequest"}}}},
+        "responses": {
+          "200": {"description": "volume", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Volume"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Remove a volume",
+        "responses": {
+          "200": {"description": "removed"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/volumes/{name}/import": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Adopt existing storage which cloudvol didn't create as a volume",
+        "responses": {
+          "200": {"description": "volume", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Volume"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/volumes/{name}/snapshot": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Take a snapshot of a volume",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/SnapshotRequest"}}}},
+        "responses": {
+          "202": {"$ref": "#/components/responses/Operation"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/volumes/{name}/resize": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Grow a volume and its file system",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ResizeRequest"}}}},
+        "responses": {
+          "202": {"$ref": "#/components/responses/Operation"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/volumes/{name}/detach": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Detach a volume from this instance, or with force from every instance",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/DetachRequest"}}}},
+        "responses": {
+          "202": {"$ref": "#/components/responses/Operation"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/volumes/{name}/migrate": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Move a volume to the location of this instance",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/MigrateRequest"}}}},
+        "responses": {
+          "202": {"$ref": "#/components/responses/Operation"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/volumes/{name}/tune": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Change the provisioned IOPS and throughput of a volume",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TuneRequest"}}}},
+        "responses": {
+          "202": {"$ref": "#/components/responses/Operation"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/volumes/{name}/backup": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}],
+      "post": {
+        "summary": "Back up a volume to the backup target",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/BackupRequest"}}}},
+        "responses": {
+          "202": {"$ref": "#/components/responses/Operation"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/backups": {
+      "get": {
+        "summary": "List backups",
+        "parameters": [{"name": "volume", "in": "query", "description": "only list the backups of this volume", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "backups", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Backup"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/backups/{name}/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}, {"$ref": "#/components/parameters/BackupID"}],
+      "delete": {
+        "summary": "Delete a backup",
+        "responses": {
+          "200": {"description": "deleted"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/backups/{name}/{id}/restore": {
+      "parameters": [{"$ref": "#/components/parameters/Name"}, {"$ref": "#/components/parameters/BackupID"}],
+      "post": {
+        "summary": "Restore a backup into a new volume",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/RestoreRequest"}}}},
+        "responses": {
+          "202": {"$ref": "#/components/responses/Operation"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/reconcile": {
+      "post": {
+        "summary": "Repair differences between local and cloud state",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReconcileRequest"}}}},
+        "responses": {
+          "200": {"description": "repairs", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ReconcileResult"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/operations": {
+      "get": {
+        "summary": "List recent operations",
+        "responses": {
+          "200": {"description": "operations", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Operation"}}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/operations/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "Get the state of an operation",
+        "responses": {
+          "200": {"description": "operation", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Operation"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "parameters": {
+      "Name": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+      "BackupID": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Operation": {"description": "operation started", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Operation"}}}},
+      "Error": {"description": "error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Volume": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "path": {"type": "string"},
+          "ready": {"type": "boolean"},
+          "status": {"type": "object", "additionalProperties": true}
+        }
+      },
+      "Option": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "prefix": {"type": "boolean", "description": "the option matches every name starting with name"},
+          "type": {"type": "string", "enum": ["string", "int", "bool", "enum"]},
+          "min": {"type": "integer"},
+          "max": {"type": "integer"},
+          "values": {"type": "array", "items": {"type": "string"}},
+          "default": {"type": "string"},
+          "description": {"type": "string"}
+        }
+      },
+      "Snapshot": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "volume": {"type": "string"},
+          "sizeGb": {"type": "integer"},
+          "created": {"type": "string"},
+          "status": {"type": "string"},
+          "inconsistent": {"type": "boolean", "description": "the snapshot wasn't captured before the volume was thawed or its post hook ran"}
+        }
+      },
+      "CreateRequest": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string"},
+          "options": {"type": "object", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "LabelRequest": {
+        "type": "object",
+        "properties": {
+          "set": {"type": "object", "additionalProperties": {"type": "string"}},
+          "remove": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "ReconcileRequest": {
+        "type": "object",
+        "properties": {"dryRun": {"type": "boolean"}}
+      },
+      "ReconcileResult": {
+        "type": "object",
+        "properties": {
+          "dryRun": {"type": "boolean"},
+          "actions": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "volume": {"type": "string"},
+                "action": {"type": "string"},
+                "reason": {"type": "string"},
+                "error": {"type": "string"}
+              }
+            }
+          }
+        }
+      },
+      "SnapshotRequest": {
+        "type": "object",
+        "properties": {"name": {"type": "string", "description": "generated if empty"}}
+      },
+      "ResizeRequest": {
+        "type": "object",
+        "required": ["sizeGb"],
+        "properties": {"sizeGb": {"type": "integer", "minimum": 1}}
+      },
+      "DetachRequest": {
+        "type": "object",
+        "properties": {"force": {"type": "boolean"}}
+      },
+      "MigrateRequest": {
+        "type": "object",
+        "properties": {"deleteSource": {"type": "boolean"}}
+      },
+      "TuneRequest": {
+        "type": "object",
+        "properties": {
+          "iops": {"type": "integer", "minimum": 1, "description": "unchanged if omitted"},
+          "throughput": {"type": "integer", "minimum": 1, "description": "MB/s, unchanged if omitted"}
+        }
+      },
+      "BackupRequest": {
+        "type": "object",
+        "properties": {"snapshot": {"type": "boolean", "description": "back up a copy made from a snapshot rather than the live file system"}}
+      },
+      "RestoreRequest": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string", "description": "name of the new volume, the backed up volume's name if empty"},
+          "options": {"type": "object", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "Backup": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "volume": {"type": "string"},
+          "created": {"type": "string", "format": "date-time"},
+          "source": {"type": "string", "enum": ["volume", "snapshot"]},
+          "files": {"type": "integer"},
+          "size": {"type": "integer", "description": "bytes of file content"},
+          "stored": {"type": "integer", "description": "compressed bytes added to the store"},
+          "chunks": {"type": "integer", "description": "chunks added to the store"}
+        }
+      },
+      "Operation": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "type": {"type": "string", "enum": ["snapshot", "resize", "detach", "migrate", "tune", "backup", "restore"]},
+          "volume": {"type": "string"},
+          "state": {"type": "string", "enum": ["running", "done", "failed"]},
+          "error": {"type": "string"},
+          "result": {"description": "Snapshot for snapshot operations, Backup for backup operations, Volume for migrate, tune and restore operations"},
+          "started": {"type": "string", "format": "date-time"},
+          "finished": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {"message": {"type": "string"}}
+      }
+    }
+  }
+}
+`
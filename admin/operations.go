@@ -0,0 +1,114 @@
+package admin
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+const (
+	operationRetention = time.Hour
+)
+
+// operationFunc is the work done by an operation
+type operationFunc func(ctx context.Context) (interface{}, error)
+
+// operationTracker runs long running jobs in the background and keeps their state
+type operationTracker struct {
+	mu  sync.Mutex
+	ops map[string]*Operation
+}
+
+// newOperationTracker creates a new operation tracker
+func newOperationTracker() *operationTracker {
+	return &operationTracker{ops: make(map[string]*Operation)}
+}
+
+// start runs the given function in the background and returns the new operation
+func (t *operationTracker) start(ctx context.Context, kind string, volume string, fn operationFunc) *Operation {
+	op := &Operation{
+		ID:      logging.NewRequestID(),
+		Type:    kind,
+		Volume:  volume,
+		State:   OperationRunning,
+		Started: time.Now().UTC(),
+	}
+
+	t.mu.Lock()
+	t.prune()
+	t.ops[op.ID] = op
+	started := *op
+	t.mu.Unlock()
+
+	// the operation outlives the request, but keeps its correlation ID
+	opCtx := logging.WithRequestID(context.Background(), logging.RequestID(ctx))
+
+	go func() {
+		logging.FromContext(opCtx).WithFields(log.Fields{
+			"operation": op.ID,
+			"type":      kind,
+			"volume":    volume,
+		}).Info("ADMIN: operation started")
+
+		result, err := fn(opCtx)
+		finished := time.Now().UTC()
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		op.Finished = &finished
+
+		if err != nil {
+			op.State = OperationFailed
+			op.Error = err.Error()
+			logging.FromContext(opCtx).WithFields(log.Fields{
+				"operation": op.ID,
+				"err":       err,
+			}).Error("ADMIN: operation failed")
+			return
+		}
+
+		op.State = OperationDone
+		op.Result = result
+		logging.FromContext(opCtx).WithFields(log.Fields{"operation": op.ID}).Info("ADMIN: operation done")
+	}()
+
+	return &started
+}
+
+// get gets a copy of an operation
+func (t *operationTracker) get(id string) (*Operation, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	op, exists := t.ops[id]
+	if !exists {
+		return nil, false
+	}
+	copy := *op
+	return &copy, true
+}
+
+// list gets copies of all operations
+func (t *operationTracker) list() []*Operation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ops := make([]*Operation, 0, len(t.ops))
+	for _, op := range t.ops {
+		copy := *op
+		ops = append(ops, &copy)
+	}
+	return ops
+}
+
+// prune forgets operations which finished longer ago than the retention period, the lock must be held
+func (t *operationTracker) prune() {
+	for id, op := range t.ops {
+		if op.Finished != nil && time.Since(*op.Finished) > operationRetention {
+			delete(t.ops, id)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+func TestOperationTracker(t *testing.T) {
+	tracker := newOperationTracker()
+	done := make(chan struct{})
+	requestIDs := make(chan string, 1)
+
+	ctx, cancel := context.WithCancel(logging.WithRequestID(context.Background(), "request"))
+	op := tracker.start(ctx, OperationResize, "data", func(ctx context.Context) (interface{}, error) {
+		<-done
+		requestIDs <- logging.RequestID(ctx)
+		return nil, ctx.Err()
+	})
+	if op.State != OperationRunning {
+		t.Errorf("expected the operation to be running, got %v", op)
+	}
+
+	// the operation outlives the request which started it
+	cancel()
+	close(done)
+	if id := <-requestIDs; id != "request" {
+		t.Errorf("expected the operation to keep the request ID, got '%s'", id)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if op, _ = tracker.get(op.ID); op.State != OperationRunning {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if op.State != OperationDone {
+		t.Errorf("expected the operation to be done, got %v", op)
+	}
+
+	failed := tracker.start(context.Background(), OperationResize, "data", func(ctx context.Context) (interface{}, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	for i := 0; i < 1000; i++ {
+		if failed, _ = tracker.get(failed.ID); failed.State != OperationRunning {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if failed.State != OperationFailed || failed.Error != "failed" {
+		t.Errorf("expected the operation to fail, got %v", failed)
+	}
+}
+
+func TestOperationTrackerPrune(t *testing.T) {
+	tracker := newOperationTracker()
+	old := time.Now().Add(-2 * operationRetention)
+	recent := time.Now()
+	tracker.ops["old"] = &Operation{ID: "old", State: OperationDone, Finished: &old}
+	tracker.ops["recent"] = &Operation{ID: "recent", State: OperationDone, Finished: &recent}
+	tracker.ops["running"] = &Operation{ID: "running", State: OperationRunning}
+
+	tracker.mu.Lock()
+	tracker.prune()
+	tracker.mu.Unlock()
+
+	if _, exists := tracker.get("old"); exists {
+		t.Errorf("expected the old operation to be forgotten")
+	}
+	if len(tracker.list()) != 2 {
+		t.Errorf("expected 2 operations to be kept, got %v", tracker.list())
+	}
+}
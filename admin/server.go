@@ -0,0 +1,280 @@
+package admin
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/driver"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+const (
+	apiPrefix       = "/v1/"
+	requestIDHeader = "X-Request-Id"
+	maxRequestSize  = 1 << 20
+)
+
+// requestIDPattern is what a client's correlation ID must look like to be logged, others are replaced
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Server serves the admin API over HTTP
+type Server struct {
+	service API
+}
+
+// NewServer creates a new admin API server
+func NewServer(service API) *Server {
+	return &Server{service: service}
+}
+
+// ServeUnix serves the admin API on a unix socket which only the owner can connect to
+func (s *Server) ServeUnix(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return err
+	}
+
+	log.WithFields(log.Fields{"socket": path}).Info("ADMIN: listening on socket file")
+	return http.Serve(l, s)
+}
+
+// ServeTCP serves the admin API on a TCP address; the TLS config must authenticate clients
+func (s *Server) ServeTCP(addr string, config *tls.Config) error {
+	if config == nil || config.ClientAuth != tls.RequireAndVerifyClientCert {
+		return fmt.Errorf("the admin API can only be served on TCP with client certificate authentication")
+	}
+
+	l, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"addr": l.Addr().String()}).Info("ADMIN: listening with mutual TLS")
+	return http.Serve(l, s)
+}
+
+// ServeHTTP routes an admin API request
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = logging.NewRequestID()
+	}
+	ctx := logging.WithRequestID(r.Context(), id)
+	w.Header().Set(requestIDHeader, id)
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	}).Info("ADMIN REQUEST")
+
+	if !strings.HasPrefix(r.URL.Path, apiPrefix) {
+		s.writeError(ctx, w, http.StatusNotFound, fmt.Errorf("not found"))
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, apiPrefix), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "openapi.json" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, openAPISpec)
+
+	case len(parts) == 1 && parts[0] == "options" && r.Method == http.MethodGet:
+		opts, err := s.service.Options(ctx)
+		s.writeResult(ctx, w, http.StatusOK, opts, err)
+
+	case len(parts) == 1 && parts[0] == "volumes" && r.Method == http.MethodGet:
+		vols, err := s.service.List(ctx)
+		s.writeResult(ctx, w, http.StatusOK, vols, err)
+
+	case len(parts) == 1 && parts[0] == "volumes" && r.Method == http.MethodPost:
+		req := &CreateRequest{}
+		err := decodeRequest(w, r, req)
+		var vol *Volume
+		if err == nil {
+			vol, err = s.service.Create(ctx, req)
+		}
+		s.writeResult(ctx, w, http.StatusCreated, vol, err)
+
+	case len(parts) == 2 && parts[0] == "volumes" && r.Method == http.MethodGet:
+		vol, err := s.service.Inspect(ctx, parts[1])
+		s.writeResult(ctx, w, http.StatusOK, vol, err)
+
+	case len(parts) == 2 && parts[0] == "volumes" && r.Method == http.MethodDelete:
+		err := s.service.Remove(ctx, parts[1])
+		s.writeResult(ctx, w, http.StatusOK, struct{}{}, err)
+
+	case len(parts) == 2 && parts[0] == "volumes" && r.Method == http.MethodPatch:
+		req := &LabelRequest{}
+		err := decodeRequest(w, r, req)
+		var vol *Volume
+		if err == nil {
+			vol, err = s.service.Label(ctx, parts[1], req)
+		}
+		s.writeResult(ctx, w, http.StatusOK, vol, err)
+
+	case len(parts) == 3 && parts[0] == "volumes" && parts[2] == "import" && r.Method == http.MethodPost:
+		vol, err := s.service.Import(ctx, parts[1])
+		s.writeResult(ctx, w, http.StatusOK, vol, err)
+
+	case len(parts) == 3 && parts[0] == "volumes" && r.Method == http.MethodPost:
+		s.serveVolumeAction(ctx, w, r, parts[1], parts[2])
+
+	case len(parts) == 1 && parts[0] == "backups" && r.Method == http.MethodGet:
+		backups, err := s.service.Backups(ctx, r.URL.Query().Get("volume"))
+		s.writeResult(ctx, w, http.StatusOK, backups, err)
+
+	case len(parts) == 3 && parts[0] == "backups" && r.Method == http.MethodDelete:
+		err := s.service.DeleteBackup(ctx, parts[1], parts[2])
+		s.writeResult(ctx, w, http.StatusOK, struct{}{}, err)
+
+	case len(parts) == 4 && parts[0] == "backups" && parts[3] == "restore" && r.Method == http.MethodPost:
+		req := &RestoreRequest{}
+		err := decodeRequest(w, r, req)
+		var op *Operation
+		if err == nil {
+			op, err = s.service.Restore(ctx, parts[1], parts[2], req)
+		}
+		s.writeResult(ctx, w, http.StatusAccepted, op, err)
+
+	case len(parts) == 1 && parts[0] == "reconcile" && r.Method == http.MethodPost:
+		req := &ReconcileRequest{}
+		err := decodeRequest(w, r, req)
+		var result *ReconcileResult
+		if err == nil {
+			result, err = s.service.Reconcile(ctx, req)
+		}
+		s.writeResult(ctx, w, http.StatusOK, result, err)
+
+	case len(parts) == 1 && parts[0] == "operations" && r.Method == http.MethodGet:
+		ops, err := s.service.Operations(ctx)
+		s.writeResult(ctx, w, http.StatusOK, ops, err)
+
+	case len(parts) == 2 && parts[0] == "operations" && r.Method == http.MethodGet:
+		op, err := s.service.Operation(ctx, parts[1])
+		s.writeResult(ctx, w, http.StatusOK, op, err)
+
+	default:
+		s.writeError(ctx, w, http.StatusNotFound, fmt.Errorf("no route for %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// serveVolumeAction starts an operation on a volume
+func (s *Server) serveVolumeAction(ctx context.Context, w http.ResponseWriter, r *http.Request, name string, action string) {
+	var op *Operation
+	var err error
+
+	switch action {
+	case OperationSnapshot:
+		req := &SnapshotRequest{}
+		if err = decodeRequest(w, r, req); err == nil {
+			op, err = s.service.Snapshot(ctx, name, req)
+		}
+	case OperationResize:
+		req := &ResizeRequest{}
+		if err = decodeRequest(w, r, req); err == nil {
+			op, err = s.service.Resize(ctx, name, req)
+		}
+	case OperationDetach:
+		req := &DetachRequest{}
+		if err = decodeRequest(w, r, req); err == nil {
+			op, err = s.service.Detach(ctx, name, req)
+		}
+	case OperationMigrate:
+		req := &MigrateRequest{}
+		if err = decodeRequest(w, r, req); err == nil {
+			op, err = s.service.Migrate(ctx, name, req)
+		}
+	case OperationTune:
+		req := &TuneRequest{}
+		if err = decodeRequest(w, r, req); err == nil {
+			op, err = s.service.Tune(ctx, name, req)
+		}
+	case OperationBackup:
+		req := &BackupRequest{}
+		if err = decodeRequest(w, r, req); err == nil {
+			op, err = s.service.Backup(ctx, name, req)
+		}
+	default:
+		s.writeError(ctx, w, http.StatusNotFound, fmt.Errorf("unknown action '%s'", action))
+		return
+	}
+
+	s.writeResult(ctx, w, http.StatusAccepted, op, err)
+}
+
+// decodeRequest reads a json request body, an empty body leaves the defaults
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if r.ContentLength == 0 {
+		return nil
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(v); err != nil {
+		return &invalidRequestError{fmt.Sprintf("invalid request body: %v", err)}
+	}
+	return nil
+}
+
+// writeResult writes a json response, or an error response if err is set
+func (s *Server) writeResult(ctx context.Context, w http.ResponseWriter, code int, v interface{}, err error) {
+	if err != nil {
+		s.writeError(ctx, w, errorStatus(err), err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err = json.NewEncoder(w).Encode(v); err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("ADMIN RESPONSE: error writing response")
+	}
+}
+
+// writeError writes a json error response
+func (s *Server) writeError(ctx context.Context, w http.ResponseWriter, code int, err error) {
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"code": code,
+		"err":  err,
+	}).Error("ADMIN RESPONSE: error")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&Error{Message: err.Error()})
+}
+
+// errorStatus gets the HTTP status code for an error
+func errorStatus(err error) int {
+	switch err.(type) {
+	case *invalidRequestError, *driver.OptionsError:
+		return http.StatusBadRequest
+	case *driver.PolicyError:
+		return http.StatusForbidden
+	case *driver.CapacityError:
+		return http.StatusConflict
+	}
+
+	switch err {
+	case ErrNotSupported, ErrBackupsNotConfigured:
+		return http.StatusNotImplemented
+	case ErrOperationNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
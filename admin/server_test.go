@@ -0,0 +1,225 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stugotech/cloudvol2/driver"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+// newTestServer serves the admin API of a service over HTTP and gets a client for it
+func newTestServer(service API) (*Client, *httptest.Server) {
+	server := httptest.NewServer(NewServer(service))
+	return &Client{http: http.DefaultClient, base: server.URL}, server
+}
+
+func TestServerVolumes(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	c, server := newTestServer(NewService(d, nil))
+	defer server.Close()
+	ctx := context.Background()
+
+	vol, err := c.Create(ctx, &CreateRequest{Name: "data", Options: map[string]string{"sizeGb": "10"}})
+	if err != nil || vol.Name != "data" {
+		t.Fatalf("unexpected result %v (%v)", vol, err)
+	}
+	if vol, err = c.Inspect(ctx, "data"); err != nil || vol.Name != "data" {
+		t.Errorf("unexpected result %v (%v)", vol, err)
+	}
+	if vols, err := c.List(ctx); err != nil || len(vols) != 1 || vols[0].Name != "data" {
+		t.Errorf("expected one volume, got %v (%v)", vols, err)
+	}
+
+	vol, err = c.Label(ctx, "data", &LabelRequest{Set: map[string]string{"team": "a"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if labels, ok := vol.Status["labels"].(map[string]interface{}); !ok || labels["team"] != "a" {
+		t.Errorf("expected the label to be set, got %v", vol.Status)
+	}
+
+	opts, err := c.Options(ctx)
+	if err != nil || len(opts) != 2 || opts[0].Name != "sizeGb" || opts[0].Type != "int" || !opts[1].Prefix {
+		t.Errorf("unexpected options %v (%v)", opts, err)
+	}
+
+	if err = c.Remove(ctx, "data"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = c.Inspect(ctx, "data"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected the volume not to be found, got %v", err)
+	}
+}
+
+func TestServerOperations(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	c, server := newTestServer(NewService(d, nil))
+	defer server.Close()
+	ctx := context.Background()
+	if _, err := c.Create(ctx, &CreateRequest{Name: "data"}); err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := c.Snapshot(ctx, "data", &SnapshotRequest{Name: "snap"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op.ID == "" || op.Type != OperationSnapshot {
+		t.Errorf("unexpected operation %v", op)
+	}
+	op = waitForOperation(t, c, op)
+	if result, ok := op.Result.(map[string]interface{}); op.State != OperationDone || !ok || result["name"] != "snap" {
+		t.Errorf("expected the snapshot as the result, got %v", op)
+	}
+
+	if ops, err := c.Operations(ctx); err != nil || len(ops) != 1 || ops[0].ID != op.ID {
+		t.Errorf("expected the operation to be listed, got %v (%v)", ops, err)
+	}
+	if _, err = c.Operation(ctx, "missing"); err == nil || err.Error() != ErrOperationNotFound.Error() {
+		t.Errorf("expected the operation not to be found, got %v", err)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	c, server := newTestServer(NewService(d, nil))
+	defer server.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{http.MethodGet, "/other", "", http.StatusNotFound},
+		{http.MethodGet, "/v1/nothing", "", http.StatusNotFound},
+		{http.MethodPut, "/v1/volumes", "", http.StatusNotFound},
+		{http.MethodPost, "/v1/volumes/data/unknown", "", http.StatusNotFound},
+		{http.MethodPost, "/v1/volumes", "{", http.StatusBadRequest},
+		{http.MethodPost, "/v1/volumes", `{"name": ""}`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/volumes", `{"name": "data", "options": {"sizeGb": "-1"}}`, http.StatusBadRequest},
+		{http.MethodPost, "/v1/volumes/data/resize", `{"sizeGb": 0}`, http.StatusBadRequest},
+		{http.MethodGet, "/v1/backups", "", http.StatusNotImplemented},
+		{http.MethodGet, "/v1/operations/missing", "", http.StatusNotFound},
+		{http.MethodGet, "/v1/volumes/missing", "", http.StatusInternalServerError},
+		{http.MethodGet, "/v1/openapi.json", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != test.code {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.path, test.code, res.StatusCode)
+		}
+		if res.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s: expected a json response", test.method, test.path)
+		}
+	}
+
+	// errors keep their meaning through the client
+	if _, err := c.Backups(ctx, "data"); err != ErrBackupsNotConfigured {
+		t.Errorf("expected backups not to be configured, got %v", err)
+	}
+	if _, err := c.Create(ctx, &CreateRequest{}); errorStatus(err) != http.StatusBadRequest {
+		t.Errorf("expected a bad request, got %v", err)
+	}
+
+	c, server = newTestServer(NewService(basicDriver{d}, nil))
+	defer server.Close()
+	if _, err := c.Snapshot(ctx, "data", &SnapshotRequest{}); err != ErrNotSupported {
+		t.Errorf("expected the operation not to be supported, got %v", err)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{&invalidRequestError{"bad"}, http.StatusBadRequest},
+		{&driver.OptionsError{}, http.StatusBadRequest},
+		{&driver.PolicyError{}, http.StatusForbidden},
+		{&driver.CapacityError{}, http.StatusConflict},
+		{ErrNotSupported, http.StatusNotImplemented},
+		{ErrBackupsNotConfigured, http.StatusNotImplemented},
+		{ErrOperationNotFound, http.StatusNotFound},
+		{context.Canceled, http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if code := errorStatus(test.err); code != test.code {
+			t.Errorf("%v: expected %d, got %d", test.err, test.code, code)
+		}
+	}
+}
+
+func TestServerRequestID(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	_, server := newTestServer(NewService(d, nil))
+	defer server.Close()
+
+	tests := []struct {
+		id   string
+		kept bool
+	}{
+		{"", false},
+		{"abc-123_x.y", true},
+		{strings.Repeat("a", 64), true},
+		{strings.Repeat("a", 65), false},
+		{"a b", false},
+		{"a\"b", false},
+		{"ü", false},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/v1/volumes", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(requestIDHeader, test.id)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		id := res.Header.Get(requestIDHeader)
+		if test.kept && id != test.id {
+			t.Errorf("%q: expected the ID to be kept, got %q", test.id, id)
+		} else if !test.kept && (id == test.id || !requestIDPattern.MatchString(id)) {
+			t.Errorf("%q: expected a new ID, got %q", test.id, id)
+		}
+	}
+}
+
+func TestClientRequestID(t *testing.T) {
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(requestIDHeader)
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	c := &Client{http: http.DefaultClient, base: server.URL}
+
+	if _, err := c.List(logging.WithRequestID(context.Background(), "abc")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if received != "abc" {
+		t.Errorf("expected the request ID to be sent, got '%s'", received)
+	}
+}
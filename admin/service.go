@@ -0,0 +1,515 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/backup"
+	"github.com/stugotech/cloudvol2/driver"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+// Operation types
+const (
+	OperationSnapshot = "snapshot"
+	OperationResize   = "resize"
+	OperationDetach   = "detach"
+	OperationMigrate  = "migrate"
+	OperationTune     = "tune"
+	OperationBackup   = "backup"
+	OperationRestore  = "restore"
+)
+
+var (
+	// ErrNotSupported is returned when the storage driver does not implement an operation
+	ErrNotSupported = errors.New("operation not supported by the storage driver")
+	// ErrOperationNotFound is returned when an operation ID is unknown
+	ErrOperationNotFound = errors.New("operation not found")
+	// ErrBackupsNotConfigured is returned for backup operations when no backup target is set
+	ErrBackupsNotConfigured = errors.New("backups are not configured, set a backup target")
+)
+
+// API is the set of admin operations, implemented locally by Service and remotely by Client
+type API interface {
+	// List gets all volumes
+	List(ctx context.Context) ([]*Volume, error)
+	// Inspect gets the state of a volume
+	Inspect(ctx context.Context, name string) (*Volume, error)
+	// Options gets the volume options accepted by the storage driver
+	Options(ctx context.Context) ([]*Option, error)
+	// Create makes a new volume
+	Create(ctx context.Context, req *CreateRequest) (*Volume, error)
+	// Remove deletes a volume
+	Remove(ctx context.Context, name string) error
+	// Import adopts existing storage as a volume
+	Import(ctx context.Context, name string) (*Volume, error)
+	// Label changes the labels of a volume
+	Label(ctx context.Context, name string, req *LabelRequest) (*Volume, error)
+	// Snapshot starts taking a snapshot of a volume
+	Snapshot(ctx context.Context, name string, req *SnapshotRequest) (*Operation, error)
+	// Resize starts growing a volume
+	Resize(ctx context.Context, name string, req *ResizeRequest) (*Operation, error)
+	// Detach starts detaching a volume
+	Detach(ctx context.Context, name string, req *DetachRequest) (*Operation, error)
+	// Migrate starts moving a volume to the location of this instance
+	Migrate(ctx context.Context, name string, req *MigrateRequest) (*Operation, error)
+	// Tune starts changing the provisioned performance of a volume
+	Tune(ctx context.Context, name string, req *TuneRequest) (*Operation, error)
+	// Backup starts backing up a volume
+	Backup(ctx context.Context, name string, req *BackupRequest) (*Operation, error)
+	// Backups gets the backups of a volume, or of every volume if name is empty
+	Backups(ctx context.Context, name string) ([]*Backup, error)
+	// Restore starts restoring a backup into a new volume
+	Restore(ctx context.Context, name string, id string, req *RestoreRequest) (*Operation, error)
+	// DeleteBackup deletes a backup
+	DeleteBackup(ctx context.Context, name string, id string) error
+	// Reconcile repairs inconsistencies between local and cloud state
+	Reconcile(ctx context.Context, req *ReconcileRequest) (*ReconcileResult, error)
+	// Operation gets the state of an operation
+	Operation(ctx context.Context, id string) (*Operation, error)
+	// Operations gets the state of all recent operations
+	Operations(ctx context.Context) ([]*Operation, error)
+}
+
+// invalidRequestError is returned when a request is malformed
+type invalidRequestError struct {
+	message string
+}
+
+func (e *invalidRequestError) Error() string {
+	return e.message
+}
+
+// Service implements the admin operations on top of a storage driver
+type Service struct {
+	driver  driver.Driver
+	backups *backup.Engine
+	ops     *operationTracker
+}
+
+// NewService creates a new admin service for the given driver, backups are not supported if the backup
+// engine is nil
+func NewService(d driver.Driver, backups *backup.Engine) *Service {
+	return &Service{
+		driver:  d,
+		backups: backups,
+		ops:     newOperationTracker(),
+	}
+}
+
+// List gets all volumes
+func (s *Service) List(ctx context.Context) ([]*Volume, error) {
+	vols, err := s.driver.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Volume, 0, len(vols))
+	for _, vol := range vols {
+		result = append(result, toVolume(vol))
+	}
+	return result, nil
+}
+
+// Inspect gets the state of a volume
+func (s *Service) Inspect(ctx context.Context, name string) (*Volume, error) {
+	vol, err := s.driver.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return toVolume(vol), nil
+}
+
+// Options gets the volume options accepted by the storage driver
+func (s *Service) Options(ctx context.Context) ([]*Option, error) {
+	describer, ok := s.driver.(driver.Describer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	schema := describer.Options()
+	result := make([]*Option, 0, len(schema))
+	for _, opt := range schema {
+		result = append(result, &Option{
+			Name:        opt.Name,
+			Prefix:      opt.Prefix,
+			Type:        string(opt.Type),
+			Min:         opt.Min,
+			Max:         opt.Max,
+			Values:      opt.Values,
+			Default:     opt.Default,
+			Description: opt.Description,
+		})
+	}
+	return result, nil
+}
+
+// Create makes a new volume
+func (s *Service) Create(ctx context.Context, req *CreateRequest) (*Volume, error) {
+	if req.Name == "" {
+		return nil, &invalidRequestError{"volume name is required"}
+	}
+
+	vol, err := s.driver.Create(ctx, req.Name, req.Options)
+	if err != nil {
+		return nil, err
+	}
+	return toVolume(vol), nil
+}
+
+// Remove deletes a volume
+func (s *Service) Remove(ctx context.Context, name string) error {
+	return s.driver.Remove(ctx, name)
+}
+
+// Import adopts existing storage as a volume
+func (s *Service) Import(ctx context.Context, name string) (*Volume, error) {
+	importer, ok := s.driver.(driver.Importer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	vol, err := importer.Import(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return toVolume(vol), nil
+}
+
+// Label changes the labels of a volume
+func (s *Service) Label(ctx context.Context, name string, req *LabelRequest) (*Volume, error) {
+	labeller, ok := s.driver.(driver.Labeller)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if len(req.Set) == 0 && len(req.Remove) == 0 {
+		return nil, &invalidRequestError{"no labels to set or remove"}
+	}
+
+	vol, err := labeller.SetLabels(ctx, name, req.Set, req.Remove)
+	if err != nil {
+		return nil, err
+	}
+	return toVolume(vol), nil
+}
+
+// Snapshot starts taking a snapshot of a volume
+func (s *Service) Snapshot(ctx context.Context, name string, req *SnapshotRequest) (*Operation, error) {
+	snapshotter, ok := s.driver.(driver.Snapshotter)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return s.ops.start(ctx, OperationSnapshot, name, func(ctx context.Context) (interface{}, error) {
+		snapshot, err := snapshotter.Snapshot(ctx, name, req.Name)
+		if err != nil {
+			return nil, err
+		}
+		return toSnapshot(snapshot), nil
+	}), nil
+}
+
+// Resize starts growing a volume
+func (s *Service) Resize(ctx context.Context, name string, req *ResizeRequest) (*Operation, error) {
+	resizer, ok := s.driver.(driver.Resizer)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if req.SizeGb <= 0 {
+		return nil, &invalidRequestError{fmt.Sprintf("invalid size %dGB", req.SizeGb)}
+	}
+
+	return s.ops.start(ctx, OperationResize, name, func(ctx context.Context) (interface{}, error) {
+		return nil, resizer.Resize(ctx, name, req.SizeGb)
+	}), nil
+}
+
+// Detach starts detaching a volume, from this instance or with force from every instance
+func (s *Service) Detach(ctx context.Context, name string, req *DetachRequest) (*Operation, error) {
+	if !req.Force {
+		return s.ops.start(ctx, OperationDetach, name, func(ctx context.Context) (interface{}, error) {
+			return nil, s.driver.Unmount(ctx, name)
+		}), nil
+	}
+
+	detacher, ok := s.driver.(driver.Detacher)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return s.ops.start(ctx, OperationDetach, name, func(ctx context.Context) (interface{}, error) {
+		return nil, detacher.ForceDetach(ctx, name)
+	}), nil
+}
+
+// Migrate starts moving a volume to the location of this instance
+func (s *Service) Migrate(ctx context.Context, name string, req *MigrateRequest) (*Operation, error) {
+	migrator, ok := s.driver.(driver.Migrator)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	return s.ops.start(ctx, OperationMigrate, name, func(ctx context.Context) (interface{}, error) {
+		vol, err := migrator.Migrate(ctx, name, driver.MigrateOptions{DeleteSource: req.DeleteSource})
+		if err != nil {
+			return nil, err
+		}
+		return toVolume(vol), nil
+	}), nil
+}
+
+// Tune starts changing the provisioned performance of a volume
+func (s *Service) Tune(ctx context.Context, name string, req *TuneRequest) (*Operation, error) {
+	setter, ok := s.driver.(driver.PerformanceSetter)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if req.Iops < 0 || req.Throughput < 0 || (req.Iops == 0 && req.Throughput == 0) {
+		return nil, &invalidRequestError{"iops or throughput must be a positive number"}
+	}
+
+	return s.ops.start(ctx, OperationTune, name, func(ctx context.Context) (interface{}, error) {
+		vol, err := setter.SetPerformance(ctx, name, req.Iops, req.Throughput)
+		if err != nil {
+			return nil, err
+		}
+		return toVolume(vol), nil
+	}), nil
+}
+
+// Backup starts backing up a volume, from its live file system or from a copy made from a snapshot
+func (s *Service) Backup(ctx context.Context, name string, req *BackupRequest) (*Operation, error) {
+	if s.backups == nil {
+		return nil, ErrBackupsNotConfigured
+	}
+	if !req.Snapshot {
+		return s.ops.start(ctx, OperationBackup, name, func(ctx context.Context) (interface{}, error) {
+			return s.backupVolume(ctx, name)
+		}), nil
+	}
+
+	cloner, ok := s.driver.(driver.Cloner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return s.ops.start(ctx, OperationBackup, name, func(ctx context.Context) (interface{}, error) {
+		return s.backupClone(ctx, cloner, name)
+	}), nil
+}
+
+// backupVolume backs up the live file system of a volume, mounting it for the backup if it isn't mounted
+func (s *Service) backupVolume(ctx context.Context, name string) (*Backup, error) {
+	vol, err := s.driver.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	path := vol.Path
+	if path == "" {
+		if path, err = s.driver.Mount(ctx, name); err != nil {
+			return nil, err
+		}
+		defer s.unmount(ctx, name)
+	}
+
+	b, err := s.backups.Backup(ctx, name, backup.SourceVolume, path)
+	if err != nil {
+		return nil, err
+	}
+	return toBackup(b), nil
+}
+
+// backupClone backs up a read-only copy of a volume made from a snapshot, deleting the copy afterwards;
+// a copy which can't be deleted fails the backup so that it isn't left behind unnoticed
+func (s *Service) backupClone(ctx context.Context, cloner driver.Cloner, name string) (result *Backup, err error) {
+	clone, err := cloner.Clone(ctx, name, "backup-"+logging.NewRequestID())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		made := result
+		if err = s.remove(ctx, clone.Name, err); err != nil {
+			result = nil
+			if made != nil {
+				err = fmt.Errorf("backup '%s' was made, but %v", made.ID, err)
+			}
+		}
+	}()
+
+	path, err := s.driver.Mount(ctx, clone.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer s.unmount(ctx, clone.Name)
+
+	b, err := s.backups.Backup(ctx, name, backup.SourceSnapshot, path)
+	if err != nil {
+		return nil, err
+	}
+	return toBackup(b), nil
+}
+
+// Backups gets the backups of a volume, or of every volume if name is empty
+func (s *Service) Backups(ctx context.Context, name string) ([]*Backup, error) {
+	if s.backups == nil {
+		return nil, ErrBackupsNotConfigured
+	}
+
+	backups, err := s.backups.List(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Backup, 0, len(backups))
+	for _, b := range backups {
+		result = append(result, toBackup(b))
+	}
+	return result, nil
+}
+
+// Restore starts restoring a backup into a new volume, which is removed if the restore fails
+func (s *Service) Restore(ctx context.Context, name string, id string, req *RestoreRequest) (*Operation, error) {
+	if s.backups == nil {
+		return nil, ErrBackupsNotConfigured
+	}
+	target := req.Name
+	if target == "" {
+		target = name
+	}
+
+	return s.ops.start(ctx, OperationRestore, target, func(ctx context.Context) (interface{}, error) {
+		vol, err := s.driver.Create(ctx, target, req.Options)
+		if err != nil {
+			return nil, err
+		}
+
+		// drivers may leave new volumes mounted, which are left as they are
+		path, mounted := vol.Path, false
+		if path == "" {
+			if path, err = s.driver.Mount(ctx, target); err != nil {
+				return nil, s.remove(ctx, target, err)
+			}
+			mounted = true
+		}
+
+		if _, err = s.backups.Restore(ctx, name, id, path); err != nil {
+			s.unmount(ctx, target)
+			return nil, s.remove(ctx, target, err)
+		}
+
+		if mounted {
+			s.unmount(ctx, target)
+		}
+		if vol, err = s.driver.Get(ctx, target); err != nil {
+			return nil, err
+		}
+		return toVolume(vol), nil
+	}), nil
+}
+
+// DeleteBackup deletes a backup
+func (s *Service) DeleteBackup(ctx context.Context, name string, id string) error {
+	if s.backups == nil {
+		return ErrBackupsNotConfigured
+	}
+	return s.backups.Delete(ctx, name, id)
+}
+
+// unmount unmounts a volume mounted by an operation, logging rather than returning errors
+func (s *Service) unmount(ctx context.Context, name string) {
+	if err := s.driver.Unmount(ctx, name); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{"volume": name, "err": err}).Warn("ADMIN: error unmounting volume")
+	}
+}
+
+// remove deletes a volume created by an operation, adding the error if it can't be deleted to the
+// operation's error, which may be nil
+func (s *Service) remove(ctx context.Context, name string, opErr error) error {
+	err := s.driver.Remove(ctx, name)
+	if err == nil {
+		return opErr
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{"volume": name, "err": err}).Warn("ADMIN: error removing volume")
+	if opErr == nil {
+		return fmt.Errorf("volume '%s' was left behind as it couldn't be removed: %v", name, err)
+	}
+	return fmt.Errorf("%v, and volume '%s' was left behind as it couldn't be removed: %v", opErr, name, err)
+}
+
+// Reconcile repairs inconsistencies between local and cloud state
+func (s *Service) Reconcile(ctx context.Context, req *ReconcileRequest) (*ReconcileResult, error) {
+	reconciler, ok := s.driver.(driver.Reconciler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	actions, err := reconciler.Reconcile(ctx, req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReconcileResult{DryRun: req.DryRun, Actions: make([]*ReconcileAction, 0, len(actions))}
+	for _, action := range actions {
+		result.Actions = append(result.Actions, &ReconcileAction{
+			Volume: action.Volume,
+			Action: action.Action,
+			Reason: action.Reason,
+			Error:  action.Error,
+		})
+	}
+	return result, nil
+}
+
+// Operation gets the state of an operation
+func (s *Service) Operation(ctx context.Context, id string) (*Operation, error) {
+	op, exists := s.ops.get(id)
+	if !exists {
+		return nil, ErrOperationNotFound
+	}
+	return op, nil
+}
+
+// Operations gets the state of all recent operations
+func (s *Service) Operations(ctx context.Context) ([]*Operation, error) {
+	return s.ops.list(), nil
+}
+
+// toVolume converts a driver volume
+func toVolume(vol *driver.Volume) *Volume {
+	return &Volume{
+		Name:   vol.Name,
+		Path:   vol.Path,
+		Ready:  vol.Ready,
+		Status: vol.Status,
+	}
+}
+
+// toSnapshot converts a driver snapshot
+func toSnapshot(snapshot *driver.Snapshot) *Snapshot {
+	return &Snapshot{
+		Name:    snapshot.Name,
+		Volume:  snapshot.Volume,
+		SizeGb:  snapshot.SizeGb,
+		Created: snapshot.Created,
+		Status:  snapshot.Status,
+
+		Inconsistent: snapshot.Inconsistent,
+	}
+}
+
+// toBackup converts a backup
+func toBackup(b *backup.Backup) *Backup {
+	return &Backup{
+		ID:      b.ID,
+		Volume:  b.Volume,
+		Created: b.Created,
+		Source:  b.Source,
+		Files:   b.Files,
+		Size:    b.Size,
+		Stored:  b.Stored,
+		Chunks:  b.Chunks,
+	}
+}
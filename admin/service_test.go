@@ -0,0 +1,493 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stugotech/cloudvol2/backup"
+	"github.com/stugotech/cloudvol2/driver"
+	"github.com/stugotech/cloudvol2/fs"
+	"golang.org/x/net/context"
+)
+
+// fakeDriver keeps volumes in memory and mounts them on directories under root, refusing to mount a
+// mounted volume or remove one which is mounted as the GCE driver does
+type fakeDriver struct {
+	root string
+	// mountOnCreate leaves new volumes mounted, as the GCE driver does for read-write volumes
+	mountOnCreate bool
+	// failMount and failRemove are returned by Mount and Remove when set
+	failMount  error
+	failRemove error
+	// block, when set, holds every snapshot until it is closed or the context is done
+	block chan struct{}
+
+	mu      sync.Mutex
+	volumes map[string]*driver.Volume
+	labels  map[string]map[string]string
+	sizes   map[string]int64
+}
+
+func newFakeDriver(t *testing.T) (*fakeDriver, func()) {
+	root, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &fakeDriver{
+		root:    root,
+		volumes: make(map[string]*driver.Volume),
+		labels:  make(map[string]map[string]string),
+		sizes:   make(map[string]int64),
+	}
+	return d, func() { os.RemoveAll(root) }
+}
+
+func (d *fakeDriver) Create(ctx context.Context, name string, opts map[string]string) (*driver.Volume, error) {
+	d.mu.Lock()
+	if _, exists := d.volumes[name]; exists {
+		d.mu.Unlock()
+		return nil, fmt.Errorf("volume '%s' already exists", name)
+	}
+	if opts["sizeGb"] == "-1" {
+		d.mu.Unlock()
+		return nil, &driver.OptionsError{Problems: []string{"option 'sizeGb': invalid"}}
+	}
+	d.volumes[name] = &driver.Volume{Name: name, Status: map[string]interface{}{}}
+	d.labels[name] = map[string]string{}
+	d.mu.Unlock()
+
+	if d.mountOnCreate {
+		if _, err := d.Mount(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	return d.Get(ctx, name)
+}
+
+func (d *fakeDriver) Remove(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	vol, exists := d.volumes[id]
+	switch {
+	case !exists:
+		return fmt.Errorf("volume '%s' not found", id)
+	case d.failRemove != nil:
+		return d.failRemove
+	case vol.Path != "":
+		return fmt.Errorf("volume '%s' is mounted on '%s'", id, vol.Path)
+	}
+	delete(d.volumes, id)
+	return nil
+}
+
+func (d *fakeDriver) List(ctx context.Context) ([]*driver.Volume, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var vols []*driver.Volume
+	for _, vol := range d.volumes {
+		copy := *vol
+		vols = append(vols, &copy)
+	}
+	return vols, nil
+}
+
+func (d *fakeDriver) Get(ctx context.Context, id string) (*driver.Volume, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	vol, exists := d.volumes[id]
+	if !exists {
+		return nil, fmt.Errorf("volume '%s' not found", id)
+	}
+	copy := *vol
+	return &copy, nil
+}
+
+func (d *fakeDriver) Mount(ctx context.Context, id string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	vol, exists := d.volumes[id]
+	switch {
+	case !exists:
+		return "", fmt.Errorf("volume '%s' not found", id)
+	case vol.Path != "":
+		return vol.Path, fmt.Errorf("volume '%s' already mounted on '%s'", id, vol.Path)
+	case d.failMount != nil:
+		return "", d.failMount
+	}
+
+	p := filepath.Join(d.root, id)
+	if err := os.MkdirAll(p, 0700); err != nil {
+		return "", err
+	}
+	vol.Path = p
+	vol.Ready = true
+	return p, nil
+}
+
+func (d *fakeDriver) Unmount(ctx context.Context, id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	vol, exists := d.volumes[id]
+	if !exists {
+		return fmt.Errorf("volume '%s' not found", id)
+	}
+	vol.Path = ""
+	vol.Ready = false
+	return nil
+}
+
+func (d *fakeDriver) Snapshot(ctx context.Context, id string, name string) (*driver.Snapshot, error) {
+	if d.block != nil {
+		select {
+		case <-d.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if _, err := d.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	return &driver.Snapshot{Name: name, Volume: id, SizeGb: 10, Status: "READY"}, nil
+}
+
+func (d *fakeDriver) Resize(ctx context.Context, id string, sizeGb int64) error {
+	if _, err := d.Get(ctx, id); err != nil {
+		return err
+	}
+	if sizeGb > 100 {
+		return &driver.PolicyError{Volume: id, Violations: []string{"too large"}}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sizes[id] = sizeGb
+	return nil
+}
+
+func (d *fakeDriver) Clone(ctx context.Context, id string, cloneID string) (*driver.Volume, error) {
+	if _, err := d.Get(ctx, id); err != nil {
+		return nil, err
+	}
+
+	// copies are read-only, so they are never left mounted
+	d.mu.Lock()
+	d.volumes[cloneID] = &driver.Volume{Name: cloneID, Status: map[string]interface{}{}}
+	d.labels[cloneID] = map[string]string{}
+	d.mu.Unlock()
+	return d.Get(ctx, cloneID)
+}
+
+func (d *fakeDriver) SetLabels(ctx context.Context, id string, set map[string]string, remove []string) (*driver.Volume, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	vol, exists := d.volumes[id]
+	if !exists {
+		return nil, fmt.Errorf("volume '%s' not found", id)
+	}
+	for key, value := range set {
+		d.labels[id][key] = value
+	}
+	for _, key := range remove {
+		delete(d.labels[id], key)
+	}
+	vol.Status["labels"] = d.labels[id]
+	copy := *vol
+	return &copy, nil
+}
+
+func (d *fakeDriver) Options() driver.Schema {
+	return driver.Schema{
+		{Name: "sizeGb", Type: driver.OptionInt, Min: 1, Description: "size"},
+		{Name: "label.", Prefix: true, Type: driver.OptionString},
+	}
+}
+
+func (d *fakeDriver) exists(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, exists := d.volumes[name]
+	return exists
+}
+
+// basicDriver hides every optional interface of a driver
+type basicDriver struct {
+	driver.Driver
+}
+
+// waitForOperation waits for an operation to finish
+func waitForOperation(t *testing.T, api API, op *Operation) *Operation {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	op, err := Wait(ctx, api, op, time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return op
+}
+
+func TestServiceCreate(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	s := NewService(d, nil)
+	ctx := context.Background()
+
+	if _, err := s.Create(ctx, &CreateRequest{}); errorStatus(err) != 400 {
+		t.Errorf("expected a bad request without a name, got %v", err)
+	}
+	vol, err := s.Create(ctx, &CreateRequest{Name: "data"})
+	if err != nil || vol.Name != "data" {
+		t.Fatalf("unexpected result %v (%v)", vol, err)
+	}
+	if vols, err := s.List(ctx); err != nil || len(vols) != 1 {
+		t.Errorf("expected one volume, got %v (%v)", vols, err)
+	}
+	if err = s.Remove(ctx, "data"); err != nil || d.exists("data") {
+		t.Errorf("expected the volume to be removed (%v)", err)
+	}
+}
+
+func TestServiceValidation(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	s := NewService(d, nil)
+	ctx := context.Background()
+
+	if _, err := s.Label(ctx, "data", &LabelRequest{}); errorStatus(err) != 400 {
+		t.Errorf("expected a bad request without labels, got %v", err)
+	}
+	if _, err := s.Resize(ctx, "data", &ResizeRequest{SizeGb: 0}); errorStatus(err) != 400 {
+		t.Errorf("expected a bad request without a size, got %v", err)
+	}
+	if _, err := s.Backup(ctx, "data", &BackupRequest{}); err != ErrBackupsNotConfigured {
+		t.Errorf("expected backups not to be configured, got %v", err)
+	}
+	if _, err := s.Backups(ctx, ""); err != ErrBackupsNotConfigured {
+		t.Errorf("expected backups not to be configured, got %v", err)
+	}
+	if _, err := s.Restore(ctx, "data", "id", &RestoreRequest{}); err != ErrBackupsNotConfigured {
+		t.Errorf("expected backups not to be configured, got %v", err)
+	}
+	if _, err := s.Operation(ctx, "missing"); err != ErrOperationNotFound {
+		t.Errorf("expected the operation not to be found, got %v", err)
+	}
+}
+
+func TestServiceNotSupported(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	s := NewService(basicDriver{d}, nil)
+	ctx := context.Background()
+
+	calls := map[string]func() error{
+		"options":  func() error { _, err := s.Options(ctx); return err },
+		"import":   func() error { _, err := s.Import(ctx, "data"); return err },
+		"label":    func() error { _, err := s.Label(ctx, "data", &LabelRequest{Remove: []string{"a"}}); return err },
+		"snapshot": func() error { _, err := s.Snapshot(ctx, "data", &SnapshotRequest{}); return err },
+		"resize":   func() error { _, err := s.Resize(ctx, "data", &ResizeRequest{SizeGb: 1}); return err },
+		"detach":   func() error { _, err := s.Detach(ctx, "data", &DetachRequest{Force: true}); return err },
+		"migrate":  func() error { _, err := s.Migrate(ctx, "data", &MigrateRequest{}); return err },
+		"tune":     func() error { _, err := s.Tune(ctx, "data", &TuneRequest{Iops: 1}); return err },
+		"reconcile": func() error {
+			_, err := s.Reconcile(ctx, &ReconcileRequest{})
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); err != ErrNotSupported {
+			t.Errorf("%s: expected the operation not to be supported, got %v", name, err)
+		}
+	}
+}
+
+func TestServiceOperations(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	s := NewService(d, nil)
+	ctx := context.Background()
+	if _, err := s.Create(ctx, &CreateRequest{Name: "data"}); err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := s.Snapshot(ctx, "data", &SnapshotRequest{Name: "snap"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op.Type != OperationSnapshot || op.Volume != "data" {
+		t.Errorf("unexpected operation %v", op)
+	}
+	op = waitForOperation(t, s, op)
+	if snapshot, ok := op.Result.(*Snapshot); op.State != OperationDone || !ok || snapshot.Name != "snap" {
+		t.Errorf("expected the snapshot as the result, got %v", op)
+	}
+	if op.Finished == nil {
+		t.Errorf("expected the finish time to be set")
+	}
+
+	op, err = s.Resize(ctx, "data", &ResizeRequest{SizeGb: 200})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op = waitForOperation(t, s, op); op.State != OperationFailed || op.Error == "" {
+		t.Errorf("expected the resize to fail, got %v", op)
+	}
+
+	if ops, err := s.Operations(ctx); err != nil || len(ops) != 2 {
+		t.Errorf("expected 2 operations, got %v (%v)", ops, err)
+	}
+}
+
+// newBackupService creates a service for the driver which backs up to a temporary directory
+func newBackupService(t *testing.T, d driver.Driver) (*Service, func()) {
+	dir, err := ioutil.TempDir("", "backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := backup.NewStore(backup.StoreConfig{Target: dir})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return NewService(d, backup.NewEngine(store, fs.NewFilesystem(), backup.Retention{})), func() { os.RemoveAll(dir) }
+}
+
+// backupFile backs up a volume holding a single file, returning the backup's id
+func backupFile(t *testing.T, s *Service, d *fakeDriver, name string) string {
+	ctx := context.Background()
+	if _, err := s.Create(ctx, &CreateRequest{Name: name}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(d.root, name, "hello.txt"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	op, err := s.Backup(ctx, name, &BackupRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op = waitForOperation(t, s, op)
+	b, ok := op.Result.(*Backup)
+	if op.State != OperationDone || !ok {
+		t.Fatalf("expected a backup, got %v", op)
+	}
+	return b.ID
+}
+
+func TestServiceRestore(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	d.mountOnCreate = true
+	s, cleanupBackups := newBackupService(t, d)
+	defer cleanupBackups()
+	ctx := context.Background()
+	id := backupFile(t, s, d, "data")
+
+	tests := []struct {
+		name          string
+		id            string
+		mountOnCreate bool
+		failRemove    error
+		// mounted is whether the restored volume is left mounted
+		mounted bool
+		err     string
+	}{
+		{name: "left mounted", id: id, mountOnCreate: true, mounted: true},
+		{name: "mounted for the restore", id: id},
+		{name: "missing backup", id: "20170101-000000", err: "20170101-000000"},
+		{name: "left behind", id: "20170101-000000", failRemove: errors.New("busy"), err: "left behind"},
+	}
+
+	for i, test := range tests {
+		target := fmt.Sprintf("restored-%d", i)
+		d.mu.Lock()
+		d.mountOnCreate = test.mountOnCreate
+		d.failRemove = test.failRemove
+		d.mu.Unlock()
+
+		op, err := s.Restore(ctx, "data", test.id, &RestoreRequest{Name: target})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		op = waitForOperation(t, s, op)
+
+		if test.err != "" {
+			if op.State != OperationFailed || !strings.Contains(op.Error, test.err) {
+				t.Errorf("%s: expected the restore to fail with '%s', got %v", test.name, test.err, op)
+			}
+			if exists := d.exists(target); exists != (test.failRemove != nil) {
+				t.Errorf("%s: expected volume %v, got %v", test.name, test.failRemove != nil, exists)
+			}
+			continue
+		}
+
+		vol, ok := op.Result.(*Volume)
+		if op.State != OperationDone || !ok {
+			t.Errorf("%s: expected the restored volume, got %v", test.name, op)
+			continue
+		}
+		if mounted := vol.Path != ""; mounted != test.mounted {
+			t.Errorf("%s: expected mounted %v, got %v", test.name, test.mounted, vol)
+		}
+		if data, err := ioutil.ReadFile(filepath.Join(d.root, target, "hello.txt")); err != nil || string(data) != "hello" {
+			t.Errorf("%s: expected the file to be restored, got '%s' (%v)", test.name, data, err)
+		}
+	}
+}
+
+func TestServiceBackupClone(t *testing.T) {
+	d, cleanup := newFakeDriver(t)
+	defer cleanup()
+	s, cleanupBackups := newBackupService(t, d)
+	defer cleanupBackups()
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		failRemove error
+		err        string
+	}{
+		{name: "removed"},
+		{name: "left behind", failRemove: errors.New("busy"), err: "was made, but volume"},
+	}
+
+	for _, test := range tests {
+		volume := strings.Replace(test.name, " ", "-", -1)
+		if _, err := s.Create(ctx, &CreateRequest{Name: volume}); err != nil {
+			t.Fatal(err)
+		}
+		d.mu.Lock()
+		d.failRemove = test.failRemove
+		d.mu.Unlock()
+
+		op, err := s.Backup(ctx, volume, &BackupRequest{Snapshot: true})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		op = waitForOperation(t, s, op)
+
+		if test.err == "" {
+			if b, ok := op.Result.(*Backup); op.State != OperationDone || !ok || b.Source != backup.SourceSnapshot {
+				t.Errorf("%s: expected a backup of a snapshot, got %v", test.name, op)
+			}
+		} else if op.State != OperationFailed || !strings.Contains(op.Error, test.err) {
+			t.Errorf("%s: expected the backup to fail with '%s', got %v", test.name, test.err, op)
+		}
+
+		// only a copy which couldn't be removed is left behind
+		vols, _ := d.List(ctx)
+		clones := 0
+		for _, vol := range vols {
+			if strings.HasPrefix(vol.Name, "backup-") {
+				clones++
+			}
+		}
+		if left := clones > 0; left != (test.failRemove != nil) {
+			t.Errorf("%s: expected a copy left behind %v, got %v", test.name, test.failRemove != nil, vols)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package admin
+
+import "time"
+
+// Volume is the admin API representation of a volume
+type Volume struct {
+	Name   string                 `json:"name"`
+	Path   string                 `json:"path,omitempty"`
+	Ready  bool                   `json:"ready"`
+	Status map[string]interface{} `json:"status,omitempty"`
+}
+
+// Option describes a volume option accepted by the storage driver
+type Option struct {
+	Name        string   `json:"name"`
+	Prefix      bool     `json:"prefix,omitempty"`
+	Type        string   `json:"type"`
+	Min         int64    `json:"min,omitempty"`
+	Max         int64    `json:"max,omitempty"`
+	Values      []string `json:"values,omitempty"`
+	Default     string   `json:"default,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// Snapshot is the admin API representation of a snapshot
+type Snapshot struct {
+	Name    string `json:"name"`
+	Volume  string `json:"volume"`
+	SizeGb  int64  `json:"sizeGb"`
+	Created string `json:"created,omitempty"`
+	Status  string `json:"status,omitempty"`
+	// Inconsistent is set on snapshots which aren't application consistent
+	Inconsistent bool `json:"inconsistent,omitempty"`
+}
+
+// CreateRequest is the body of a create request
+type CreateRequest struct {
+	Name    string            `json:"name"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// SnapshotRequest is the body of a snapshot request
+type SnapshotRequest struct {
+	// Name of the snapshot, generated if empty
+	Name string `json:"name,omitempty"`
+}
+
+// ResizeRequest is the body of a resize request
+type ResizeRequest struct {
+	SizeGb int64 `json:"sizeGb"`
+}
+
+// DetachRequest is the body of a detach request
+type DetachRequest struct {
+	// Force detaches the volume from every instance, not just this one
+	Force bool `json:"force"`
+}
+
+// MigrateRequest is the body of a migrate request
+type MigrateRequest struct {
+	DeleteSource bool `json:"deleteSource"`
+}
+
+// TuneRequest is the body of a request to change the provisioned performance of a volume
+type TuneRequest struct {
+	// Iops is the new provisioned IOPS, unchanged if zero
+	Iops int64 `json:"iops,omitempty"`
+	// Throughput is the new provisioned throughput in MB/s, unchanged if zero
+	Throughput int64 `json:"throughput,omitempty"`
+}
+
+// LabelRequest is the body of a request to change the labels of a volume
+type LabelRequest struct {
+	// Set adds or changes labels
+	Set map[string]string `json:"set,omitempty"`
+	// Remove deletes labels
+	Remove []string `json:"remove,omitempty"`
+}
+
+// BackupRequest is the body of a backup request
+type BackupRequest struct {
+	// Snapshot backs up a copy of the volume made from a snapshot rather than the live file system
+	Snapshot bool `json:"snapshot"`
+}
+
+// RestoreRequest is the body of a request to restore a backup into a new volume
+type RestoreRequest struct {
+	// Name of the new volume, the backed up volume's name if empty
+	Name string `json:"name,omitempty"`
+	// Options of the new volume
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// Backup is the admin API representation of a backup
+type Backup struct {
+	ID      string    `json:"id"`
+	Volume  string    `json:"volume"`
+	Created time.Time `json:"created"`
+	Source  string    `json:"source"`
+	Files   int64     `json:"files"`
+	Size    int64     `json:"size"`
+	Stored  int64     `json:"stored"`
+	Chunks  int64     `json:"chunks"`
+}
+
+// ReconcileRequest is the body of a reconcile request
+type ReconcileRequest struct {
+	// DryRun reports the repairs without making them
+	DryRun bool `json:"dryRun"`
+}
+
+// ReconcileAction is a repair made, or which would be made, by reconcile
+type ReconcileAction struct {
+	Volume string `json:"volume"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReconcileResult is the response to a reconcile request
+type ReconcileResult struct {
+	DryRun  bool               `json:"dryRun"`
+	Actions []*ReconcileAction `json:"actions"`
+}
+
+// Operation states
+const (
+	OperationRunning = "running"
+	OperationDone    = "done"
+	OperationFailed  = "failed"
+)
+
+// Operation tracks a long running job
+type Operation struct {
+	ID       string      `json:"id"`
+	Type     string      `json:"type"`
+	Volume   string      `json:"volume"`
+	State    string      `json:"state"`
+	Error    string      `json:"error,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+}
+
+// Error is the body of an error response
+type Error struct {
+	Message string `json:"message"`
+}
@@ -0,0 +1,286 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+// Entry types
+const (
+	entryDir     = "dir"
+	entryFile    = "file"
+	entrySymlink = "symlink"
+)
+
+// manifest lists the entries of a backup, parents before their children
+type manifest struct {
+	Version int      `json:"version"`
+	Backup  *Backup  `json:"backup"`
+	Entries []*entry `json:"entries"`
+}
+
+// entry is a file, directory or symlink in a backup; a file's content is the concatenation of its chunks
+type entry struct {
+	Path     string      `json:"path"`
+	Type     string      `json:"type"`
+	Mode     os.FileMode `json:"mode"`
+	UID      int         `json:"uid"`
+	GID      int         `json:"gid"`
+	Modified time.Time   `json:"modified"`
+	Size     int64       `json:"size,omitempty"`
+	Target   string      `json:"target,omitempty"`
+	Chunks   []string    `json:"chunks,omitempty"`
+}
+
+// archiveWriter writes the chunks of a tree to a store
+type archiveWriter struct {
+	store  Store
+	backup *Backup
+	// stored holds the chunks known to be in the store, to save checking twice
+	stored map[string]bool
+	// dedup reuses chunks written by earlier backups, rather than uploading every chunk this backup uses
+	dedup bool
+}
+
+func newArchiveWriter(store Store, backup *Backup, dedup bool) *archiveWriter {
+	return &archiveWriter{store: store, backup: backup, stored: make(map[string]bool), dedup: dedup}
+}
+
+// writeTree writes the files under root and gets the entries for the manifest; sockets, devices and
+// pipes are skipped
+func (w *archiveWriter) writeTree(ctx context.Context, root string) ([]*entry, error) {
+	var entries []*entry
+	logger := logging.FromContext(ctx)
+
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		e := &entry{
+			Path:     filepath.ToSlash(rel),
+			Mode:     info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky),
+			Modified: info.ModTime().UTC(),
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			e.UID = int(stat.Uid)
+			e.GID = int(stat.Gid)
+		}
+
+		switch {
+		case info.IsDir():
+			e.Type = entryDir
+		case info.Mode()&os.ModeSymlink != 0:
+			e.Type = entrySymlink
+			if e.Target, err = os.Readlink(p); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			e.Type = entryFile
+			if err = w.writeFile(ctx, p, e); err != nil {
+				return fmt.Errorf("error backing up '%s': %v", e.Path, err)
+			}
+		default:
+			logger.WithFields(log.Fields{"path": e.Path, "mode": info.Mode().String()}).Warn("BACKUP: skipping special file")
+			return nil
+		}
+
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// writeFile splits a file into chunks and writes those which aren't already stored
+func (w *archiveWriter) writeFile(ctx context.Context, p string, e *entry) error {
+	file, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	c := newChunker(file)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		hash := hashChunk(chunk)
+		if err = w.writeChunk(ctx, hash, chunk); err != nil {
+			return err
+		}
+		e.Chunks = append(e.Chunks, hash)
+		e.Size += int64(len(chunk))
+	}
+
+	w.backup.Files++
+	w.backup.Size += e.Size
+	return nil
+}
+
+// writeChunk compresses and writes a chunk unless the store has it and deduplication is on
+func (w *archiveWriter) writeChunk(ctx context.Context, hash string, chunk []byte) error {
+	if w.stored[hash] {
+		return nil
+	}
+
+	key := chunkKey(hash)
+	exists := false
+	if w.dedup {
+		var err error
+		if exists, err = w.store.Exists(ctx, key); err != nil {
+			return err
+		}
+	}
+	if !exists {
+		compressed, err := gzipBytes(chunk)
+		if err != nil {
+			return err
+		}
+		if err = w.store.Put(ctx, key, compressed); err != nil {
+			return err
+		}
+		w.backup.Stored += int64(len(compressed))
+		w.backup.Chunks++
+	}
+
+	w.stored[hash] = true
+	return nil
+}
+
+// archiveReader restores entries from the chunks in a store
+type archiveReader struct {
+	store Store
+}
+
+// restoreTree writes the entries under root; directory modes and times are set last, since adding
+// their children would change them
+func (r *archiveReader) restoreTree(ctx context.Context, root string, entries []*entry) error {
+	var dirs []*entry
+	symlinks := make(map[string]bool)
+
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		target, err := entryPath(root, e.Path)
+		if err != nil {
+			return err
+		}
+		// nothing is written through a restored symlink, which could point outside the root
+		for parent := path.Dir(path.Clean(e.Path)); parent != "." && parent != "/"; parent = path.Dir(parent) {
+			if symlinks[parent] {
+				return fmt.Errorf("invalid path '%s' in backup, it is under a symlink", e.Path)
+			}
+		}
+
+		switch e.Type {
+		case entryDir:
+			if err = os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, e)
+		case entryFile:
+			if err = r.restoreFile(ctx, target, e); err != nil {
+				return fmt.Errorf("error restoring '%s': %v", e.Path, err)
+			}
+		case entrySymlink:
+			if err = os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err = os.Symlink(e.Target, target); err != nil {
+				return err
+			}
+			symlinks[path.Clean(e.Path)] = true
+		default:
+			return fmt.Errorf("unknown type '%s' of '%s'", e.Type, e.Path)
+		}
+
+		if err = os.Lchown(target, e.UID, e.GID); err != nil {
+			return err
+		}
+		if e.Type == entryFile {
+			if err = setAttributes(target, e); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target, _ := entryPath(root, dirs[i].Path)
+		if err := setAttributes(target, dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFile writes a file from its chunks, checking each against its hash
+func (r *archiveReader) restoreFile(ctx context.Context, target string, e *entry) error {
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, hash := range e.Chunks {
+		compressed, err := r.store.Get(ctx, chunkKey(hash))
+		if err == ErrNotFound {
+			return fmt.Errorf("chunk %s is missing", hash)
+		}
+		if err != nil {
+			return err
+		}
+		chunk, err := gunzipBytes(compressed)
+		if err != nil {
+			return fmt.Errorf("chunk %s is corrupt: %v", hash, err)
+		}
+		if hashChunk(chunk) != hash {
+			return fmt.Errorf("chunk %s is corrupt", hash)
+		}
+		if _, err = io.Copy(file, bytes.NewReader(chunk)); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// setAttributes sets the mode and modified time of a restored file or directory
+func setAttributes(target string, e *entry) error {
+	if err := os.Chmod(target, e.Mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, e.Modified, e.Modified)
+}
+
+// entryPath gets where an entry is restored, refusing paths which would escape the root
+func entryPath(root string, p string) (string, error) {
+	clean := path.Clean(p)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid path '%s' in backup", p)
+	}
+	return filepath.Join(root, filepath.FromSlash(clean)), nil
+}
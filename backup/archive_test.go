@@ -0,0 +1,99 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestEntryPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"file", "/root/file"},
+		{"dir/file", "/root/dir/file"},
+		{"dir/../file", "/root/file"},
+		{"./dir/", "/root/dir"},
+		{".", "/root"},
+		{"..", ""},
+		{"../file", ""},
+		{"dir/../../file", ""},
+		{"/etc/passwd", ""},
+	}
+
+	for _, test := range tests {
+		p, err := entryPath("/root", test.path)
+		if test.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got '%s'", test.path, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.path, err)
+		} else if p != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.path, test.expected, p)
+		}
+	}
+}
+
+func TestRestoreRefusesPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*entry
+	}{
+		{"escape", []*entry{
+			{Path: "../outside/file", Type: entryFile},
+		}},
+		{"absolute", []*entry{
+			{Path: "/outside/file", Type: entryFile},
+		}},
+		{"under symlink", []*entry{
+			{Path: "link", Type: entrySymlink, Target: "../outside"},
+			{Path: "link/file", Type: entryFile},
+		}},
+		{"under symlink dir", []*entry{
+			{Path: "link", Type: entrySymlink, Target: "../outside"},
+			{Path: "link/dir", Type: entryDir},
+		}},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "restore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		root := filepath.Join(dir, "root")
+		outside := filepath.Join(dir, "outside")
+		for _, d := range []string{root, outside} {
+			if err = os.Mkdir(d, 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, e := range test.entries {
+			e.Mode = 0600
+			e.UID = os.Getuid()
+			e.GID = os.Getgid()
+			e.Modified = time.Now()
+		}
+		r := &archiveReader{store: &dirStore{root: filepath.Join(dir, "store")}}
+		if err = r.restoreTree(context.Background(), root, test.entries); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+
+		written, err := ioutil.ReadDir(outside)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(written) != 0 {
+			t.Errorf("%s: restore wrote '%s' outside the root", test.name, written[0].Name())
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"bufio"
+	"io"
+)
+
+// Chunk sizes; boundaries are found where a rolling hash of the content matches a mask, so an insert
+// into a file only changes the chunks around it and the rest dedupe against earlier backups
+const (
+	minChunkSize = 256 << 10
+	maxChunkSize = 4 << 20
+	// chunkMask gives an average chunk of 1MB after the minimum; it tests the high bits of the
+	// hash, which depend on the last 64 bytes rather than the last 20
+	chunkMask = (1<<20 - 1) << 44
+)
+
+// gearTable maps each byte to a random value for the gear hash, it is generated from a fixed seed
+// because the boundaries, and so deduplication, depend on it
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x636c6f7564766f6c)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content defined chunks
+type chunker struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{
+		r:   bufio.NewReaderSize(r, 1<<20),
+		buf: make([]byte, 0, maxChunkSize),
+	}
+}
+
+// next gets the next chunk, which is only valid until the following call, or io.EOF at the end
+func (c *chunker) next() ([]byte, error) {
+	c.buf = c.buf[:0]
+	var hash uint64
+
+	for len(c.buf) < maxChunkSize {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		c.buf = append(c.buf, b)
+		hash = hash<<1 + gearTable[b]
+		if len(c.buf) >= minChunkSize && hash&chunkMask == 0 {
+			break
+		}
+	}
+
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
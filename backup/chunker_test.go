@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testData gets reproducible random content
+func testData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunkAll splits data, copying each chunk since they are only valid until the next
+func chunkAll(t *testing.T, data []byte) [][]byte {
+	var chunks [][]byte
+	c := newChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerEmpty(t *testing.T) {
+	if chunks := chunkAll(t, nil); len(chunks) != 0 {
+		t.Errorf("expected no chunks, got %d", len(chunks))
+	}
+}
+
+func TestChunkerBounds(t *testing.T) {
+	for _, data := range [][]byte{testData(1, 16<<20), make([]byte, 9<<20)} {
+		chunks := chunkAll(t, data)
+		if !bytes.Equal(bytes.Join(chunks, nil), data) {
+			t.Fatalf("chunks don't add up to the content")
+		}
+		for i, chunk := range chunks {
+			if len(chunk) > maxChunkSize {
+				t.Errorf("chunk %d is %d bytes, over the maximum", i, len(chunk))
+			}
+			if i < len(chunks)-1 && len(chunk) < minChunkSize {
+				t.Errorf("chunk %d is %d bytes, under the minimum", i, len(chunk))
+			}
+		}
+	}
+}
+
+func TestChunkerDeterministic(t *testing.T) {
+	data := testData(2, 8<<20)
+	first := chunkAll(t, data)
+	second := chunkAll(t, data)
+	if len(first) != len(second) {
+		t.Fatalf("expected %d chunks, got %d", len(first), len(second))
+	}
+	for i := range first {
+		if !bytes.Equal(first[i], second[i]) {
+			t.Errorf("chunk %d differs", i)
+		}
+	}
+}
+
+func TestChunkerInsert(t *testing.T) {
+	data := testData(3, 16<<20)
+	original := make(map[string]bool)
+	for _, chunk := range chunkAll(t, data) {
+		original[hashChunk(chunk)] = true
+	}
+
+	// an insert near the start should only change the chunks around it
+	inserted := append(append(append([]byte(nil), data[:1000]...), []byte("inserted")...), data[1000:]...)
+	chunks := chunkAll(t, inserted)
+	changed := 0
+	for _, chunk := range chunks {
+		if !original[hashChunk(chunk)] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Errorf("expected at most 2 of %d chunks to change, got %d", len(chunks), changed)
+	}
+}
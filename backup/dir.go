@@ -0,0 +1,92 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// dirStore keeps objects as files in a local directory, e.g. a mounted network share
+type dirStore struct {
+	root string
+}
+
+// Put writes an object through a temporary file, so a partly written object is never seen
+func (s *dirStore) Put(ctx context.Context, key string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err = temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// Get reads an object
+func (s *dirStore) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Exists checks if an object exists
+func (s *dirStore) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Delete removes an object
+func (s *dirStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List gets the objects whose keys start with the prefix
+func (s *dirStore) List(ctx context.Context, prefix string) ([]*Object, error) {
+	var objects []*Object
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		key := filepath.ToSlash(strings.TrimPrefix(path, s.root+string(filepath.Separator)))
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, &Object{Key: key, Size: info.Size(), Modified: info.ModTime()})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// path gets the file of an object
+func (s *dirStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
@@ -0,0 +1,445 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/fs"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+const (
+	manifestVersion = 1
+	backupIDFormat  = "20060102-150405"
+	volumesPrefix   = "volumes/"
+	chunksPrefix    = "chunks/"
+	summarySuffix   = ".json"
+	manifestSuffix  = ".manifest.gz"
+	// gcGracePeriod protects the chunks and manifests of backups which are still being written
+	gcGracePeriod = 24 * time.Hour
+	// markers of backups and garbage collections in progress, each checks for the other's after writing its own
+	backupMarkerPrefix = "running/backup/"
+	gcMarkerPrefix     = "running/gc/"
+)
+
+// Backup sources
+const (
+	SourceVolume   = "volume"
+	SourceSnapshot = "snapshot"
+)
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// Backup describes a stored backup of a volume
+type Backup struct {
+	ID      string    `json:"id"`
+	Volume  string    `json:"volume"`
+	Created time.Time `json:"created"`
+	// Source is volume for a backup of the live file system or snapshot for one of a snapshot's copy
+	Source string `json:"source"`
+	Files  int64  `json:"files"`
+	// Size is the size of the backed up files, Stored the compressed size of the chunks the backup
+	// added to the store, which excludes those deduplicated against earlier backups
+	Size   int64 `json:"size"`
+	Stored int64 `json:"stored"`
+	Chunks int64 `json:"chunks"`
+}
+
+// Retention decides which backups of a volume are kept, zero values keep every backup; the newest
+// backup is always kept
+type Retention struct {
+	// Count is the number of backups to keep
+	Count int
+	// MaxAge is the age after which backups are deleted
+	MaxAge time.Duration
+}
+
+// Engine writes backups of file systems to a store and restores them
+type Engine struct {
+	store     Store
+	fs        fs.Filesystem
+	retention Retention
+}
+
+// NewEngine creates a backup engine, the file system resolves the mount points of volumes
+func NewEngine(store Store, cfs fs.Filesystem, retention Retention) *Engine {
+	return &Engine{store: store, fs: cfs, retention: retention}
+}
+
+// Backup writes the files under a volume's mount point to the store as a new backup, then applies
+// the retention policy to the volume's backups
+func (e *Engine) Backup(ctx context.Context, volume string, source string, mountPoint string) (*Backup, error) {
+	if !namePattern.MatchString(volume) {
+		return nil, fmt.Errorf("invalid volume name '%s'", volume)
+	}
+
+	backup := &Backup{
+		ID:      time.Now().UTC().Format(backupIDFormat),
+		Volume:  volume,
+		Created: time.Now().UTC(),
+		Source:  source,
+	}
+	exists, err := e.store.Exists(ctx, summaryKey(volume, backup.ID))
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, fmt.Errorf("backup '%s' of volume '%s' already exists", backup.ID, volume)
+	}
+
+	logger := logging.FromContext(ctx).WithFields(log.Fields{"volume": volume, "backup": backup.ID})
+	logger.Info("BACKUP: starting")
+
+	// chunks already in the store are only reused while no garbage collection could delete them before
+	// the manifest referencing them is written
+	marker := backupMarkerPrefix + volume + "/" + backup.ID
+	if err = e.store.Put(ctx, marker, nil); err != nil {
+		return nil, fmt.Errorf("error marking backup '%s' in progress: %v", backup.ID, err)
+	}
+	defer e.removeMarker(ctx, marker)
+	collecting, err := e.running(ctx, gcMarkerPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if collecting {
+		logger.Warn("BACKUP: garbage collection running, uploading every chunk")
+	}
+
+	w := newArchiveWriter(e.store, backup, !collecting)
+	entries, err := w.writeTree(ctx, e.fs.HostPath(mountPoint))
+	if err != nil {
+		return nil, fmt.Errorf("error backing up volume '%s': %v", volume, err)
+	}
+
+	// the summary is written last, a backup without one is incomplete
+	if err = e.putJSON(ctx, manifestKey(volume, backup.ID), &manifest{Version: manifestVersion, Backup: backup, Entries: entries}, true); err != nil {
+		return nil, fmt.Errorf("error writing manifest of backup '%s': %v", backup.ID, err)
+	}
+	if err = e.putJSON(ctx, summaryKey(volume, backup.ID), backup, false); err != nil {
+		return nil, fmt.Errorf("error writing summary of backup '%s': %v", backup.ID, err)
+	}
+
+	logger.WithFields(log.Fields{
+		"files":  backup.Files,
+		"size":   backup.Size,
+		"stored": backup.Stored,
+	}).Info("BACKUP: done")
+
+	if _, err = e.Prune(ctx, volume); err != nil {
+		logger.WithError(err).Warn("BACKUP: error applying retention policy")
+	}
+	return backup, nil
+}
+
+// Restore writes the files of a backup under a mount point
+func (e *Engine) Restore(ctx context.Context, volume string, id string, mountPoint string) (*Backup, error) {
+	m, err := e.readManifest(ctx, volume, id)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logging.FromContext(ctx).WithFields(log.Fields{"volume": volume, "backup": id, "target": mountPoint})
+	logger.Info("RESTORE: starting")
+
+	r := &archiveReader{store: e.store}
+	if err = r.restoreTree(ctx, e.fs.HostPath(mountPoint), m.Entries); err != nil {
+		return nil, fmt.Errorf("error restoring backup '%s' of volume '%s': %v", id, volume, err)
+	}
+
+	logger.Info("RESTORE: done")
+	return m.Backup, nil
+}
+
+// List gets the complete backups of a volume, or of every volume if volume is empty, oldest first
+func (e *Engine) List(ctx context.Context, volume string) ([]*Backup, error) {
+	prefix := volumesPrefix
+	if volume != "" {
+		prefix += volume + "/"
+	}
+	objects, err := e.store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []*Backup{}
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, summarySuffix) {
+			continue
+		}
+		data, err := e.store.Get(ctx, object.Key)
+		if err == ErrNotFound {
+			// deleted since listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		backup := &Backup{}
+		if err = json.Unmarshal(data, backup); err != nil {
+			return nil, fmt.Errorf("invalid backup summary '%s': %v", object.Key, err)
+		}
+		backups = append(backups, backup)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Volume != backups[j].Volume {
+			return backups[i].Volume < backups[j].Volume
+		}
+		return backups[i].Created.Before(backups[j].Created)
+	})
+	return backups, nil
+}
+
+// Delete removes a backup and the chunks no other backup uses
+func (e *Engine) Delete(ctx context.Context, volume string, id string) error {
+	if err := e.remove(ctx, volume, id); err != nil {
+		return err
+	}
+	return e.collectGarbage(ctx)
+}
+
+// Prune deletes the backups of a volume which the retention policy doesn't keep
+func (e *Engine) Prune(ctx context.Context, volume string) ([]*Backup, error) {
+	if e.retention.Count <= 0 && e.retention.MaxAge <= 0 {
+		return nil, nil
+	}
+
+	backups, err := e.List(ctx, volume)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []*Backup
+	now := time.Now()
+	for i := len(backups) - 2; i >= 0; i-- {
+		// i counts back from the second newest, which is the first that can be removed
+		keep := len(backups) - i - 1
+		backup := backups[i]
+		if (e.retention.Count > 0 && keep >= e.retention.Count) || (e.retention.MaxAge > 0 && now.Sub(backup.Created) > e.retention.MaxAge) {
+			logging.FromContext(ctx).WithFields(log.Fields{"volume": volume, "backup": backup.ID}).Info("BACKUP: deleting backup beyond retention")
+			if err = e.remove(ctx, volume, backup.ID); err != nil {
+				return removed, err
+			}
+			removed = append(removed, backup)
+		}
+	}
+
+	if len(removed) > 0 {
+		err = e.collectGarbage(ctx)
+	}
+	return removed, err
+}
+
+// remove deletes the summary and manifest of a backup
+func (e *Engine) remove(ctx context.Context, volume string, id string) error {
+	exists, err := e.store.Exists(ctx, summaryKey(volume, id))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("backup '%s' of volume '%s' not found", id, volume)
+	}
+
+	if err = e.store.Delete(ctx, summaryKey(volume, id)); err != nil {
+		return err
+	}
+	return e.store.Delete(ctx, manifestKey(volume, id))
+}
+
+// collectGarbage deletes the chunks which no manifest uses, and manifests left by backups which never
+// completed. Recent objects are kept, as they may belong to a backup being written.
+func (e *Engine) collectGarbage(ctx context.Context) error {
+	marker := fmt.Sprintf("%s%d", gcMarkerPrefix, time.Now().UnixNano())
+	if err := e.store.Put(ctx, marker, nil); err != nil {
+		return fmt.Errorf("error marking garbage collection in progress: %v", err)
+	}
+	defer e.removeMarker(ctx, marker)
+
+	// a running backup may reuse chunks which no manifest references yet
+	backingUp, err := e.running(ctx, backupMarkerPrefix)
+	if err != nil {
+		return err
+	}
+	if backingUp {
+		logging.FromContext(ctx).Info("BACKUP: backups in progress, leaving unused chunks for a later collection")
+		return nil
+	}
+
+	objects, err := e.store.List(ctx, volumesPrefix)
+	if err != nil {
+		return err
+	}
+
+	summaries := make(map[string]bool)
+	for _, object := range objects {
+		if strings.HasSuffix(object.Key, summarySuffix) {
+			summaries[strings.TrimSuffix(object.Key, summarySuffix)] = true
+		}
+	}
+
+	cutoff := time.Now().Add(-gcGracePeriod)
+	used := make(map[string]bool)
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, manifestSuffix) {
+			continue
+		}
+		if !summaries[strings.TrimSuffix(object.Key, manifestSuffix)] && object.Modified.Before(cutoff) {
+			if err = e.store.Delete(ctx, object.Key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		m := &manifest{}
+		if err = e.getJSON(ctx, object.Key, m, true); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, entry := range m.Entries {
+			for _, chunk := range entry.Chunks {
+				used[chunkKey(chunk)] = true
+			}
+		}
+	}
+
+	chunks, err := e.store.List(ctx, chunksPrefix)
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	for _, chunk := range chunks {
+		if !used[chunk.Key] && chunk.Modified.Before(cutoff) {
+			if err = e.store.Delete(ctx, chunk.Key); err != nil {
+				return err
+			}
+			deleted++
+		}
+	}
+	logging.FromContext(ctx).WithFields(log.Fields{"chunks": deleted}).Info("BACKUP: deleted unused chunks")
+	return nil
+}
+
+// running checks for markers under a prefix, ignoring those left by processes which stopped before removing
+// them
+func (e *Engine) running(ctx context.Context, prefix string) (bool, error) {
+	markers, err := e.store.List(ctx, prefix)
+	if err != nil {
+		return false, err
+	}
+	cutoff := time.Now().Add(-gcGracePeriod)
+	for _, marker := range markers {
+		if marker.Modified.After(cutoff) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// removeMarker deletes a marker once its operation is finished
+func (e *Engine) removeMarker(ctx context.Context, key string) {
+	if err := e.store.Delete(ctx, key); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{"marker": key, "err": err}).Warn("BACKUP: error removing marker")
+	}
+}
+
+// readManifest reads the manifest of a complete backup
+func (e *Engine) readManifest(ctx context.Context, volume string, id string) (*manifest, error) {
+	exists, err := e.store.Exists(ctx, summaryKey(volume, id))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("backup '%s' of volume '%s' not found", id, volume)
+	}
+
+	m := &manifest{}
+	if err = e.getJSON(ctx, manifestKey(volume, id), m, true); err != nil {
+		return nil, fmt.Errorf("error reading manifest of backup '%s': %v", id, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("backup '%s' has unsupported manifest version %d", id, m.Version)
+	}
+	return m, nil
+}
+
+// putJSON writes a value as json, compressed if asked
+func (e *Engine) putJSON(ctx context.Context, key string, v interface{}, compress bool) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if compress {
+		if data, err = gzipBytes(data); err != nil {
+			return err
+		}
+	}
+	return e.store.Put(ctx, key, data)
+}
+
+// getJSON reads a json value, decompressing it if asked
+func (e *Engine) getJSON(ctx context.Context, key string, v interface{}, compressed bool) error {
+	data, err := e.store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if compressed {
+		if data, err = gunzipBytes(data); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+func summaryKey(volume string, id string) string {
+	return volumesPrefix + volume + "/" + id + summarySuffix
+}
+
+func manifestKey(volume string, id string) string {
+	return volumesPrefix + volume + "/" + id + manifestSuffix
+}
+
+// chunkKey gets the key of a chunk from its hash, spread over directories by the first byte
+func chunkKey(hash string) string {
+	return chunksPrefix + hash[:2] + "/" + hash
+}
+
+// hashChunk gets the hash which identifies a chunk
+func hashChunk(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+func gunzipBytes(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
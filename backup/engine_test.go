@@ -0,0 +1,344 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stugotech/cloudvol2/fs"
+	"golang.org/x/net/context"
+)
+
+// tempDir creates a directory which the returned function removes
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// writeTestTree creates files, directories and a symlink under root, with content depending on seed
+func writeTestTree(t *testing.T, root string, seed int64) {
+	files := map[string][]byte{
+		"small.txt":      []byte(fmt.Sprintf("hello %d", seed)),
+		"empty":          nil,
+		"dir/large.bin":  testData(seed, 3<<20),
+		"dir/sub/second": testData(seed+1, 100<<10),
+	}
+	for name, data := range files {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir/large.bin", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Join(root, "dir/sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// compareTrees checks that the files under restored match those under original
+func compareTrees(t *testing.T, original string, restored string) {
+	count := 0
+	err := filepath.Walk(original, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(original, p)
+		other, err := os.Lstat(filepath.Join(restored, rel))
+		if err != nil {
+			t.Errorf("%s: %v", rel, err)
+			return nil
+		}
+		count++
+
+		if info.Mode() != other.Mode() {
+			t.Errorf("%s: expected mode %s, got %s", rel, info.Mode(), other.Mode())
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			expected, _ := os.Readlink(p)
+			target, _ := os.Readlink(filepath.Join(restored, rel))
+			if expected != target {
+				t.Errorf("%s: expected target '%s', got '%s'", rel, expected, target)
+			}
+			return nil
+		case info.Mode().IsRegular():
+			expected, _ := ioutil.ReadFile(p)
+			data, _ := ioutil.ReadFile(filepath.Join(restored, rel))
+			if !bytes.Equal(expected, data) {
+				t.Errorf("%s: content differs", rel)
+			}
+		}
+		if rel != "." && !info.ModTime().Equal(other.ModTime()) {
+			t.Errorf("%s: expected modified time %s, got %s", rel, info.ModTime(), other.ModTime())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count < 7 {
+		t.Errorf("expected at least 7 entries, compared %d", count)
+	}
+}
+
+// testBackup backs up a new test tree as a volume
+func testBackup(t *testing.T, e *Engine, volume string, seed int64) (*Backup, string) {
+	source, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestTree(t, source, seed)
+
+	backup, err := e.Backup(context.Background(), volume, SourceVolume, source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return backup, source
+}
+
+// testRestore restores a backup and compares it with its source
+func testRestore(t *testing.T, e *Engine, backup *Backup, source string) {
+	target, remove := tempDir(t)
+	defer remove()
+
+	if _, err := e.Restore(context.Background(), backup.Volume, backup.ID, target); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	compareTrees(t, source, target)
+}
+
+// storeKeys lists the keys under a prefix
+func storeKeys(t *testing.T, store Store, prefix string) []string {
+	objects, err := store.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return keys
+}
+
+// backdate makes the objects under a prefix of a directory store older than the garbage collection
+// grace period
+func backdate(t *testing.T, store *dirStore, prefix string) {
+	old := time.Now().Add(-2 * gcGracePeriod)
+	err := filepath.Walk(store.path(prefix), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(p, old, old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	e := NewEngine(&dirStore{root: dir}, fs.NewFilesystem(), Retention{})
+
+	backup, source := testBackup(t, e, "volume", 1)
+	defer os.RemoveAll(source)
+	if backup.Files != 4 || backup.Chunks == 0 || backup.Size != 7+3<<20+100<<10 {
+		t.Errorf("unexpected backup summary %+v", backup)
+	}
+
+	backups, err := e.List(context.Background(), "volume")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(backups) != 1 || backups[0].ID != backup.ID {
+		t.Errorf("expected backup '%s', got %+v", backup.ID, backups)
+	}
+	testRestore(t, e, backup, source)
+
+	// the same content as another volume reuses the stored chunks
+	other, err := e.Backup(context.Background(), "other", SourceVolume, source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if other.Chunks != 0 {
+		t.Errorf("expected no new chunks, got %d", other.Chunks)
+	}
+	testRestore(t, e, other, source)
+}
+
+func TestBackupInvalidVolume(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	e := NewEngine(&dirStore{root: dir}, fs.NewFilesystem(), Retention{})
+
+	for _, volume := range []string{"", "../volume", "a/b", ".hidden"} {
+		if _, err := e.Backup(context.Background(), volume, SourceVolume, dir); err == nil {
+			t.Errorf("%s: expected an error", volume)
+		}
+	}
+}
+
+func TestBackupWhileCollecting(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	store := &dirStore{root: dir}
+	e := NewEngine(store, fs.NewFilesystem(), Retention{})
+
+	first, source := testBackup(t, e, "volume", 1)
+	defer os.RemoveAll(source)
+
+	// with a collection running, chunks already stored may be about to be deleted so are written again
+	if err := store.Put(context.Background(), gcMarkerPrefix+"1", nil); err != nil {
+		t.Fatal(err)
+	}
+	second, err := e.Backup(context.Background(), "other", SourceVolume, source)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.Chunks != first.Chunks {
+		t.Errorf("expected %d chunks to be written, got %d", first.Chunks, second.Chunks)
+	}
+
+	if keys := storeKeys(t, store, backupMarkerPrefix); len(keys) != 0 {
+		t.Errorf("expected backup markers to be removed, got %v", keys)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	now := time.Now().UTC()
+	ages := []time.Duration{100 * time.Hour, 50 * time.Hour, 10 * time.Hour, 2 * time.Hour, time.Hour}
+
+	tests := []struct {
+		retention Retention
+		kept      int
+	}{
+		{Retention{}, 5},
+		{Retention{Count: 2}, 2},
+		{Retention{Count: 10}, 5},
+		{Retention{MaxAge: 24 * time.Hour}, 3},
+		{Retention{Count: 4, MaxAge: 24 * time.Hour}, 3},
+		{Retention{Count: 2, MaxAge: 24 * time.Hour}, 2},
+		// the newest backup is kept however old
+		{Retention{MaxAge: time.Minute}, 1},
+	}
+
+	for _, test := range tests {
+		dir, remove := tempDir(t)
+		defer remove()
+		e := NewEngine(&dirStore{root: dir}, fs.NewFilesystem(), test.retention)
+
+		for _, age := range ages {
+			backup := &Backup{ID: now.Add(-age).Format(backupIDFormat), Volume: "volume", Created: now.Add(-age)}
+			if err := e.putJSON(context.Background(), manifestKey("volume", backup.ID), &manifest{Version: manifestVersion, Backup: backup}, true); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.putJSON(context.Background(), summaryKey("volume", backup.ID), backup, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		removed, err := e.Prune(context.Background(), "volume")
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", test.retention, err)
+		}
+		backups, err := e.List(context.Background(), "volume")
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", test.retention, err)
+		}
+		if len(backups) != test.kept || len(removed) != len(ages)-test.kept {
+			t.Errorf("%+v: expected %d backups kept, got %d with %d removed", test.retention, test.kept, len(backups), len(removed))
+			continue
+		}
+		// the newest are kept
+		for i, backup := range backups {
+			if expected := now.Add(-ages[len(ages)-test.kept+i]).Format(backupIDFormat); backup.ID != expected {
+				t.Errorf("%+v: expected backup '%s' to be kept, got '%s'", test.retention, expected, backup.ID)
+			}
+		}
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	store := &dirStore{root: dir}
+	e := NewEngine(store, fs.NewFilesystem(), Retention{})
+
+	deleted, source := testBackup(t, e, "deleted", 1)
+	defer os.RemoveAll(source)
+	kept, keptSource := testBackup(t, e, "kept", 2)
+	defer os.RemoveAll(keptSource)
+	chunks := storeKeys(t, store, chunksPrefix)
+
+	// recent chunks may belong to a backup being written
+	if err := e.Delete(context.Background(), "deleted", deleted.ID); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys := storeKeys(t, store, chunksPrefix); len(keys) != len(chunks) {
+		t.Errorf("expected %d chunks within the grace period to be kept, got %d", len(chunks), len(keys))
+	}
+
+	backdate(t, store, chunksPrefix)
+	if err := e.collectGarbage(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys := storeKeys(t, store, chunksPrefix); int64(len(keys)) != kept.Chunks {
+		t.Errorf("expected the %d chunks of the kept backup, got %d", kept.Chunks, len(keys))
+	}
+	testRestore(t, e, kept, keptSource)
+
+	if keys := storeKeys(t, store, "running/"); len(keys) != 0 {
+		t.Errorf("expected markers to be removed, got %v", keys)
+	}
+}
+
+func TestCollectGarbageDuringBackup(t *testing.T) {
+	dir, remove := tempDir(t)
+	defer remove()
+	store := &dirStore{root: dir}
+	e := NewEngine(store, fs.NewFilesystem(), Retention{})
+
+	backup, source := testBackup(t, e, "volume", 1)
+	defer os.RemoveAll(source)
+	if err := e.remove(context.Background(), "volume", backup.ID); err != nil {
+		t.Fatal(err)
+	}
+	backdate(t, store, chunksPrefix)
+
+	// a running backup may reuse the unreferenced chunks
+	marker := backupMarkerPrefix + "other/1"
+	if err := store.Put(context.Background(), marker, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.collectGarbage(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys := storeKeys(t, store, chunksPrefix); int64(len(keys)) != backup.Chunks {
+		t.Errorf("expected %d chunks to be kept, got %d", backup.Chunks, len(keys))
+	}
+
+	// markers left by a process which stopped are ignored once old
+	backdate(t, store, backupMarkerPrefix)
+	if err := e.collectGarbage(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if keys := storeKeys(t, store, chunksPrefix); len(keys) != 0 {
+		t.Errorf("expected every chunk to be deleted, got %d", len(keys))
+	}
+	if keys := storeKeys(t, store, "running/"); len(keys) != 1 || !strings.HasSuffix(keys[0], marker) {
+		t.Errorf("expected only the stale marker to be left, got %v", keys)
+	}
+}
@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrNotFound is returned by a store when an object doesn't exist
+var ErrNotFound = errors.New("object not found")
+
+// Store is the object storage backups are written to
+type Store interface {
+	// Put writes an object, replacing it if it exists
+	Put(ctx context.Context, key string, data []byte) error
+	// Get reads an object, returning ErrNotFound if it doesn't exist
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Exists checks if an object exists
+	Exists(ctx context.Context, key string) (bool, error)
+	// Delete removes an object, doing nothing if it doesn't exist
+	Delete(ctx context.Context, key string) error
+	// List gets the objects whose keys start with the prefix
+	List(ctx context.Context, prefix string) ([]*Object, error)
+}
+
+// Object describes a stored object
+type Object struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
+
+// StoreConfig configures the store backups are written to
+type StoreConfig struct {
+	// Target is s3://bucket/prefix, or a local directory as file:///path or /path
+	Target string
+	// Endpoint is the URL of an S3 compatible service, AWS S3 if empty
+	Endpoint string
+	// Region is the region requests to S3 are signed for
+	Region string
+	// AccessKey, SecretKey and SessionToken are the S3 credentials
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// NewStore creates the store for a target
+func NewStore(config StoreConfig) (Store, error) {
+	target, err := url.Parse(config.Target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup target '%s': %v", config.Target, err)
+	}
+
+	switch target.Scheme {
+	case "s3":
+		if target.Host == "" {
+			return nil, fmt.Errorf("invalid backup target '%s', expected s3://bucket/prefix", config.Target)
+		}
+		if config.AccessKey == "" || config.SecretKey == "" {
+			return nil, fmt.Errorf("S3 backup targets need an access key and secret key")
+		}
+		return newS3Store(config, target.Host, strings.Trim(target.Path, "/"))
+	case "file", "":
+		if !strings.HasPrefix(target.Path, "/") {
+			return nil, fmt.Errorf("invalid backup target '%s', expected an absolute path", config.Target)
+		}
+		if err = os.MkdirAll(target.Path, 0700); err != nil {
+			return nil, fmt.Errorf("error creating backup directory: %v", err)
+		}
+		return &dirStore{root: target.Path}, nil
+	}
+	return nil, fmt.Errorf("unsupported backup target '%s', expected s3:// or file://", config.Target)
+}
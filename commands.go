@@ -0,0 +1,435 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/stugotech/cloudvol2/admin"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+const (
+	operationPollInterval = time.Second
+)
+
+// commands gets the cloudvol subcommands
+func commands() []*command {
+	return []*command{
+		{"serve", "", "run the volume plugin daemon", runServe},
+		{"ls", "", "list volumes", runList},
+		{"inspect", "<volume>", "show the state of a volume", runInspect},
+		{"options", "", "list the volume options of the storage driver", runOptions},
+		{"create", "[-o key=value]... <volume>", "create a volume", runCreate},
+		{"rm", "<volume>", "remove a volume", runRemove},
+		{"import", "<volume>", "adopt an existing disk which cloudvol didn't create", runImport},
+		{"label", "[-l key=value]... [-rm key]... <volume>", "change the labels of a volume", runLabel},
+		{"snapshot", "<volume>", "take a snapshot of a volume", runSnapshot},
+		{"resize", "-size <GB> <volume>", "grow a volume and its file system", runResize},
+		{"detach", "<volume>", "detach a volume, from every instance with -force", runDetach},
+		{"tune", "[-iops N] [-throughput MB/s] <volume>", "change the provisioned performance of a volume", runTune},
+		{"migrate", "<volume>", "move a volume to the location of this instance", runMigrate},
+		{"backup", "[-snapshot] <volume>", "back up a volume to the backup target", runBackup},
+		{"backups", "[-volume <volume>]", "list backups", runBackups},
+		{"restore", "[-name <new volume>] [-o key=value]... <volume> <backup>", "restore a backup into a new volume", runRestore},
+		{"rm-backup", "<volume> <backup>", "delete a backup", runRemoveBackup},
+		{"reconcile", "", "repair differences between local and cloud state", runReconcile},
+	}
+}
+
+// cliFlags are the flags shared by the operator commands
+type cliFlags struct {
+	flags    *flag.FlagSet
+	addr     *string
+	direct   *bool
+	format   *string
+	logLevel *string
+	tls      *tlsFlags
+	driver   *driverFlags
+	backup   *backupFlags
+}
+
+// newCLIFlags creates the flag set for an operator command
+func newCLIFlags(cmd *command) *cliFlags {
+	flags := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	f := &cliFlags{
+		flags:    flags,
+		addr:     flags.String("admin", defaultAdminSock, "admin API address (unix:///path or tcp://host:port)"),
+		direct:   flags.Bool("direct", false, "drive the storage driver directly instead of using a running daemon"),
+		format:   flags.String("format", formatTable, "output format (table, json)"),
+		logLevel: flags.String("log-level", "warn", "log level (debug, info, warn, error)"),
+		tls:      addClientTLSFlags(flags),
+		driver:   addDriverFlags(flags),
+		backup:   addBackupFlags(flags),
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s [flags] %s\n\nflags:\n", driverName, cmd.name, cmd.args)
+		flags.PrintDefaults()
+	}
+	return f
+}
+
+// parse parses the command line, checking for the expected number of arguments
+func (f *cliFlags) parse(args []string, nargs int) error {
+	if err := flagsFromEnv(f.flags); err != nil {
+		return err
+	}
+	f.flags.Parse(args)
+
+	if f.flags.NArg() != nargs {
+		f.flags.Usage()
+		os.Exit(2)
+	}
+	if *f.format != formatTable && *f.format != formatJSON {
+		return fmt.Errorf("unknown output format '%s'", *f.format)
+	}
+	return logging.Configure(*f.logLevel, "text")
+}
+
+// api gets the admin API, either from the daemon or by creating the storage driver in process
+func (f *cliFlags) api() (admin.API, error) {
+	if *f.direct {
+		cfs := f.driver.filesystem()
+		d, err := f.driver.create(cfs)
+		if err != nil {
+			return nil, err
+		}
+		backups, err := f.backup.create(cfs)
+		if err != nil {
+			return nil, err
+		}
+		return admin.NewService(d, backups), nil
+	}
+
+	if strings.HasPrefix(*f.addr, "/") || strings.HasPrefix(*f.addr, "unix://") {
+		return admin.NewClient(*f.addr, nil)
+	}
+
+	config, err := newClientTLSConfig(*f.tls.cert, *f.tls.key, *f.tls.caCert)
+	if err != nil {
+		return nil, err
+	}
+	return admin.NewClient(*f.addr, config)
+}
+
+// newCommandContext creates the context for a command, carrying a new correlation ID
+func newCommandContext() context.Context {
+	return logging.WithRequestID(context.Background(), logging.NewRequestID())
+}
+
+// optionsFlag collects repeated key=value flags
+type optionsFlag map[string]string
+
+func (o optionsFlag) String() string {
+	pairs := make([]string, 0, len(o))
+	for key, value := range o {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (o optionsFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=value, got '%s'", s)
+	}
+	o[parts[0]] = parts[1]
+	return nil
+}
+
+// listFlag collects repeated flags
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func runList(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	if err := f.parse(args, 0); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	vols, err := api.List(newCommandContext())
+	if err != nil {
+		return err
+	}
+	return printVolumes(*f.format, vols)
+}
+
+func runInspect(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	vol, err := api.Inspect(newCommandContext(), f.flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printVolume(*f.format, vol)
+}
+
+func runOptions(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	if err := f.parse(args, 0); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	opts, err := api.Options(newCommandContext())
+	if err != nil {
+		return err
+	}
+	return printOptions(*f.format, opts)
+}
+
+func runCreate(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	opts := optionsFlag{}
+	f.flags.Var(opts, "o", "volume option as key=value, may be repeated")
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	vol, err := api.Create(newCommandContext(), &admin.CreateRequest{Name: f.flags.Arg(0), Options: opts})
+	if err != nil {
+		return err
+	}
+	return printVolume(*f.format, vol)
+}
+
+func runRemove(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	return api.Remove(newCommandContext(), f.flags.Arg(0))
+}
+
+func runImport(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	vol, err := api.Import(newCommandContext(), f.flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	return printVolume(*f.format, vol)
+}
+
+func runLabel(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	set := optionsFlag{}
+	var remove listFlag
+	f.flags.Var(set, "l", "label to add or change as key=value, may be repeated")
+	f.flags.Var(&remove, "rm", "label to remove, may be repeated")
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	vol, err := api.Label(newCommandContext(), f.flags.Arg(0), &admin.LabelRequest{Set: set, Remove: remove})
+	if err != nil {
+		return err
+	}
+	return printVolume(*f.format, vol)
+}
+
+func runSnapshot(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	snapshotName := f.flags.String("name", "", "snapshot name, generated if empty")
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+
+	return runOperation(f, func(ctx context.Context, api admin.API) (*admin.Operation, error) {
+		return api.Snapshot(ctx, f.flags.Arg(0), &admin.SnapshotRequest{Name: *snapshotName})
+	})
+}
+
+func runResize(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	size := f.flags.Int64("size", 0, "new size in GB")
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+
+	return runOperation(f, func(ctx context.Context, api admin.API) (*admin.Operation, error) {
+		return api.Resize(ctx, f.flags.Arg(0), &admin.ResizeRequest{SizeGb: *size})
+	})
+}
+
+func runDetach(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	force := f.flags.Bool("force", false, "detach from every instance, not just this one")
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+
+	return runOperation(f, func(ctx context.Context, api admin.API) (*admin.Operation, error) {
+		return api.Detach(ctx, f.flags.Arg(0), &admin.DetachRequest{Force: *force})
+	})
+}
+
+func runTune(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	iops := f.flags.Int64("iops", 0, "provisioned IOPS, unchanged if 0")
+	throughput := f.flags.Int64("throughput", 0, "provisioned throughput in MB/s, unchanged if 0")
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+
+	return runOperation(f, func(ctx context.Context, api admin.API) (*admin.Operation, error) {
+		return api.Tune(ctx, f.flags.Arg(0), &admin.TuneRequest{Iops: *iops, Throughput: *throughput})
+	})
+}
+
+func runMigrate(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	deleteSource := f.flags.Bool("delete-source", false, "delete the original volume once copied, which needs -allow-remove")
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+
+	return runOperation(f, func(ctx context.Context, api admin.API) (*admin.Operation, error) {
+		return api.Migrate(ctx, f.flags.Arg(0), &admin.MigrateRequest{DeleteSource: *deleteSource})
+	})
+}
+
+func runBackup(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	snapshot := f.flags.Bool("snapshot", false, "back up a copy made from a snapshot rather than the live file system")
+	if err := f.parse(args, 1); err != nil {
+		return err
+	}
+
+	return runOperation(f, func(ctx context.Context, api admin.API) (*admin.Operation, error) {
+		return api.Backup(ctx, f.flags.Arg(0), &admin.BackupRequest{Snapshot: *snapshot})
+	})
+}
+
+func runBackups(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	volume := f.flags.String("volume", "", "only list the backups of this volume")
+	if err := f.parse(args, 0); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	backups, err := api.Backups(newCommandContext(), *volume)
+	if err != nil {
+		return err
+	}
+	return printBackups(*f.format, backups)
+}
+
+func runRestore(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	name := f.flags.String("name", "", "name of the new volume, the backed up volume's name if empty")
+	opts := optionsFlag{}
+	f.flags.Var(opts, "o", "option of the new volume as key=value, may be repeated")
+	if err := f.parse(args, 2); err != nil {
+		return err
+	}
+
+	return runOperation(f, func(ctx context.Context, api admin.API) (*admin.Operation, error) {
+		return api.Restore(ctx, f.flags.Arg(0), f.flags.Arg(1), &admin.RestoreRequest{Name: *name, Options: opts})
+	})
+}
+
+func runRemoveBackup(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	if err := f.parse(args, 2); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	return api.DeleteBackup(newCommandContext(), f.flags.Arg(0), f.flags.Arg(1))
+}
+
+func runReconcile(cmd *command, args []string) error {
+	f := newCLIFlags(cmd)
+	dryRun := f.flags.Bool("dry-run", false, "report the repairs without making them")
+	if err := f.parse(args, 0); err != nil {
+		return err
+	}
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	result, err := api.Reconcile(newCommandContext(), &admin.ReconcileRequest{DryRun: *dryRun})
+	if err != nil {
+		return err
+	}
+	return printReconcile(*f.format, result)
+}
+
+// runOperation starts an operation, waits for it to finish and prints the outcome
+func runOperation(f *cliFlags, start func(ctx context.Context, api admin.API) (*admin.Operation, error)) error {
+	api, err := f.api()
+	if err != nil {
+		return err
+	}
+
+	ctx := newCommandContext()
+	op, err := start(ctx, api)
+	if err != nil {
+		return err
+	}
+
+	if op, err = admin.Wait(ctx, api, op, operationPollInterval); err != nil {
+		return err
+	}
+	if err = printOperation(*f.format, op); err != nil {
+		return err
+	}
+	if op.State == admin.OperationFailed {
+		return fmt.Errorf("%s of '%s' failed", op.Type, op.Volume)
+	}
+	return nil
+}
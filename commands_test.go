@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stugotech/cloudvol2/admin"
+	"golang.org/x/net/context"
+)
+
+// fakeAPI records the admin requests the commands make, the methods it doesn't implement panic
+type fakeAPI struct {
+	admin.API
+
+	mu       sync.Mutex
+	calls    []string
+	requests []interface{}
+}
+
+func (a *fakeAPI) record(call string, req interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = append(a.calls, call)
+	a.requests = append(a.requests, req)
+}
+
+func (a *fakeAPI) List(ctx context.Context) ([]*admin.Volume, error) {
+	a.record("list", nil)
+	return []*admin.Volume{
+		{Name: "data", Ready: true, Path: "/mnt/data", Status: map[string]interface{}{"zone": "europe-west1-b"}},
+		{Name: "logs", Status: map[string]interface{}{"region": "europe-west1"}},
+	}, nil
+}
+
+func (a *fakeAPI) Inspect(ctx context.Context, name string) (*admin.Volume, error) {
+	a.record("inspect "+name, nil)
+	if name == "missing" {
+		return nil, fmt.Errorf("volume '%s' not found", name)
+	}
+	return &admin.Volume{Name: name, Status: map[string]interface{}{"sizeGb": 10}}, nil
+}
+
+func (a *fakeAPI) Create(ctx context.Context, req *admin.CreateRequest) (*admin.Volume, error) {
+	a.record("create", req)
+	return &admin.Volume{Name: req.Name}, nil
+}
+
+func (a *fakeAPI) Remove(ctx context.Context, name string) error {
+	a.record("remove "+name, nil)
+	return nil
+}
+
+func (a *fakeAPI) Label(ctx context.Context, name string, req *admin.LabelRequest) (*admin.Volume, error) {
+	a.record("label "+name, req)
+	return &admin.Volume{Name: name}, nil
+}
+
+func (a *fakeAPI) Resize(ctx context.Context, name string, req *admin.ResizeRequest) (*admin.Operation, error) {
+	a.record("resize "+name, req)
+	state := admin.OperationDone
+	if req.SizeGb > 100 {
+		state = admin.OperationFailed
+	}
+	return &admin.Operation{ID: "op", Type: admin.OperationResize, Volume: name, State: state}, nil
+}
+
+func (a *fakeAPI) Restore(ctx context.Context, name string, id string, req *admin.RestoreRequest) (*admin.Operation, error) {
+	a.record("restore "+name+" "+id, req)
+	return &admin.Operation{ID: "op", Type: admin.OperationRestore, Volume: req.Name, State: admin.OperationRunning}, nil
+}
+
+func (a *fakeAPI) Operation(ctx context.Context, id string) (*admin.Operation, error) {
+	a.record("operation "+id, nil)
+	return &admin.Operation{ID: id, Type: admin.OperationRestore, State: admin.OperationDone}, nil
+}
+
+func (a *fakeAPI) Reconcile(ctx context.Context, req *admin.ReconcileRequest) (*admin.ReconcileResult, error) {
+	a.record("reconcile", req)
+	return &admin.ReconcileResult{DryRun: req.DryRun, Actions: []*admin.ReconcileAction{
+		{Volume: "data", Action: "unmount", Reason: "not attached"},
+	}}, nil
+}
+
+// serveFakeAPI serves a fake admin API on a unix socket and gets its path, the returned function stops it
+func serveFakeAPI(t *testing.T, api admin.API) (string, func()) {
+	dir, err := ioutil.TempDir("", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "admin.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	go http.Serve(l, admin.NewServer(api))
+	return sock, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// captureOutput runs a function and gets what it writes to stdout
+func captureOutput(t *testing.T, fn func() error) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		output <- buf.String()
+	}()
+
+	err = fn()
+	w.Close()
+	return <-output, err
+}
+
+// runCommand runs a subcommand against an admin API socket
+func runCommand(t *testing.T, sock string, name string, args ...string) (string, error) {
+	cmd := findCommand(name)
+	if cmd == nil {
+		t.Fatalf("no command '%s'", name)
+	}
+	return captureOutput(t, func() error {
+		return cmd.run(cmd, append([]string{"-admin", sock}, args...))
+	})
+}
+
+func TestCommandsList(t *testing.T) {
+	api := &fakeAPI{}
+	sock, stop := serveFakeAPI(t, api)
+	defer stop()
+
+	output, err := runCommand(t, sock, "ls")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "NAME") {
+		t.Fatalf("expected a header and 2 volumes, got\n%s", output)
+	}
+	if fields := strings.Fields(lines[1]); !reflect.DeepEqual(fields, []string{"data", "europe-west1-b", "true", "/mnt/data"}) {
+		t.Errorf("unexpected row %v", fields)
+	}
+	if fields := strings.Fields(lines[2]); !reflect.DeepEqual(fields, []string{"logs", "europe-west1", "false"}) {
+		t.Errorf("unexpected row %v", fields)
+	}
+
+	output, err = runCommand(t, sock, "ls", "-format", "json")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var vols []*admin.Volume
+	if err = json.Unmarshal([]byte(output), &vols); err != nil || len(vols) != 2 || vols[0].Name != "data" {
+		t.Errorf("expected the volumes as json, got %s (%v)", output, err)
+	}
+
+	if _, err = runCommand(t, sock, "ls", "-format", "yaml"); err == nil {
+		t.Errorf("expected an unknown format to be refused")
+	}
+}
+
+func TestCommandsVolumes(t *testing.T) {
+	api := &fakeAPI{}
+	sock, stop := serveFakeAPI(t, api)
+	defer stop()
+
+	output, err := runCommand(t, sock, "inspect", "data")
+	if err != nil || !strings.Contains(output, "sizeGb") {
+		t.Errorf("expected the status to be shown, got\n%s (%v)", output, err)
+	}
+	if _, err = runCommand(t, sock, "inspect", "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected the error to be returned, got %v", err)
+	}
+
+	if _, err = runCommand(t, sock, "create", "-o", "sizeGb=20", "-o", "label.team=a", "data"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = runCommand(t, sock, "label", "-l", "team=b", "-rm", "env", "-rm", "owner", "data"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = runCommand(t, sock, "rm", "data"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	expected := []string{"inspect data", "inspect missing", "create", "label data", "remove data"}
+	if !reflect.DeepEqual(api.calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, api.calls)
+	}
+	create := api.requests[2].(*admin.CreateRequest)
+	if create.Name != "data" || !reflect.DeepEqual(create.Options, map[string]string{"sizeGb": "20", "label.team": "a"}) {
+		t.Errorf("unexpected create request %v", create)
+	}
+	label := api.requests[3].(*admin.LabelRequest)
+	if !reflect.DeepEqual(label.Set, map[string]string{"team": "b"}) || !reflect.DeepEqual(label.Remove, []string{"env", "owner"}) {
+		t.Errorf("unexpected label request %v", label)
+	}
+}
+
+func TestCommandsOperations(t *testing.T) {
+	api := &fakeAPI{}
+	sock, stop := serveFakeAPI(t, api)
+	defer stop()
+
+	output, err := runCommand(t, sock, "resize", "-size", "20", "data")
+	if err != nil || !strings.Contains(output, admin.OperationDone) {
+		t.Errorf("expected the operation to be shown, got\n%s (%v)", output, err)
+	}
+	if _, err = runCommand(t, sock, "resize", "-size", "200", "data"); err == nil {
+		t.Errorf("expected a failed operation to be an error")
+	}
+
+	// a running operation is polled until it finishes
+	output, err = runCommand(t, sock, "restore", "-name", "copy", "-o", "sizeGb=20", "-format", "json", "data", "backup")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	op := &admin.Operation{}
+	if err = json.Unmarshal([]byte(output), op); err != nil || op.State != admin.OperationDone {
+		t.Errorf("expected the finished operation as json, got %s (%v)", output, err)
+	}
+
+	expected := []string{"resize data", "resize data", "restore data backup", "operation op"}
+	if !reflect.DeepEqual(api.calls, expected) {
+		t.Fatalf("expected calls %v, got %v", expected, api.calls)
+	}
+	if resize := api.requests[0].(*admin.ResizeRequest); resize.SizeGb != 20 {
+		t.Errorf("unexpected resize request %v", resize)
+	}
+	restore := api.requests[2].(*admin.RestoreRequest)
+	if restore.Name != "copy" || restore.Options["sizeGb"] != "20" {
+		t.Errorf("unexpected restore request %v", restore)
+	}
+}
+
+func TestCommandsReconcile(t *testing.T) {
+	api := &fakeAPI{}
+	sock, stop := serveFakeAPI(t, api)
+	defer stop()
+
+	output, err := runCommand(t, sock, "reconcile", "-dry-run")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(output, "unmount") || !strings.Contains(output, "not attached") {
+		t.Errorf("expected the actions to be shown, got\n%s", output)
+	}
+	if req := api.requests[0].(*admin.ReconcileRequest); !req.DryRun {
+		t.Errorf("expected a dry run")
+	}
+}
+
+func TestCommandsUnreachable(t *testing.T) {
+	start := time.Now()
+	_, err := runCommand(t, "/nonexistent/admin.sock", "ls")
+	if err == nil || !strings.Contains(err.Error(), "error contacting cloudvol daemon") {
+		t.Errorf("expected the daemon to be unreachable, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("expected the command to fail quickly")
+	}
+}
+
+func TestOptionsFlag(t *testing.T) {
+	opts := optionsFlag{}
+	for _, value := range []string{"a=1", "b=x=y", "c="} {
+		if err := opts.Set(value); err != nil {
+			t.Errorf("%s: unexpected error: %v", value, err)
+		}
+	}
+	if !reflect.DeepEqual(map[string]string(opts), map[string]string{"a": "1", "b": "x=y", "c": ""}) {
+		t.Errorf("unexpected options %v", opts)
+	}
+	for _, value := range []string{"a", "=1", ""} {
+		if err := opts.Set(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/stugotech/cloudvol2/driver"
+)
+
+// Config is the daemon configuration file, for settings which don't fit in flags
+type Config struct {
+	// Profiles, defaultProfile and requireProfile define the volume profiles
+	driver.Profiles
+	// snapshotHooks and freezeTimeout configure application consistent snapshots
+	driver.SnapshotHooks
+	// Policy limits the volumes which can be created
+	Policy *driver.Policy `json:"policy,omitempty"`
+}
+
+// Load reads a json config file, an empty path gives an empty config
+func Load(path string) (*Config, error) {
+	config := &Config{}
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file: %v", err)
+	}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("error parsing config file '%s': %v", path, err)
+	}
+	return config, nil
+}
@@ -1,17 +1,98 @@
 package driver
 
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
 // Driver represents a cloud storage platform
 type Driver interface {
 	// Create makes a new volume
-	Create(name string, opts map[string]string) (*Volume, error)
+	Create(ctx context.Context, name string, opts map[string]string) (*Volume, error)
 	// Remove delets a volume
-	Remove(id string) error
+	Remove(ctx context.Context, id string) error
 	// List gets all volumes
-	List() ([]*Volume, error)
+	List(ctx context.Context) ([]*Volume, error)
 	// Get gets a single volume
-	Get(id string) (*Volume, error)
+	Get(ctx context.Context, id string) (*Volume, error)
 	// Mount makes a volume available locally
-	Mount(id string) (string, error)
+	Mount(ctx context.Context, id string) (string, error)
 	// Unmount makes a volume unavailable locally
-	Unmount(id string) error
+	Unmount(ctx context.Context, id string) error
+}
+
+// Snapshotter is implemented by drivers which can take snapshots of volumes
+type Snapshotter interface {
+	// Snapshot takes a snapshot of a volume, a name is generated if none is given
+	Snapshot(ctx context.Context, id string, name string) (*Snapshot, error)
+}
+
+// Resizer is implemented by drivers which can grow volumes
+type Resizer interface {
+	// Resize grows a volume and its file system to the given size
+	Resize(ctx context.Context, id string, sizeGb int64) error
+}
+
+// Detacher is implemented by drivers which can detach volumes from other instances
+type Detacher interface {
+	// ForceDetach detaches a volume from every instance it is attached to
+	ForceDetach(ctx context.Context, id string) error
+}
+
+// Migrator is implemented by drivers which can move volumes to the current location
+type Migrator interface {
+	// Migrate moves a volume into the location of the current instance
+	Migrate(ctx context.Context, id string, opts MigrateOptions) (*Volume, error)
+}
+
+// MigrateOptions controls how a volume is migrated
+type MigrateOptions struct {
+	// DeleteSource deletes the original volume once the copy is complete
+	DeleteSource bool
+}
+
+// Cloner is implemented by drivers which can make point in time copies of volumes
+type Cloner interface {
+	// Clone creates a read-only copy of a volume from a snapshot, which is consistent if the volume
+	// asks for consistent snapshots
+	Clone(ctx context.Context, id string, cloneID string) (*Volume, error)
+}
+
+// Importer is implemented by drivers which can adopt storage they didn't create
+type Importer interface {
+	// Import marks existing storage as a volume managed by the driver
+	Import(ctx context.Context, id string) (*Volume, error)
+}
+
+// Labeller is implemented by drivers which can change the labels of existing volumes
+type Labeller interface {
+	// SetLabels adds or changes the labels in set and removes the labels in remove
+	SetLabels(ctx context.Context, id string, set map[string]string, remove []string) (*Volume, error)
+}
+
+// PerformanceSetter is implemented by drivers whose volumes have provisioned performance
+type PerformanceSetter interface {
+	// SetPerformance changes the provisioned IOPS and throughput in MB/s of a volume, leaving zero values unchanged
+	SetPerformance(ctx context.Context, id string, iops int64, throughput int64) (*Volume, error)
+}
+
+// Scheduler is implemented by drivers which run scheduled jobs, such as snapshots
+type Scheduler interface {
+	// RunSchedules runs the jobs which are due every interval until the context is done
+	RunSchedules(ctx context.Context, interval time.Duration)
+}
+
+// Reconciler is implemented by drivers which can repair differences between local and cloud state
+type Reconciler interface {
+	// Reconcile finds and, unless dryRun is set, repairs inconsistencies
+	Reconcile(ctx context.Context, dryRun bool) ([]*ReconcileAction, error)
+}
+
+// ReconcileAction describes a repair made, or which would be made, by Reconcile
+type ReconcileAction struct {
+	Volume string
+	Action string
+	Reason string
+	Error  string
 }
@@ -0,0 +1,125 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/fs"
+	"github.com/stugotech/cloudvol2/keys"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+const (
+	// EncryptedOption is the volume option which enables host side LUKS encryption on block device drivers
+	EncryptedOption  = "encrypted"
+	mapperNamePrefix = "cloudvol-"
+)
+
+// encryption layers LUKS over the block devices of a volume driver, with keys which never leave the host
+type encryption struct {
+	fs   fs.Filesystem
+	keys keys.Source
+}
+
+// newEncryption creates the LUKS layer for a block device driver, keys may be nil if encryption isn't configured
+func newEncryption(fs fs.Filesystem, keys keys.Source) *encryption {
+	return &encryption{fs: fs, keys: keys}
+}
+
+// parseOption parses the encrypted volume option
+func (e *encryption) parseOption(value string) (bool, error) {
+	encrypted, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, err
+	}
+	if encrypted && e.keys == nil {
+		return false, fmt.Errorf("encryption needs a key source")
+	}
+	return encrypted, nil
+}
+
+// format formats a device as a LUKS container holding a new file system
+func (e *encryption) format(ctx context.Context, volume string, device string, fsType string, projectQuota bool) error {
+	key, err := e.key(ctx, volume)
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"volume": volume,
+		"device": device,
+	}).Info("formatting encrypted volume")
+
+	if err = e.fs.FormatLuks(ctx, device, key); err != nil {
+		return fmt.Errorf("error formatting encrypted volume '%s': %v", volume, err)
+	}
+
+	mapper, err := e.fs.OpenLuks(ctx, device, mapperName(volume), key, false)
+	if err != nil {
+		return fmt.Errorf("error opening encrypted volume '%s': %v", volume, err)
+	}
+	if err = e.fs.Format(ctx, mapper, fsType, projectQuota); err != nil {
+		e.close(ctx, volume)
+		return fmt.Errorf("error formatting encrypted volume '%s': %v", volume, err)
+	}
+	return e.close(ctx, volume)
+}
+
+// open unlocks the LUKS container on a device and returns the device to mount
+func (e *encryption) open(ctx context.Context, volume string, device string, readOnly bool) (string, error) {
+	key, err := e.key(ctx, volume)
+	if err != nil {
+		return "", err
+	}
+
+	// a container left open by an earlier failed mount can't be opened again
+	if err = e.close(ctx, volume); err != nil {
+		return "", err
+	}
+
+	mapper, err := e.fs.OpenLuks(ctx, device, mapperName(volume), key, readOnly)
+	if err != nil {
+		return "", fmt.Errorf("error opening encrypted volume '%s': %v", volume, err)
+	}
+	return mapper, nil
+}
+
+// close locks the LUKS container of a volume if it is open
+func (e *encryption) close(ctx context.Context, volume string) error {
+	if err := e.fs.CloseLuks(ctx, mapperName(volume)); err != nil {
+		return fmt.Errorf("error closing encrypted volume '%s': %v", volume, err)
+	}
+	return nil
+}
+
+// grow grows the open LUKS container of a volume after its device has grown
+func (e *encryption) grow(ctx context.Context, volume string) error {
+	key, err := e.key(ctx, volume)
+	if err != nil {
+		return err
+	}
+	if err = e.fs.ResizeLuks(ctx, mapperName(volume), key); err != nil {
+		return fmt.Errorf("error resizing encrypted volume '%s': %v", volume, err)
+	}
+	return nil
+}
+
+// key gets the key of a volume
+func (e *encryption) key(ctx context.Context, volume string) ([]byte, error) {
+	if e.keys == nil {
+		return nil, fmt.Errorf("volume '%s' is encrypted but no key source is configured", volume)
+	}
+	return e.keys.Key(ctx, volume)
+}
+
+// mapperName gets the device mapper name of an encrypted volume
+func mapperName(volume string) string {
+	return mapperNamePrefix + volume
+}
+
+// mapperDevice gets the device mapper device of an encrypted volume
+func mapperDevice(volume string) string {
+	return fs.MapperDevice(mapperName(volume))
+}
@@ -0,0 +1,134 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+const testKey = "0123456789abcdef"
+
+// staticKeys gives every volume the same key, or fails if err is set
+type staticKeys struct {
+	err error
+}
+
+func (k *staticKeys) Key(ctx context.Context, volume string) ([]byte, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	return []byte(testKey), nil
+}
+
+func TestEncryptionParseOption(t *testing.T) {
+	tests := []struct {
+		value     string
+		keys      bool
+		encrypted bool
+		valid     bool
+	}{
+		{"true", true, true, true},
+		{"1", true, true, true},
+		{"false", true, false, true},
+		{"false", false, false, true},
+		{"true", false, false, false},
+		{"yes", true, false, false},
+	}
+
+	for _, test := range tests {
+		e := newEncryption(newFakeFilesystem(), nil)
+		if test.keys {
+			e = newEncryption(newFakeFilesystem(), &staticKeys{})
+		}
+
+		encrypted, err := e.parseOption(test.value)
+		if test.valid && (err != nil || encrypted != test.encrypted) {
+			t.Errorf("%s (keys %v): expected %v, got %v, %v", test.value, test.keys, test.encrypted, encrypted, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s (keys %v): expected error", test.value, test.keys)
+		}
+	}
+}
+
+func TestEncryptionFormat(t *testing.T) {
+	mapper := mapperDevice("data")
+	failure := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		keysErr error
+		fail    string
+		calls   string
+	}{
+		{
+			"formatted",
+			nil, "",
+			fmt.Sprintf("FormatLuks /dev/sdb %s; OpenLuks /dev/sdb cloudvol-data %s false; Format %s xfs true; CloseLuks cloudvol-data", testKey, testKey, mapper),
+		},
+		{"no key", failure, "", ""},
+		{"luks fails", nil, "FormatLuks", "FormatLuks /dev/sdb " + testKey},
+		{
+			// the container is closed again when the file system can't be made
+			"format fails",
+			nil, "Format",
+			fmt.Sprintf("FormatLuks /dev/sdb %s; OpenLuks /dev/sdb cloudvol-data %s false; Format %s xfs true; CloseLuks cloudvol-data", testKey, testKey, mapper),
+		},
+	}
+
+	for _, test := range tests {
+		filesystem := newFakeFilesystem()
+		if test.fail != "" {
+			filesystem.failures[test.fail] = failure
+		}
+		e := newEncryption(filesystem, &staticKeys{err: test.keysErr})
+
+		err := e.format(context.Background(), "data", "/dev/sdb", "xfs", true)
+		if (err != nil) != (test.keysErr != nil || test.fail != "") {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+		if calls := filesystem.recorded(); calls != test.calls {
+			t.Errorf("%s: expected calls '%s', got '%s'", test.name, test.calls, calls)
+		}
+	}
+}
+
+func TestEncryptionOpen(t *testing.T) {
+	filesystem := newFakeFilesystem()
+	e := newEncryption(filesystem, &staticKeys{})
+
+	device, err := e.open(context.Background(), "data", "/dev/sdb", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device != mapperDevice("data") {
+		t.Errorf("expected mapper device %s, got %s", mapperDevice("data"), device)
+	}
+	// a container left open by a failed mount is closed before it is opened
+	expected := "CloseLuks cloudvol-data; OpenLuks /dev/sdb cloudvol-data " + testKey + " true"
+	if calls := filesystem.recorded(); calls != expected {
+		t.Errorf("expected calls '%s', got '%s'", expected, calls)
+	}
+
+	filesystem = newFakeFilesystem()
+	filesystem.failures["CloseLuks"] = errors.New("busy")
+	if _, err = newEncryption(filesystem, &staticKeys{}).open(context.Background(), "data", "/dev/sdb", false); err == nil {
+		t.Errorf("expected error when the open container can't be closed")
+	}
+}
+
+func TestEncryptionGrow(t *testing.T) {
+	filesystem := newFakeFilesystem()
+	if err := newEncryption(filesystem, &staticKeys{}).grow(context.Background(), "data"); err != nil {
+		t.Fatal(err)
+	}
+	if calls := filesystem.recorded(); calls != "ResizeLuks cloudvol-data "+testKey {
+		t.Errorf("unexpected calls '%s'", calls)
+	}
+
+	if err := newEncryption(newFakeFilesystem(), nil).grow(context.Background(), "data"); err == nil {
+		t.Errorf("expected error without a key source")
+	}
+}
@@ -0,0 +1,29 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// InUseError is returned when a volume is attached to other instances
+type InUseError struct {
+	Volume string
+	Users  []string
+}
+
+func (e *InUseError) Error() string {
+	return fmt.Sprintf("volume '%s' is in use by %s", e.Volume, strings.Join(e.Users, ", "))
+}
+
+// CapacityError is returned when an instance has as many disks attached as it can
+type CapacityError struct {
+	Volume   string
+	Instance string
+	Attached int64
+	Limit    int64
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("can't attach volume '%s': instance '%s' has %d disks attached, the most its machine type allows is %d",
+		e.Volume, e.Instance, e.Attached, e.Limit)
+}
@@ -0,0 +1,133 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/stugotech/cloudvol2/fs"
+	"golang.org/x/net/context"
+)
+
+// fakeFilesystem records the file system operations the driver makes, failing those listed in failures;
+// operations it doesn't implement go to the embedded interface, which panics unless it is set
+type fakeFilesystem struct {
+	fs.Filesystem
+
+	mutex    sync.Mutex
+	calls    []string
+	failures map[string]error
+	// env is the environment of the last command run
+	env []string
+	// mounts are the targets of bind mounts
+	mounts map[string]bool
+}
+
+func newFakeFilesystem() *fakeFilesystem {
+	return &fakeFilesystem{failures: make(map[string]error), mounts: make(map[string]bool)}
+}
+
+// record notes a call and returns the error it should fail with
+func (f *fakeFilesystem) record(method string, args ...interface{}) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	call := method
+	for _, arg := range args {
+		call += fmt.Sprintf(" %v", arg)
+	}
+	f.calls = append(f.calls, call)
+	return f.failures[method]
+}
+
+// recorded gets the calls made so far, separated by '; '
+func (f *fakeFilesystem) recorded() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return strings.Join(f.calls, "; ")
+}
+
+func (f *fakeFilesystem) Format(ctx context.Context, target string, fsType string, projectQuota bool) error {
+	return f.record("Format", target, fsType, projectQuota)
+}
+
+func (f *fakeFilesystem) FormatLuks(ctx context.Context, device string, key []byte) error {
+	return f.record("FormatLuks", device, string(key))
+}
+
+func (f *fakeFilesystem) OpenLuks(ctx context.Context, device string, name string, key []byte, readOnly bool) (string, error) {
+	if err := f.record("OpenLuks", device, name, string(key), readOnly); err != nil {
+		return "", err
+	}
+	return fs.MapperDevice(name), nil
+}
+
+func (f *fakeFilesystem) CloseLuks(ctx context.Context, name string) error {
+	return f.record("CloseLuks", name)
+}
+
+func (f *fakeFilesystem) ResizeLuks(ctx context.Context, name string, key []byte) error {
+	return f.record("ResizeLuks", name, string(key))
+}
+
+// liveness describes whether a call's context was still usable
+func liveness(ctx context.Context) string {
+	if ctx.Err() != nil {
+		return "cancelled"
+	}
+	return "live"
+}
+
+func (f *fakeFilesystem) Freeze(ctx context.Context, mountPoint string) error {
+	return f.record("Freeze", mountPoint, liveness(ctx))
+}
+
+func (f *fakeFilesystem) Thaw(ctx context.Context, mountPoint string) error {
+	return f.record("Thaw", mountPoint, liveness(ctx))
+}
+
+func (f *fakeFilesystem) Run(ctx context.Context, env []string, args ...string) (string, error) {
+	f.mutex.Lock()
+	f.env = env
+	f.mutex.Unlock()
+	return "", f.record("Run", strings.Join(args, " "), liveness(ctx))
+}
+
+func (f *fakeFilesystem) Chmod(ctx context.Context, target string, mode os.FileMode) error {
+	return f.record("Chmod", target, fs.FormatMode(mode))
+}
+
+func (f *fakeFilesystem) Chown(ctx context.Context, target string, uid int, gid int, recursive bool) error {
+	return f.record("Chown", target, uid, gid, recursive)
+}
+
+func (f *fakeFilesystem) SetProjectQuota(ctx context.Context, mountPoint string, dir string, project uint32, limitKb int64) error {
+	return f.record("SetProjectQuota", mountPoint, dir, project, limitKb)
+}
+
+func (f *fakeFilesystem) Bind(ctx context.Context, source string, target string) error {
+	if err := f.record("Bind", source, target); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.mounts[target] = true
+	return nil
+}
+
+func (f *fakeFilesystem) Unmount(ctx context.Context, target string) error {
+	if err := f.record("Unmount", target); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.mounts, target)
+	return nil
+}
+
+func (f *fakeFilesystem) IsMountPoint(ctx context.Context, dir string) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.mounts[dir], nil
+}
@@ -9,6 +9,8 @@ import (
 	"path"
 
 	"strconv"
+	"strings"
+	"sync"
 
 	"errors"
 
@@ -16,6 +18,8 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/gordonmleigh/mountpath"
 	"github.com/stugotech/cloudvol2/fs"
+	"github.com/stugotech/cloudvol2/keys"
+	"github.com/stugotech/cloudvol2/logging"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/compute/v1"
@@ -26,32 +30,145 @@ const (
 	operationWaitTimeout  = 5 * time.Second
 	operationPollInterval = 100 * time.Millisecond
 	defaultVolumeSizeGb   = 10
+	maxResourceNameLength = 63
+	gceDefaultDiskType    = "pd-standard"
 )
 
+// GceConfig holds the settings for the GCE driver
+type GceConfig struct {
+	// DefaultSizeGb is the size of volumes created without a sizeGb option
+	DefaultSizeGb int64
+	// DefaultDiskType is the disk type of volumes created without a type option
+	DefaultDiskType string
+	// Takeover is the policy for disks attached to another instance: fail, wait or force
+	Takeover string
+	// TakeoverTimeout is how long the wait policy waits for the other instance
+	TakeoverTimeout time.Duration
+	// ListAllZones makes List include disks in every zone of the instance's region, and lookups of missing
+	// volumes report the zone they are in
+	ListAllZones bool
+	// ManagedLabel is the key=value label which marks the disks cloudvol manages
+	ManagedLabel string
+	// Namespace, if set, further restricts cloudvol to disks labelled with the namespace
+	Namespace string
+	// DefaultLabels are added to every disk cloudvol creates, label options override them
+	DefaultLabels map[string]string
+	// DefaultKmsKey is the Cloud KMS key for disks created without a kmsKey option
+	DefaultKmsKey string
+	// RequireKmsKey refuses to create disks which aren't encrypted with a Cloud KMS key
+	RequireKmsKey bool
+	// Keys provides the keys of volumes created with host side encryption
+	Keys keys.Source
+	// Profiles are the named option sets volumes can be created from
+	Profiles *Profiles
+	// Policy limits the volumes which can be created
+	Policy *Policy
+	// Hooks are the snapshot hooks volumes can select
+	Hooks *SnapshotHooks
+	// MountDirMode is the mode of the directories volumes are mounted on, DefaultMountDirMode if zero
+	MountDirMode os.FileMode
+	// MaxAttachedDisks is the most disks, including the boot disk, the instance can have attached, read
+	// from its machine type if zero
+	MaxAttachedDisks int64
+	// DetachIdle detaches a volume which is attached but not mounted when a volume can't be attached as
+	// the instance is at its limit
+	DetachIdle bool
+	// AllowRemove lets Remove delete the disks of volumes, otherwise removing a volume is refused and
+	// its disk is kept
+	AllowRemove bool
+}
+
 type gceDriver struct {
 	fs          fs.Filesystem
 	client      *compute.Service
 	project     string
 	zone        string
+	region      string
 	instance    string
 	instanceURI string
 	mountPath   string
+	config      GceConfig
+	scope       map[string]string
+	crypt       *encryption
 	diskTypes   map[string]*compute.DiskType
+	// diskTypesMutex guards the cache of disk types, which concurrent requests share
+	diskTypesMutex sync.Mutex
+	// maxDisks is the limit of attached disks, 0 if unknown; attachMutex serialises checking it and attaching
+	maxDisks    int64
+	attachMutex sync.Mutex
+	holds       *volumeHolds
+	// scheduleErrors are the errors of failed scheduled snapshots taken by this instance
+	scheduleErrors *scheduleErrors
 }
 
 type gceVolume struct {
 	Volume
 	diskURI    string
+	region     string
 	devicePath string
+	sizeGb     int64
+	users      []string
+	kmsKey     string
+	encrypted  bool
+	mode       string
+	// growPending is set on disks created from a smaller image or disk until the file system is grown
+	growPending bool
+	fsType      string
+	mountOpts   []string
+	readOnly    bool
+	// projectQuota is set on file systems mounted with project quotas
+	projectQuota bool
+	// fsFreeze and snapshotHook make snapshots application consistent
+	fsFreeze     bool
+	snapshotHook string
+	root         volumeRoot
 }
 
 type gceVolumeOptions struct {
-	sizeGb      int64
-	diskTypeURI string
+	sizeGb       int64
+	diskTypeURI  string
+	mode         string
+	replicaZones []string
+	labels       map[string]string
+	description  string
+	kmsKey       string
+	encrypted    bool
+	sizeGbSet    bool
+	source       diskSource
+	iops         int64
+	throughput   int64
+	fsType       string
+	mountOpts    string
+	projectQuota bool
+	profile      string
+	// snapshotSchedule is label encoded
+	snapshotSchedule string
+	snapshotRetain   int64
+	fsFreeze         bool
+	snapshotHook     string
+	// seedChecksum and seedOwner are moved into seed once every option is parsed
+	seed         *volumeSeed
+	seedChecksum []byte
+	seedOwner    []int
+	root         volumeRoot
 }
 
 // NewGceDriver creates a new instance of the GCE volume driver
-func NewGceDriver(mountPath string, fs fs.Filesystem) (Driver, error) {
+func NewGceDriver(mountPath string, fs fs.Filesystem, config GceConfig) (Driver, error) {
+	if config.DefaultSizeGb <= 0 {
+		config.DefaultSizeGb = defaultVolumeSizeGb
+	}
+	if config.MountDirMode == 0 {
+		config.MountDirMode = DefaultMountDirMode
+	}
+	if err := validateTakeover(&config); err != nil {
+		return nil, err
+	}
+	scope, err := scopeLabels(&config)
+	if err != nil {
+		return nil, err
+	}
+
 	if !metadata.OnGCE() {
 		log.Warn("GCE: not on GCE or can't contact metadata server")
 		return nil, fmt.Errorf("GCE: not on GCE or can't contact metadata server")
@@ -60,7 +177,7 @@ func NewGceDriver(mountPath string, fs fs.Filesystem) (Driver, error) {
 	creds := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
 
 	if creds != "" {
-		log.WithFields(log.Fields{"file": creds}).Info("GCE: using credentials from GOOGLE_APPLICATION_CREDENTIALS")
+		log.WithFields(log.Fields{"credentials": creds}).Info("GCE: using credentials from GOOGLE_APPLICATION_CREDENTIALS")
 	} else {
 		log.Info("GCE: using instance default credentials")
 	}
@@ -108,73 +225,189 @@ func NewGceDriver(mountPath string, fs fs.Filesystem) (Driver, error) {
 		client:      computeService,
 		instance:    instance,
 		zone:        zone,
+		region:      zoneRegion(zone),
 		project:     project,
 		instanceURI: instanceData.SelfLink,
 		mountPath:   mountPath,
+		config:      config,
+		scope:       scope,
+		crypt:       newEncryption(fs, config.Keys),
+
+		scheduleErrors: newScheduleErrors(),
+		holds:          newVolumeHolds(),
+	}
+	provider.maxDisks = provider.diskLimit(ctx, instanceData)
+	if err = provider.validateDefaultLabels(); err != nil {
+		return nil, err
+	}
+	if err = config.Profiles.Validate(provider.Options()); err != nil {
+		return nil, fmt.Errorf("GCE: %v", err)
+	}
+	if err = config.Policy.Validate(); err != nil {
+		return nil, fmt.Errorf("GCE: %v", err)
+	}
+	if err = config.Hooks.Validate(); err != nil {
+		return nil, fmt.Errorf("GCE: %v", err)
+	}
+	if config.DefaultKmsKey != "" {
+		if err = provider.validateKmsKey(config.DefaultKmsKey); err != nil {
+			return nil, fmt.Errorf("GCE: invalid default KMS key: %v", err)
+		}
 	}
 
 	return provider, nil
 }
 
 // Create makes a new volume
-func (d *gceDriver) Create(id string, optsMap map[string]string) (*Volume, error) {
+func (d *gceDriver) Create(ctx context.Context, id string, optsMap map[string]string) (*Volume, error) {
+	if err := d.checkPolicy(ctx, id, optsMap); err != nil {
+		return nil, err
+	}
+
+	defer d.holds.hold(id)()
+
 	// parse options
-	opts, err := d.parseVolumeOptions(optsMap)
+	opts, err := d.parseVolumeOptions(ctx, optsMap)
 	if err != nil {
 		return nil, err
 	}
 
+	if opts.seed != nil {
+		// a create which failed while seeding is finished rather than failing as the disk exists
+		if vol, resumed, err := d.resumeSeed(ctx, id, opts.seed); resumed {
+			return vol, err
+		}
+	}
+
 	// create disk
-	vol, err := d.createDisk(id, opts)
+	vol, err := d.createDisk(ctx, id, opts)
 	if err != nil {
 		return nil, err
 	}
 
 	// attach
-	if err = d.attachDisk(vol); err != nil {
+	if err = d.attachDisk(ctx, vol); err != nil {
 		return nil, err
 	}
 
-	// format
-	if err = d.fs.Format(vol.devicePath); err != nil {
-		return nil, fmt.Errorf("GCE: error formatting new volume '%s': %v", id, err)
+	// format, unless the image or disk brings its own file system
+	if !opts.source.isSet() {
+		if opts.seed != nil {
+			err = d.formatSeedDisk(ctx, vol)
+		} else {
+			err = d.formatDisk(ctx, vol)
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// mount
-	if err = d.mountDisk(vol); err != nil {
-		return nil, err
+	if opts.seed != nil {
+		if err = d.seedDisk(ctx, vol, opts.seed); err != nil {
+			return nil, err
+		}
 	}
+	return d.finishCreate(ctx, vol)
+}
 
-	return &vol.Volume, err
+// formatDisk creates the file system of a new disk attached read-write to this instance
+func (d *gceDriver) formatDisk(ctx context.Context, vol *gceVolume) error {
+	var err error
+	if vol.encrypted {
+		err = d.crypt.format(ctx, vol.Name, vol.devicePath, vol.fsType, vol.projectQuota)
+	} else {
+		err = d.fs.Format(ctx, vol.devicePath, vol.fsType, vol.projectQuota)
+	}
+	if err != nil {
+		return fmt.Errorf("GCE: error formatting new volume '%s': %v", vol.Name, err)
+	}
+	return nil
 }
 
-// Remove deletes a disk
-func (d *gceDriver) Remove(id string) error {
-	return fmt.Errorf("GCE: Remove not supported")
+// finishCreate leaves a new disk, attached read-write for formatting and seeding, as it is used: mounted,
+// or detached for read-only modes as the volume is attached read-only when mounted
+func (d *gceDriver) finishCreate(ctx context.Context, vol *gceVolume) (*Volume, error) {
+	if isReadOnlyMode(vol.mode) {
+		if vol.Path != "" {
+			if err := d.unmountDisk(ctx, vol); err != nil {
+				return nil, err
+			}
+		}
+		if err := d.detachDisk(ctx, vol); err != nil {
+			return nil, err
+		}
+		return &vol.Volume, nil
+	}
+
+	// mount
+	if vol.Path == "" {
+		if err := d.mountDisk(ctx, vol); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.growIfPending(ctx, vol); err != nil {
+		return nil, err
+	}
+	return &vol.Volume, nil
 }
 
-// List gets info about disks from GCE
-func (d *gceDriver) List() ([]*Volume, error) {
-	ctx := context.Background()
-	call := d.client.Disks.List(d.project, d.zone)
-	var volumes []*Volume
+// Remove deletes a disk, if deleting disks is enabled
+func (d *gceDriver) Remove(ctx context.Context, id string) error {
+	if !d.config.AllowRemove {
+		return fmt.Errorf("GCE: Remove not supported, deleting disks isn't enabled")
+	}
 
-	err := call.Pages(ctx, func(page *compute.DiskList) error {
-		for _, disk := range page.Items {
-			volumes = append(volumes, &Volume{Name: disk.Name})
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if vol.Path != "" {
+		return fmt.Errorf("GCE: volume '%s' is mounted on '%s'", id, vol.Path)
+	}
+
+	if vol.Ready {
+		// attached here but not mounted, e.g. after a failed unmount
+		if err = d.detachDisk(ctx, vol); err != nil {
+			return err
 		}
-		return nil
-	})
+	} else if len(vol.users) > 0 {
+		return &InUseError{Volume: id, Users: instanceNames(vol.users)}
+	}
+
+	op, err := d.deleteDisk(ctx, vol)
+	if err != nil {
+		return fmt.Errorf("GCE: error deleting disk '%s': %v", id, err)
+	}
+	if err = d.waitForOp(ctx, op); err != nil {
+		return fmt.Errorf("GCE: error deleting disk '%s': %v", id, err)
+	}
+	return nil
+}
 
+// List gets info about zonal disks in this instance's zone and regional disks in its region
+func (d *gceDriver) List(ctx context.Context) ([]*Volume, error) {
+	disks, err := d.listDisks(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("GCE: error listing disks: %v", err)
 	}
+
+	var volumes []*Volume
+	for _, disk := range disks {
+		vol := &Volume{Name: disk.Name, Status: map[string]interface{}{}}
+		if disk.Region != "" {
+			vol.Status["region"] = path.Base(disk.Region)
+		} else {
+			vol.Status["zone"] = path.Base(disk.Zone)
+		}
+		volumes = append(volumes, vol)
+	}
 	return volumes, nil
 }
 
 // Get gets info about a volume
-func (d *gceDriver) Get(id string) (*Volume, error) {
-	vol, err := d.getVolume(id)
+func (d *gceDriver) Get(ctx context.Context, id string) (*Volume, error) {
+	vol, err := d.getVolume(ctx, id)
 	if err != nil {
 		return nil, err
 	}
@@ -182,33 +415,55 @@ func (d *gceDriver) Get(id string) (*Volume, error) {
 }
 
 // Mount mounts a volume
-func (d *gceDriver) Mount(id string) (string, error) {
-	vol, err := d.getVolume(id)
+func (d *gceDriver) Mount(ctx context.Context, id string) (string, error) {
+	defer d.holds.hold(id)()
+
+	vol, err := d.getVolume(ctx, id)
 	if err != nil {
 		return "", err
 	}
 
 	if vol.Path != "" {
+		if isReadOnlyMode(vol.mode) && !vol.readOnly {
+			return "", fmt.Errorf("GCE: volume '%s' is mounted read-write on '%s', it can't be mounted read-only", id, vol.Path)
+		}
 		return vol.Path, fmt.Errorf("GCE: volume '%s' already mounted on '%s'", id, vol.Path)
 	}
 
+	if vol.Ready && vol.readOnly != isReadOnlyMode(vol.mode) {
+		// attached here in the wrong mode, reattach
+		if err = d.detachDisk(ctx, vol); err != nil {
+			return "", err
+		}
+		vol.Ready = false
+	}
+
 	if !vol.Ready {
+		// make sure no other instance holds the disk in a conflicting mode
+		if vol, err = d.claim(ctx, vol); err != nil {
+			return "", err
+		}
+		vol.readOnly = isReadOnlyMode(vol.mode)
+
 		// attach
-		if err = d.attachDisk(vol); err != nil {
+		if err = d.attachDisk(ctx, vol); err != nil {
 			return "", err
 		}
 	}
 
 	// mount
-	if err = d.mountDisk(vol); err != nil {
+	if err = d.mountDisk(ctx, vol); err != nil {
+		return "", err
+	}
+	if err = d.growIfPending(ctx, vol); err != nil {
 		return "", err
 	}
 	return vol.Path, nil
 }
 
 // Unmount unmounts a volume
-func (d *gceDriver) Unmount(id string) error {
-	vol, err := d.getVolume(id)
+func (d *gceDriver) Unmount(ctx context.Context, id string) error {
+	vol, err := d.getVolume(ctx, id)
 	if err != nil {
 		return err
 	}
@@ -218,32 +473,110 @@ func (d *gceDriver) Unmount(id string) error {
 	}
 
 	// unmount
-	if err = d.unmountDisk(vol); err != nil {
+	if err = d.unmountDisk(ctx, vol); err != nil {
 		return err
 	}
 
 	// detach
-	if err = d.detachDisk(vol); err != nil {
+	if err = d.detachDisk(ctx, vol); err != nil {
 		return err
 	}
 	return nil
 }
 
 // getVolume gets info about a volume
-func (d *gceDriver) getVolume(id string) (*gceVolume, error) {
-	disk, err := d.client.Disks.Get(d.project, d.zone, id).Do()
+func (d *gceDriver) getVolume(ctx context.Context, id string) (*gceVolume, error) {
+	disk, err := d.getDisk(ctx, id)
+	if isNotFound(err) && d.config.ListAllZones {
+		// looking in every zone costs a request per zone, so only do it where List shows those disks
+		if zone, _ := d.findDiskZone(ctx, id); zone != "" {
+			return nil, fmt.Errorf("GCE: disk '%s' is in zone '%s', not in this instance's zone '%s', migrate it to use it here", id, zone, d.zone)
+		}
+	}
 	if err != nil {
 		return nil, fmt.Errorf("GCE: error getting info about disk '%s': %v", id, err)
 	}
+	if !d.inScope(disk) {
+		return nil, fmt.Errorf("GCE: disk '%s' is not managed by cloudvol, import it to use it as a volume", id)
+	}
 
 	vol := &gceVolume{
 		Volume: Volume{
 			Name: disk.Name,
+			Status: map[string]interface{}{
+				"sizeGb": disk.SizeGb,
+				"type":   path.Base(disk.Type),
+				"status": disk.Status,
+				"users":  instanceNames(disk.Users),
+			},
 		},
 		diskURI: disk.SelfLink,
+		sizeGb:  disk.SizeGb,
+		users:   disk.Users,
+		mode:    volumeMode(disk),
+		kmsKey:  diskKmsKey(disk),
+
+		encrypted:   disk.Labels[encryptedLabel] == "true",
+		growPending: disk.Labels[growLabel] == "true",
+		fsType:      disk.Labels[fsTypeLabel],
+		mountOpts:   splitMountOpts(decodeLabelValue(disk.Labels[mountOptsLabel])),
+
+		projectQuota: disk.Labels[quotaLabel] == "true",
+
+		fsFreeze:     disk.Labels[fsFreezeLabel] == "true",
+		snapshotHook: disk.Labels[hookLabel],
+		root:         rootFromLabels(disk),
+	}
+	vol.Status["mode"] = vol.mode
+	if vol.kmsKey != "" {
+		vol.Status["kmsKey"] = vol.kmsKey
+	}
+	if vol.encrypted {
+		vol.Status["encrypted"] = true
+	}
+	if vol.fsType != "" {
+		vol.Status["fstype"] = vol.fsType
+	}
+	if profile := disk.Labels[profileLabel]; profile != "" {
+		vol.Status["profile"] = profile
+	}
+	if len(vol.mountOpts) > 0 {
+		vol.Status["mountOpts"] = strings.Join(vol.mountOpts, ",")
+	}
+	if vol.projectQuota {
+		vol.Status[ProjectQuotaOption] = true
+	}
+	if disk.ProvisionedIops != 0 {
+		vol.Status["provisionedIops"] = disk.ProvisionedIops
+	}
+	if disk.ProvisionedThroughput != 0 {
+		vol.Status["provisionedThroughput"] = disk.ProvisionedThroughput
+	}
+	if vol.fsFreeze {
+		vol.Status[FreezeOption] = true
+	}
+	if vol.snapshotHook != "" {
+		vol.Status[SnapshotHookOption] = vol.snapshotHook
+	}
+	if seed := disk.Labels[seedLabel]; seed != "" {
+		vol.Status[SeedOption] = seed
+	}
+	vol.root.status(vol.Status)
+	d.scheduleStatus(disk, vol.Status)
+	vol.Status["labels"] = d.userLabels(disk.Labels)
+	if disk.Description != "" {
+		vol.Status["description"] = disk.Description
 	}
 
-	log.WithFields(log.Fields{
+	if disk.Region != "" {
+		vol.region = path.Base(disk.Region)
+		vol.Status["region"] = vol.region
+		vol.Status["replicaZones"] = instanceNames(disk.ReplicaZones)
+	} else {
+		vol.Status["zone"] = path.Base(disk.Zone)
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
 		"disk":  disk.Name,
 		"users": disk.Users,
 	}).Info("GCE: found disk")
@@ -251,7 +584,7 @@ func (d *gceDriver) getVolume(id string) (*gceVolume, error) {
 	if stringInSlice(disk.Users, d.instanceURI) {
 		// this disk is already attached
 		vol.Ready = true
-		log.WithFields(log.Fields{"disk": disk.Name}).Info("disk is attached to current instance")
+		logging.FromContext(ctx).WithFields(log.Fields{"disk": disk.Name}).Info("disk is attached to current instance")
 
 		attachment, err := d.getAttachedDisk(d.instance, disk.SelfLink)
 		if err != nil {
@@ -259,71 +592,337 @@ func (d *gceDriver) getVolume(id string) (*gceVolume, error) {
 		}
 
 		vol.devicePath = fmt.Sprintf(devicePathFormat, attachment.DeviceName)
+		vol.readOnly = attachment.Mode == attachReadOnly
+		vol.Status["devicePath"] = vol.devicePath
 
-		vol.Path, err = mountpath.GetMountPath(vol.devicePath)
+		vol.Path, err = getMountPath(vol.mountDevice())
 		if err != nil {
 			return nil, fmt.Errorf("GCE: unable to get mount info for disk '%s': %v", id, err)
 		}
 
-		log.WithFields(log.Fields{
+		logging.FromContext(ctx).WithFields(log.Fields{
 			"disk":       disk.Name,
 			"devicePath": vol.devicePath,
 			"mount":      vol.Path,
 		}).Info("GCE: found volume attachment")
 	} else {
-		log.WithFields(log.Fields{"disk": disk.Name}).Info("disk not attached to current instance")
+		logging.FromContext(ctx).WithFields(log.Fields{"disk": disk.Name}).Info("disk not attached to current instance")
 	}
 
 	return vol, nil
 }
 
-// parseVolumeOptions parses the string options
-func (d *gceDriver) parseVolumeOptions(opts map[string]string) (*gceVolumeOptions, error) {
+// parseVolumeOptions parses the string options, reporting every invalid option
+func (d *gceDriver) parseVolumeOptions(ctx context.Context, opts map[string]string) (*gceVolumeOptions, error) {
 	parsed := &gceVolumeOptions{
-		sizeGb: defaultVolumeSizeGb,
+		sizeGb: d.config.DefaultSizeGb,
+		mode:   modeReadWrite,
+		labels: make(map[string]string),
+		kmsKey: d.config.DefaultKmsKey,
+		root:   volumeRoot{uid: -1, gid: -1},
+	}
+	for key, value := range d.config.DefaultLabels {
+		parsed.labels[key] = value
 	}
 
-	for key, value := range opts {
-		if err := d.parseVolumeOption(parsed, key, value); err != nil {
-			return nil, fmt.Errorf("GCE: error processing option '%s' with value '%s': %v", key, value, err)
+	if _, exists := opts["type"]; !exists && d.config.DefaultDiskType != "" {
+		if err := d.parseVolumeOption(ctx, parsed, "type", d.config.DefaultDiskType); err != nil {
+			return nil, fmt.Errorf("GCE: error processing default disk type '%s': %v", d.config.DefaultDiskType, err)
+		}
+	}
+
+	problems := &OptionsError{}
+	opts = d.config.Profiles.Expand(opts, problems)
+	for _, key := range d.Options().check(opts, problems) {
+		if err := d.parseVolumeOption(ctx, parsed, key, opts[key]); err != nil {
+			problems.add(key, "%v", err)
+		}
+	}
+	_, parsed.sizeGbSet = opts["sizeGb"]
+
+	if parsed.iops != 0 || parsed.throughput != 0 {
+		diskType := gceDefaultDiskType
+		if parsed.diskTypeURI != "" {
+			diskType = path.Base(parsed.diskTypeURI)
+		}
+		if err := validatePerformance(diskType, parsed.iops, parsed.throughput); err != nil {
+			problems.add("type", "%v", err)
+		}
+	}
+
+	if parsed.source.isSet() && parsed.encrypted {
+		problems.add(EncryptedOption, "encrypted volumes can't be created from an image or disk")
+	}
+	if parsed.source.isSet() && parsed.projectQuota {
+		problems.add(ProjectQuotaOption, "volumes created from an image or disk keep its file system, which may not support project quotas")
+	}
+
+	if parsed.snapshotRetain != 0 && parsed.snapshotSchedule == "" {
+		problems.add("snapshotRetain", "only applies to volumes with a snapshotSchedule")
+	}
+
+	if parsed.seed == nil {
+		if parsed.seedChecksum != nil {
+			problems.add(SeedChecksumOption, "only applies to volumes with a seed")
+		}
+		if parsed.seedOwner != nil {
+			problems.add(SeedOwnerOption, "only applies to volumes with a seed")
 		}
+	} else {
+		if parsed.seedChecksum != nil && parsed.seed.kind == seedVolume {
+			problems.add(SeedChecksumOption, "only applies to seed archives")
+		}
+		parsed.seed.checksum = parsed.seedChecksum
+		if parsed.seedOwner != nil {
+			parsed.seed.owner = true
+			parsed.seed.uid, parsed.seed.gid = parsed.seedOwner[0], parsed.seedOwner[1]
+		}
+	}
+
+	if d.config.RequireKmsKey && parsed.kmsKey == "" {
+		problems.add("kmsKey", "disks must be encrypted with a Cloud KMS key")
 	}
 
+	if err := problems.orNil(); err != nil {
+		return nil, err
+	}
 	return parsed, nil
 }
 
-// parseVolumeOption parses a single option
-func (d *gceDriver) parseVolumeOption(opts *gceVolumeOptions, key string, value string) error {
-	var err error
+// parseVolumeOption parses a single option, which has already been checked against the schema
+func (d *gceDriver) parseVolumeOption(ctx context.Context, opts *gceVolumeOptions, key string, value string) error {
 	switch key {
 	case "sizeGb":
-		if sizeGb, err := strconv.ParseInt(value, 10, 64); err == nil {
-			opts.sizeGb = sizeGb
+		sizeGb, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
 		}
+		opts.sizeGb = sizeGb
 	case "type":
-		if diskType, err := d.getDiskType(value); err == nil {
-			opts.diskTypeURI = diskType.SelfLink
+		diskType, err := d.getDiskType(ctx, value)
+		if err != nil {
+			return err
+		}
+		opts.diskTypeURI = diskType.SelfLink
+	case "mode":
+		mode, err := parseMode(value)
+		if err != nil {
+			return err
+		}
+		opts.mode = mode
+	case "replicaZones":
+		zones, err := d.parseReplicaZones(value)
+		if err != nil {
+			return err
+		}
+		opts.replicaZones = zones
+	case "regional":
+		regional, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		if regional && opts.replicaZones == nil {
+			if opts.replicaZones, err = d.defaultReplicaZones(ctx); err != nil {
+				return err
+			}
+		}
+	case "description":
+		opts.description = value
+	case ProfileOption:
+		opts.profile = value
+	case "snapshotSchedule":
+		schedule, err := parseSnapshotSchedule(value)
+		if err != nil {
+			return err
+		}
+		opts.snapshotSchedule = schedule
+	case FreezeOption:
+		freeze, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		opts.fsFreeze = freeze
+	case SnapshotHookOption:
+		opts.snapshotHook = value
+	case "snapshotRetain":
+		retain, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		opts.snapshotRetain = retain
+	case "fstype":
+		opts.fsType = value
+	case "mountOpts":
+		if _, err := encodeLabelValue(value); err != nil {
+			return err
+		}
+		opts.mountOpts = value
+	case ProjectQuotaOption:
+		projectQuota, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		opts.projectQuota = projectQuota
+	case "iops":
+		iops, err := parsePerformance(value)
+		if err != nil {
+			return err
+		}
+		opts.iops = iops
+	case "throughput":
+		throughput, err := parsePerformance(value)
+		if err != nil {
+			return err
+		}
+		opts.throughput = throughput
+	case "image", "imageFamily", "sourceDisk":
+		return opts.setSourceOption(key, value)
+	case UIDOption:
+		uid, err := parseOwnerID(value)
+		if err != nil {
+			return err
+		}
+		opts.root.uid = uid
+	case GIDOption:
+		gid, err := parseOwnerID(value)
+		if err != nil {
+			return err
+		}
+		opts.root.gid = gid
+	case RootModeOption:
+		mode, err := fs.ParseMode(value)
+		if err != nil {
+			return err
+		}
+		opts.root.mode = &mode
+	case SeedOption:
+		seed, err := parseSeed(value)
+		if err != nil {
+			return err
+		}
+		opts.seed = seed
+	case SeedChecksumOption:
+		checksum, err := parseSeedChecksum(value)
+		if err != nil {
+			return err
+		}
+		opts.seedChecksum = checksum
+	case SeedOwnerOption:
+		uid, gid, err := parseSeedOwner(value)
+		if err != nil {
+			return err
+		}
+		opts.seedOwner = []int{uid, gid}
+	case EncryptedOption:
+		encrypted, err := d.crypt.parseOption(value)
+		if err != nil {
+			return err
+		}
+		opts.encrypted = encrypted
+	case "kmsKey":
+		if err := d.validateKmsKey(value); err != nil {
+			return err
 		}
+		opts.kmsKey = value
 	default:
+		if strings.HasPrefix(key, labelOptionPrefix) {
+			label := strings.TrimPrefix(key, labelOptionPrefix)
+			if err := d.validateLabel(label, value); err != nil {
+				return err
+			}
+			opts.labels[label] = value
+			return nil
+		}
 		return errors.New("unknown option")
 	}
-	return err
+	return nil
 }
 
 // createDisk creates a new disk
-func (d *gceDriver) createDisk(id string, opts *gceVolumeOptions) (*gceVolume, error) {
+func (d *gceDriver) createDisk(ctx context.Context, id string, opts *gceVolumeOptions) (*gceVolume, error) {
+	labels := d.withScope(opts.labels)
+	labels[modeLabel] = opts.mode
+	if opts.encrypted {
+		labels[encryptedLabel] = "true"
+	}
+	if opts.fsType != "" {
+		labels[fsTypeLabel] = opts.fsType
+	}
+	if opts.profile != "" {
+		labels[profileLabel] = opts.profile
+	}
+	if opts.mountOpts != "" {
+		// checked when the option was parsed
+		labels[mountOptsLabel], _ = encodeLabelValue(opts.mountOpts)
+	}
+	if opts.projectQuota {
+		labels[quotaLabel] = "true"
+	}
+	if opts.fsFreeze {
+		labels[fsFreezeLabel] = "true"
+	}
+	if opts.snapshotHook != "" {
+		labels[hookLabel] = opts.snapshotHook
+	}
+	if opts.seed != nil {
+		labels[seedLabel] = seedPending
+		if opts.source.isSet() {
+			// the image or disk brings its own file system
+			labels[seedLabel] = seedFormatted
+		}
+	}
+	opts.root.setLabels(labels)
+	if opts.snapshotSchedule != "" {
+		labels[snapshotScheduleLabel] = opts.snapshotSchedule
+		if opts.snapshotRetain != 0 {
+			labels[snapshotRetainLabel] = strconv.FormatInt(opts.snapshotRetain, 10)
+		}
+	}
+
 	disk := &compute.Disk{
-		Name:   id,
-		SizeGb: opts.sizeGb,
-		Type:   opts.diskTypeURI,
+		Name:        id,
+		SizeGb:      opts.sizeGb,
+		Type:        opts.diskTypeURI,
+		Description: opts.description,
+		Labels:      labels,
+
+		ProvisionedIops:       opts.iops,
+		ProvisionedThroughput: opts.throughput,
+
+		DiskEncryptionKey: diskEncryptionKey(opts.kmsKey),
 	}
 
-	op, err := d.client.Disks.Insert(d.project, d.zone, disk).Do()
+	sourceSizeGb, err := d.applySource(ctx, disk, &opts.source, len(opts.replicaZones) > 0)
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error creating disk '%s': %v", id, err)
+	}
+	if opts.source.isSet() {
+		if !opts.sizeGbSet && opts.sizeGb < sourceSizeGb {
+			// the default size only applies to blank disks, so the policy was checked with the wrong size
+			disk.SizeGb = sourceSizeGb
+			if err = d.checkSourcePolicy(ctx, disk); err != nil {
+				return nil, err
+			}
+		}
+		if disk.SizeGb < sourceSizeGb {
+			return nil, fmt.Errorf("GCE: error creating disk '%s': %dGB is smaller than the %dGB source", id, disk.SizeGb, sourceSizeGb)
+		}
+		if disk.SizeGb > sourceSizeGb {
+			labels[growLabel] = "true"
+		}
+	}
+
+	op, err := d.insertDisk(ctx, disk, opts.replicaZones)
 	if err != nil {
 		return nil, fmt.Errorf("GCE: error creating disk '%s': %v", id, err)
 	}
 
-	err = d.waitForOp(op)
+	timeout := operationWaitTimeout
+	if opts.source.isSet() {
+		// the disk is written from its source, which takes as long as a snapshot
+		timeout = snapshotWaitTimeout
+	}
+	err = d.waitForOpTimeout(ctx, op, timeout)
 	if err != nil {
 		return nil, fmt.Errorf("GCE: error creating disk '%s': %v", id, err)
 	}
@@ -333,26 +932,50 @@ func (d *gceDriver) createDisk(id string, opts *gceVolumeOptions) (*gceVolume, e
 			Name: id,
 		},
 		diskURI: op.TargetLink,
+		mode:    opts.mode,
+		kmsKey:  opts.kmsKey,
+
+		encrypted:   opts.encrypted,
+		fsType:      opts.fsType,
+		mountOpts:   splitMountOpts(opts.mountOpts),
+		sizeGb:      disk.SizeGb,
+		growPending: labels[growLabel] == "true",
+		root:        opts.root,
+
+		projectQuota: opts.projectQuota,
+	}
+	if len(opts.replicaZones) > 0 {
+		vol.region = d.region
 	}
 
 	return vol, nil
 }
 
 // attachDisk attaches a disk to the current instance
-func (d *gceDriver) attachDisk(vol *gceVolume) error {
+func (d *gceDriver) attachDisk(ctx context.Context, vol *gceVolume) error {
 	attachment := &compute.AttachedDisk{
 		DeviceName: vol.Name,
 		Source:     vol.diskURI,
+		Mode:       attachReadWrite,
+	}
+	if vol.readOnly {
+		attachment.Mode = attachReadOnly
 	}
 	devicePath := fmt.Sprintf(devicePathFormat, vol.Name)
 
+	d.attachMutex.Lock()
+	defer d.attachMutex.Unlock()
+	if err := d.checkCapacity(ctx, vol); err != nil {
+		return err
+	}
+
 	op, err := d.client.Instances.AttachDisk(d.project, d.zone, d.instance, attachment).Do()
 	if err != nil {
-		return fmt.Errorf("GCE: error attaching volume '%s'", vol.Name)
+		return fmt.Errorf("GCE: error attaching volume '%s': %v", vol.Name, err)
 	}
-	err = d.waitForOp(op)
+	err = d.waitForOp(ctx, op)
 	if err != nil {
-		return fmt.Errorf("GCE: error attaching volume '%s'", vol.Name)
+		return fmt.Errorf("GCE: error attaching volume '%s': %v", vol.Name, err)
 	}
 
 	// set this only on success
@@ -362,12 +985,19 @@ func (d *gceDriver) attachDisk(vol *gceVolume) error {
 }
 
 // detachDisk detaches a disk from the current instance
-func (d *gceDriver) detachDisk(vol *gceVolume) error {
+func (d *gceDriver) detachDisk(ctx context.Context, vol *gceVolume) error {
+	if vol.encrypted {
+		// an open LUKS container keeps the device busy
+		if err := d.crypt.close(ctx, vol.Name); err != nil {
+			return fmt.Errorf("GCE: %v", err)
+		}
+	}
+
 	op, err := d.client.Instances.DetachDisk(d.project, d.zone, d.instance, vol.Name).Do()
 	if err != nil {
 		return fmt.Errorf("GCE: error detaching volume '%s': %v", vol.Name, err)
 	}
-	err = d.waitForOp(op)
+	err = d.waitForOp(ctx, op)
 	if err != nil {
 		return fmt.Errorf("GCE: error detatching volume '%s': %v", vol.Name, err)
 	}
@@ -376,27 +1006,63 @@ func (d *gceDriver) detachDisk(vol *gceVolume) error {
 }
 
 // mountDisk mounts a disk device on the current instance
-func (d *gceDriver) mountDisk(vol *gceVolume) error {
+func (d *gceDriver) mountDisk(ctx context.Context, vol *gceVolume) error {
 	mountPoint := path.Join(d.mountPath, vol.Name)
 
-	if err := d.fs.CreateDir(mountPoint, true, 700); err != nil {
+	if err := d.fs.CreateDir(ctx, mountPoint, true, d.config.MountDirMode); err != nil {
 		return fmt.Errorf("GCE: error creating mount point '%s' for volume '%s': %v", mountPoint, vol.Name, err)
 	}
-	if err := d.fs.Mount(vol.devicePath, mountPoint); err != nil {
+	// the mode given to mkdir is masked by the umask, and the directory may be left from an earlier mount
+	if err := d.fs.Chmod(ctx, mountPoint, d.config.MountDirMode); err != nil {
+		return fmt.Errorf("GCE: error setting mode of mount point '%s' for volume '%s': %v", mountPoint, vol.Name, err)
+	}
+	options := append([]string{}, vol.mountOpts...)
+	if vol.readOnly {
+		options = append(options, readOnlyMountOptions(vol.fsType)...)
+	}
+	if vol.projectQuota {
+		options = append(options, "prjquota")
+	}
+
+	device := vol.devicePath
+	if vol.encrypted {
+		var err error
+		if device, err = d.crypt.open(ctx, vol.Name, vol.devicePath, vol.readOnly); err != nil {
+			return fmt.Errorf("GCE: %v", err)
+		}
+	}
+
+	if err := d.fs.Mount(ctx, device, mountPoint, options...); err != nil {
+		if vol.encrypted {
+			d.crypt.close(ctx, vol.Name)
+		}
 		return fmt.Errorf("GCE: error mounting volume '%s' on '%s': %v", vol.Name, mountPoint, err)
 	}
 	vol.Path = mountPoint
+
+	if err := d.applyRoot(ctx, vol); err != nil {
+		if unmountErr := d.unmountDisk(ctx, vol); unmountErr != nil {
+			logging.FromContext(ctx).WithError(unmountErr).Warn("GCE: error unmounting volume")
+		}
+		return err
+	}
 	return nil
 }
 
 // unmountDisk removes a disk from the file system
-func (d *gceDriver) unmountDisk(vol *gceVolume) error {
-	if err := d.fs.Unmount(vol.Path); err != nil {
+func (d *gceDriver) unmountDisk(ctx context.Context, vol *gceVolume) error {
+	if err := d.fs.Unmount(ctx, vol.Path); err != nil {
 		return fmt.Errorf("GCE: error unmounting volume '%s' from '%s': %v", vol.Name, vol.Path, err)
 	}
 
-	if err := d.fs.RemoveDir(vol.Path, true); err != nil {
-		log.WithFields(log.Fields{
+	if vol.encrypted {
+		if err := d.crypt.close(ctx, vol.Name); err != nil {
+			return fmt.Errorf("GCE: %v", err)
+		}
+	}
+
+	if err := d.fs.RemoveDir(ctx, vol.Path, true); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
 			"name":  vol.Name,
 			"mount": vol.Path,
 			"err":   err,
@@ -407,6 +1073,34 @@ func (d *gceDriver) unmountDisk(vol *gceVolume) error {
 	return nil
 }
 
+// splitMountOpts splits a comma separated list of mount options
+func splitMountOpts(value string) []string {
+	var opts []string
+	for _, opt := range strings.Split(value, ",") {
+		if opt = strings.TrimSpace(opt); opt != "" {
+			opts = append(opts, opt)
+		}
+	}
+	return opts
+}
+
+// mountDevice gets the device which is mounted for a volume, the LUKS mapper device for encrypted volumes
+func (vol *gceVolume) mountDevice() string {
+	if vol.encrypted {
+		return mapperDevice(vol.Name)
+	}
+	return vol.devicePath
+}
+
+// getMountPath gets the mount point of a device, or an empty string if the device isn't mounted or doesn't exist,
+// as a LUKS mapper device doesn't while its container is closed; tests replace it to fake mounts
+var getMountPath = func(device string) (string, error) {
+	if _, err := os.Stat(device); os.IsNotExist(err) {
+		return "", nil
+	}
+	return mountpath.GetMountPath(device)
+}
+
 // getAttachedDisk gets the disk attachment info for a disk
 func (d *gceDriver) getAttachedDisk(instanceName string, diskURI string) (*compute.AttachedDisk, error) {
 	instance, err := d.client.Instances.Get(d.project, d.zone, instanceName).Do()
@@ -422,12 +1116,14 @@ func (d *gceDriver) getAttachedDisk(instanceName string, diskURI string) (*compu
 }
 
 // getDiskType tries to get a disk type by name from the cache and refreshes the cache if not found
-func (d *gceDriver) getDiskType(name string) (*compute.DiskType, error) {
+func (d *gceDriver) getDiskType(ctx context.Context, name string) (*compute.DiskType, error) {
+	d.diskTypesMutex.Lock()
+	defer d.diskTypesMutex.Unlock()
 	fresh := false
 
 	for !fresh {
 		if d.diskTypes == nil {
-			if err := d.loadDiskTypes(); err != nil {
+			if err := d.loadDiskTypes(ctx); err != nil {
 				return nil, err
 			}
 			fresh = true
@@ -441,33 +1137,42 @@ func (d *gceDriver) getDiskType(name string) (*compute.DiskType, error) {
 	return nil, fmt.Errorf("disk type '%s' not found", name)
 }
 
-// loadDiskTypes caches the disk type for the current zone
-func (d *gceDriver) loadDiskTypes() error {
+// loadDiskTypes caches the disk type for the current zone, it must be called with diskTypesMutex held
+func (d *gceDriver) loadDiskTypes(ctx context.Context) error {
 	call := d.client.DiskTypes.List(d.project, d.zone)
-	d.diskTypes = make(map[string]*compute.DiskType)
+	diskTypes := make(map[string]*compute.DiskType)
 
-	err := call.Pages(context.Background(), func(page *compute.DiskTypeList) error {
+	err := call.Pages(ctx, func(page *compute.DiskTypeList) error {
 		for _, disk := range page.Items {
-			d.diskTypes[disk.Name] = disk
+			diskTypes[disk.Name] = disk
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	d.diskTypes = diskTypes
+	return nil
 }
 
 // waitForOp waits for an operation to complete
-func (d *gceDriver) waitForOp(op *compute.Operation) error {
+func (d *gceDriver) waitForOp(ctx context.Context, op *compute.Operation) error {
+	return d.waitForOpTimeout(ctx, op, operationWaitTimeout)
+}
+
+// waitForOpTimeout waits for an operation to complete, giving up after the timeout
+func (d *gceDriver) waitForOpTimeout(ctx context.Context, op *compute.Operation, timeout time.Duration) error {
 	// poll for operation completion
-	for start := time.Now(); time.Since(start) < operationWaitTimeout; time.Sleep(operationPollInterval) {
-		log.WithFields(log.Fields{
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(operationPollInterval) {
+		logging.FromContext(ctx).WithFields(log.Fields{
 			"project":   d.project,
 			"zone":      d.zone,
 			"operation": op.Name,
 		}).Info("GCE: wait for operation")
 
-		if op, err := d.client.ZoneOperations.Get(d.project, d.zone, op.Name).Do(); err == nil {
-			log.WithFields(log.Fields{
+		if op, err := d.getOperation(ctx, op); err == nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
 				"project":   d.project,
 				"zone":      d.zone,
 				"operation": op.Name,
@@ -475,11 +1180,11 @@ func (d *gceDriver) waitForOp(op *compute.Operation) error {
 			}).Info("GCE: operation status")
 
 			if op.Status == "DONE" {
-				return nil
+				return operationError(op)
 			}
 		} else {
 			// output warning
-			log.WithFields(log.Fields{
+			logging.FromContext(ctx).WithFields(log.Fields{
 				"operation":  op.Name,
 				"targetLink": op.TargetLink,
 				"error":      err,
@@ -487,15 +1192,44 @@ func (d *gceDriver) waitForOp(op *compute.Operation) error {
 		}
 	}
 
-	log.WithFields(log.Fields{
+	logging.FromContext(ctx).WithFields(log.Fields{
 		"operation":  op.Name,
 		"targetLink": op.TargetLink,
-		"timeout":    operationWaitTimeout,
+		"timeout":    timeout,
 	}).Warn("GCE: timeout while waiting for operation to complete")
 
 	return fmt.Errorf("GCE: timeout while waiting for operation %s on %s to complete", op.Name, op.TargetLink)
 }
 
+// operationError gets the error a finished operation failed with, nil if it succeeded
+func operationError(op *compute.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(op.Error.Errors))
+	for _, e := range op.Error.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.Code, e.Message))
+	}
+	return fmt.Errorf("operation %s failed: %s", op.Name, strings.Join(messages, "; "))
+}
+
+// instanceNames gets the names of the instances from their URIs
+func instanceNames(uris []string) []string {
+	names := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		names = append(names, path.Base(uri))
+	}
+	return names
+}
+
+// resourceName builds a name for a new resource which fits GCE's length limit
+func resourceName(base string, suffix string) string {
+	if max := maxResourceNameLength - len(suffix) - 1; len(base) > max {
+		base = strings.TrimSuffix(base[:max], "-")
+	}
+	return base + "-" + suffix
+}
+
 func stringInSlice(slice []string, target string) bool {
 	for _, candidate := range slice {
 		if candidate == target {
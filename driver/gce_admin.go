@@ -0,0 +1,230 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	snapshotWaitTimeout = 10 * time.Minute
+	resizeWaitTimeout   = 2 * time.Minute
+	snapshotNameFormat  = "20060102-150405"
+)
+
+// Snapshot takes a snapshot of a disk
+func (d *gceDriver) Snapshot(ctx context.Context, id string, name string) (*Snapshot, error) {
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = resourceName(vol.Name, time.Now().UTC().Format(snapshotNameFormat))
+	}
+
+	op, err := d.snapshotVolume(ctx, vol, name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error creating snapshot '%s' of disk '%s': %v", name, vol.Name, err)
+	}
+	if err = d.waitForOpTimeout(ctx, op, snapshotWaitTimeout); err != nil {
+		return nil, fmt.Errorf("GCE: error creating snapshot '%s' of disk '%s': %v", name, vol.Name, err)
+	}
+
+	created, err := d.client.Snapshots.Get(d.project, name).Do()
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error getting info about snapshot '%s': %v", name, err)
+	}
+	return toSnapshot(vol.Name, created), nil
+}
+
+// takeSnapshot starts a snapshot of a volume, labelled with the volume's name and any extra labels
+func (d *gceDriver) takeSnapshot(ctx context.Context, vol *gceVolume, name string, extra map[string]string) (*compute.Operation, error) {
+	labels := d.withScope(extra)
+	labels[snapshotVolumeLabel] = vol.Name
+
+	snapshot := &compute.Snapshot{
+		Name:   name,
+		Labels: labels,
+		// keep snapshots under the same key as the disk, rather than Google managed encryption
+		SnapshotEncryptionKey: diskEncryptionKey(vol.kmsKey),
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk":     vol.Name,
+		"snapshot": name,
+		"kms":      vol.kmsKey,
+	}).Info("GCE: creating snapshot")
+
+	return d.snapshotDisk(ctx, vol, snapshot)
+}
+
+// Resize grows a disk, and its file system if it is mounted on this instance
+func (d *gceDriver) Resize(ctx context.Context, id string, sizeGb int64) error {
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if sizeGb <= vol.sizeGb {
+		return fmt.Errorf("GCE: disk '%s' is already %dGB, disks can only grow", vol.Name, vol.sizeGb)
+	}
+	if err = d.checkGrowPolicy(ctx, vol, sizeGb); err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk": vol.Name,
+		"from": vol.sizeGb,
+		"to":   sizeGb,
+	}).Info("GCE: resizing disk")
+
+	op, err := d.resizeDisk(ctx, vol, sizeGb)
+	if err != nil {
+		return fmt.Errorf("GCE: error resizing disk '%s': %v", vol.Name, err)
+	}
+	if err = d.waitForOpTimeout(ctx, op, resizeWaitTimeout); err != nil {
+		return fmt.Errorf("GCE: error resizing disk '%s': %v", vol.Name, err)
+	}
+
+	if vol.Path != "" {
+		if vol.encrypted {
+			if err = d.crypt.grow(ctx, vol.Name); err != nil {
+				return fmt.Errorf("GCE: %v", err)
+			}
+		}
+		if err = d.fs.Grow(ctx, vol.mountDevice(), vol.Path); err != nil {
+			return fmt.Errorf("GCE: error growing file system of volume '%s': %v", vol.Name, err)
+		}
+	}
+	return nil
+}
+
+// ForceDetach unmounts a disk if it is mounted here and detaches it from every instance using it
+func (d *gceDriver) ForceDetach(ctx context.Context, id string) error {
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if vol.Path != "" {
+		if err = d.unmountDisk(ctx, vol); err != nil {
+			return err
+		}
+	}
+
+	for _, instanceURI := range vol.users {
+		if err = d.detachFromInstance(ctx, vol, instanceURI); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// detachFromInstance detaches a disk from the given instance, which need not be the current one
+func (d *gceDriver) detachFromInstance(ctx context.Context, vol *gceVolume, instanceURI string) error {
+	zone, instance, err := parseInstanceURI(instanceURI)
+	if err != nil {
+		return err
+	}
+
+	instanceData, err := d.client.Instances.Get(d.project, zone, instance).Do()
+	if err != nil {
+		return fmt.Errorf("GCE: error retrieving instance '%s': %v", instance, err)
+	}
+
+	for _, attachment := range instanceData.Disks {
+		if attachment.Source != vol.diskURI {
+			continue
+		}
+
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"disk":     vol.Name,
+			"instance": instance,
+			"zone":     zone,
+			"device":   attachment.DeviceName,
+		}).Warn("GCE: force detaching disk")
+
+		op, err := d.client.Instances.DetachDisk(d.project, zone, instance, attachment.DeviceName).Do()
+		if err != nil {
+			return fmt.Errorf("GCE: error detaching volume '%s' from '%s': %v", vol.Name, instance, err)
+		}
+		if err = d.waitForOp(ctx, op); err != nil {
+			return fmt.Errorf("GCE: error detaching volume '%s' from '%s': %v", vol.Name, instance, err)
+		}
+	}
+
+	if instanceURI == d.instanceURI {
+		vol.devicePath = ""
+		vol.Ready = false
+	}
+	return nil
+}
+
+// parseInstanceURI gets the zone and name from an instance URI of the form
+// https://www.googleapis.com/compute/v1/projects/<project>/zones/<zone>/instances/<name>
+func parseInstanceURI(uri string) (string, string, error) {
+	instance := path.Base(uri)
+	zone := path.Base(path.Dir(path.Dir(uri)))
+
+	if path.Base(path.Dir(uri)) != "instances" || path.Base(path.Dir(path.Dir(path.Dir(uri)))) != "zones" {
+		return "", "", fmt.Errorf("GCE: unrecognised instance URI '%s'", uri)
+	}
+	return zone, instance, nil
+}
+
+// toSnapshot converts a GCE snapshot
+func toSnapshot(volume string, snapshot *compute.Snapshot) *Snapshot {
+	return &Snapshot{
+		Name:    snapshot.Name,
+		Volume:  volume,
+		SizeGb:  snapshot.DiskSizeGb,
+		Created: snapshot.CreationTimestamp,
+		Status:  snapshot.Status,
+
+		Inconsistent: snapshot.Labels[snapshotInconsistentLabel] == "true",
+	}
+}
+
+// Reconcile detaches disks which cloudvol attached to this instance but which are no longer mounted,
+// e.g. because the plugin stopped between unmounting and detaching
+func (d *gceDriver) Reconcile(ctx context.Context, dryRun bool) ([]*ReconcileAction, error) {
+	instance, err := d.client.Instances.Get(d.project, d.zone, d.instance).Do()
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error retrieving instance data: %v", err)
+	}
+
+	idle, err := d.idleAttachments(ctx, instance)
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []*ReconcileAction
+
+	for _, vol := range idle {
+		action := &ReconcileAction{
+			Volume: vol.Name,
+			Action: "detach",
+			Reason: "attached but not mounted",
+		}
+		actions = append(actions, action)
+
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"disk":   action.Volume,
+			"dryRun": dryRun,
+		}).Info("GCE: reconcile: detaching unmounted disk")
+
+		if !dryRun {
+			if err := d.detachDisk(ctx, vol); err != nil {
+				action.Error = err.Error()
+			}
+		}
+	}
+
+	return actions, nil
+}
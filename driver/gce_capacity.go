@@ -0,0 +1,143 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+// volumeHolds counts the operations of this process working on each volume, whose disk may be attached
+// without being mounted yet, e.g. while it is formatted, so it isn't detached as idle
+type volumeHolds struct {
+	mutex sync.Mutex
+	holds map[string]int
+}
+
+func newVolumeHolds() *volumeHolds {
+	return &volumeHolds{holds: make(map[string]int)}
+}
+
+// hold marks a volume as in use until the returned function is called
+func (h *volumeHolds) hold(volume string) func() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.holds[volume]++
+
+	return func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if h.holds[volume]--; h.holds[volume] <= 0 {
+			delete(h.holds, volume)
+		}
+	}
+}
+
+func (h *volumeHolds) held(volume string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.holds[volume] > 0
+}
+
+// diskLimit gets the most disks, including the boot disk, the instance can have attached: the configured
+// limit, or that of its machine type. It is 0, unchecked, if the machine type can't be read.
+func (d *gceDriver) diskLimit(ctx context.Context, instance *compute.Instance) int64 {
+	if d.config.MaxAttachedDisks > 0 {
+		return d.config.MaxAttachedDisks
+	}
+
+	machineType, err := d.client.MachineTypes.Get(d.project, d.zone, path.Base(instance.MachineType)).Context(ctx).Do()
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"machineType": path.Base(instance.MachineType),
+			"err":         err,
+		}).Warn("GCE: error getting machine type, attached disks won't be limited")
+		return 0
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"machineType": machineType.Name,
+		"maxDisks":    machineType.MaximumPersistentDisks,
+	}).Info("GCE: detected attached disk limit")
+	return machineType.MaximumPersistentDisks
+}
+
+// checkCapacity makes sure the instance has room for another disk before it is attached, detaching an
+// idle volume to make room if configured to; it must be called with attachMutex held so concurrent
+// attaches don't take the same slot
+func (d *gceDriver) checkCapacity(ctx context.Context, vol *gceVolume) error {
+	if d.maxDisks <= 0 {
+		return nil
+	}
+
+	instance, err := d.client.Instances.Get(d.project, d.zone, d.instance).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("GCE: error retrieving instance data: %v", err)
+	}
+	attached := int64(len(instance.Disks))
+	if attached < d.maxDisks {
+		return nil
+	}
+
+	if d.config.DetachIdle {
+		idle, err := d.idleAttachments(ctx, instance)
+		if err != nil {
+			return err
+		}
+		if len(idle) > 0 {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"disk":     idle[0].Name,
+				"volume":   vol.Name,
+				"attached": attached,
+				"maxDisks": d.maxDisks,
+			}).Warn("GCE: detaching idle disk to make room")
+
+			return d.detachDisk(ctx, idle[0])
+		}
+	}
+
+	return &CapacityError{Volume: vol.Name, Instance: d.instance, Attached: attached, Limit: d.maxDisks}
+}
+
+// idleAttachments gets the volumes attached to this instance which aren't mounted or being worked on
+func (d *gceDriver) idleAttachments(ctx context.Context, instance *compute.Instance) ([]*gceVolume, error) {
+	var idle []*gceVolume
+
+	for _, attachment := range instance.Disks {
+		// cloudvol names the device after the disk, but so do other tools, so the disk must be in scope too
+		if attachment.Boot || attachment.DeviceName != path.Base(attachment.Source) || d.holds.held(attachment.DeviceName) {
+			continue
+		}
+
+		mounted := false
+		// encrypted volumes are mounted through their LUKS mapper device
+		for _, device := range []string{fmt.Sprintf(devicePathFormat, attachment.DeviceName), mapperDevice(attachment.DeviceName)} {
+			mount, err := getMountPath(device)
+			if err != nil {
+				return nil, fmt.Errorf("GCE: unable to get mount info for '%s': %v", device, err)
+			}
+			mounted = mounted || mount != ""
+		}
+		if mounted {
+			continue
+		}
+
+		disk, err := d.getDisk(ctx, attachment.DeviceName)
+		if err != nil {
+			return nil, fmt.Errorf("GCE: error getting info about disk '%s': %v", attachment.DeviceName, err)
+		}
+		if disk.SelfLink != attachment.Source || !d.inScope(disk) {
+			continue
+		}
+		idle = append(idle, &gceVolume{
+			Volume:    Volume{Name: disk.Name},
+			diskURI:   disk.SelfLink,
+			encrypted: disk.Labels[encryptedLabel] == "true",
+		})
+	}
+	return idle, nil
+}
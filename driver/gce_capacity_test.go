@@ -0,0 +1,148 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestDiskLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		configured  int64
+		machineType *compute.MachineType
+		limit       int64
+	}{
+		{"configured", 5, &compute.MachineType{Name: "n1-standard-1", MaximumPersistentDisks: 16}, 5},
+		{"machine type", 0, &compute.MachineType{Name: "n1-standard-1", MaximumPersistentDisks: 16}, 16},
+		// the limit isn't checked rather than failing the driver
+		{"unknown machine type", 0, nil, 0},
+	}
+
+	for _, test := range tests {
+		fake := newFakeCompute()
+		if test.machineType != nil {
+			fake.add("zones/"+testZone+"/machineTypes", test.machineType)
+		}
+		d, closeFake := newTestDriver(t, fake, GceConfig{MaxAttachedDisks: test.configured})
+
+		instance := fake.instance(testZone, testInstance)
+		if limit := d.diskLimit(context.Background(), instance); limit != test.limit {
+			t.Errorf("%s: expected limit %d, got %d", test.name, test.limit, limit)
+		}
+		// a configured limit saves looking up the machine type
+		if looked := fake.called("GET zones/" + testZone + "/machineTypes/n1-standard-1"); looked != (test.configured == 0) {
+			t.Errorf("%s: expected machine type lookup %v, got %v", test.name, test.configured == 0, looked)
+		}
+		closeFake()
+	}
+}
+
+func TestCheckCapacity(t *testing.T) {
+	detachCall := "POST zones/" + testZone + "/instances/" + testInstance + "/detachDisk"
+
+	tests := []struct {
+		name       string
+		maxDisks   int64
+		detachIdle bool
+		// held leaves the idle disk held by an operation
+		held     bool
+		err      bool
+		detached bool
+	}{
+		{name: "unlimited", maxDisks: 0},
+		{name: "room", maxDisks: 3},
+		{name: "full", maxDisks: 2, err: true},
+		{name: "detach idle", maxDisks: 2, detachIdle: true, detached: true},
+		{name: "nothing idle", maxDisks: 2, detachIdle: true, held: true, err: true},
+	}
+
+	for _, test := range tests {
+		fake := newFakeCompute()
+		d, closeFake := newTestDriver(t, fake, GceConfig{DetachIdle: test.detachIdle})
+		d.maxDisks = test.maxDisks
+
+		instance := fake.instance(testZone, testInstance)
+		instance.Disks = append(instance.Disks, &compute.AttachedDisk{DeviceName: "boot", Source: testLink("zones/" + testZone + "/disks/boot"), Boot: true})
+		fake.attach(instance, fake.addDisk("zones/"+testZone, testDisk("idle", nil)), attachReadWrite)
+		if test.held {
+			defer d.holds.hold("idle")()
+		}
+
+		vol := &gceVolume{Volume: Volume{Name: "data"}}
+		err := d.checkCapacity(context.Background(), vol)
+		if test.err {
+			if capacityErr, ok := err.(*CapacityError); !ok {
+				t.Errorf("%s: expected a capacity error, got %v", test.name, err)
+			} else if capacityErr.Attached != 2 || capacityErr.Limit != test.maxDisks || capacityErr.Instance != testInstance {
+				t.Errorf("%s: unexpected capacity error %v", test.name, capacityErr)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+
+		if detached := fake.called(detachCall); detached != test.detached {
+			t.Errorf("%s: expected detach %v, got %v", test.name, test.detached, detached)
+		}
+		if looked := fake.called("GET zones/" + testZone + "/instances/" + testInstance); looked != (test.maxDisks > 0) {
+			t.Errorf("%s: expected instance lookup %v, got %v", test.name, test.maxDisks > 0, looked)
+		}
+		closeFake()
+	}
+}
+
+func TestIdleAttachments(t *testing.T) {
+	fake := newFakeCompute()
+	d, closeFake := newTestDriver(t, fake, GceConfig{})
+	defer closeFake()
+
+	instance := fake.instance(testZone, testInstance)
+	instance.Disks = append(instance.Disks, &compute.AttachedDisk{DeviceName: "boot", Source: testLink("zones/" + testZone + "/disks/boot"), Boot: true})
+	for _, name := range []string{"idle", "held", "mounted", "encrypted"} {
+		fake.attach(instance, fake.addDisk("zones/"+testZone, testDisk(name, map[string]string{encryptedLabel: fmt.Sprint(name == "encrypted")})), attachReadWrite)
+	}
+	// disks of other tools, with or without a device named after them, aren't detached
+	unmanaged := fake.addDisk("zones/"+testZone, &compute.Disk{Name: "unmanaged", Status: diskReady})
+	fake.attach(instance, unmanaged, attachReadWrite)
+	foreign := fake.addDisk("zones/"+testZone, testDisk("foreign", nil))
+	instance.Disks = append(instance.Disks, &compute.AttachedDisk{DeviceName: "scratch", Source: foreign.SelfLink})
+
+	defer d.holds.hold("held")()
+	mounts := map[string]string{
+		fmt.Sprintf(devicePathFormat, "mounted"): "/mnt/cloudvol/mounted",
+		// an encrypted volume's device is only opened, its file system is on the mapper device
+		mapperDevice("encrypted"): "/mnt/cloudvol/encrypted",
+	}
+	defer func(lookup func(string) (string, error)) { getMountPath = lookup }(getMountPath)
+	getMountPath = func(device string) (string, error) {
+		return mounts[device], nil
+	}
+
+	idle, err := d.idleAttachments(context.Background(), instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, vol := range idle {
+		names = append(names, vol.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"idle"}) {
+		t.Errorf("expected only the idle disk, got %v", names)
+	}
+	if len(idle) == 1 && (idle[0].encrypted || path.Base(idle[0].diskURI) != "idle") {
+		t.Errorf("unexpected idle volume %v", idle[0])
+	}
+
+	// an encrypted volume whose container is closed is idle too
+	delete(mounts, mapperDevice("encrypted"))
+	if idle, err = d.idleAttachments(context.Background(), instance); err != nil {
+		t.Fatal(err)
+	}
+	if len(idle) != 2 || idle[1].Name != "encrypted" || !idle[1].encrypted {
+		t.Errorf("expected the closed encrypted volume to be idle, got %v", idle)
+	}
+}
@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+// Clone creates a read-only zonal copy of a disk in this instance's zone from a snapshot, which is taken
+// with the disk's freeze and hook settings and deleted once the copy exists
+func (d *gceDriver) Clone(ctx context.Context, id string, cloneID string) (*Volume, error) {
+	if !d.config.AllowRemove {
+		// the copy would be left behind once it is used
+		return nil, fmt.Errorf("GCE: clones can't be removed as deleting disks isn't enabled")
+	}
+
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if vol.encrypted {
+		return nil, fmt.Errorf("GCE: volume '%s' is encrypted with its own key and can't be cloned", id)
+	}
+
+	// a disk already using the name would make the clean up after a failed clone delete it
+	_, err = d.client.Disks.Get(d.project, d.zone, cloneID).Context(ctx).Do()
+	if err == nil {
+		return nil, fmt.Errorf("GCE: disk '%s' already exists", cloneID)
+	}
+	if !isNotFound(err) {
+		return nil, fmt.Errorf("GCE: error getting info about disk '%s': %v", cloneID, err)
+	}
+
+	snapshotName := resourceName(cloneID, "clone")
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk":  id,
+		"clone": cloneID,
+	}).Info("GCE: cloning disk")
+
+	op, err := d.snapshotVolume(ctx, vol, snapshotName, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error creating snapshot '%s' of disk '%s': %v", snapshotName, id, err)
+	}
+	// the snapshot is kept while a disk may still be being created from it
+	keepSnapshot := false
+	defer func() {
+		if keepSnapshot {
+			logging.FromContext(ctx).WithFields(log.Fields{"snapshot": snapshotName}).Warn("GCE: keeping clone snapshot")
+			return
+		}
+		if err := d.deleteSnapshot(ctx, snapshotName); err != nil {
+			logging.FromContext(ctx).WithError(err).Warn("GCE: error deleting clone snapshot")
+		}
+	}()
+	if err = d.waitForOpTimeout(ctx, op, snapshotWaitTimeout); err != nil {
+		return nil, fmt.Errorf("GCE: error creating snapshot '%s' of disk '%s': %v", snapshotName, id, err)
+	}
+
+	// the clone has the disk's type and performance, so reading it doesn't fall behind the disk
+	diskTypeName, _ := vol.Status["type"].(string)
+	diskType, err := d.getDiskType(ctx, diskTypeName)
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error creating disk '%s': %v", cloneID, err)
+	}
+	labels, _ := vol.Status["labels"].(map[string]string)
+	iops, _ := vol.Status["provisionedIops"].(int64)
+	throughput, _ := vol.Status["provisionedThroughput"].(int64)
+
+	clone, err := d.createDisk(ctx, cloneID, &gceVolumeOptions{
+		sizeGb:      vol.sizeGb,
+		sizeGbSet:   true,
+		diskTypeURI: diskType.SelfLink,
+		iops:        iops,
+		throughput:  throughput,
+		mode:        modeReadOnly,
+		labels:      labels,
+		kmsKey:      vol.kmsKey,
+		fsType:      vol.fsType,
+		mountOpts:   strings.Join(vol.mountOpts, ","),
+		source:      diskSource{snapshot: snapshotName},
+	})
+	if err != nil {
+		if cleanupErr := d.removeClone(ctx, cloneID, snapshotName); cleanupErr != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{"clone": cloneID, "err": cleanupErr}).Warn("GCE: error removing failed clone")
+			keepSnapshot = true
+		}
+		return nil, err
+	}
+	return &clone.Volume, nil
+}
+
+// removeClone deletes the disk of a clone which failed, if it was created, waiting for it to finish being
+// created from the snapshot first
+func (d *gceDriver) removeClone(ctx context.Context, cloneID string, snapshotName string) error {
+	for start := time.Now(); time.Since(start) < snapshotWaitTimeout; time.Sleep(snapshotPollInterval) {
+		disk, err := d.client.Disks.Get(d.project, d.zone, cloneID).Context(ctx).Do()
+		if isNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("GCE: error getting info about disk '%s': %v", cloneID, err)
+		}
+		if path.Base(disk.SourceSnapshot) != snapshotName {
+			return fmt.Errorf("GCE: disk '%s' wasn't created from snapshot '%s'", cloneID, snapshotName)
+		}
+		if disk.Status != diskReady && disk.Status != diskFailed {
+			continue
+		}
+
+		op, err := d.client.Disks.Delete(d.project, d.zone, cloneID).Context(ctx).Do()
+		if isNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("GCE: error deleting disk '%s': %v", cloneID, err)
+		}
+		if err = d.waitForOpTimeout(ctx, op, snapshotWaitTimeout); err != nil {
+			return fmt.Errorf("GCE: error deleting disk '%s': %v", cloneID, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("GCE: timeout while waiting for disk '%s' to be created", cloneID)
+}
@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+// snapshotInconsistentLabel marks snapshots whose data may have been captured after their volume was thawed
+// or its post hook ran
+const snapshotInconsistentLabel = labelPrefix + "inconsistent"
+
+// errNotCaptured is returned when a snapshot's data isn't captured before the volume has to be released
+var errNotCaptured = errors.New("snapshot not captured")
+
+// snapshotVolume starts a snapshot of a volume. Volumes with fsfreeze or a snapshot hook which are
+// mounted here are frozen and have their hooks run until GCE has captured the snapshot's data.
+func (d *gceDriver) snapshotVolume(ctx context.Context, vol *gceVolume, name string, extra map[string]string) (*compute.Operation, error) {
+	hook := d.config.Hooks.find(vol.snapshotHook)
+	if vol.snapshotHook != "" && hook == nil {
+		return nil, fmt.Errorf("GCE: snapshot hook '%s' of volume '%s' is not configured", vol.snapshotHook, vol.Name)
+	}
+	if !vol.fsFreeze && hook == nil {
+		return d.takeSnapshot(ctx, vol, name, extra)
+	}
+
+	if vol.Path == "" {
+		// nothing writes to a volume which isn't mounted anywhere
+		_, writers, err := d.otherUsersByMode(ctx, vol)
+		if err != nil {
+			return nil, err
+		}
+		if len(writers) > 0 {
+			return nil, fmt.Errorf("GCE: volume '%s' needs consistent snapshots and is in use by %s, snapshot it there",
+				vol.Name, strings.Join(instanceNames(writers), ", "))
+		}
+		return d.takeSnapshot(ctx, vol, name, extra)
+	}
+
+	var op *compute.Operation
+	captured := true
+	snapshot := &consistentSnapshot{
+		fs:            d.fs,
+		volume:        vol.Name,
+		mountPoint:    vol.Path,
+		snapshot:      name,
+		hook:          hook,
+		freeze:        vol.fsFreeze && !vol.readOnly,
+		freezeTimeout: d.config.Hooks.getFreezeTimeout(),
+	}
+	err := snapshot.run(ctx, func(ctx context.Context) error {
+		var err error
+		if op, err = d.takeSnapshot(ctx, vol, name, extra); err != nil {
+			return err
+		}
+		if err = d.waitForSnapshotCapture(ctx, name); err == errNotCaptured {
+			// the snapshot goes on, but isn't application consistent
+			captured = false
+			return nil
+		}
+		return err
+	})
+	if !captured {
+		if markErr := d.markInconsistent(ctx, name); markErr != nil && err == nil {
+			err = markErr
+		}
+	}
+	return op, err
+}
+
+// waitForSnapshotCapture waits until GCE has captured the data of a new snapshot and is uploading it,
+// after which the disk can be written to again. If the context is done first it returns errNotCaptured.
+func (d *gceDriver) waitForSnapshotCapture(ctx context.Context, name string) error {
+	for {
+		snapshot, err := d.client.Snapshots.Get(d.project, name).Context(ctx).Do()
+		if err == nil {
+			switch snapshot.Status {
+			case "UPLOADING", "READY":
+				return nil
+			case "FAILED":
+				return fmt.Errorf("GCE: snapshot '%s' failed", name)
+			}
+		} else if !isNotFound(err) && ctx.Err() == nil {
+			return fmt.Errorf("GCE: error getting info about snapshot '%s': %v", name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return errNotCaptured
+		case <-time.After(snapshotPollInterval):
+		}
+	}
+}
+
+// markInconsistent labels a snapshot which wasn't captured in time as not application consistent, even
+// if the request has been cancelled
+func (d *gceDriver) markInconsistent(ctx context.Context, name string) error {
+	logging.FromContext(ctx).WithField("snapshot", name).Warn("GCE: snapshot wasn't captured before the freeze timeout, marking it inconsistent")
+
+	markCtx, cancel := context.WithTimeout(logging.WithRequestID(context.Background(), logging.RequestID(ctx)), thawTimeout)
+	defer cancel()
+
+	snapshot, err := d.client.Snapshots.Get(d.project, name).Context(markCtx).Do()
+	if err != nil {
+		return fmt.Errorf("GCE: error marking snapshot '%s' inconsistent: %v", name, err)
+	}
+	labels := make(map[string]string, len(snapshot.Labels)+1)
+	for key, value := range snapshot.Labels {
+		labels[key] = value
+	}
+	labels[snapshotInconsistentLabel] = "true"
+
+	req := &compute.GlobalSetLabelsRequest{Labels: labels, LabelFingerprint: snapshot.LabelFingerprint}
+	op, err := d.client.Snapshots.SetLabels(d.project, name, req).Context(markCtx).Do()
+	if err != nil {
+		return fmt.Errorf("GCE: error marking snapshot '%s' inconsistent: %v", name, err)
+	}
+	if err = d.waitForOp(markCtx, op); err != nil {
+		return fmt.Errorf("GCE: error marking snapshot '%s' inconsistent: %v", name, err)
+	}
+	return nil
+}
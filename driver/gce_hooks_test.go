@@ -0,0 +1,138 @@
+package driver
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestSnapshotVolumeCapture(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		// timeout is the request's, the freeze timeout is a minute unless the request has none
+		timeout      time.Duration
+		inconsistent bool
+	}{
+		{"captured", "UPLOADING", 0, false},
+		{"freeze timeout", "CREATING", 0, true},
+		{"cancelled", "CREATING", 50 * time.Millisecond, true},
+	}
+
+	for _, test := range tests {
+		fake := newFakeCompute()
+		fake.snapshotStatus = test.status
+		fake.addDisk("zones/"+testZone, testDisk("data", nil))
+
+		freezeTimeout := "1m"
+		if test.timeout == 0 {
+			freezeTimeout = "50ms"
+		}
+		hooks := &SnapshotHooks{FreezeTimeout: freezeTimeout}
+		if err := hooks.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		d, closeFake := newTestDriver(t, fake, GceConfig{Hooks: hooks})
+		filesystem := newFakeFilesystem()
+		d.fs = filesystem
+
+		vol, err := d.getVolume(context.Background(), "data")
+		if err != nil {
+			closeFake()
+			t.Fatal(err)
+		}
+		vol.Path = "/mnt/data"
+		vol.fsFreeze = true
+
+		ctx, cancel := context.Background(), func() {}
+		if test.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, test.timeout)
+		}
+		op, err := d.snapshotVolume(ctx, vol, "data-snap", nil)
+		cancel()
+
+		if err != nil || op == nil {
+			t.Errorf("%s: expected the snapshot to be started, got %v", test.name, err)
+		}
+		if calls := filesystem.recorded(); calls != "Freeze /mnt/data live; Thaw /mnt/data live" {
+			t.Errorf("%s: expected the file system to be frozen and thawed, got '%s'", test.name, calls)
+		}
+		snapshot := fake.snapshot("data-snap")
+		if snapshot == nil {
+			t.Errorf("%s: expected a snapshot", test.name)
+		} else if inconsistent := snapshot.Labels[snapshotInconsistentLabel] == "true"; inconsistent != test.inconsistent {
+			t.Errorf("%s: expected inconsistent %v, got labels %v", test.name, test.inconsistent, snapshot.Labels)
+		} else if toSnapshot("data", snapshot).Inconsistent != test.inconsistent {
+			t.Errorf("%s: expected the snapshot to report inconsistent %v", test.name, test.inconsistent)
+		}
+		closeFake()
+	}
+}
+
+func TestSnapshotVolumeUnmounted(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		valid bool
+	}{
+		{"unused", "", true},
+		{"reader elsewhere", attachReadOnly, true},
+		// only the instance writing to the volume can make its snapshot consistent
+		{"writer elsewhere", attachReadWrite, false},
+	}
+
+	for _, test := range tests {
+		fake := newFakeCompute()
+		disk := fake.addDisk("zones/"+testZone, testDisk("data", map[string]string{fsFreezeLabel: "true"}))
+		if test.mode != "" {
+			other := fake.addInstance("us-central1-b", &compute.Instance{Name: "other"})
+			fake.attach(other, disk, test.mode)
+		}
+		d, closeFake := newTestDriver(t, fake, GceConfig{})
+		filesystem := newFakeFilesystem()
+		d.fs = filesystem
+
+		vol, err := d.getVolume(context.Background(), "data")
+		if err != nil {
+			closeFake()
+			t.Fatal(err)
+		}
+		_, err = d.snapshotVolume(context.Background(), vol, "data-snap", nil)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+		if created := fake.snapshot("data-snap") != nil; created != test.valid {
+			t.Errorf("%s: expected snapshot %v, got %v", test.name, test.valid, created)
+		}
+		if calls := filesystem.recorded(); calls != "" {
+			t.Errorf("%s: expected no file system calls for an unmounted volume, got '%s'", test.name, calls)
+		}
+		closeFake()
+	}
+}
+
+func TestSnapshotVolumeMissingHook(t *testing.T) {
+	fake := newFakeCompute()
+	fake.addDisk("zones/"+testZone, testDisk("data", map[string]string{hookLabel: "mysql"}))
+	d, closeFake := newTestDriver(t, fake, GceConfig{Hooks: &SnapshotHooks{Hooks: map[string]*SnapshotHook{
+		"postgres": {Pre: []string{"checkpoint"}},
+	}}})
+	defer closeFake()
+
+	vol, err := d.getVolume(context.Background(), "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol.Path = "/mnt/data"
+	if _, err = d.snapshotVolume(context.Background(), vol, "data-snap", nil); err == nil {
+		t.Errorf("expected error for a hook which isn't configured")
+	}
+	if fake.snapshot("data-snap") != nil {
+		t.Errorf("expected no snapshot")
+	}
+}
@@ -0,0 +1,45 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+)
+
+var (
+	kmsKeyPattern     = regexp.MustCompile(`^projects/[^/]+/locations/([^/]+)/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+	kmsVersionPattern = regexp.MustCompile(`/cryptoKeyVersions/[^/]+$`)
+)
+
+// validateKmsKey checks that a Cloud KMS key name is well formed and in a location which can encrypt disks in this region
+func (d *gceDriver) validateKmsKey(key string) error {
+	match := kmsKeyPattern.FindStringSubmatch(key)
+	if match == nil {
+		return fmt.Errorf("invalid KMS key '%s', expected projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>", key)
+	}
+
+	// keys can be global, in the disk's region or in the multi-region containing it
+	location := match[1]
+	if location != "global" && location != d.region && !strings.HasPrefix(d.region, location+"-") {
+		return fmt.Errorf("KMS key '%s' is in location '%s', which can't encrypt disks in region '%s'", key, location, d.region)
+	}
+	return nil
+}
+
+// diskKmsKey gets the KMS key which encrypts a disk, without the key version, or an empty string
+func diskKmsKey(disk *compute.Disk) string {
+	if disk.DiskEncryptionKey == nil {
+		return ""
+	}
+	return kmsVersionPattern.ReplaceAllString(disk.DiskEncryptionKey.KmsKeyName, "")
+}
+
+// diskEncryptionKey builds the encryption settings for a new disk, nil for Google managed encryption
+func diskEncryptionKey(kmsKey string) *compute.CustomerEncryptionKey {
+	if kmsKey == "" {
+		return nil
+	}
+	return &compute.CustomerEncryptionKey{KmsKeyName: kmsKey}
+}
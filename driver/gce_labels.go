@@ -0,0 +1,162 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+const (
+	labelOptionPrefix   = "label."
+	maxLabels           = 64
+	maxLabelValueLength = 63
+)
+
+// validateLabel checks a user label against the GCE label rules and the labels cloudvol reserves
+func (d *gceDriver) validateLabel(key string, value string) error {
+	if !labelKeyPattern.MatchString(key) {
+		return fmt.Errorf("invalid label key '%s', keys start with a lowercase letter and contain up to 63 lowercase letters, digits, '-' and '_'", key)
+	}
+	if !labelValuePattern.MatchString(value) {
+		return fmt.Errorf("invalid value '%s' for label '%s', values contain up to 63 lowercase letters, digits, '-' and '_'", value, key)
+	}
+	if strings.HasPrefix(key, labelPrefix) {
+		return fmt.Errorf("label '%s' uses the reserved prefix '%s'", key, labelPrefix)
+	}
+	if _, exists := d.scope[key]; exists {
+		return fmt.Errorf("label '%s' is set by cloudvol", key)
+	}
+	return nil
+}
+
+// userLabels gets the labels of a disk which weren't set by cloudvol
+func (d *gceDriver) userLabels(labels map[string]string) map[string]string {
+	user := make(map[string]string)
+	for key, value := range labels {
+		if _, exists := d.scope[key]; !exists && !strings.HasPrefix(key, labelPrefix) {
+			user[key] = value
+		}
+	}
+	return user
+}
+
+// encodeLabelValue stores an arbitrary value in a label value by writing characters other than lowercase
+// letters, digits and '-' as '_' followed by their hex code
+func encodeLabelValue(value string) (string, error) {
+	var encoded bytes.Buffer
+	for _, b := range []byte(value) {
+		if (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "_%02x", b)
+		}
+	}
+
+	if encoded.Len() > maxLabelValueLength {
+		return "", fmt.Errorf("'%s' is too long to store in a label", value)
+	}
+	return encoded.String(), nil
+}
+
+// decodeLabelValue reverses encodeLabelValue
+func decodeLabelValue(value string) string {
+	var decoded []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] == '_' && i+2 < len(value) {
+			if b, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+				decoded = append(decoded, byte(b))
+				i += 2
+				continue
+			}
+		}
+		decoded = append(decoded, value[i])
+	}
+	return string(decoded)
+}
+
+// ParseLabels parses a comma separated list of key=value labels
+func ParseLabels(value string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected key=value, got '%s'", pair)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// validateDefaultLabels checks the default labels from the config
+func (d *gceDriver) validateDefaultLabels() error {
+	for key, value := range d.config.DefaultLabels {
+		if err := d.validateLabel(key, value); err != nil {
+			return fmt.Errorf("GCE: invalid default label: %v", err)
+		}
+	}
+	return nil
+}
+
+// SetLabels adds, changes and removes user labels on a volume
+func (d *gceDriver) SetLabels(ctx context.Context, id string, set map[string]string, remove []string) (*Volume, error) {
+	for key, value := range set {
+		if err := d.validateLabel(key, value); err != nil {
+			return nil, fmt.Errorf("GCE: %v", err)
+		}
+	}
+	for _, key := range remove {
+		if err := d.validateLabel(key, ""); err != nil {
+			return nil, fmt.Errorf("GCE: %v", err)
+		}
+	}
+
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	disk, err := d.getDisk(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error getting info about disk '%s': %v", id, err)
+	}
+
+	labels := make(map[string]string, len(disk.Labels)+len(set))
+	for key, value := range disk.Labels {
+		labels[key] = value
+	}
+	for key, value := range set {
+		labels[key] = value
+	}
+	for _, key := range remove {
+		delete(labels, key)
+	}
+	if len(labels) > maxLabels {
+		return nil, fmt.Errorf("GCE: disk '%s' can't have more than %d labels", id, maxLabels)
+	}
+	if err = d.checkLabelPolicy(ctx, vol, labels); err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk":   vol.Name,
+		"set":    set,
+		"remove": remove,
+	}).Info("GCE: updating disk labels")
+
+	if err = d.setDiskLabels(ctx, disk, labels); err != nil {
+		return nil, err
+	}
+
+	if vol, err = d.getVolume(ctx, id); err != nil {
+		return nil, err
+	}
+	return &vol.Volume, nil
+}
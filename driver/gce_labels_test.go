@@ -0,0 +1,120 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestEncodeLabelValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"abc-123", "abc-123"},
+		{"0 2 * * *", "0_202_20_2a_20_2a_20_2a"},
+		{"ABC", "_41_42_43"},
+		{"a_b", "a_5fb"},
+		{"rw,noatime", "rw_2cnoatime"},
+		{"ü", "_c3_bc"},
+	}
+
+	for _, test := range tests {
+		encoded, err := encodeLabelValue(test.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if encoded != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.value, test.expected, encoded)
+		}
+		if !labelValuePattern.MatchString(encoded) {
+			t.Errorf("%s: '%s' is not a valid label value", test.value, encoded)
+		}
+		if decoded := decodeLabelValue(encoded); decoded != test.value {
+			t.Errorf("%s: decoded as '%s'", test.value, decoded)
+		}
+	}
+
+	if _, err := encodeLabelValue(strings.Repeat("a", maxLabelValueLength)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := encodeLabelValue(strings.Repeat("a", maxLabelValueLength+1)); err == nil {
+		t.Errorf("expected a value which is too long to be refused")
+	}
+	if _, err := encodeLabelValue(strings.Repeat(" ", maxLabelValueLength/3+1)); err == nil {
+		t.Errorf("expected a value which is too long once encoded to be refused")
+	}
+}
+
+func TestDecodeLabelValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		// labels set by hand may not be encoded
+		{"plain", "plain"},
+		{"a_b", "a_b"},
+		{"a_zz", "a_zz"},
+		{"trailing_", "trailing_"},
+		{"end_2", "end_2"},
+		{"end_2f", "end/"},
+	}
+	for _, test := range tests {
+		if decoded := decodeLabelValue(test.value); decoded != test.expected {
+			t.Errorf("%s: expected '%s', got '%s'", test.value, test.expected, decoded)
+		}
+	}
+}
+
+func TestSetLabelsPolicy(t *testing.T) {
+	policy := &Policy{
+		RequiredLabels: []string{"team"},
+		Quotas:         []*Quota{{Label: "team", MaxVolumes: 1}},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		set     map[string]string
+		remove  []string
+		allowed bool
+	}{
+		{"add label", map[string]string{"env": "prod"}, nil, true},
+		{"change team", map[string]string{"team": "c"}, nil, true},
+		{"remove required label", nil, []string{"team"}, false},
+		{"team over quota", map[string]string{"team": "a"}, nil, false},
+	}
+
+	for _, test := range tests {
+		fake := newFakeCompute()
+		fake.addDisk("zones/"+testZone, testDisk("a1", map[string]string{"team": "a"}))
+		fake.addDisk("zones/"+testZone, testDisk("b1", map[string]string{"team": "b"}))
+		d, closeFake := newTestDriver(t, fake, GceConfig{Policy: policy})
+
+		_, err := d.SetLabels(context.Background(), "b1", test.set, test.remove)
+		labels := fake.disk("zones/" + testZone + "/disks/b1").Labels
+		if test.allowed {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			for key, value := range test.set {
+				if labels[key] != value {
+					t.Errorf("%s: expected label %s=%s, got %v", test.name, key, value, labels)
+				}
+			}
+		} else {
+			if _, ok := err.(*PolicyError); !ok {
+				t.Errorf("%s: expected policy error, got %v", test.name, err)
+			}
+			if labels["team"] != "b" {
+				t.Errorf("%s: expected the labels to be unchanged, got %v", test.name, labels)
+			}
+		}
+		closeFake()
+	}
+}
@@ -0,0 +1,230 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	migrateSnapshotSuffix = "migrate"
+	snapshotReady         = "READY"
+	snapshotPollInterval  = 2 * time.Second
+	diskReady             = "READY"
+	diskFailed            = "FAILED"
+)
+
+// Migrate moves a disk from another zone of the region into this instance's zone by way of a snapshot.
+// Each step checks for the resources left by earlier steps, so an interrupted migration can be resumed
+// by running it again.
+func (d *gceDriver) Migrate(ctx context.Context, id string, opts MigrateOptions) (*Volume, error) {
+	if opts.DeleteSource && !d.config.AllowRemove {
+		return nil, fmt.Errorf("GCE: can't delete the source of migrating disk '%s', deleting disks isn't enabled", id)
+	}
+
+	sourceZone, err := d.findDiskZone(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	snapshotName := resourceName(id, migrateSnapshotSuffix)
+
+	target, err := d.client.Disks.Get(d.project, d.zone, id).Context(ctx).Do()
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("GCE: error getting info about disk '%s': %v", id, err)
+	}
+
+	if target != nil && sourceZone != "" && path.Base(target.SourceSnapshot) != snapshotName {
+		return nil, fmt.Errorf("GCE: can't migrate disk '%s' from zone '%s', a different disk with that name exists in zone '%s'", id, sourceZone, d.zone)
+	}
+	if target == nil && sourceZone == "" {
+		if _, err := d.client.RegionDisks.Get(d.project, d.region, id).Context(ctx).Do(); err == nil {
+			return nil, fmt.Errorf("GCE: disk '%s' is regional, it doesn't need migrating", id)
+		}
+		return nil, fmt.Errorf("GCE: disk '%s' not found in region '%s'", id, d.region)
+	}
+
+	entry := logging.FromContext(ctx).WithFields(log.Fields{
+		"disk":     id,
+		"from":     sourceZone,
+		"to":       d.zone,
+		"snapshot": snapshotName,
+	})
+
+	if target == nil {
+		source, err := d.client.Disks.Get(d.project, sourceZone, id).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("GCE: error getting info about disk '%s': %v", id, err)
+		}
+		if !d.inScope(source) {
+			return nil, fmt.Errorf("GCE: disk '%s' is not managed by cloudvol, import it before migrating it", id)
+		}
+		if len(source.Users) > 0 {
+			return nil, &InUseError{Volume: id, Users: instanceNames(source.Users)}
+		}
+
+		entry.Info("GCE: migrate: snapshotting source disk")
+		if err = d.ensureMigrateSnapshot(ctx, source, snapshotName); err != nil {
+			return nil, err
+		}
+
+		entry.Info("GCE: migrate: creating disk from snapshot")
+		if err = d.createFromSnapshot(ctx, source, snapshotName); err != nil {
+			return nil, err
+		}
+	}
+
+	if sourceZone != "" {
+		// the source and the snapshot are the only copies of the data until the new disk is complete
+		if err = d.waitForMigratedDisk(ctx, id, snapshotName); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.DeleteSource && sourceZone != "" {
+		entry.Info("GCE: migrate: deleting source disk")
+		op, err := d.client.Disks.Delete(d.project, sourceZone, id).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("GCE: error deleting disk '%s' in zone '%s': %v", id, sourceZone, err)
+		}
+		if err = d.waitForOp(ctx, op); err != nil {
+			return nil, fmt.Errorf("GCE: error deleting disk '%s' in zone '%s': %v", id, sourceZone, err)
+		}
+	}
+
+	// a rerun recognises the new disk by its source snapshot, which doesn't need to exist any more
+	if err = d.deleteSnapshot(ctx, snapshotName); err != nil {
+		return nil, err
+	}
+
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	entry.Info("GCE: migrate: done")
+	return &vol.Volume, nil
+}
+
+// findDiskZone finds the zone of a zonal disk elsewhere in this instance's region,
+// returning an empty zone if there isn't one
+func (d *gceDriver) findDiskZone(ctx context.Context, id string) (string, error) {
+	zones, err := d.regionZones(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, zone := range zones {
+		_, err := d.client.Disks.Get(d.project, zone, id).Context(ctx).Do()
+		if err == nil {
+			return zone, nil
+		}
+		if !isNotFound(err) {
+			return "", fmt.Errorf("GCE: error getting info about disk '%s' in zone '%s': %v", id, zone, err)
+		}
+	}
+	return "", nil
+}
+
+// ensureMigrateSnapshot snapshots the source disk of a migration, unless an earlier attempt already did
+func (d *gceDriver) ensureMigrateSnapshot(ctx context.Context, source *compute.Disk, name string) error {
+	_, err := d.client.Snapshots.Get(d.project, name).Context(ctx).Do()
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("GCE: error getting info about snapshot '%s': %v", name, err)
+	}
+
+	if err != nil {
+		labels := d.withScope(nil)
+		labels[snapshotVolumeLabel] = source.Name
+
+		snapshot := &compute.Snapshot{
+			Name:                  name,
+			Labels:                labels,
+			SnapshotEncryptionKey: diskEncryptionKey(diskKmsKey(source)),
+		}
+		if _, err = d.client.Disks.CreateSnapshot(d.project, path.Base(source.Zone), source.Name, snapshot).Context(ctx).Do(); err != nil {
+			return fmt.Errorf("GCE: error creating snapshot '%s' of disk '%s': %v", name, source.Name, err)
+		}
+	}
+
+	// wait on the snapshot rather than the operation, which a resumed migration doesn't have
+	for start := time.Now(); time.Since(start) < snapshotWaitTimeout; time.Sleep(snapshotPollInterval) {
+		snapshot, err := d.client.Snapshots.Get(d.project, name).Context(ctx).Do()
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("GCE: error getting info about snapshot '%s': %v", name, err)
+		}
+		if snapshot != nil && snapshot.Status == snapshotReady {
+			return nil
+		}
+	}
+	return fmt.Errorf("GCE: timeout while waiting for snapshot '%s' to be ready", name)
+}
+
+// createFromSnapshot recreates the source disk of a migration in this instance's zone
+func (d *gceDriver) createFromSnapshot(ctx context.Context, source *compute.Disk, snapshotName string) error {
+	disk := &compute.Disk{
+		Name:           source.Name,
+		SizeGb:         source.SizeGb,
+		Labels:         source.Labels,
+		SourceSnapshot: "global/snapshots/" + snapshotName,
+
+		ProvisionedIops:       source.ProvisionedIops,
+		ProvisionedThroughput: source.ProvisionedThroughput,
+
+		DiskEncryptionKey: diskEncryptionKey(diskKmsKey(source)),
+	}
+
+	diskType, err := d.getDiskType(ctx, path.Base(source.Type))
+	if err != nil {
+		return fmt.Errorf("GCE: error creating disk '%s': %v", source.Name, err)
+	}
+	disk.Type = diskType.SelfLink
+
+	op, err := d.client.Disks.Insert(d.project, d.zone, disk).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("GCE: error creating disk '%s': %v", source.Name, err)
+	}
+	if err = d.waitForOpTimeout(ctx, op, snapshotWaitTimeout); err != nil {
+		return fmt.Errorf("GCE: error creating disk '%s': %v", source.Name, err)
+	}
+	return nil
+}
+
+// waitForMigratedDisk waits for the disk created in this instance's zone by a migration, which may have
+// been started by an earlier attempt, to be ready
+func (d *gceDriver) waitForMigratedDisk(ctx context.Context, id string, snapshotName string) error {
+	for start := time.Now(); time.Since(start) < snapshotWaitTimeout; time.Sleep(snapshotPollInterval) {
+		disk, err := d.client.Disks.Get(d.project, d.zone, id).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("GCE: error getting info about disk '%s': %v", id, err)
+		}
+		if path.Base(disk.SourceSnapshot) != snapshotName {
+			return fmt.Errorf("GCE: disk '%s' in zone '%s' wasn't created from snapshot '%s'", id, d.zone, snapshotName)
+		}
+		switch disk.Status {
+		case diskReady:
+			return nil
+		case diskFailed:
+			return fmt.Errorf("GCE: creating disk '%s' from snapshot '%s' failed", id, snapshotName)
+		}
+	}
+	return fmt.Errorf("GCE: timeout while waiting for disk '%s' to be ready", id)
+}
+
+// deleteSnapshot removes a snapshot used to copy a disk, if it still exists
+func (d *gceDriver) deleteSnapshot(ctx context.Context, name string) error {
+	op, err := d.client.Snapshots.Delete(d.project, name).Context(ctx).Do()
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("GCE: error deleting snapshot '%s': %v", name, err)
+	}
+	if err = d.waitForOp(ctx, op); err != nil {
+		return fmt.Errorf("GCE: error deleting snapshot '%s': %v", name, err)
+	}
+	return nil
+}
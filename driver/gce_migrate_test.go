@@ -0,0 +1,175 @@
+package driver
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	migrateFrom     = "us-central1-b"
+	migrateSnapshot = "data-migrate"
+)
+
+// newMigrateFake creates a fake compute API for a region of three zones, with the disk type migrated disks use
+func newMigrateFake() *fakeCompute {
+	fake := newFakeCompute()
+	region := &compute.Region{Name: testRegion}
+	for _, zone := range []string{testZone, migrateFrom, "us-central1-c"} {
+		region.Zones = append(region.Zones, testLink("zones/"+zone))
+	}
+	fake.add("regions", region)
+	fake.add("zones/"+testZone+"/diskTypes", &compute.DiskType{Name: gceDefaultDiskType})
+	return fake
+}
+
+// migrateSource adds the disk to migrate in another zone
+func migrateSource(fake *fakeCompute) {
+	disk := testDisk("data", nil)
+	disk.Type = testLink("zones/" + migrateFrom + "/diskTypes/" + gceDefaultDiskType)
+	fake.addDisk("zones/"+migrateFrom, disk)
+}
+
+// migrateTarget adds a disk with the migrated disk's name in this instance's zone, made from the given snapshot
+func migrateTarget(fake *fakeCompute, snapshot string) {
+	disk := testDisk("data", nil)
+	disk.SourceSnapshot = testLink("global/snapshots/" + snapshot)
+	fake.addDisk("zones/"+testZone, disk)
+}
+
+func TestMigrate(t *testing.T) {
+	snapshotCall := "POST zones/" + migrateFrom + "/disks/data/createSnapshot"
+	insertCall := "POST zones/" + testZone + "/disks"
+	deleteCall := "DELETE zones/" + migrateFrom + "/disks/data"
+
+	tests := []struct {
+		name string
+		// setup leaves what an interrupted migration would have done
+		setup        func(fake *fakeCompute)
+		deleteSource bool
+		allowRemove  bool
+		err          bool
+		calls        []string
+		noCalls      []string
+	}{
+		{
+			name:    "fresh",
+			setup:   migrateSource,
+			calls:   []string{snapshotCall, insertCall},
+			noCalls: []string{deleteCall},
+		},
+		{
+			name: "snapshot taken",
+			setup: func(fake *fakeCompute) {
+				migrateSource(fake)
+				fake.add("global/snapshots", &compute.Snapshot{Name: migrateSnapshot})
+			},
+			calls:   []string{insertCall},
+			noCalls: []string{snapshotCall},
+		},
+		{
+			name: "disk created",
+			setup: func(fake *fakeCompute) {
+				migrateSource(fake)
+				fake.add("global/snapshots", &compute.Snapshot{Name: migrateSnapshot})
+				migrateTarget(fake, migrateSnapshot)
+			},
+			deleteSource: true,
+			allowRemove:  true,
+			calls:        []string{deleteCall},
+			noCalls:      []string{snapshotCall, insertCall},
+		},
+		{
+			name: "source deleted",
+			setup: func(fake *fakeCompute) {
+				migrateTarget(fake, migrateSnapshot)
+			},
+			deleteSource: true,
+			allowRemove:  true,
+			noCalls:      []string{snapshotCall, insertCall, deleteCall},
+		},
+		{
+			name: "other disk with the name",
+			setup: func(fake *fakeCompute) {
+				migrateSource(fake)
+				migrateTarget(fake, "unrelated")
+			},
+			err:     true,
+			noCalls: []string{snapshotCall, insertCall, deleteCall},
+		},
+		{
+			name:         "delete source without remove",
+			setup:        migrateSource,
+			deleteSource: true,
+			err:          true,
+			noCalls:      []string{snapshotCall, insertCall, deleteCall},
+		},
+		{
+			name:  "missing",
+			setup: func(fake *fakeCompute) {},
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		fake := newMigrateFake()
+		test.setup(fake)
+		d, closeFake := newTestDriver(t, fake, GceConfig{AllowRemove: test.allowRemove})
+
+		vol, err := d.Migrate(context.Background(), "data", MigrateOptions{DeleteSource: test.deleteSource})
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected error", test.name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else {
+			if vol.Name != "data" || vol.Status["zone"] != testZone {
+				t.Errorf("%s: expected volume data in zone %s, got %v", test.name, testZone, vol)
+			}
+			disk := fake.disk("zones/" + testZone + "/disks/data")
+			if disk == nil || path.Base(disk.SourceSnapshot) != migrateSnapshot {
+				t.Errorf("%s: expected the migrated disk to be made from the snapshot, got %v", test.name, disk)
+			}
+			if fake.has("global/snapshots/" + migrateSnapshot) {
+				t.Errorf("%s: expected the snapshot to be deleted", test.name)
+			}
+		}
+
+		for _, call := range test.calls {
+			if !fake.called(call) {
+				t.Errorf("%s: expected call %s", test.name, call)
+			}
+		}
+		for _, call := range test.noCalls {
+			if fake.called(call) {
+				t.Errorf("%s: unexpected call %s", test.name, call)
+			}
+		}
+		closeFake()
+	}
+}
+
+func TestGetVolumeOtherZone(t *testing.T) {
+	for _, allZones := range []bool{false, true} {
+		fake := newMigrateFake()
+		migrateSource(fake)
+		d, closeFake := newTestDriver(t, fake, GceConfig{ListAllZones: allZones})
+
+		_, err := d.getVolume(context.Background(), "data")
+		if err == nil {
+			t.Errorf("all zones %v: expected error", allZones)
+		} else if mentioned := strings.Contains(err.Error(), migrateFrom); mentioned != allZones {
+			t.Errorf("all zones %v: unexpected error: %v", allZones, err)
+		}
+
+		// other zones are only searched where List shows their disks
+		if searched := fake.called("GET zones/" + migrateFrom + "/disks/data"); searched != allZones {
+			t.Errorf("all zones %v: expected search of other zones %v, got %v", allZones, allZones, searched)
+		}
+		closeFake()
+	}
+}
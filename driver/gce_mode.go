@@ -0,0 +1,136 @@
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stugotech/cloudvol2/fs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+// Attachment modes of a volume, set with the mode option
+const (
+	// modeReadWrite attaches the disk read-write to a single instance
+	modeReadWrite = "rw"
+	// modeReadOnly attaches the disk read-only to a single instance
+	modeReadOnly = "ro"
+	// modeReadOnlyMany attaches the disk read-only to any number of instances, for disks meant to be shared
+	modeReadOnlyMany = "ro-many"
+)
+
+// ProjectQuotaOption formats and mounts a volume with project quotas, which limit the space used by
+// directories in it
+const ProjectQuotaOption = "projectQuota"
+
+const (
+	labelPrefix     = "cloudvol-"
+	modeLabel       = labelPrefix + "mode"
+	encryptedLabel  = labelPrefix + "encrypted"
+	fsTypeLabel     = labelPrefix + "fstype"
+	mountOptsLabel  = labelPrefix + "mount-opts"
+	profileLabel    = labelPrefix + "profile"
+	fsFreezeLabel   = labelPrefix + "fsfreeze"
+	hookLabel       = labelPrefix + "snapshot-hook"
+	quotaLabel      = labelPrefix + "project-quota"
+	attachReadWrite = "READ_WRITE"
+	attachReadOnly  = "READ_ONLY"
+)
+
+// parseMode validates an attachment mode
+func parseMode(value string) (string, error) {
+	switch value {
+	case modeReadWrite, modeReadOnly, modeReadOnlyMany:
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown mode '%s', expected %s, %s or %s", value, modeReadWrite, modeReadOnly, modeReadOnlyMany)
+}
+
+// readOnlyMountOptions gets the options which mount a file system read-only without replaying its journal,
+// which would write to the read-only device
+func readOnlyMountOptions(fsType string) []string {
+	if fsType == fs.FsTypeXfs {
+		return []string{"ro", "norecovery"}
+	}
+	return []string{"ro", "noload"}
+}
+
+// isReadOnlyMode checks if volumes in the given mode are attached read-only
+func isReadOnlyMode(mode string) bool {
+	return mode == modeReadOnly || mode == modeReadOnlyMany
+}
+
+// volumeMode gets the attachment mode of a disk from its labels
+func volumeMode(disk *compute.Disk) string {
+	if mode, err := parseMode(disk.Labels[modeLabel]); err == nil {
+		return mode
+	}
+	return modeReadWrite
+}
+
+// claim makes sure the disk can be attached to this instance in the volume's mode
+func (d *gceDriver) claim(ctx context.Context, vol *gceVolume) (*gceVolume, error) {
+	if len(d.otherUsers(vol)) == 0 {
+		return vol, nil
+	}
+
+	readers, writers, err := d.otherUsersByMode(ctx, vol)
+	if err != nil {
+		return nil, err
+	}
+
+	if isReadOnlyMode(vol.mode) {
+		// never take the disk from a writer, and only share it with other readers in ro-many mode
+		if len(writers) > 0 {
+			return nil, &InUseError{Volume: vol.Name, Users: instanceNames(writers)}
+		}
+		if vol.mode == modeReadOnly {
+			return nil, &InUseError{Volume: vol.Name, Users: instanceNames(readers)}
+		}
+		return vol, nil
+	}
+
+	if len(readers) > 0 {
+		return nil, fmt.Errorf("GCE: volume '%s' can't be attached read-write while it has read-only users: %s",
+			vol.Name, strings.Join(instanceNames(readers), ", "))
+	}
+	return d.takeOver(ctx, vol)
+}
+
+// otherUsersByMode splits the other instances using a disk into those with read-only and read-write attachments
+func (d *gceDriver) otherUsersByMode(ctx context.Context, vol *gceVolume) ([]string, []string, error) {
+	var readers, writers []string
+
+	for _, instanceURI := range d.otherUsers(vol) {
+		attachment, err := d.getAttachment(ctx, instanceURI, vol.diskURI)
+		if err != nil {
+			return nil, nil, err
+		}
+		if attachment != nil && attachment.Mode == attachReadOnly {
+			readers = append(readers, instanceURI)
+		} else {
+			writers = append(writers, instanceURI)
+		}
+	}
+	return readers, writers, nil
+}
+
+// getAttachment gets the attachment of a disk to the given instance, which need not be the current one
+func (d *gceDriver) getAttachment(ctx context.Context, instanceURI string, diskURI string) (*compute.AttachedDisk, error) {
+	zone, instance, err := parseInstanceURI(instanceURI)
+	if err != nil {
+		return nil, err
+	}
+
+	instanceData, err := d.client.Instances.Get(d.project, zone, instance).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error retrieving instance '%s': %v", instance, err)
+	}
+
+	for _, attachment := range instanceData.Disks {
+		if attachment.Source == diskURI {
+			return attachment, nil
+		}
+	}
+	return nil, nil
+}
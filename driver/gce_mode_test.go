@@ -0,0 +1,145 @@
+package driver
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/stugotech/cloudvol2/fs"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{modeReadWrite, true},
+		{modeReadOnly, true},
+		{modeReadOnlyMany, true},
+		{"", false},
+		{"RW", false},
+		{"ro-once", false},
+	}
+
+	for _, test := range tests {
+		mode, err := parseMode(test.value)
+		if test.valid && (err != nil || mode != test.value) {
+			t.Errorf("'%s': expected valid mode, got '%s', %v", test.value, mode, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("'%s': expected error", test.value)
+		}
+	}
+}
+
+func TestVolumeMode(t *testing.T) {
+	tests := []struct {
+		labels map[string]string
+		mode   string
+	}{
+		{nil, modeReadWrite},
+		{map[string]string{modeLabel: modeReadOnly}, modeReadOnly},
+		{map[string]string{modeLabel: modeReadOnlyMany}, modeReadOnlyMany},
+		{map[string]string{modeLabel: "bogus"}, modeReadWrite},
+	}
+
+	for _, test := range tests {
+		if mode := volumeMode(&compute.Disk{Labels: test.labels}); mode != test.mode {
+			t.Errorf("%v: expected %s, got %s", test.labels, test.mode, mode)
+		}
+	}
+}
+
+func TestReadOnlyMountOptions(t *testing.T) {
+	if options := readOnlyMountOptions(fs.FsTypeXfs); !reflect.DeepEqual(options, []string{"ro", "norecovery"}) {
+		t.Errorf("xfs: unexpected options %v", options)
+	}
+	if options := readOnlyMountOptions("ext4"); !reflect.DeepEqual(options, []string{"ro", "noload"}) {
+		t.Errorf("ext4: unexpected options %v", options)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	tests := []struct {
+		mode     string
+		others   []string
+		takeover string
+		inUse    bool
+		err      bool
+	}{
+		// nobody else has the disk
+		{modeReadWrite, nil, TakeoverFail, false, false},
+		{modeReadOnly, nil, TakeoverFail, false, false},
+		{modeReadOnlyMany, nil, TakeoverFail, false, false},
+		// read-only volumes are never taken from a writer, whatever the takeover policy
+		{modeReadOnly, []string{attachReadWrite}, TakeoverForce, true, true},
+		{modeReadOnlyMany, []string{attachReadWrite}, TakeoverForce, true, true},
+		// only ro-many volumes are shared between readers
+		{modeReadOnly, []string{attachReadOnly}, TakeoverFail, true, true},
+		{modeReadOnlyMany, []string{attachReadOnly}, TakeoverFail, false, false},
+		{modeReadOnlyMany, []string{attachReadOnly, attachReadOnly}, TakeoverFail, false, false},
+		{modeReadOnlyMany, []string{attachReadOnly, attachReadWrite}, TakeoverFail, true, true},
+		// a writer needs the disk to itself, and takes it from other writers by the takeover policy
+		{modeReadWrite, []string{attachReadOnly}, TakeoverForce, false, true},
+		{modeReadWrite, []string{attachReadWrite}, TakeoverFail, true, true},
+		{modeReadWrite, []string{attachReadWrite}, TakeoverForce, false, false},
+	}
+
+	for i, test := range tests {
+		fake := newFakeCompute()
+		d, closeFake := newTestDriver(t, fake, GceConfig{Takeover: test.takeover})
+
+		disk := fake.addDisk("zones/"+testZone, testDisk("data", map[string]string{modeLabel: test.mode}))
+		for j, mode := range test.others {
+			// readers and writers in other zones of the region too
+			zone := testZone
+			if j%2 == 1 {
+				zone = "us-central1-b"
+			}
+			other := fake.addInstance(zone, &compute.Instance{Name: fmt.Sprintf("other-%d", j)})
+			fake.attach(other, disk, mode)
+		}
+
+		vol, err := d.getVolume(context.Background(), "data")
+		if err != nil {
+			closeFake()
+			t.Fatal(err)
+		}
+
+		_, err = d.claim(context.Background(), vol)
+		_, inUse := err.(*InUseError)
+		if inUse != test.inUse || (err != nil) != test.err {
+			t.Errorf("%d: %s with other users %v (%s): unexpected result %v", i, test.mode, test.others, test.takeover, err)
+		}
+		closeFake()
+	}
+}
+
+func TestOtherUsersByMode(t *testing.T) {
+	fake := newFakeCompute()
+	d, closeFake := newTestDriver(t, fake, GceConfig{})
+	defer closeFake()
+
+	disk := fake.addDisk("zones/"+testZone, testDisk("data", nil))
+	reader := fake.addInstance(testZone, &compute.Instance{Name: "reader"})
+	writer := fake.addInstance("us-central1-b", &compute.Instance{Name: "writer"})
+	fake.attach(reader, disk, attachReadOnly)
+	fake.attach(writer, disk, attachReadWrite)
+
+	vol, err := d.getVolume(context.Background(), "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readers, writers, err := d.otherUsersByMode(context.Background(), vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(readers, []string{reader.SelfLink}) {
+		t.Errorf("expected readers [%s], got %v", reader.SelfLink, readers)
+	}
+	if !reflect.DeepEqual(writers, []string{writer.SelfLink}) {
+		t.Errorf("expected writers [%s], got %v", writer.SelfLink, writers)
+	}
+}
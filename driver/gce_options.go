@@ -0,0 +1,80 @@
+package driver
+
+import (
+	"strconv"
+
+	"github.com/stugotech/cloudvol2/fs"
+)
+
+// profileDefault gets the name of the default profile, if any
+func (d *gceDriver) profileDefault() string {
+	if d.config.Profiles == nil {
+		return ""
+	}
+	return d.config.Profiles.Default
+}
+
+// maxDiskSizeGb is the largest persistent disk GCE can create
+const maxDiskSizeGb = 65536
+
+// Options gets the schema of the volume options accepted by the GCE driver
+func (d *gceDriver) Options() Schema {
+	return Schema{
+		{Name: ProfileOption, Type: OptionEnum, Values: d.config.Profiles.Names(), Default: d.profileDefault(),
+			Description: "operator defined set of options to start from"},
+		{Name: "sizeGb", Type: OptionInt, Min: 1, Max: maxDiskSizeGb, Default: strconv.FormatInt(d.config.DefaultSizeGb, 10),
+			Description: "size of the disk in GB"},
+		{Name: "type", Type: OptionString, Default: d.config.DefaultDiskType,
+			Description: "disk type in the instance's zone, e.g. pd-ssd"},
+		{Name: "mode", Type: OptionEnum, Values: []string{modeReadWrite, modeReadOnly, modeReadOnlyMany}, Default: modeReadWrite,
+			Description: "attachment mode: read-write or read-only on one instance, or read-only shared by many instances"},
+		{Name: "regional", Type: OptionBool, Default: "false",
+			Description: "create a regional disk replicated to this instance's zone and another"},
+		{Name: "replicaZones", Type: OptionString,
+			Description: "comma separated pair of zones to replicate a regional disk to"},
+		{Name: "fstype", Type: OptionEnum, Values: []string{fs.FsTypeExt4, fs.FsTypeXfs}, Default: fs.FsTypeExt4,
+			Description: "file system to format the disk with"},
+		{Name: "mountOpts", Type: OptionString,
+			Description: "comma separated extra mount options, e.g. noatime"},
+		{Name: ProjectQuotaOption, Type: OptionBool, Default: "false",
+			Description: "format and mount the file system with project quotas, which can limit the space used by directories"},
+		{Name: UIDOption, Type: OptionInt, Max: maxOwnerID,
+			Description: "numeric owner of the volume's root directory, applied on every read-write mount"},
+		{Name: GIDOption, Type: OptionInt, Max: maxOwnerID,
+			Description: "numeric group of the volume's root directory, applied on every read-write mount"},
+		{Name: RootModeOption, Type: OptionString,
+			Description: "octal permissions of the volume's root directory, e.g. 0775, applied on every read-write mount"},
+		{Name: "description", Type: OptionString,
+			Description: "description of the disk"},
+		{Name: labelOptionPrefix, Prefix: true, Type: OptionString,
+			Description: "label.<key>=<value> adds a label to the disk"},
+		{Name: "kmsKey", Type: OptionString, Default: d.config.DefaultKmsKey,
+			Description: "Cloud KMS key to encrypt the disk with"},
+		{Name: EncryptedOption, Type: OptionBool, Default: "false",
+			Description: "encrypt the disk on the host with LUKS"},
+		{Name: "iops", Type: OptionInt, Min: 1,
+			Description: "provisioned IOPS, for disk types which support it"},
+		{Name: "throughput", Type: OptionInt, Min: 1,
+			Description: "provisioned throughput in MB/s, for disk types which support it"},
+		{Name: FreezeOption, Type: OptionBool, Default: "false",
+			Description: "freeze the file system while it is snapshotted"},
+		{Name: SnapshotHookOption, Type: OptionEnum, Values: d.config.Hooks.Names(),
+			Description: "operator defined commands to run before and after snapshots"},
+		{Name: "snapshotSchedule", Type: OptionString,
+			Description: "when to snapshot the disk: a cron expression in UTC, @hourly, @daily, @weekly, @monthly or an interval such as 6h"},
+		{Name: "snapshotRetain", Type: OptionInt, Min: 1, Max: maxSnapshotRetain, Default: strconv.Itoa(defaultSnapshotRetain),
+			Description: "number of scheduled snapshots to keep"},
+		{Name: "image", Type: OptionString,
+			Description: "image to create the disk from, [project/]name"},
+		{Name: "imageFamily", Type: OptionString,
+			Description: "image family to create the disk from the newest image of, [project/]family"},
+		{Name: "sourceDisk", Type: OptionString,
+			Description: "cloudvol disk to clone"},
+		{Name: SeedOption, Type: OptionString,
+			Description: "fill the new volume from a .tar, .tar.gz or .tar.zst archive on the host or at an http(s) URL, or from another volume"},
+		{Name: SeedChecksumOption, Type: OptionString,
+			Description: "sha256 the seed archive must have, as [sha256:]<hex>"},
+		{Name: SeedOwnerOption, Type: OptionString,
+			Description: "numeric uid:gid given to every seeded file"},
+	}
+}
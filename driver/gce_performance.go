@@ -0,0 +1,115 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+// performanceLimits are the ranges of provisioned performance a disk type accepts, zero if it isn't provisioned
+type performanceLimits struct {
+	minIops, maxIops             int64
+	minThroughput, maxThroughput int64
+}
+
+// diskPerformanceLimits holds the per-disk limits of the disk types with provisioned performance; GCE
+// may enforce tighter limits depending on size and machine type, which are reported when the request is made
+var diskPerformanceLimits = map[string]performanceLimits{
+	"pd-extreme":           {minIops: 10000, maxIops: 120000},
+	"hyperdisk-extreme":    {minIops: 2500, maxIops: 350000},
+	"hyperdisk-balanced":   {minIops: 3000, maxIops: 160000, minThroughput: 140, maxThroughput: 2400},
+	"hyperdisk-throughput": {minThroughput: 20, maxThroughput: 600},
+	"hyperdisk-ml":         {minThroughput: 400, maxThroughput: 1200000},
+}
+
+// validatePerformance checks provisioned IOPS and throughput in MB/s against the limits of a disk type,
+// zero values are left for GCE to default
+func validatePerformance(diskType string, iops int64, throughput int64) error {
+	limits, supported := diskPerformanceLimits[diskType]
+
+	if iops != 0 {
+		if !supported || limits.maxIops == 0 {
+			return fmt.Errorf("disk type '%s' doesn't support provisioned IOPS", diskType)
+		}
+		if iops < limits.minIops || iops > limits.maxIops {
+			return fmt.Errorf("disk type '%s' supports between %d and %d IOPS, not %d", diskType, limits.minIops, limits.maxIops, iops)
+		}
+	}
+
+	if throughput != 0 {
+		if !supported || limits.maxThroughput == 0 {
+			return fmt.Errorf("disk type '%s' doesn't support provisioned throughput", diskType)
+		}
+		if throughput < limits.minThroughput || throughput > limits.maxThroughput {
+			return fmt.Errorf("disk type '%s' supports between %d and %d MB/s of throughput, not %d", diskType, limits.minThroughput, limits.maxThroughput, throughput)
+		}
+	}
+	return nil
+}
+
+// parsePerformance parses an iops or throughput option
+func parsePerformance(value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("expected a positive number, got '%s'", value)
+	}
+	return n, nil
+}
+
+// SetPerformance changes the provisioned IOPS and throughput of a disk, leaving zero values unchanged
+func (d *gceDriver) SetPerformance(ctx context.Context, id string, iops int64, throughput int64) (*Volume, error) {
+	disk, err := d.getDisk(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error getting info about disk '%s': %v", id, err)
+	}
+	if !d.inScope(disk) {
+		return nil, fmt.Errorf("GCE: disk '%s' is not managed by cloudvol, import it to use it as a volume", id)
+	}
+
+	if err = validatePerformance(path.Base(disk.Type), iops, throughput); err != nil {
+		return nil, fmt.Errorf("GCE: %v", err)
+	}
+
+	update := &compute.Disk{ProvisionedIops: iops, ProvisionedThroughput: throughput}
+	var paths []string
+	if iops != 0 {
+		paths = append(paths, "provisionedIops")
+	}
+	if throughput != 0 {
+		paths = append(paths, "provisionedThroughput")
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("GCE: no IOPS or throughput given for disk '%s'", id)
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk":       id,
+		"iops":       iops,
+		"throughput": throughput,
+	}).Info("GCE: updating provisioned performance")
+
+	var op *compute.Operation
+	if disk.Region != "" {
+		op, err = d.client.RegionDisks.Update(d.project, path.Base(disk.Region), id, update).Paths(paths...).UpdateMask(strings.Join(paths, ",")).Context(ctx).Do()
+	} else {
+		op, err = d.client.Disks.Update(d.project, path.Base(disk.Zone), id, update).Paths(paths...).UpdateMask(strings.Join(paths, ",")).Context(ctx).Do()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error updating disk '%s': %v", id, err)
+	}
+	if err = d.waitForOpTimeout(ctx, op, resizeWaitTimeout); err != nil {
+		return nil, fmt.Errorf("GCE: error updating disk '%s': %v", id, err)
+	}
+
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &vol.Volume, nil
+}
@@ -0,0 +1,138 @@
+package driver
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+// checkPolicy checks a new volume against the policy. The rules which only depend on the request are
+// checked first, from the options as given, so that a refused volume makes no cloud API calls at all.
+func (d *gceDriver) checkPolicy(ctx context.Context, id string, opts map[string]string) error {
+	if d.config.Policy == nil {
+		return nil
+	}
+
+	// profile problems are reported when the options are parsed
+	opts = d.config.Profiles.Expand(opts, &OptionsError{})
+	return d.enforcePolicy(ctx, d.policyRequest(id, opts))
+}
+
+// checkGrowPolicy checks that growing a volume to the given size is allowed by the policy
+func (d *gceDriver) checkGrowPolicy(ctx context.Context, vol *gceVolume, sizeGb int64) error {
+	if d.config.Policy == nil {
+		return nil
+	}
+
+	labels, _ := vol.Status["labels"].(map[string]string)
+	return d.enforcePolicy(ctx, &PolicyRequest{
+		Name:   vol.Name,
+		SizeGb: sizeGb,
+		Labels: labels,
+		Grow:   true,
+	})
+}
+
+// checkLabelPolicy checks that the policy allows a volume to have the given labels, which must include the
+// required labels and not take the volume over the quota of a label
+func (d *gceDriver) checkLabelPolicy(ctx context.Context, vol *gceVolume, labels map[string]string) error {
+	if d.config.Policy == nil {
+		return nil
+	}
+
+	return d.enforcePolicy(ctx, &PolicyRequest{
+		Name:    vol.Name,
+		SizeGb:  vol.sizeGb,
+		Labels:  d.userLabels(labels),
+		Relabel: true,
+	})
+}
+
+// checkSourcePolicy checks a volume against the policy again once it takes the size of the image, snapshot
+// or disk it is created from
+func (d *gceDriver) checkSourcePolicy(ctx context.Context, disk *compute.Disk) error {
+	if d.config.Policy == nil {
+		return nil
+	}
+
+	diskType := gceDefaultDiskType
+	if disk.Type != "" {
+		diskType = path.Base(disk.Type)
+	}
+	return d.enforcePolicy(ctx, &PolicyRequest{
+		Name:   disk.Name,
+		SizeGb: disk.SizeGb,
+		Type:   diskType,
+		Labels: d.userLabels(disk.Labels),
+	})
+}
+
+// enforcePolicy returns a PolicyError if the request breaks any rule, only listing the existing
+// disks when the policy has limits which need them
+func (d *gceDriver) enforcePolicy(ctx context.Context, req *PolicyRequest) error {
+	policy := d.config.Policy
+	violations := policy.Check(req)
+
+	if len(violations) == 0 && policy.NeedsUsage() {
+		disks, err := d.listDisks(ctx)
+		if err != nil {
+			return err
+		}
+
+		existing := make([]*PolicyRequest, 0, len(disks))
+		for _, disk := range disks {
+			existing = append(existing, &PolicyRequest{
+				Name:   disk.Name,
+				SizeGb: disk.SizeGb,
+				Type:   path.Base(disk.Type),
+				Labels: d.userLabels(disk.Labels),
+			})
+		}
+		violations = policy.CheckUsage(req, existing)
+	}
+
+	if len(violations) > 0 {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"volume":     req.Name,
+			"violations": violations,
+		}).Warn("GCE: volume refused by policy")
+		return &PolicyError{Volume: req.Name, Violations: violations}
+	}
+	return nil
+}
+
+// policyRequest describes a new volume from its unparsed options, invalid values are left for
+// the options parser to report
+func (d *gceDriver) policyRequest(id string, opts map[string]string) *PolicyRequest {
+	req := &PolicyRequest{
+		Name:   id,
+		SizeGb: d.config.DefaultSizeGb,
+		Type:   gceDefaultDiskType,
+		Labels: make(map[string]string),
+	}
+
+	if d.config.DefaultDiskType != "" {
+		req.Type = d.config.DefaultDiskType
+	}
+	if diskType, exists := opts["type"]; exists {
+		req.Type = path.Base(diskType)
+	}
+	if sizeGb, err := strconv.ParseInt(opts["sizeGb"], 10, 64); err == nil {
+		req.SizeGb = sizeGb
+	}
+
+	for key, value := range d.config.DefaultLabels {
+		req.Labels[key] = value
+	}
+	for key, value := range opts {
+		if strings.HasPrefix(key, labelOptionPrefix) {
+			req.Labels[strings.TrimPrefix(key, labelOptionPrefix)] = value
+		}
+	}
+	return req
+}
@@ -0,0 +1,231 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// regionalReplicaCount is the number of zones a regional disk is replicated to
+const regionalReplicaCount = 2
+
+// zoneRegion gets the region of a zone, e.g. us-central1 for us-central1-a
+func zoneRegion(zone string) string {
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// isNotFound checks if an error from the compute API means the resource doesn't exist
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusNotFound
+}
+
+// isAlreadyExists checks if an error from the compute API is caused by a resource name which is taken
+func isAlreadyExists(err error) bool {
+	apiErr, ok := err.(*googleapi.Error)
+	return ok && apiErr.Code == http.StatusConflict
+}
+
+// parseReplicaZones parses a comma separated list of zones for a regional disk
+func (d *gceDriver) parseReplicaZones(value string) ([]string, error) {
+	var zones []string
+	for _, zone := range strings.Split(value, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			zones = append(zones, zone)
+		}
+	}
+
+	if len(zones) != regionalReplicaCount {
+		return nil, fmt.Errorf("expected %d zones, got %d", regionalReplicaCount, len(zones))
+	}
+	for _, zone := range zones {
+		if zoneRegion(zone) != d.region {
+			return nil, fmt.Errorf("zone '%s' is not in region '%s'", zone, d.region)
+		}
+	}
+	if !stringInSlice(zones, d.zone) {
+		return nil, fmt.Errorf("zones must include '%s' so the disk can be attached to this instance", d.zone)
+	}
+	return zones, nil
+}
+
+// regionZones gets the zones of this instance's region other than its own, in name order
+func (d *gceDriver) regionZones(ctx context.Context) ([]string, error) {
+	region, err := d.client.Regions.Get(d.project, d.region).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error retrieving region '%s': %v", d.region, err)
+	}
+
+	var others []string
+	for _, zoneURI := range region.Zones {
+		if zone := path.Base(zoneURI); zone != d.zone {
+			others = append(others, zone)
+		}
+	}
+	sort.Strings(others)
+	return others, nil
+}
+
+// defaultReplicaZones picks the zones for a regional disk: this instance's zone and the next zone in the region
+func (d *gceDriver) defaultReplicaZones(ctx context.Context) ([]string, error) {
+	others, err := d.regionZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(others) == 0 {
+		return nil, fmt.Errorf("GCE: region '%s' has no zone to replicate to", d.region)
+	}
+	return []string{d.zone, others[0]}, nil
+}
+
+// getDisk gets a disk by name, looking for a zonal disk in this instance's zone and then for a regional disk
+func (d *gceDriver) getDisk(ctx context.Context, id string) (*compute.Disk, error) {
+	disk, err := d.client.Disks.Get(d.project, d.zone, id).Context(ctx).Do()
+	if err == nil || !isNotFound(err) {
+		return disk, err
+	}
+	return d.client.RegionDisks.Get(d.project, d.region, id).Context(ctx).Do()
+}
+
+// listDisks gets the zonal disks in this instance's zone, or every zone of its region if configured,
+// and the regional disks in its region
+func (d *gceDriver) listDisks(ctx context.Context) ([]*compute.Disk, error) {
+	var disks []*compute.Disk
+	collect := func(page *compute.DiskList) error {
+		disks = append(disks, page.Items...)
+		return nil
+	}
+
+	zones := []string{d.zone}
+	if d.config.ListAllZones {
+		others, err := d.regionZones(ctx)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, others...)
+	}
+
+	filter := d.scopeFilter()
+	for _, zone := range zones {
+		if err := d.client.Disks.List(d.project, zone).Filter(filter).Pages(ctx, collect); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.client.RegionDisks.List(d.project, d.region).Filter(filter).Pages(ctx, collect); err != nil {
+		return nil, err
+	}
+	return disks, nil
+}
+
+// insertDisk creates a disk, regional if replica zones are given
+func (d *gceDriver) insertDisk(ctx context.Context, disk *compute.Disk, replicaZones []string) (*compute.Operation, error) {
+	if len(replicaZones) == 0 {
+		return d.client.Disks.Insert(d.project, d.zone, disk).Context(ctx).Do()
+	}
+
+	for _, zone := range replicaZones {
+		disk.ReplicaZones = append(disk.ReplicaZones, d.client.BasePath+path.Join("projects", d.project, "zones", zone))
+	}
+
+	if disk.Type != "" {
+		// zonal and regional disk types are separate resources with the same names
+		diskType, err := d.client.RegionDiskTypes.Get(d.project, d.region, path.Base(disk.Type)).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("regional disk type '%s' not found: %v", path.Base(disk.Type), err)
+		}
+		disk.Type = diskType.SelfLink
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk":         disk.Name,
+		"region":       d.region,
+		"replicaZones": replicaZones,
+	}).Info("GCE: creating regional disk")
+
+	return d.client.RegionDisks.Insert(d.project, d.region, disk).Context(ctx).Do()
+}
+
+// setDiskLabel sets a label of a disk, rereading the disk as a snapshot or seed can take long enough
+// for its labels to change
+func (d *gceDriver) setDiskLabel(ctx context.Context, id string, key string, value string) error {
+	disk, err := d.getDisk(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	labels := make(map[string]string, len(disk.Labels)+1)
+	for k, v := range disk.Labels {
+		labels[k] = v
+	}
+	labels[key] = value
+	return d.setDiskLabels(ctx, disk, labels)
+}
+
+// setDiskLabels replaces the labels of a disk
+func (d *gceDriver) setDiskLabels(ctx context.Context, disk *compute.Disk, labels map[string]string) error {
+	var op *compute.Operation
+	var err error
+
+	if disk.Region != "" {
+		req := &compute.RegionSetLabelsRequest{Labels: labels, LabelFingerprint: disk.LabelFingerprint}
+		op, err = d.client.RegionDisks.SetLabels(d.project, path.Base(disk.Region), disk.Name, req).Context(ctx).Do()
+	} else {
+		req := &compute.ZoneSetLabelsRequest{Labels: labels, LabelFingerprint: disk.LabelFingerprint}
+		op, err = d.client.Disks.SetLabels(d.project, path.Base(disk.Zone), disk.Name, req).Context(ctx).Do()
+	}
+	if err != nil {
+		return fmt.Errorf("GCE: error setting labels of disk '%s': %v", disk.Name, err)
+	}
+	if err = d.waitForOp(ctx, op); err != nil {
+		return fmt.Errorf("GCE: error setting labels of disk '%s': %v", disk.Name, err)
+	}
+	return nil
+}
+
+// deleteDisk deletes the disk of a volume
+func (d *gceDriver) deleteDisk(ctx context.Context, vol *gceVolume) (*compute.Operation, error) {
+	if vol.region != "" {
+		return d.client.RegionDisks.Delete(d.project, vol.region, vol.Name).Context(ctx).Do()
+	}
+	return d.client.Disks.Delete(d.project, d.zone, vol.Name).Context(ctx).Do()
+}
+
+// resizeDisk grows the disk of a volume
+func (d *gceDriver) resizeDisk(ctx context.Context, vol *gceVolume, sizeGb int64) (*compute.Operation, error) {
+	if vol.region != "" {
+		req := &compute.RegionDisksResizeRequest{SizeGb: sizeGb}
+		return d.client.RegionDisks.Resize(d.project, vol.region, vol.Name, req).Context(ctx).Do()
+	}
+	req := &compute.DisksResizeRequest{SizeGb: sizeGb}
+	return d.client.Disks.Resize(d.project, d.zone, vol.Name, req).Context(ctx).Do()
+}
+
+// snapshotDisk starts a snapshot of the disk of a volume
+func (d *gceDriver) snapshotDisk(ctx context.Context, vol *gceVolume, snapshot *compute.Snapshot) (*compute.Operation, error) {
+	if vol.region != "" {
+		return d.client.RegionDisks.CreateSnapshot(d.project, vol.region, vol.Name, snapshot).Context(ctx).Do()
+	}
+	return d.client.Disks.CreateSnapshot(d.project, d.zone, vol.Name, snapshot).Context(ctx).Do()
+}
+
+// getOperation refreshes an operation, which may be zonal, regional or global
+func (d *gceDriver) getOperation(ctx context.Context, op *compute.Operation) (*compute.Operation, error) {
+	switch {
+	case op.Zone != "":
+		return d.client.ZoneOperations.Get(d.project, path.Base(op.Zone), op.Name).Context(ctx).Do()
+	case op.Region != "":
+		return d.client.RegionOperations.Get(d.project, path.Base(op.Region), op.Name).Context(ctx).Do()
+	}
+	return d.client.GlobalOperations.Get(d.project, op.Name).Context(ctx).Do()
+}
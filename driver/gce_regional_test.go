@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestZoneRegion(t *testing.T) {
+	tests := []struct {
+		zone   string
+		region string
+	}{
+		{"us-central1-a", "us-central1"},
+		{"europe-west4-c", "europe-west4"},
+		{"asia-northeast1-b", "asia-northeast1"},
+		{"nodash", "nodash"},
+		{"-a", "-a"},
+	}
+
+	for _, test := range tests {
+		if region := zoneRegion(test.zone); region != test.region {
+			t.Errorf("%s: expected %s, got %s", test.zone, test.region, region)
+		}
+	}
+}
+
+func TestParseReplicaZones(t *testing.T) {
+	d := &gceDriver{zone: testZone, region: testRegion}
+
+	tests := []struct {
+		value string
+		zones []string
+	}{
+		{"us-central1-a,us-central1-b", []string{"us-central1-a", "us-central1-b"}},
+		{" us-central1-c , us-central1-a ", []string{"us-central1-c", "us-central1-a"}},
+		{"us-central1-a,,us-central1-f,", []string{"us-central1-a", "us-central1-f"}},
+		// one zone, or more than two
+		{"us-central1-a", nil},
+		{"us-central1-a,us-central1-b,us-central1-c", nil},
+		// zones in another region
+		{"us-central1-a,us-east1-b", nil},
+		// both zones away from the instance
+		{"us-central1-b,us-central1-c", nil},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		zones, err := d.parseReplicaZones(test.value)
+		if test.zones == nil {
+			if err == nil {
+				t.Errorf("'%s': expected error, got %v", test.value, zones)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %v", test.value, err)
+		} else if !reflect.DeepEqual(zones, test.zones) {
+			t.Errorf("'%s': expected %v, got %v", test.value, test.zones, zones)
+		}
+	}
+}
+
+func TestDefaultReplicaZones(t *testing.T) {
+	tests := []struct {
+		zones []string
+		pick  []string
+	}{
+		{[]string{"us-central1-f", "us-central1-a", "us-central1-c"}, []string{testZone, "us-central1-c"}},
+		{[]string{"us-central1-a"}, nil},
+	}
+
+	for _, test := range tests {
+		fake := newFakeCompute()
+		d, closeFake := newTestDriver(t, fake, GceConfig{})
+
+		region := &compute.Region{Name: testRegion}
+		for _, zone := range test.zones {
+			region.Zones = append(region.Zones, testLink("zones/"+zone))
+		}
+		fake.add("regions", region)
+
+		zones, err := d.defaultReplicaZones(context.Background())
+		if test.pick == nil {
+			if err == nil {
+				t.Errorf("%v: expected error, got %v", test.zones, zones)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error: %v", test.zones, err)
+		} else if !reflect.DeepEqual(zones, test.pick) {
+			t.Errorf("%v: expected %v, got %v", test.zones, test.pick, zones)
+		}
+		closeFake()
+	}
+}
+
+func TestGetDisk(t *testing.T) {
+	fake := newFakeCompute()
+	d, closeFake := newTestDriver(t, fake, GceConfig{})
+	defer closeFake()
+
+	fake.addDisk("zones/"+testZone, testDisk("zonal", nil))
+	fake.addDisk("regions/"+testRegion, testDisk("regional", nil))
+	fake.addDisk("zones/us-central1-b", testDisk("elsewhere", nil))
+
+	disk, err := d.getDisk(context.Background(), "zonal")
+	if err != nil || disk.Zone == "" {
+		t.Errorf("zonal: expected a zonal disk, got %v, %v", disk, err)
+	}
+	disk, err = d.getDisk(context.Background(), "regional")
+	if err != nil || disk.Region == "" {
+		t.Errorf("regional: expected a regional disk, got %v, %v", disk, err)
+	}
+	if _, err = d.getDisk(context.Background(), "elsewhere"); !isNotFound(err) {
+		t.Errorf("elsewhere: expected not found, got %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/fs"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// UIDOption and GIDOption set the owner of the root directory of a volume's file system
+	UIDOption = "uid"
+	GIDOption = "gid"
+	// RootModeOption sets the permissions of the root directory of a volume's file system; the mode option
+	// is the attachment mode
+	RootModeOption = "rootMode"
+
+	// DefaultMountDirMode is the mode of the directories volumes are mounted on
+	DefaultMountDirMode os.FileMode = 0700
+
+	rootUIDLabel  = labelPrefix + "uid"
+	rootGIDLabel  = labelPrefix + "gid"
+	rootModeLabel = labelPrefix + "root-mode"
+
+	maxOwnerID = 1<<31 - 1
+)
+
+// volumeRoot is the owner and permissions given to the root directory of a volume's file system each time
+// it is mounted read-write; a uid or gid of -1 and a nil mode are left as they are
+type volumeRoot struct {
+	uid  int
+	gid  int
+	mode *os.FileMode
+}
+
+// isSet checks if any of the root's owner or permissions are given
+func (r *volumeRoot) isSet() bool {
+	return r.uid >= 0 || r.gid >= 0 || r.mode != nil
+}
+
+// parseOwnerID parses a uid or gid option
+func parseOwnerID(value string) (int, error) {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 || id > maxOwnerID {
+		return 0, fmt.Errorf("expected a numeric id from 0 to %d", maxOwnerID)
+	}
+	return int(id), nil
+}
+
+// setLabels records the root owner and permissions of a new disk
+func (r *volumeRoot) setLabels(labels map[string]string) {
+	if r.uid >= 0 {
+		labels[rootUIDLabel] = strconv.Itoa(r.uid)
+	}
+	if r.gid >= 0 {
+		labels[rootGIDLabel] = strconv.Itoa(r.gid)
+	}
+	if r.mode != nil {
+		labels[rootModeLabel] = fs.FormatMode(*r.mode)
+	}
+}
+
+// rootFromLabels gets the root owner and permissions of a disk, ignoring labels which don't parse
+func rootFromLabels(disk *compute.Disk) volumeRoot {
+	root := volumeRoot{uid: -1, gid: -1}
+	if uid, err := parseOwnerID(disk.Labels[rootUIDLabel]); err == nil {
+		root.uid = uid
+	}
+	if gid, err := parseOwnerID(disk.Labels[rootGIDLabel]); err == nil {
+		root.gid = gid
+	}
+	if mode, err := fs.ParseMode(disk.Labels[rootModeLabel]); err == nil {
+		root.mode = &mode
+	}
+	return root
+}
+
+// status adds the root owner and permissions to a volume's status
+func (r *volumeRoot) status(status map[string]interface{}) {
+	if r.uid >= 0 {
+		status[UIDOption] = r.uid
+	}
+	if r.gid >= 0 {
+		status[GIDOption] = r.gid
+	}
+	if r.mode != nil {
+		status[RootModeOption] = fs.FormatMode(*r.mode)
+	}
+}
+
+// applyRoot gives the root directory of a volume mounted read-write its owner and permissions
+func (d *gceDriver) applyRoot(ctx context.Context, vol *gceVolume) error {
+	if vol.readOnly || !vol.root.isSet() {
+		return nil
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk": vol.Name,
+		"uid":  vol.root.uid,
+		"gid":  vol.root.gid,
+	}).Debug("GCE: setting owner and permissions of volume root")
+
+	if err := d.fs.Chown(ctx, vol.Path, vol.root.uid, vol.root.gid, false); err != nil {
+		return fmt.Errorf("GCE: error setting owner of volume '%s': %v", vol.Name, err)
+	}
+	if vol.root.mode != nil {
+		if err := d.fs.Chmod(ctx, vol.Path, *vol.root.mode); err != nil {
+			return fmt.Errorf("GCE: error setting permissions of volume '%s': %v", vol.Name, err)
+		}
+	}
+	return nil
+}
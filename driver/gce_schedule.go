@@ -0,0 +1,262 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	snapshotScheduleLabel  = labelPrefix + "snapshot-schedule"
+	snapshotRetainLabel    = labelPrefix + "snapshot-retain"
+	snapshotLastLabel      = labelPrefix + "snapshot-last"
+	snapshotFailedLabel    = labelPrefix + "snapshot-failed"
+	snapshotVolumeLabel    = labelPrefix + "volume"
+	snapshotScheduledLabel = labelPrefix + "scheduled"
+
+	defaultSnapshotRetain   = 7
+	maxSnapshotRetain       = 1000
+	snapshotRetryInterval   = 10 * time.Minute
+	scheduledSnapshotFormat = "20060102-1504"
+)
+
+// scheduleErrors remembers the error of the last failed scheduled snapshot of each volume taken
+// by this instance, the disk labels only have room for the time
+type scheduleErrors struct {
+	mutex  sync.Mutex
+	errors map[string]string
+}
+
+func newScheduleErrors() *scheduleErrors {
+	return &scheduleErrors{errors: make(map[string]string)}
+}
+
+func (e *scheduleErrors) set(volume string, err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if err == nil {
+		delete(e.errors, volume)
+	} else {
+		e.errors[volume] = err.Error()
+	}
+}
+
+func (e *scheduleErrors) get(volume string) string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.errors[volume]
+}
+
+// parseSnapshotSchedule checks a snapshotSchedule option and encodes it for the disk's labels
+func parseSnapshotSchedule(value string) (string, error) {
+	if err := validateSchedule(value); err != nil {
+		return "", err
+	}
+	encoded, err := encodeLabelValue(value)
+	if err != nil {
+		return "", fmt.Errorf("schedule '%s' is too long", value)
+	}
+	return encoded, nil
+}
+
+// RunSchedules takes the scheduled snapshots which are due every interval until the context is done.
+// Every instance runs the schedules of the disks in its zone and region; the snapshot of each run is
+// named after the scheduled time, so GCE only lets one instance take it.
+func (d *gceDriver) RunSchedules(ctx context.Context, interval time.Duration) {
+	log.WithFields(log.Fields{"interval": interval}).Info("GCE: running snapshot schedules")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		d.runSnapshotSchedules(logging.WithRequestID(ctx, logging.NewRequestID()))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runSnapshotSchedules takes the snapshots which are due
+func (d *gceDriver) runSnapshotSchedules(ctx context.Context) {
+	disks, err := d.listDisks(ctx)
+	if err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("GCE: error listing disks for snapshot schedules")
+		return
+	}
+
+	now := time.Now().UTC()
+	for _, disk := range disks {
+		if disk.Labels[snapshotScheduleLabel] == "" || !d.isLocal(disk) {
+			continue
+		}
+		if (disk.Labels[fsFreezeLabel] == "true" || disk.Labels[hookLabel] != "") &&
+			len(disk.Users) > 0 && !stringInSlice(disk.Users, d.instanceURI) {
+			// consistent snapshots are taken on the instance the disk is attached to
+			continue
+		}
+
+		due, err := snapshotDue(disk, now)
+		if err != nil {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"disk": disk.Name,
+				"err":  err,
+			}).Warn("GCE: invalid snapshot schedule")
+			continue
+		}
+		if !due.IsZero() {
+			d.runScheduledSnapshot(ctx, disk, due)
+		}
+	}
+}
+
+// isLocal checks if a disk is in this instance's zone, or for a regional disk its region
+func (d *gceDriver) isLocal(disk *compute.Disk) bool {
+	if disk.Region != "" {
+		return path.Base(disk.Region) == d.region
+	}
+	return path.Base(disk.Zone) == d.zone
+}
+
+// snapshotDue gets the time of the latest scheduled snapshot of a disk which hasn't been taken,
+// or the zero time if none is due. Missed runs are skipped rather than caught up on, and a failed
+// run is only retried after a while.
+func snapshotDue(disk *compute.Disk, now time.Time) (time.Time, error) {
+	s, err := parseSchedule(decodeLabelValue(disk.Labels[snapshotScheduleLabel]))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	after := labelTime(disk.Labels[snapshotLastLabel])
+	if after.IsZero() {
+		if after, err = time.Parse(time.RFC3339, disk.CreationTimestamp); err != nil {
+			return time.Time{}, fmt.Errorf("invalid creation time '%s': %v", disk.CreationTimestamp, err)
+		}
+	}
+
+	failed := labelTime(disk.Labels[snapshotFailedLabel])
+	if failed.After(after) && now.Sub(failed) < snapshotRetryInterval {
+		return time.Time{}, nil
+	}
+	return latestRun(s, after, now), nil
+}
+
+// runScheduledSnapshot takes a scheduled snapshot, records the result in the disk's labels and
+// deletes the scheduled snapshots beyond the retention count
+func (d *gceDriver) runScheduledSnapshot(ctx context.Context, disk *compute.Disk, due time.Time) {
+	name := resourceName(disk.Name, "auto-"+due.Format(scheduledSnapshotFormat))
+	logger := logging.FromContext(ctx).WithFields(log.Fields{"disk": disk.Name, "snapshot": name})
+
+	vol, err := d.getVolume(ctx, disk.Name)
+	var op *compute.Operation
+	if err == nil {
+		op, err = d.snapshotVolume(ctx, vol, name, map[string]string{snapshotScheduledLabel: "true"})
+		if isAlreadyExists(err) {
+			logger.Info("GCE: scheduled snapshot already taken by another instance")
+			return
+		}
+	}
+	if err == nil {
+		err = d.waitForOpTimeout(ctx, op, snapshotWaitTimeout)
+	}
+	d.scheduleErrors.set(disk.Name, err)
+
+	label, value := snapshotLastLabel, strconv.FormatInt(due.Unix(), 10)
+	if err != nil {
+		logger.WithError(err).Error("GCE: scheduled snapshot failed")
+		label, value = snapshotFailedLabel, strconv.FormatInt(time.Now().Unix(), 10)
+	} else {
+		logger.Info("GCE: scheduled snapshot taken")
+	}
+
+	if err = d.setDiskLabel(ctx, disk.Name, label, value); err != nil {
+		logger.WithError(err).Error("GCE: error recording scheduled snapshot")
+	}
+	if label == snapshotLastLabel {
+		d.pruneSnapshots(ctx, disk)
+	}
+}
+
+// pruneSnapshots deletes the oldest scheduled snapshots of a disk beyond its retention count,
+// snapshots taken by hand are kept
+func (d *gceDriver) pruneSnapshots(ctx context.Context, disk *compute.Disk) {
+	retain, err := strconv.Atoi(disk.Labels[snapshotRetainLabel])
+	if err != nil || retain <= 0 {
+		retain = defaultSnapshotRetain
+	}
+
+	filter := fmt.Sprintf(`%s AND (labels.%s = "%s") AND (labels.%s = "true")`,
+		d.scopeFilter(), snapshotVolumeLabel, disk.Name, snapshotScheduledLabel)
+
+	var snapshots []*compute.Snapshot
+	err = d.client.Snapshots.List(d.project).Filter(filter).Pages(ctx, func(page *compute.SnapshotList) error {
+		snapshots = append(snapshots, page.Items...)
+		return nil
+	})
+	if err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{"disk": disk.Name, "err": err}).Warn("GCE: error listing scheduled snapshots")
+		return
+	}
+	if len(snapshots) <= retain {
+		return
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreationTimestamp < snapshots[j].CreationTimestamp
+	})
+
+	for _, snapshot := range snapshots[:len(snapshots)-retain] {
+		logger := logging.FromContext(ctx).WithFields(log.Fields{"disk": disk.Name, "snapshot": snapshot.Name})
+		logger.Info("GCE: deleting scheduled snapshot beyond retention")
+
+		// another instance may be pruning the same snapshots
+		if _, err := d.client.Snapshots.Delete(d.project, snapshot.Name).Context(ctx).Do(); err != nil && !isNotFound(err) {
+			logger.WithError(err).Warn("GCE: error deleting scheduled snapshot")
+		}
+	}
+}
+
+// scheduleStatus adds the snapshot schedule of a disk and the result of its last run to a volume's status
+func (d *gceDriver) scheduleStatus(disk *compute.Disk, status map[string]interface{}) {
+	spec := disk.Labels[snapshotScheduleLabel]
+	if spec == "" {
+		return
+	}
+
+	schedule := map[string]interface{}{
+		"schedule": decodeLabelValue(spec),
+		"retain":   defaultSnapshotRetain,
+	}
+	if retain, err := strconv.Atoi(disk.Labels[snapshotRetainLabel]); err == nil {
+		schedule["retain"] = retain
+	}
+	if last := labelTime(disk.Labels[snapshotLastLabel]); !last.IsZero() {
+		schedule["lastSuccess"] = last.Format(time.RFC3339)
+	}
+	if failed := labelTime(disk.Labels[snapshotFailedLabel]); !failed.IsZero() {
+		schedule["lastFailure"] = failed.Format(time.RFC3339)
+		if message := d.scheduleErrors.get(disk.Name); message != "" {
+			schedule["lastError"] = message
+		}
+	}
+	status["snapshotSchedule"] = schedule
+}
+
+// labelTime parses a unix time stored in a label, giving the zero time if there is none
+func labelTime(value string) time.Time {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0).UTC()
+}
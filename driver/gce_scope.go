@@ -0,0 +1,119 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	// DefaultManagedLabel is the label stamped on the disks cloudvol creates
+	DefaultManagedLabel = "managed-by=cloudvol"
+	namespaceLabel      = labelPrefix + "namespace"
+)
+
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValuePattern = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+)
+
+// scopeLabels builds the labels which mark the disks belonging to this driver from the config
+func scopeLabels(config *GceConfig) (map[string]string, error) {
+	if config.ManagedLabel == "" {
+		config.ManagedLabel = DefaultManagedLabel
+	}
+
+	parts := strings.SplitN(config.ManagedLabel, "=", 2)
+	if len(parts) != 2 || !labelKeyPattern.MatchString(parts[0]) || !labelValuePattern.MatchString(parts[1]) {
+		return nil, fmt.Errorf("GCE: invalid managed label '%s', expected key=value with lowercase letters, digits, '-' and '_'", config.ManagedLabel)
+	}
+	if strings.HasPrefix(parts[0], labelPrefix) {
+		return nil, fmt.Errorf("GCE: invalid managed label '%s', the '%s' prefix is reserved", config.ManagedLabel, labelPrefix)
+	}
+	labels := map[string]string{parts[0]: parts[1]}
+
+	if config.Namespace != "" {
+		if !labelValuePattern.MatchString(config.Namespace) {
+			return nil, fmt.Errorf("GCE: invalid namespace '%s', use lowercase letters, digits, '-' and '_'", config.Namespace)
+		}
+		labels[namespaceLabel] = config.Namespace
+	}
+	return labels, nil
+}
+
+// inScope checks if a disk carries this driver's scope labels
+func (d *gceDriver) inScope(disk *compute.Disk) bool {
+	for key, value := range d.scope {
+		if disk.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// scopeFilter builds a compute API list filter which matches this driver's disks
+func (d *gceDriver) scopeFilter() string {
+	terms := make([]string, 0, len(d.scope))
+	for key, value := range d.scope {
+		terms = append(terms, fmt.Sprintf(`(labels.%s = "%s")`, key, value))
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, " AND ")
+}
+
+// withScope adds this driver's scope labels to a disk's labels
+func (d *gceDriver) withScope(labels map[string]string) map[string]string {
+	scoped := make(map[string]string, len(labels)+len(d.scope))
+	for key, value := range labels {
+		scoped[key] = value
+	}
+	for key, value := range d.scope {
+		scoped[key] = value
+	}
+	return scoped
+}
+
+// Import adopts an existing disk which cloudvol didn't create by labelling it, so that it can be used as a volume
+func (d *gceDriver) Import(ctx context.Context, id string) (*Volume, error) {
+	disk, err := d.getDisk(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("GCE: error getting info about disk '%s': %v", id, err)
+	}
+
+	if !d.inScope(disk) {
+		if namespace, exists := disk.Labels[namespaceLabel]; exists && namespace != d.config.Namespace {
+			return nil, fmt.Errorf("GCE: disk '%s' belongs to namespace '%s'", id, namespace)
+		}
+
+		for _, instanceURI := range disk.Users {
+			attachment, err := d.getAttachment(ctx, instanceURI, disk.SelfLink)
+			if err != nil {
+				return nil, err
+			}
+			if attachment != nil && attachment.Boot {
+				return nil, fmt.Errorf("GCE: disk '%s' is the boot disk of '%s' and can't be imported", id, instanceNames([]string{instanceURI})[0])
+			}
+		}
+
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"disk":   id,
+			"labels": d.scope,
+		}).Info("GCE: importing disk")
+
+		if err = d.setDiskLabels(ctx, disk, d.withScope(disk.Labels)); err != nil {
+			return nil, err
+		}
+	}
+
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &vol.Volume, nil
+}
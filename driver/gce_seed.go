@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+// seedLabel records how far creating a seeded disk got, so a retried create carries on from there: it
+// is pending until the disk is formatted, then formatted until the disk is filled
+const (
+	seedLabel     = labelPrefix + "seed"
+	seedPending   = "pending"
+	seedFormatted = "formatted"
+	seedDone      = "done"
+)
+
+// formatSeedDisk formats a new disk which is to be seeded and records that it was
+func (d *gceDriver) formatSeedDisk(ctx context.Context, vol *gceVolume) error {
+	if err := d.formatDisk(ctx, vol); err != nil {
+		return err
+	}
+	if err := d.setDiskLabel(ctx, vol.Name, seedLabel, seedFormatted); err != nil {
+		return fmt.Errorf("GCE: error marking volume '%s' formatted: %v", vol.Name, err)
+	}
+	return nil
+}
+
+// seedDisk fills a new disk attached read-write to this instance, mounting it if it isn't mounted, and
+// marks it seeded
+func (d *gceDriver) seedDisk(ctx context.Context, vol *gceVolume, seed *volumeSeed) error {
+	if vol.Path == "" {
+		if err := d.mountDisk(ctx, vol); err != nil {
+			return err
+		}
+		if err := d.growIfPending(ctx, vol); err != nil {
+			return err
+		}
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk": vol.Name,
+		"seed": seed.source,
+	}).Info("GCE: seeding volume")
+
+	var err error
+	if seed.kind == seedVolume {
+		err = d.seedFromVolume(ctx, vol, seed.source)
+	} else {
+		err = seedFromArchive(ctx, d.fs, seed, vol.Path)
+	}
+	if err == nil && seed.owner {
+		err = d.fs.Chown(ctx, vol.Path, seed.uid, seed.gid, true)
+	}
+	if err != nil {
+		return fmt.Errorf("GCE: error seeding volume '%s': %v", vol.Name, err)
+	}
+	// the seed may have replaced the root's owner and permissions
+	if err = d.applyRoot(ctx, vol); err != nil {
+		return err
+	}
+
+	if err = d.setDiskLabel(ctx, vol.Name, seedLabel, seedDone); err != nil {
+		return fmt.Errorf("GCE: error marking volume '%s' seeded: %v", vol.Name, err)
+	}
+	return nil
+}
+
+// seedFromVolume copies the files of another volume, which is mounted here for the copy if it isn't
+// already; a read-write volume is never taken from another instance for this
+func (d *gceDriver) seedFromVolume(ctx context.Context, vol *gceVolume, id string) error {
+	if id == vol.Name {
+		return fmt.Errorf("a volume can't be seeded from itself")
+	}
+	src, err := d.getVolume(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if src.Path == "" {
+		if !isReadOnlyMode(src.mode) && len(d.otherUsers(src)) > 0 {
+			return &InUseError{Volume: id, Users: instanceNames(d.otherUsers(src))}
+		}
+		if _, err = d.Mount(ctx, id); err != nil {
+			return err
+		}
+		defer func() {
+			if err := d.Unmount(ctx, id); err != nil {
+				logging.FromContext(ctx).WithError(err).Warn("GCE: error unmounting seed volume")
+			}
+		}()
+		if src, err = d.getVolume(ctx, id); err != nil {
+			return err
+		}
+	}
+
+	return d.fs.Copy(ctx, src.Path, vol.Path)
+}
+
+// resumeSeed finishes creating a seeded volume whose disk was left by an earlier create. It returns false
+// if there is no such disk, so the create goes ahead.
+func (d *gceDriver) resumeSeed(ctx context.Context, id string, seed *volumeSeed) (*Volume, bool, error) {
+	disk, err := d.getDisk(ctx, id)
+	if isNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, fmt.Errorf("GCE: error getting info about disk '%s': %v", id, err)
+	}
+	if !d.inScope(disk) || disk.Labels[seedLabel] == "" {
+		// not ours to resume, creating it fails as the name is taken
+		return nil, false, nil
+	}
+
+	vol, err := d.getVolume(ctx, id)
+	if err != nil {
+		return nil, true, err
+	}
+	if disk.Labels[seedLabel] == seedDone {
+		logging.FromContext(ctx).WithFields(log.Fields{"disk": id}).Info("GCE: volume already created and seeded")
+		return &vol.Volume, true, nil
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{"disk": id}).Info("GCE: resuming seed of volume")
+	if users := d.otherUsers(vol); len(users) > 0 {
+		return nil, true, &InUseError{Volume: id, Users: instanceNames(users)}
+	}
+	if vol.Ready && vol.readOnly {
+		if err = d.detachDisk(ctx, vol); err != nil {
+			return nil, true, err
+		}
+		vol.Ready = false
+	}
+	if !vol.Ready {
+		vol.readOnly = false
+		if err = d.attachDisk(ctx, vol); err != nil {
+			return nil, true, err
+		}
+	}
+
+	// a disk which was mounted was formatted, even if the label wasn't updated
+	if disk.Labels[seedLabel] == seedPending && vol.Path == "" {
+		if err = d.formatSeedDisk(ctx, vol); err != nil {
+			return nil, true, err
+		}
+	}
+
+	if err = d.seedDisk(ctx, vol, seed); err != nil {
+		return nil, true, err
+	}
+	result, err := d.finishCreate(ctx, vol)
+	return result, true, err
+}
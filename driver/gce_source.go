@@ -0,0 +1,140 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+// growLabel marks disks whose file system is smaller than the disk until it is grown on the next read-write mount
+const growLabel = labelPrefix + "grow"
+
+// diskSource is the image, disk or snapshot a new disk is created from
+type diskSource struct {
+	image       string
+	imageFamily string
+	disk        string
+	// snapshot is only used internally, e.g. for clones
+	snapshot string
+}
+
+// isSet checks if a source is given
+func (s *diskSource) isSet() bool {
+	return s.image != "" || s.imageFamily != "" || s.disk != "" || s.snapshot != ""
+}
+
+// setSourceOption records an image, imageFamily or sourceDisk option, only one of which can be given
+func (opts *gceVolumeOptions) setSourceOption(key string, value string) error {
+	if opts.source.isSet() {
+		return fmt.Errorf("only one of image, imageFamily and sourceDisk can be given")
+	}
+	if value == "" {
+		return fmt.Errorf("a source is required")
+	}
+
+	switch key {
+	case "image":
+		opts.source.image = value
+	case "imageFamily":
+		opts.source.imageFamily = value
+	case "sourceDisk":
+		opts.source.disk = value
+	}
+	return nil
+}
+
+// applySource sets the source of a new disk, returning the size of the source in GB
+func (d *gceDriver) applySource(ctx context.Context, disk *compute.Disk, source *diskSource, regional bool) (int64, error) {
+	switch {
+	case source.image != "":
+		project, name := d.splitProject(source.image)
+		image, err := d.client.Images.Get(project, name).Context(ctx).Do()
+		if err != nil {
+			return 0, fmt.Errorf("image '%s' not found: %v", source.image, err)
+		}
+		disk.SourceImage = image.SelfLink
+		return image.DiskSizeGb, nil
+
+	case source.imageFamily != "":
+		project, family := d.splitProject(source.imageFamily)
+		image, err := d.client.Images.GetFromFamily(project, family).Context(ctx).Do()
+		if err != nil {
+			return 0, fmt.Errorf("image family '%s' not found: %v", source.imageFamily, err)
+		}
+		// keep the family rather than the image, so the insert uses whatever is newest then
+		disk.SourceImage = path.Join("projects", project, "global/images/family", family)
+		return image.DiskSizeGb, nil
+
+	case source.disk != "":
+		src, err := d.getDisk(ctx, source.disk)
+		if err != nil {
+			return 0, fmt.Errorf("source disk '%s' not found: %v", source.disk, err)
+		}
+		if !d.inScope(src) {
+			return 0, fmt.Errorf("source disk '%s' is not managed by cloudvol", source.disk)
+		}
+		if src.Labels[encryptedLabel] == "true" {
+			return 0, fmt.Errorf("source disk '%s' is encrypted with its own key and can't be cloned", source.disk)
+		}
+		if regional != (src.Region != "") {
+			return 0, fmt.Errorf("source disk '%s' must be regional if and only if the new disk is", source.disk)
+		}
+		disk.SourceDisk = src.SelfLink
+		return src.SizeGb, nil
+
+	case source.snapshot != "":
+		snapshot, err := d.client.Snapshots.Get(d.project, source.snapshot).Context(ctx).Do()
+		if err != nil {
+			return 0, fmt.Errorf("snapshot '%s' not found: %v", source.snapshot, err)
+		}
+		disk.SourceSnapshot = snapshot.SelfLink
+		return snapshot.DiskSizeGb, nil
+	}
+	return 0, nil
+}
+
+// splitProject splits an optional project prefix, e.g. debian-cloud/debian-9, from a resource name
+func (d *gceDriver) splitProject(value string) (string, string) {
+	if i := strings.Index(value, "/"); i > 0 {
+		return value[:i], value[i+1:]
+	}
+	return d.project, value
+}
+
+// growIfPending grows the file system of a disk created from a smaller source, once it is mounted read-write
+func (d *gceDriver) growIfPending(ctx context.Context, vol *gceVolume) error {
+	if !vol.growPending || vol.readOnly || vol.Path == "" {
+		return nil
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk":   vol.Name,
+		"sizeGb": vol.sizeGb,
+	}).Info("GCE: growing file system to fill disk created from a smaller source")
+
+	if err := d.fs.Grow(ctx, vol.mountDevice(), vol.Path); err != nil {
+		return fmt.Errorf("GCE: error growing file system of volume '%s': %v", vol.Name, err)
+	}
+
+	disk, err := d.getDisk(ctx, vol.Name)
+	if err != nil {
+		return fmt.Errorf("GCE: error getting info about disk '%s': %v", vol.Name, err)
+	}
+	labels := make(map[string]string, len(disk.Labels))
+	for key, value := range disk.Labels {
+		if key != growLabel {
+			labels[key] = value
+		}
+	}
+	if err = d.setDiskLabels(ctx, disk, labels); err != nil {
+		return err
+	}
+
+	vol.growPending = false
+	return nil
+}
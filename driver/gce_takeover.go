@@ -0,0 +1,110 @@
+package driver
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+// Takeover policies, which decide what happens when a disk to be mounted is attached to another instance
+const (
+	// TakeoverFail refuses to mount the disk
+	TakeoverFail = "fail"
+	// TakeoverWait waits for the other instance to release the disk
+	TakeoverWait = "wait"
+	// TakeoverForce detaches the disk from the other instance
+	TakeoverForce = "force"
+)
+
+const (
+	defaultTakeoverTimeout = time.Minute
+	takeoverPollInterval   = 2 * time.Second
+)
+
+// takeOver makes sure no other instance holds the disk, according to the configured policy
+func (d *gceDriver) takeOver(ctx context.Context, vol *gceVolume) (*gceVolume, error) {
+	owners := d.otherUsers(vol)
+	if len(owners) == 0 {
+		return vol, nil
+	}
+
+	switch d.config.Takeover {
+	case TakeoverWait:
+		return d.waitForRelease(ctx, vol)
+
+	case TakeoverForce:
+		for _, owner := range owners {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"disk":          vol.Name,
+				"previousOwner": path.Base(owner),
+			}).Warn("GCE: taking over disk from other instance")
+
+			if err := d.detachFromInstance(ctx, vol, owner); err != nil {
+				return nil, err
+			}
+		}
+		return vol, nil
+	}
+
+	return nil, &InUseError{Volume: vol.Name, Users: instanceNames(owners)}
+}
+
+// waitForRelease polls the disk until no other instance holds it, or the takeover timeout passes
+func (d *gceDriver) waitForRelease(ctx context.Context, vol *gceVolume) (*gceVolume, error) {
+	owners := d.otherUsers(vol)
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"disk":    vol.Name,
+		"owners":  instanceNames(owners),
+		"timeout": d.config.TakeoverTimeout,
+	}).Info("GCE: waiting for other instances to release disk")
+
+	for start := time.Now(); time.Since(start) < d.config.TakeoverTimeout; time.Sleep(takeoverPollInterval) {
+		current, err := d.getVolume(ctx, vol.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(d.otherUsers(current)) == 0 {
+			logging.FromContext(ctx).WithFields(log.Fields{
+				"disk":          vol.Name,
+				"previousOwner": instanceNames(owners),
+				"waited":        time.Since(start).String(),
+			}).Info("GCE: disk released by other instances")
+			return current, nil
+		}
+	}
+
+	return nil, &InUseError{Volume: vol.Name, Users: instanceNames(owners)}
+}
+
+// otherUsers gets the instances other than this one which have the disk attached
+func (d *gceDriver) otherUsers(vol *gceVolume) []string {
+	var others []string
+	for _, user := range vol.users {
+		if user != d.instanceURI {
+			others = append(others, user)
+		}
+	}
+	return others
+}
+
+// validateTakeover checks the takeover policy and fills in defaults
+func validateTakeover(config *GceConfig) error {
+	switch config.Takeover {
+	case "":
+		config.Takeover = TakeoverFail
+	case TakeoverFail, TakeoverWait, TakeoverForce:
+	default:
+		return fmt.Errorf("GCE: unknown takeover policy '%s'", config.Takeover)
+	}
+
+	if config.TakeoverTimeout <= 0 {
+		config.TakeoverTimeout = defaultTakeoverTimeout
+	}
+	return nil
+}
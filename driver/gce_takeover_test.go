@@ -0,0 +1,130 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestTakeOver(t *testing.T) {
+	otherDetach := "POST zones/" + testZone + "/instances/other/detachDisk"
+
+	tests := []struct {
+		policy   string
+		attached bool
+		released bool
+		err      bool
+		detached bool
+	}{
+		{TakeoverFail, false, false, false, false},
+		{TakeoverFail, true, false, true, false},
+		{TakeoverWait, true, true, false, false},
+		{TakeoverWait, true, false, true, false},
+		{TakeoverForce, true, false, false, true},
+	}
+
+	for _, test := range tests {
+		fake := newFakeCompute()
+		d, closeFake := newTestDriver(t, fake, GceConfig{Takeover: test.policy, TakeoverTimeout: time.Millisecond})
+
+		disk := fake.addDisk("zones/"+testZone, testDisk("data", nil))
+		other := fake.addInstance(testZone, &compute.Instance{Name: "other"})
+		if test.attached {
+			fake.attach(other, disk, attachReadWrite)
+		}
+
+		vol, err := d.getVolume(context.Background(), "data")
+		if err != nil {
+			closeFake()
+			t.Fatal(err)
+		}
+		if test.released {
+			// the other instance lets go after this instance looked at the disk
+			fake.mutex.Lock()
+			disk.Users = nil
+			other.Disks = nil
+			fake.mutex.Unlock()
+		}
+
+		result, err := d.takeOver(context.Background(), vol)
+		if test.err {
+			if _, ok := err.(*InUseError); !ok {
+				t.Errorf("%s (attached %v): expected in use error, got %v", test.policy, test.attached, err)
+			} else if users := err.(*InUseError).Users; !reflect.DeepEqual(users, []string{"other"}) {
+				t.Errorf("%s: expected users [other], got %v", test.policy, users)
+			}
+		} else if err != nil {
+			t.Errorf("%s (attached %v): unexpected error: %v", test.policy, test.attached, err)
+		} else if result == nil {
+			t.Errorf("%s (attached %v): expected a volume", test.policy, test.attached)
+		}
+
+		if detached := fake.called(otherDetach); detached != test.detached {
+			t.Errorf("%s (attached %v): expected detach %v, got %v", test.policy, test.attached, test.detached, detached)
+		}
+		if test.detached && len(fake.disk("zones/"+testZone+"/disks/data").Users) != 0 {
+			t.Errorf("%s: expected the disk to be detached from the other instance", test.policy)
+		}
+		closeFake()
+	}
+}
+
+func TestOtherUsers(t *testing.T) {
+	d := &gceDriver{instanceURI: testLink("zones/" + testZone + "/instances/" + testInstance)}
+	other := testLink("zones/us-central1-b/instances/other")
+
+	tests := []struct {
+		users  []string
+		others []string
+	}{
+		{nil, nil},
+		{[]string{d.instanceURI}, nil},
+		{[]string{other}, []string{other}},
+		{[]string{d.instanceURI, other}, []string{other}},
+	}
+
+	for _, test := range tests {
+		others := d.otherUsers(&gceVolume{users: test.users})
+		if !reflect.DeepEqual(others, test.others) {
+			t.Errorf("%v: expected %v, got %v", test.users, test.others, others)
+		}
+	}
+}
+
+func TestValidateTakeover(t *testing.T) {
+	tests := []struct {
+		policy  string
+		timeout time.Duration
+		valid   bool
+		result  string
+		waits   time.Duration
+	}{
+		{"", 0, true, TakeoverFail, defaultTakeoverTimeout},
+		{TakeoverFail, 0, true, TakeoverFail, defaultTakeoverTimeout},
+		{TakeoverWait, 5 * time.Minute, true, TakeoverWait, 5 * time.Minute},
+		{TakeoverForce, -time.Second, true, TakeoverForce, defaultTakeoverTimeout},
+		{"steal", 0, false, "", 0},
+		{"Force", 0, false, "", 0},
+	}
+
+	for _, test := range tests {
+		config := GceConfig{Takeover: test.policy, TakeoverTimeout: test.timeout}
+		err := validateTakeover(&config)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("'%s': expected error", test.policy)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %v", test.policy, err)
+			continue
+		}
+		if config.Takeover != test.result || config.TakeoverTimeout != test.waits {
+			t.Errorf("'%s': expected %s after %v, got %s after %v", test.policy, test.result, test.waits, config.Takeover, config.TakeoverTimeout)
+		}
+	}
+}
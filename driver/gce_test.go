@@ -0,0 +1,452 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stugotech/cloudvol2/fs"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	testProject  = "test-project"
+	testZone     = "us-central1-a"
+	testRegion   = "us-central1"
+	testInstance = "test-instance"
+	testLinkBase = "https://www.googleapis.com/compute/v1/projects/" + testProject + "/"
+)
+
+// fakeCollections create the resources of the collections the fake compute API serves
+var fakeCollections = map[string]func() interface{}{
+	"disks":        func() interface{} { return &compute.Disk{} },
+	"instances":    func() interface{} { return &compute.Instance{} },
+	"snapshots":    func() interface{} { return &compute.Snapshot{} },
+	"machineTypes": func() interface{} { return &compute.MachineType{} },
+	"diskTypes":    func() interface{} { return &compute.DiskType{} },
+	"regions":      func() interface{} { return &compute.Region{} },
+	"operations":   func() interface{} { return &compute.Operation{} },
+}
+
+// fakeCompute is a compute API stand-in for a single project, holding resources by their path below the
+// project, e.g. zones/<zone>/disks/<name>; every operation it starts is done by the time it answers
+type fakeCompute struct {
+	mutex      sync.Mutex
+	resources  map[string]interface{}
+	operations int
+	// snapshotStatus is the status of new snapshots, READY if empty
+	snapshotStatus string
+	// calls are the method and resource path of every request made
+	calls []string
+}
+
+func newFakeCompute() *fakeCompute {
+	return &fakeCompute{resources: make(map[string]interface{})}
+}
+
+// testLink builds the self link of a resource from its path below the project
+func testLink(resource string) string {
+	return testLinkBase + resource
+}
+
+// testDisk builds a disk managed by a driver with the default scope
+func testDisk(name string, labels map[string]string) *compute.Disk {
+	disk := &compute.Disk{Name: name, SizeGb: 10, Status: diskReady, Labels: map[string]string{"managed-by": "cloudvol"}}
+	for key, value := range labels {
+		disk.Labels[key] = value
+	}
+	return disk
+}
+
+// addDisk adds a disk in a location, zones/<zone> or regions/<region>, and returns it
+func (f *fakeCompute) addDisk(location string, disk *compute.Disk) *compute.Disk {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.store(location+"/disks", disk)
+	return disk
+}
+
+// addInstance adds an instance in a zone and returns it
+func (f *fakeCompute) addInstance(zone string, instance *compute.Instance) *compute.Instance {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.store("zones/"+zone+"/instances", instance)
+	return instance
+}
+
+// instance gets an instance by zone and name, nil if it doesn't exist
+func (f *fakeCompute) instance(zone string, name string) *compute.Instance {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	instance, _ := f.resources["zones/"+zone+"/instances/"+name].(*compute.Instance)
+	return instance
+}
+
+// add adds any other resource to a collection
+func (f *fakeCompute) add(collection string, resource interface{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.store(collection, resource)
+}
+
+// attach attaches a disk to an instance in the given mode
+func (f *fakeCompute) attach(instance *compute.Instance, disk *compute.Disk, mode string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	instance.Disks = append(instance.Disks, &compute.AttachedDisk{DeviceName: disk.Name, Source: disk.SelfLink, Mode: mode})
+	disk.Users = append(disk.Users, instance.SelfLink)
+}
+
+// disk gets a disk by its path, nil if it doesn't exist
+func (f *fakeCompute) disk(resource string) *compute.Disk {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	disk, _ := f.resources[resource].(*compute.Disk)
+	return disk
+}
+
+// snapshot gets a snapshot by name, nil if it doesn't exist
+func (f *fakeCompute) snapshot(name string) *compute.Snapshot {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	snapshot, _ := f.resources["global/snapshots/"+name].(*compute.Snapshot)
+	return snapshot
+}
+
+// has checks if a resource exists
+func (f *fakeCompute) has(resource string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.resources[resource] != nil
+}
+
+// called checks if a request was made for a resource path, e.g. "POST zones/<zone>/instances/<name>/detachDisk"
+func (f *fakeCompute) called(call string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return stringInSlice(f.calls, call)
+}
+
+// store adds a resource to a collection, filling in the fields the API sets; it must be called with mutex held
+func (f *fakeCompute) store(collection string, resource interface{}) string {
+	name := nameOf(resource)
+	location := path.Dir(collection)
+
+	switch r := resource.(type) {
+	case *compute.Disk:
+		r.SelfLink = testLink(collection + "/" + name)
+		if strings.HasPrefix(location, "regions/") {
+			r.Region = testLink(location)
+		} else {
+			r.Zone = testLink(location)
+		}
+		if r.Status == "" {
+			r.Status = diskReady
+		}
+	case *compute.Instance:
+		r.SelfLink = testLink(collection + "/" + name)
+		r.Zone = testLink(location)
+	case *compute.Snapshot:
+		r.SelfLink = testLink(collection + "/" + name)
+		if r.Status == "" {
+			r.Status = snapshotReady
+		}
+	case *compute.DiskType:
+		r.SelfLink = testLink(collection + "/" + name)
+	}
+
+	key := collection + "/" + name
+	f.resources[key] = resource
+	return key
+}
+
+func (f *fakeCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the base path of older API versions ends in projects/, newer ones add it to every path
+	resource := strings.TrimPrefix(r.URL.Path, "/")
+	resource = strings.TrimPrefix(resource, "projects/")
+	if !strings.HasPrefix(resource, testProject+"/") {
+		writeAPIError(w, http.StatusNotFound, "unknown project")
+		return
+	}
+	resource = strings.TrimPrefix(resource, testProject+"/")
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls = append(f.calls, r.Method+" "+resource)
+
+	parts := strings.Split(resource, "/")
+	last := parts[len(parts)-1]
+	switch {
+	case fakeCollections[last] != nil:
+		f.serveCollection(w, r, resource, last)
+	case len(parts) > 1 && parts[len(parts)-2] == "operations":
+		writeJSON(w, &compute.Operation{Name: last, Status: "DONE"})
+	case len(parts) > 1 && fakeCollections[parts[len(parts)-2]] != nil:
+		f.serveResource(w, r, resource)
+	default:
+		f.serveAction(w, r, path.Dir(resource), last)
+	}
+}
+
+// serveCollection lists or inserts the resources of a collection
+func (f *fakeCompute) serveCollection(w http.ResponseWriter, r *http.Request, collection string, kind string) {
+	switch r.Method {
+	case http.MethodGet:
+		var keys []string
+		for key := range f.resources {
+			if path.Dir(key) == collection {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		items := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			items = append(items, f.resources[key])
+		}
+		writeJSON(w, map[string]interface{}{"items": items})
+
+	case http.MethodPost:
+		resource := fakeCollections[kind]()
+		if err := json.NewDecoder(r.Body).Decode(resource); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		key := collection + "/" + nameOf(resource)
+		if _, exists := f.resources[key]; exists {
+			writeAPIError(w, http.StatusConflict, fmt.Sprintf("resource '%s' already exists", key))
+			return
+		}
+		f.store(collection, resource)
+		f.writeOperation(w, key)
+
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, r.Method)
+	}
+}
+
+// serveResource gets or deletes a resource
+func (f *fakeCompute) serveResource(w http.ResponseWriter, r *http.Request, key string) {
+	resource, exists := f.resources[key]
+	if !exists {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("resource '%s' not found", key))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, resource)
+	case http.MethodDelete:
+		delete(f.resources, key)
+		f.writeOperation(w, key)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, r.Method)
+	}
+}
+
+// serveAction runs a custom method of a disk or instance
+func (f *fakeCompute) serveAction(w http.ResponseWriter, r *http.Request, key string, action string) {
+	resource, exists := f.resources[key]
+	if !exists {
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("resource '%s' not found", key))
+		return
+	}
+
+	var err error
+	switch target := resource.(type) {
+	case *compute.Disk:
+		err = f.diskAction(r, target, action)
+	case *compute.Instance:
+		err = f.instanceAction(r, target, action)
+	case *compute.Snapshot:
+		err = f.snapshotAction(r, target, action)
+	default:
+		err = fmt.Errorf("unknown action '%s'", action)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.writeOperation(w, key)
+}
+
+func (f *fakeCompute) diskAction(r *http.Request, disk *compute.Disk, action string) error {
+	switch action {
+	case "setLabels":
+		var req compute.ZoneSetLabelsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+		if req.LabelFingerprint != disk.LabelFingerprint {
+			return fmt.Errorf("label fingerprint of disk '%s' doesn't match", disk.Name)
+		}
+		disk.Labels = req.Labels
+		disk.LabelFingerprint = fmt.Sprintf("fingerprint-%d", f.operations)
+	case "resize":
+		var req compute.DisksResizeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return err
+		}
+		disk.SizeGb = req.SizeGb
+	case "createSnapshot":
+		snapshot := &compute.Snapshot{}
+		if err := json.NewDecoder(r.Body).Decode(snapshot); err != nil {
+			return err
+		}
+		snapshot.SourceDisk = disk.SelfLink
+		snapshot.DiskSizeGb = disk.SizeGb
+		snapshot.Status = f.snapshotStatus
+		f.store("global/snapshots", snapshot)
+	default:
+		return fmt.Errorf("unknown disk action '%s'", action)
+	}
+	return nil
+}
+
+func (f *fakeCompute) instanceAction(r *http.Request, instance *compute.Instance, action string) error {
+	switch action {
+	case "attachDisk":
+		attachment := &compute.AttachedDisk{}
+		if err := json.NewDecoder(r.Body).Decode(attachment); err != nil {
+			return err
+		}
+		disk, ok := f.resources[strings.TrimPrefix(attachment.Source, testLinkBase)].(*compute.Disk)
+		if !ok {
+			return fmt.Errorf("disk '%s' not found", attachment.Source)
+		}
+		instance.Disks = append(instance.Disks, attachment)
+		disk.Users = append(disk.Users, instance.SelfLink)
+	case "detachDisk":
+		device := r.URL.Query().Get("deviceName")
+		var kept []*compute.AttachedDisk
+		for _, attachment := range instance.Disks {
+			if attachment.DeviceName != device {
+				kept = append(kept, attachment)
+				continue
+			}
+			if disk, ok := f.resources[strings.TrimPrefix(attachment.Source, testLinkBase)].(*compute.Disk); ok {
+				disk.Users = removeString(disk.Users, instance.SelfLink)
+			}
+		}
+		if len(kept) == len(instance.Disks) {
+			return fmt.Errorf("no disk '%s' attached to instance '%s'", device, instance.Name)
+		}
+		instance.Disks = kept
+	default:
+		return fmt.Errorf("unknown instance action '%s'", action)
+	}
+	return nil
+}
+
+func (f *fakeCompute) snapshotAction(r *http.Request, snapshot *compute.Snapshot, action string) error {
+	if action != "setLabels" {
+		return fmt.Errorf("unknown snapshot action '%s'", action)
+	}
+	var req compute.GlobalSetLabelsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if req.LabelFingerprint != snapshot.LabelFingerprint {
+		return fmt.Errorf("label fingerprint of snapshot '%s' doesn't match", snapshot.Name)
+	}
+	snapshot.Labels = req.Labels
+	snapshot.LabelFingerprint = fmt.Sprintf("fingerprint-%d", f.operations)
+	return nil
+}
+
+// writeOperation answers with a finished operation on a resource
+func (f *fakeCompute) writeOperation(w http.ResponseWriter, key string) {
+	f.operations++
+	op := &compute.Operation{
+		Name:       fmt.Sprintf("operation-%d", f.operations),
+		Status:     "DONE",
+		TargetLink: testLink(key),
+	}
+	switch parts := strings.Split(key, "/"); parts[0] {
+	case "zones":
+		op.Zone = testLink(path.Join(parts[0], parts[1]))
+	case "regions":
+		op.Region = testLink(path.Join(parts[0], parts[1]))
+	}
+	writeJSON(w, op)
+}
+
+// nameOf gets the name of a resource, which every compute API resource has
+func nameOf(resource interface{}) string {
+	return reflect.ValueOf(resource).Elem().FieldByName("Name").String()
+}
+
+func removeString(slice []string, target string) []string {
+	var kept []string
+	for _, s := range slice {
+		if s != target {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message},
+	})
+}
+
+// newTestDriver creates a driver running on test-instance which uses the fake compute API, the returned
+// function shuts the fake down
+func newTestDriver(t *testing.T, fake *fakeCompute, config GceConfig) (*gceDriver, func()) {
+	server := httptest.NewServer(fake)
+	client, err := compute.New(http.DefaultClient)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	client.BasePath = server.URL + "/"
+
+	if config.MountDirMode == 0 {
+		config.MountDirMode = DefaultMountDirMode
+	}
+	if err = validateTakeover(&config); err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	scope, err := scopeLabels(&config)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	instance := fake.addInstance(testZone, &compute.Instance{Name: testInstance, MachineType: testLink("zones/" + testZone + "/machineTypes/n1-standard-1")})
+	filesystem := fs.NewFilesystem()
+
+	d := &gceDriver{
+		fs:          filesystem,
+		client:      client,
+		project:     testProject,
+		zone:        testZone,
+		region:      testRegion,
+		instance:    testInstance,
+		instanceURI: instance.SelfLink,
+		mountPath:   "/mnt/cloudvol",
+		config:      config,
+		scope:       scope,
+		crypt:       newEncryption(filesystem, config.Keys),
+
+		scheduleErrors: newScheduleErrors(),
+		holds:          newVolumeHolds(),
+	}
+	return d, server.Close
+}
@@ -0,0 +1,227 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/fs"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+const (
+	// FreezeOption is the volume option which freezes the file system while it is snapshotted
+	FreezeOption = "fsfreeze"
+	// SnapshotHookOption is the volume option which selects the hook run around snapshots
+	SnapshotHookOption = "snapshotHook"
+
+	defaultFreezeTimeout = time.Minute
+	defaultHookTimeout   = 5 * time.Minute
+	thawTimeout          = 30 * time.Second
+)
+
+// SnapshotHook is a pair of commands run on the instance a volume is mounted on before and after it is
+// snapshotted, e.g. to flush and lock a database. The commands get the CLOUDVOL_VOLUME, CLOUDVOL_MOUNTPOINT
+// and CLOUDVOL_SNAPSHOT environment variables.
+type SnapshotHook struct {
+	Description string   `json:"description,omitempty"`
+	Pre         []string `json:"pre,omitempty"`
+	// Post runs after the snapshot, even if Pre or the snapshot failed or the request was cancelled, so it
+	// can always undo Pre
+	Post []string `json:"post,omitempty"`
+	// Timeout limits each command, as a duration such as "30s"
+	Timeout string `json:"timeout,omitempty"`
+
+	timeout time.Duration
+}
+
+// SnapshotHooks are the hooks volumes can select and the limit on how long file systems stay frozen
+type SnapshotHooks struct {
+	Hooks map[string]*SnapshotHook `json:"snapshotHooks,omitempty"`
+	// FreezeTimeout is the longest a file system stays frozen, it is thawed when it expires even if
+	// the snapshot hasn't been captured
+	FreezeTimeout string `json:"freezeTimeout,omitempty"`
+
+	freezeTimeout time.Duration
+}
+
+// Names gets the hook names in order
+func (h *SnapshotHooks) Names() []string {
+	if h == nil {
+		return nil
+	}
+	names := make([]string, 0, len(h.Hooks))
+	for name := range h.Hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks the hooks and parses their timeouts
+func (h *SnapshotHooks) Validate() error {
+	if h == nil {
+		return nil
+	}
+
+	var err error
+	if h.freezeTimeout, err = parseTimeout(h.FreezeTimeout, defaultFreezeTimeout); err != nil {
+		return fmt.Errorf("invalid freeze timeout: %v", err)
+	}
+
+	for _, name := range h.Names() {
+		hook := h.Hooks[name]
+		if !labelValuePattern.MatchString(name) || name == "" {
+			return fmt.Errorf("invalid snapshot hook name '%s', use lowercase letters, digits, '-' and '_'", name)
+		}
+		if len(hook.Pre) == 0 && len(hook.Post) == 0 {
+			return fmt.Errorf("snapshot hook '%s' has no commands", name)
+		}
+		if hook.timeout, err = parseTimeout(hook.Timeout, defaultHookTimeout); err != nil {
+			return fmt.Errorf("invalid timeout of snapshot hook '%s': %v", name, err)
+		}
+	}
+	return nil
+}
+
+// find gets a hook by name, nil if there isn't one
+func (h *SnapshotHooks) find(name string) *SnapshotHook {
+	if h == nil || name == "" {
+		return nil
+	}
+	return h.Hooks[name]
+}
+
+// getFreezeTimeout gets the freeze timeout, which has a default when there is no hook config
+func (h *SnapshotHooks) getFreezeTimeout() time.Duration {
+	if h == nil || h.freezeTimeout == 0 {
+		return defaultFreezeTimeout
+	}
+	return h.freezeTimeout
+}
+
+// parseTimeout parses a positive duration, an empty value gives the default
+func parseTimeout(value string, defaultTimeout time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("%v isn't a positive duration", timeout)
+	}
+	return timeout, nil
+}
+
+// consistentSnapshot runs a snapshot function between a volume's pre and post hooks and, if freeze is
+// set, with its file system frozen. The capture function starts the snapshot and returns once the
+// snapshot no longer needs the file system frozen; the file system is thawed when it returns or when
+// the freeze timeout expires, whichever is first.
+type consistentSnapshot struct {
+	fs            fs.Filesystem
+	volume        string
+	mountPoint    string
+	snapshot      string
+	hook          *SnapshotHook
+	freeze        bool
+	freezeTimeout time.Duration
+}
+
+// run takes the snapshot with the capture function
+func (c *consistentSnapshot) run(ctx context.Context, capture func(ctx context.Context) error) (err error) {
+	if c.hook != nil {
+		defer func() {
+			// run post even if the request has been cancelled, it is still limited by the hook timeout
+			postCtx := logging.WithRequestID(context.Background(), logging.RequestID(ctx))
+			if postErr := c.runHook(postCtx, "post", c.hook.Post); postErr != nil && err == nil {
+				err = postErr
+			}
+		}()
+		if err = c.runHook(ctx, "pre", c.hook.Pre); err != nil {
+			return err
+		}
+	}
+
+	if !c.freeze {
+		return capture(ctx)
+	}
+
+	thaw, err := c.freezeFor(ctx, c.freezeTimeout)
+	if err != nil {
+		return err
+	}
+	defer thaw()
+
+	captureCtx, cancel := context.WithTimeout(ctx, c.freezeTimeout)
+	defer cancel()
+	return capture(captureCtx)
+}
+
+// freezeFor freezes the file system and returns a function which thaws it, the file system is also
+// thawed when the timeout expires
+func (c *consistentSnapshot) freezeFor(ctx context.Context, timeout time.Duration) (func(), error) {
+	logger := logging.FromContext(ctx).WithFields(log.Fields{"volume": c.volume, "mountpoint": c.mountPoint})
+
+	var once sync.Once
+	thaw := func() {
+		once.Do(func() {
+			// thaw even if the request has been cancelled
+			thawCtx, cancel := context.WithTimeout(logging.WithRequestID(context.Background(), logging.RequestID(ctx)), thawTimeout)
+			defer cancel()
+			if err := c.fs.Thaw(thawCtx, c.mountPoint); err != nil {
+				logger.WithError(err).Error("error thawing file system")
+			} else {
+				logger.Info("thawed file system")
+			}
+		})
+	}
+
+	freezeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logger.Info("freezing file system")
+	if err := c.fs.Freeze(freezeCtx, c.mountPoint); err != nil {
+		// the freeze may have taken effect before it timed out
+		thaw()
+		return nil, fmt.Errorf("error freezing file system of volume '%s': %v", c.volume, err)
+	}
+
+	timer := time.AfterFunc(timeout, func() {
+		logger.WithFields(log.Fields{"timeout": timeout}).Warn("file system frozen for too long, thawing before the snapshot was captured")
+		thaw()
+	})
+	return func() {
+		timer.Stop()
+		// waits for the timer's thaw if it is running
+		thaw()
+	}, nil
+}
+
+// runHook runs one of the hook's commands
+func (c *consistentSnapshot) runHook(ctx context.Context, stage string, command []string) error {
+	if len(command) == 0 {
+		return nil
+	}
+
+	logger := logging.FromContext(ctx).WithFields(log.Fields{"volume": c.volume, "stage": stage})
+	logger.Info("running snapshot hook")
+
+	hookCtx, cancel := context.WithTimeout(ctx, c.hook.timeout)
+	defer cancel()
+
+	output, err := c.fs.Run(hookCtx, []string{
+		"CLOUDVOL_VOLUME=" + c.volume,
+		"CLOUDVOL_MOUNTPOINT=" + c.mountPoint,
+		"CLOUDVOL_SNAPSHOT=" + c.snapshot,
+	}, command...)
+	if err != nil {
+		return fmt.Errorf("%s snapshot hook of volume '%s' failed: %v", stage, c.volume, err)
+	}
+	logger.WithFields(log.Fields{"output": output}).Debug("snapshot hook finished")
+	return nil
+}
@@ -0,0 +1,237 @@
+package driver
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestSnapshotHooksValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		hooks *SnapshotHooks
+		valid bool
+	}{
+		{"none", nil, true},
+		{"empty", &SnapshotHooks{}, true},
+		{"hook", &SnapshotHooks{Hooks: map[string]*SnapshotHook{"mysql": {Pre: []string{"lock"}, Post: []string{"unlock"}, Timeout: "30s"}}}, true},
+		{"post only", &SnapshotHooks{Hooks: map[string]*SnapshotHook{"flush": {Post: []string{"sync"}}}}, true},
+		{"no commands", &SnapshotHooks{Hooks: map[string]*SnapshotHook{"empty": {}}}, false},
+		{"bad name", &SnapshotHooks{Hooks: map[string]*SnapshotHook{"MySQL": {Pre: []string{"lock"}}}}, false},
+		{"bad timeout", &SnapshotHooks{Hooks: map[string]*SnapshotHook{"mysql": {Pre: []string{"lock"}, Timeout: "soon"}}}, false},
+		{"freeze timeout", &SnapshotHooks{FreezeTimeout: "10s"}, true},
+		{"negative freeze timeout", &SnapshotHooks{FreezeTimeout: "-10s"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.hooks.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected error", test.name)
+		}
+	}
+
+	hooks := &SnapshotHooks{FreezeTimeout: "10s", Hooks: map[string]*SnapshotHook{
+		"b": {Pre: []string{"true"}},
+		"a": {Pre: []string{"true"}, Timeout: "1m"},
+	}}
+	if err := hooks.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if timeout := hooks.getFreezeTimeout(); timeout != 10*time.Second {
+		t.Errorf("expected freeze timeout 10s, got %v", timeout)
+	}
+	if hooks.find("a").timeout != time.Minute || hooks.find("b").timeout != defaultHookTimeout {
+		t.Errorf("unexpected hook timeouts %v, %v", hooks.find("a").timeout, hooks.find("b").timeout)
+	}
+	if names := hooks.Names(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("expected names [a b], got %v", names)
+	}
+
+	var none *SnapshotHooks
+	if none.find("a") != nil || none.getFreezeTimeout() != defaultFreezeTimeout {
+		t.Errorf("expected no hooks and the default freeze timeout without a config")
+	}
+}
+
+func TestConsistentSnapshot(t *testing.T) {
+	hook := &SnapshotHook{Pre: []string{"lock", "tables"}, Post: []string{"unlock"}, timeout: time.Minute}
+	failure := errors.New("failed")
+
+	tests := []struct {
+		name       string
+		hook       *SnapshotHook
+		freeze     bool
+		fail       string
+		captureErr error
+		calls      string
+	}{
+		{
+			"freeze", nil, true, "", nil,
+			"Freeze /mnt/data live; Capture; Thaw /mnt/data live",
+		},
+		{
+			"hook and freeze", hook, true, "", nil,
+			"Run lock tables live; Freeze /mnt/data live; Capture; Thaw /mnt/data live; Run unlock live",
+		},
+		{
+			// read-only file systems can't be frozen
+			"hook only", hook, false, "", nil,
+			"Run lock tables live; Capture; Run unlock live",
+		},
+		{
+			// post undoes whatever pre managed to do
+			"pre fails", hook, true, "Run", nil,
+			"Run lock tables live; Run unlock live",
+		},
+		{
+			// a freeze which timed out may still have taken effect
+			"freeze fails", hook, true, "Freeze", nil,
+			"Run lock tables live; Freeze /mnt/data live; Thaw /mnt/data live; Run unlock live",
+		},
+		{
+			"capture fails", hook, true, "", failure,
+			"Run lock tables live; Freeze /mnt/data live; Capture; Thaw /mnt/data live; Run unlock live",
+		},
+	}
+
+	for _, test := range tests {
+		filesystem := newFakeFilesystem()
+		if test.fail != "" {
+			filesystem.failures[test.fail] = failure
+		}
+		snapshot := &consistentSnapshot{
+			fs:            filesystem,
+			volume:        "data",
+			mountPoint:    "/mnt/data",
+			snapshot:      "data-snap",
+			hook:          test.hook,
+			freeze:        test.freeze,
+			freezeTimeout: time.Minute,
+		}
+
+		err := snapshot.run(context.Background(), func(ctx context.Context) error {
+			filesystem.record("Capture")
+			return test.captureErr
+		})
+		if (err != nil) != (test.fail != "" || test.captureErr != nil) {
+			t.Errorf("%s: unexpected result %v", test.name, err)
+		}
+		if calls := filesystem.recorded(); calls != test.calls {
+			t.Errorf("%s: expected calls '%s', got '%s'", test.name, test.calls, calls)
+		}
+	}
+}
+
+func TestConsistentSnapshotHookEnv(t *testing.T) {
+	filesystem := newFakeFilesystem()
+	snapshot := &consistentSnapshot{
+		fs:         filesystem,
+		volume:     "data",
+		mountPoint: "/mnt/data",
+		snapshot:   "data-snap",
+		hook:       &SnapshotHook{Pre: []string{"lock"}, timeout: time.Minute},
+	}
+	if err := snapshot.run(context.Background(), func(ctx context.Context) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"CLOUDVOL_VOLUME=data", "CLOUDVOL_MOUNTPOINT=/mnt/data", "CLOUDVOL_SNAPSHOT=data-snap"}
+	if !reflect.DeepEqual(filesystem.env, expected) {
+		t.Errorf("expected environment %v, got %v", expected, filesystem.env)
+	}
+}
+
+func TestConsistentSnapshotThawOnTimeout(t *testing.T) {
+	filesystem := newFakeFilesystem()
+	snapshot := &consistentSnapshot{
+		fs:            filesystem,
+		volume:        "data",
+		mountPoint:    "/mnt/data",
+		snapshot:      "data-snap",
+		freeze:        true,
+		freezeTimeout: 20 * time.Millisecond,
+	}
+
+	// a capture which never finishes mustn't keep the file system frozen
+	var thawedDuringCapture bool
+	err := snapshot.run(context.Background(), func(ctx context.Context) error {
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			if strings.Contains(filesystem.recorded(), "Thaw") {
+				thawedDuringCapture = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !thawedDuringCapture {
+		t.Errorf("expected the file system to be thawed when the freeze timeout expired")
+	}
+	// the thaw when the capture returns doesn't thaw again
+	if calls := filesystem.recorded(); calls != "Freeze /mnt/data live; Thaw /mnt/data live" {
+		t.Errorf("unexpected calls '%s'", calls)
+	}
+}
+
+func TestConsistentSnapshotCancel(t *testing.T) {
+	filesystem := newFakeFilesystem()
+	snapshot := &consistentSnapshot{
+		fs:            filesystem,
+		volume:        "data",
+		mountPoint:    "/mnt/data",
+		snapshot:      "data-snap",
+		hook:          &SnapshotHook{Pre: []string{"lock"}, Post: []string{"unlock"}, timeout: time.Minute},
+		freeze:        true,
+		freezeTimeout: time.Minute,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := snapshot.run(ctx, func(ctx context.Context) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.Canceled {
+		t.Errorf("expected the cancellation, got %v", err)
+	}
+
+	// the thaw and post hook get a context of their own
+	expected := "Run lock live; Freeze /mnt/data live; Thaw /mnt/data live; Run unlock live"
+	if calls := filesystem.recorded(); calls != expected {
+		t.Errorf("expected calls '%s', got '%s'", expected, calls)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := []struct {
+		value   string
+		timeout time.Duration
+		valid   bool
+	}{
+		{"", time.Hour, true},
+		{"90s", 90 * time.Second, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"0s", 0, false},
+		{"-1m", 0, false},
+		{"10", 0, false},
+	}
+
+	for _, test := range tests {
+		timeout, err := parseTimeout(test.value, time.Hour)
+		if test.valid && (err != nil || timeout != test.timeout) {
+			t.Errorf("'%s': expected %v, got %v, %v", test.value, test.timeout, timeout, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("'%s': expected error", test.value)
+		}
+	}
+}
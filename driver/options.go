@@ -0,0 +1,139 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// OptionType is the type of the value of a volume option
+type OptionType string
+
+// Volume option types
+const (
+	OptionString OptionType = "string"
+	OptionInt    OptionType = "int"
+	OptionBool   OptionType = "bool"
+	OptionEnum   OptionType = "enum"
+)
+
+// Option describes a volume option accepted by a driver
+type Option struct {
+	// Name of the option, or its prefix if Prefix is set
+	Name string
+	// Prefix makes the option match every name starting with Name, e.g. label.<key>
+	Prefix bool
+	Type   OptionType
+	// Min and Max bound the value of int options, zero is unbounded
+	Min int64
+	Max int64
+	// Values are the allowed values of enum options
+	Values []string
+	// Default is the value used when the option isn't given, empty if there is none
+	Default     string
+	Description string
+}
+
+// Schema is the set of volume options a driver accepts
+type Schema []*Option
+
+// Describer is implemented by drivers which can list the volume options they accept
+type Describer interface {
+	// Options gets the schema of the volume options
+	Options() Schema
+}
+
+// OptionsError reports every invalid volume option given in a request
+type OptionsError struct {
+	Problems []string
+}
+
+func (e *OptionsError) Error() string {
+	return fmt.Sprintf("invalid volume options: %s", strings.Join(e.Problems, "; "))
+}
+
+// add records a problem with an option
+func (e *OptionsError) add(key string, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf("option '%s': %s", key, fmt.Sprintf(format, args...)))
+}
+
+// orNil gets the error if any problem was recorded
+func (e *OptionsError) orNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Find gets the option which matches a name
+func (s Schema) Find(name string) *Option {
+	for _, opt := range s {
+		if opt.Name == name || (opt.Prefix && strings.HasPrefix(name, opt.Name) && len(name) > len(opt.Name)) {
+			return opt
+		}
+	}
+	return nil
+}
+
+// check validates the options against the schema, recording every problem and returning the
+// names of the valid options in order
+func (s Schema) check(opts map[string]string, problems *OptionsError) []string {
+	keys := make([]string, 0, len(opts))
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	valid := keys[:0]
+	for _, key := range keys {
+		opt := s.Find(key)
+		if opt == nil {
+			problems.add(key, "unknown option")
+			continue
+		}
+		if err := opt.check(opts[key]); err != nil {
+			problems.add(key, "%v", err)
+			continue
+		}
+		valid = append(valid, key)
+	}
+	return valid
+}
+
+// check validates a value against the type of an option
+func (o *Option) check(value string) error {
+	switch o.Type {
+	case OptionInt:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got '%s'", value)
+		}
+		if (o.Min != 0 && n < o.Min) || (o.Max != 0 && n > o.Max) {
+			return fmt.Errorf("%d is outside the range %s", n, o.rangeString())
+		}
+	case OptionBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("expected true or false, got '%s'", value)
+		}
+	case OptionEnum:
+		for _, allowed := range o.Values {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s, got '%s'", strings.Join(o.Values, ", "), value)
+	}
+	return nil
+}
+
+// rangeString formats the range of an int option
+func (o *Option) rangeString() string {
+	switch {
+	case o.Max == 0:
+		return fmt.Sprintf("%d and up", o.Min)
+	case o.Min == 0:
+		return fmt.Sprintf("up to %d", o.Max)
+	}
+	return fmt.Sprintf("%d-%d", o.Min, o.Max)
+}
@@ -0,0 +1,103 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOptionCheck(t *testing.T) {
+	size := &Option{Name: "sizeGb", Type: OptionInt, Min: 10, Max: 100}
+	count := &Option{Name: "count", Type: OptionInt}
+	flag := &Option{Name: "flag", Type: OptionBool}
+	mode := &Option{Name: "mode", Type: OptionEnum, Values: []string{"rw", "ro"}}
+	name := &Option{Name: "name", Type: OptionString}
+
+	tests := []struct {
+		option *Option
+		value  string
+		valid  bool
+	}{
+		{size, "10", true},
+		{size, "100", true},
+		{size, "9", false},
+		{size, "101", false},
+		{size, "ten", false},
+		{count, "-5", true},
+		{count, "1.5", false},
+		{flag, "true", true},
+		{flag, "0", true},
+		{flag, "yes", false},
+		{mode, "ro", true},
+		{mode, "RO", false},
+		{mode, "", false},
+		{name, "", true},
+		{name, "anything at all", true},
+	}
+
+	for _, test := range tests {
+		err := test.option.check(test.value)
+		if test.valid && err != nil {
+			t.Errorf("%s=%s: unexpected error: %v", test.option.Name, test.value, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s=%s: expected an error", test.option.Name, test.value)
+		}
+	}
+}
+
+func TestOptionRange(t *testing.T) {
+	tests := []struct {
+		min, max int64
+		expected string
+	}{
+		{10, 100, "10-100"},
+		{10, 0, "10 and up"},
+		{0, 100, "up to 100"},
+	}
+	for _, test := range tests {
+		o := &Option{Type: OptionInt, Min: test.min, Max: test.max}
+		if r := o.rangeString(); r != test.expected {
+			t.Errorf("expected '%s', got '%s'", test.expected, r)
+		}
+	}
+}
+
+func TestSchemaCheck(t *testing.T) {
+	schema := Schema{
+		{Name: "sizeGb", Type: OptionInt, Min: 1},
+		{Name: "type", Type: OptionString},
+		{Name: labelOptionPrefix, Prefix: true, Type: OptionString},
+	}
+	opts := map[string]string{
+		"type":                    "pd-ssd",
+		"sizeGb":                  "0",
+		"label.team":              "storage",
+		"unknown":                 "value",
+		labelOptionPrefix + "env": "prod",
+	}
+
+	problems := &OptionsError{}
+	valid := schema.check(opts, problems)
+
+	expected := []string{"label.env", "label.team", "type"}
+	if strings.Join(valid, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected valid options %v, got %v", expected, valid)
+	}
+	if len(problems.Problems) != 2 {
+		t.Fatalf("expected 2 problems, got %v", problems.Problems)
+	}
+	for i, key := range []string{"sizeGb", "unknown"} {
+		if !strings.HasPrefix(problems.Problems[i], "option '"+key+"'") {
+			t.Errorf("expected a problem with '%s', got '%s'", key, problems.Problems[i])
+		}
+	}
+	if problems.orNil() == nil {
+		t.Errorf("expected an error")
+	}
+
+	if valid := schema.check(map[string]string{"type": "pd-ssd"}, &OptionsError{}); len(valid) != 1 {
+		t.Errorf("expected the option to be valid, got %v", valid)
+	}
+	if err := (&OptionsError{}).orNil(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
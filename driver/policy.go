@@ -0,0 +1,199 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Policy limits the volumes users can create, it is checked before a volume is created, grown or relabelled
+type Policy struct {
+	// MaxSizeGb is the largest size of a single volume
+	MaxSizeGb int64 `json:"maxSizeGb,omitempty"`
+	// MaxVolumes is the largest number of volumes the driver manages
+	MaxVolumes int `json:"maxVolumes,omitempty"`
+	// AllowedTypes are the disk types volumes can be created with, empty allows any type
+	AllowedTypes []string `json:"allowedTypes,omitempty"`
+	// NamePattern is a regular expression which volume names must match in full
+	NamePattern string `json:"namePattern,omitempty"`
+	// RequiredLabels are the label keys every volume must have when it is created and when its labels change
+	RequiredLabels []string `json:"requiredLabels,omitempty"`
+	// Quotas limit the total size and number of groups of volumes
+	Quotas []*Quota `json:"quotas,omitempty"`
+
+	namePattern *regexp.Regexp
+}
+
+// Quota limits the volumes selected by a label. A key=value label selects the volumes with that
+// label, a key on its own gives every value of the key a quota of its own and no label selects
+// every volume the driver manages, i.e. its whole namespace.
+type Quota struct {
+	Label      string `json:"label,omitempty"`
+	MaxSizeGb  int64  `json:"maxSizeGb,omitempty"`
+	MaxVolumes int    `json:"maxVolumes,omitempty"`
+}
+
+// PolicyRequest describes a volume to check against a policy
+type PolicyRequest struct {
+	Name   string
+	SizeGb int64
+	// Type is the disk type, empty for volumes which don't have one of their own
+	Type   string
+	Labels map[string]string
+	// Grow is set when an existing volume is resized, which only checks its size
+	Grow bool
+	// Relabel is set when the labels of an existing volume change, which only checks its labels
+	Relabel bool
+}
+
+// PolicyError reports every policy rule broken by a request
+type PolicyError struct {
+	Volume     string
+	Violations []string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("volume '%s' is not allowed by policy: %s", e.Volume, strings.Join(e.Violations, "; "))
+}
+
+// Validate checks the policy and compiles its name pattern
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.MaxSizeGb < 0 || p.MaxVolumes < 0 {
+		return fmt.Errorf("policy limits can't be negative")
+	}
+
+	if p.NamePattern != "" {
+		pattern, err := regexp.Compile("^(?:" + p.NamePattern + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid policy name pattern '%s': %v", p.NamePattern, err)
+		}
+		p.namePattern = pattern
+	}
+
+	for _, key := range p.RequiredLabels {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid required label '%s'", key)
+		}
+	}
+
+	for _, quota := range p.Quotas {
+		if quota.MaxSizeGb <= 0 && quota.MaxVolumes <= 0 {
+			return fmt.Errorf("quota '%s' needs a positive maxSizeGb or maxVolumes", quota.Label)
+		}
+		if key, _ := quota.selector(); quota.Label != "" && !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid quota label '%s'", quota.Label)
+		}
+	}
+	return nil
+}
+
+// NeedsUsage checks if the policy has limits which depend on the existing volumes
+func (p *Policy) NeedsUsage() bool {
+	return p != nil && (p.MaxVolumes > 0 || len(p.Quotas) > 0)
+}
+
+// Check gets the rules a request breaks on its own
+func (p *Policy) Check(req *PolicyRequest) []string {
+	if p == nil {
+		return nil
+	}
+
+	var violations []string
+	if p.MaxSizeGb > 0 && !req.Relabel && req.SizeGb > p.MaxSizeGb {
+		violations = append(violations, fmt.Sprintf("size %dGB is larger than the maximum of %dGB", req.SizeGb, p.MaxSizeGb))
+	}
+	if req.Grow {
+		return violations
+	}
+
+	if !req.Relabel {
+		if p.namePattern != nil && !p.namePattern.MatchString(req.Name) {
+			violations = append(violations, fmt.Sprintf("name doesn't match the pattern '%s'", p.NamePattern))
+		}
+		if len(p.AllowedTypes) > 0 && req.Type != "" && !stringInSlice(p.AllowedTypes, req.Type) {
+			violations = append(violations, fmt.Sprintf("type '%s' is not one of %s", req.Type, strings.Join(p.AllowedTypes, ", ")))
+		}
+	}
+	for _, key := range p.RequiredLabels {
+		if _, exists := req.Labels[key]; !exists {
+			violations = append(violations, fmt.Sprintf("label '%s' is required", key))
+		}
+	}
+	return violations
+}
+
+// CheckUsage gets the limits a request would exceed given the existing volumes, which may
+// include the volume being grown or relabelled
+func (p *Policy) CheckUsage(req *PolicyRequest, existing []*PolicyRequest) []string {
+	if p == nil {
+		return nil
+	}
+
+	var violations []string
+	if p.MaxVolumes > 0 && !req.Grow && !req.Relabel && len(existing)+1 > p.MaxVolumes {
+		violations = append(violations, fmt.Sprintf("there are already %d volumes, the maximum is %d", len(existing), p.MaxVolumes))
+	}
+
+	for _, quota := range p.Quotas {
+		if !quota.matches(req.Labels, req.Labels) {
+			continue
+		}
+
+		count, sizeGb := 1, req.SizeGb
+		for _, vol := range existing {
+			if vol.Name != req.Name && quota.matches(vol.Labels, req.Labels) {
+				count++
+				sizeGb += vol.SizeGb
+			}
+		}
+
+		if quota.MaxSizeGb > 0 && sizeGb > quota.MaxSizeGb {
+			violations = append(violations, fmt.Sprintf("%s would use %dGB of its %dGB quota", quota.describe(req.Labels), sizeGb, quota.MaxSizeGb))
+		}
+		if quota.MaxVolumes > 0 && !req.Grow && count > quota.MaxVolumes {
+			violations = append(violations, fmt.Sprintf("%s would have %d of its %d volume quota", quota.describe(req.Labels), count, quota.MaxVolumes))
+		}
+	}
+	return violations
+}
+
+// selector splits the quota label into a key and, if given, a value
+func (q *Quota) selector() (string, *string) {
+	parts := strings.SplitN(q.Label, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return parts[0], &parts[1]
+}
+
+// matches checks if a volume with the given labels counts towards the same quota as the request
+func (q *Quota) matches(labels map[string]string, request map[string]string) bool {
+	if q.Label == "" {
+		return true
+	}
+
+	key, value := q.selector()
+	actual, exists := labels[key]
+	if !exists {
+		return false
+	}
+	if value != nil {
+		return actual == *value
+	}
+	return actual == request[key]
+}
+
+// describe names the group of volumes a quota applies to for a request
+func (q *Quota) describe(request map[string]string) string {
+	if q.Label == "" {
+		return "all volumes"
+	}
+	key, value := q.selector()
+	if value == nil {
+		return fmt.Sprintf("label %s=%s", key, request[key])
+	}
+	return fmt.Sprintf("label %s", q.Label)
+}
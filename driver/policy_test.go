@@ -0,0 +1,204 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *Policy
+		valid  bool
+	}{
+		{"nil", nil, true},
+		{"empty", &Policy{}, true},
+		{"negative size", &Policy{MaxSizeGb: -1}, false},
+		{"negative count", &Policy{MaxVolumes: -1}, false},
+		{"pattern", &Policy{NamePattern: "app-.*"}, true},
+		{"bad pattern", &Policy{NamePattern: "app-("}, false},
+		{"required label", &Policy{RequiredLabels: []string{"team"}}, true},
+		{"bad required label", &Policy{RequiredLabels: []string{"Team"}}, false},
+		{"quota", &Policy{Quotas: []*Quota{{Label: "team=a", MaxSizeGb: 100}}}, true},
+		{"namespace quota", &Policy{Quotas: []*Quota{{MaxVolumes: 10}}}, true},
+		{"quota without limits", &Policy{Quotas: []*Quota{{Label: "team"}}}, false},
+		{"bad quota label", &Policy{Quotas: []*Quota{{Label: "Team=a", MaxVolumes: 1}}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.policy.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := &Policy{
+		MaxSizeGb:      100,
+		AllowedTypes:   []string{"pd-standard", "pd-ssd"},
+		NamePattern:    "app-[a-z]+",
+		RequiredLabels: []string{"team"},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{"team": "a"}
+
+	tests := []struct {
+		name       string
+		req        *PolicyRequest
+		violations int
+	}{
+		{"allowed", &PolicyRequest{Name: "app-web", SizeGb: 100, Type: "pd-ssd", Labels: labels}, 0},
+		{"too large", &PolicyRequest{Name: "app-web", SizeGb: 101, Type: "pd-ssd", Labels: labels}, 1},
+		{"partial name", &PolicyRequest{Name: "app-web-1", SizeGb: 10, Type: "pd-ssd", Labels: labels}, 1},
+		{"type", &PolicyRequest{Name: "app-web", SizeGb: 10, Type: "pd-balanced", Labels: labels}, 1},
+		{"no type", &PolicyRequest{Name: "app-web", SizeGb: 10, Labels: labels}, 0},
+		{"missing label", &PolicyRequest{Name: "app-web", SizeGb: 10, Type: "pd-ssd"}, 1},
+		{"everything", &PolicyRequest{Name: "db", SizeGb: 200, Type: "local"}, 4},
+		// growing a volume only checks its size
+		{"grow", &PolicyRequest{Name: "db", SizeGb: 50, Type: "local", Grow: true}, 0},
+		{"grow too large", &PolicyRequest{Name: "db", SizeGb: 200, Type: "local", Grow: true}, 1},
+		// relabelling a volume only checks its labels
+		{"relabel", &PolicyRequest{Name: "db", SizeGb: 200, Type: "local", Labels: labels, Relabel: true}, 0},
+		{"relabel without label", &PolicyRequest{Name: "db", SizeGb: 200, Type: "local", Relabel: true}, 1},
+	}
+
+	for _, test := range tests {
+		if violations := policy.Check(test.req); len(violations) != test.violations {
+			t.Errorf("%s: expected %d violations, got %v", test.name, test.violations, violations)
+		}
+	}
+
+	var none *Policy
+	if violations := none.Check(tests[len(tests)-1].req); violations != nil {
+		t.Errorf("expected a nil policy to allow everything, got %v", violations)
+	}
+}
+
+func TestPolicyCheckUsage(t *testing.T) {
+	existing := []*PolicyRequest{
+		{Name: "a1", SizeGb: 40, Labels: map[string]string{"team": "a"}},
+		{Name: "a2", SizeGb: 40, Labels: map[string]string{"team": "a"}},
+		{Name: "b1", SizeGb: 40, Labels: map[string]string{"team": "b"}},
+		{Name: "none", SizeGb: 40},
+	}
+
+	tests := []struct {
+		name       string
+		policy     *Policy
+		req        *PolicyRequest
+		violations []string
+	}{
+		{
+			"volume count",
+			&Policy{MaxVolumes: 4},
+			&PolicyRequest{Name: "new", SizeGb: 10},
+			[]string{"there are already 4 volumes, the maximum is 4"},
+		},
+		{
+			"grow ignores volume count",
+			&Policy{MaxVolumes: 4},
+			&PolicyRequest{Name: "a1", SizeGb: 50, Grow: true},
+			nil,
+		},
+		{
+			"namespace size",
+			&Policy{Quotas: []*Quota{{MaxSizeGb: 170}}},
+			&PolicyRequest{Name: "new", SizeGb: 20},
+			[]string{"all volumes would use 180GB of its 170GB quota"},
+		},
+		{
+			"label value size",
+			&Policy{Quotas: []*Quota{{Label: "team=a", MaxSizeGb: 100}}},
+			&PolicyRequest{Name: "new", SizeGb: 30, Labels: map[string]string{"team": "a"}},
+			[]string{"label team=a would use 110GB of its 100GB quota"},
+		},
+		{
+			"other label value",
+			&Policy{Quotas: []*Quota{{Label: "team=a", MaxSizeGb: 100}}},
+			&PolicyRequest{Name: "new", SizeGb: 30, Labels: map[string]string{"team": "b"}},
+			nil,
+		},
+		{
+			"per value count",
+			&Policy{Quotas: []*Quota{{Label: "team", MaxVolumes: 2}}},
+			&PolicyRequest{Name: "new", SizeGb: 10, Labels: map[string]string{"team": "a"}},
+			[]string{"label team=a would have 3 of its 2 volume quota"},
+		},
+		{
+			"per value count of another value",
+			&Policy{Quotas: []*Quota{{Label: "team", MaxVolumes: 2}}},
+			&PolicyRequest{Name: "new", SizeGb: 10, Labels: map[string]string{"team": "b"}},
+			nil,
+		},
+		{
+			"unlabelled volume",
+			&Policy{Quotas: []*Quota{{Label: "team", MaxVolumes: 1}}},
+			&PolicyRequest{Name: "new", SizeGb: 10},
+			nil,
+		},
+		{
+			// the grown volume is counted once, at its new size
+			"grow",
+			&Policy{Quotas: []*Quota{{Label: "team", MaxSizeGb: 100, MaxVolumes: 2}}},
+			&PolicyRequest{Name: "a1", SizeGb: 60, Labels: map[string]string{"team": "a"}, Grow: true},
+			nil,
+		},
+		{
+			"grow too large",
+			&Policy{Quotas: []*Quota{{Label: "team", MaxSizeGb: 100, MaxVolumes: 2}}},
+			&PolicyRequest{Name: "a1", SizeGb: 61, Labels: map[string]string{"team": "a"}, Grow: true},
+			[]string{"label team=a would use 101GB of its 100GB quota"},
+		},
+		{
+			"relabel ignores volume count",
+			&Policy{MaxVolumes: 4},
+			&PolicyRequest{Name: "none", SizeGb: 40, Labels: map[string]string{"team": "a"}, Relabel: true},
+			nil,
+		},
+		{
+			// the relabelled volume moves into the group of its new label
+			"relabel into full quota",
+			&Policy{Quotas: []*Quota{{Label: "team", MaxSizeGb: 100, MaxVolumes: 2}}},
+			&PolicyRequest{Name: "b1", SizeGb: 40, Labels: map[string]string{"team": "a"}, Relabel: true},
+			[]string{"label team=a would use 120GB of its 100GB quota", "label team=a would have 3 of its 2 volume quota"},
+		},
+		{
+			"relabel within quota",
+			&Policy{Quotas: []*Quota{{Label: "team", MaxSizeGb: 100, MaxVolumes: 2}}},
+			&PolicyRequest{Name: "a1", SizeGb: 40, Labels: map[string]string{"team": "a", "env": "prod"}, Relabel: true},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		if err := test.policy.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		violations := test.policy.CheckUsage(test.req, existing)
+		if strings.Join(violations, "; ") != strings.Join(test.violations, "; ") {
+			t.Errorf("%s: expected %v, got %v", test.name, test.violations, violations)
+		}
+	}
+}
+
+func TestPolicyNeedsUsage(t *testing.T) {
+	tests := []struct {
+		policy   *Policy
+		expected bool
+	}{
+		{nil, false},
+		{&Policy{MaxSizeGb: 100}, false},
+		{&Policy{MaxVolumes: 1}, true},
+		{&Policy{Quotas: []*Quota{{MaxSizeGb: 1}}}, true},
+	}
+	for i, test := range tests {
+		if needs := test.policy.NeedsUsage(); needs != test.expected {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, needs)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ProfileOption is the volume option which selects a profile
+const ProfileOption = "profile"
+
+// overrideAll in a profile's overridable list lets users set any option
+const overrideAll = "*"
+
+// Profile is a named set of volume options defined by the operator, like a storage class
+type Profile struct {
+	Description string            `json:"description,omitempty"`
+	Options     map[string]string `json:"options"`
+	// Overridable lists the options users may set on top of the profile, a name ending in '.' allows
+	// every option with that prefix and "*" allows every option
+	Overridable []string `json:"overridable,omitempty"`
+}
+
+// Profiles are the profiles available to a driver
+type Profiles struct {
+	Profiles map[string]*Profile `json:"profiles,omitempty"`
+	// Default is used for volumes created without a profile option
+	Default string `json:"defaultProfile,omitempty"`
+	// Require refuses volumes which don't select a profile, when there is no default
+	Require bool `json:"requireProfile,omitempty"`
+}
+
+// Names gets the profile names in order
+func (p *Profiles) Names() []string {
+	if p == nil {
+		return nil
+	}
+	names := make([]string, 0, len(p.Profiles))
+	for name := range p.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks the profiles' options against a driver's schema
+func (p *Profiles) Validate(schema Schema) error {
+	if p == nil {
+		return nil
+	}
+	if p.Default != "" && p.Profiles[p.Default] == nil {
+		return fmt.Errorf("default profile '%s' is not defined", p.Default)
+	}
+
+	for _, name := range p.Names() {
+		profile := p.Profiles[name]
+		if !labelValuePattern.MatchString(name) || name == "" {
+			return fmt.Errorf("invalid profile name '%s', use lowercase letters, digits, '-' and '_'", name)
+		}
+		if _, exists := profile.Options[ProfileOption]; exists {
+			return fmt.Errorf("profile '%s' can't select another profile", name)
+		}
+
+		problems := &OptionsError{}
+		schema.check(profile.Options, problems)
+		if len(problems.Problems) > 0 {
+			return fmt.Errorf("profile '%s': %v", name, problems)
+		}
+	}
+	return nil
+}
+
+// Expand uses the options of the selected profile as the base for the user's options, recording any
+// options the profile doesn't let users override
+func (p *Profiles) Expand(opts map[string]string, problems *OptionsError) map[string]string {
+	name, selected := opts[ProfileOption]
+	if !selected && p != nil {
+		name = p.Default
+	}
+
+	if name == "" {
+		if p != nil && p.Require {
+			problems.add(ProfileOption, "a profile is required, one of %s", strings.Join(p.Names(), ", "))
+		}
+		return opts
+	}
+
+	if p == nil || p.Profiles[name] == nil {
+		problems.add(ProfileOption, "unknown profile '%s', expected one of %s", name, strings.Join(p.Names(), ", "))
+		return withoutOption(opts, ProfileOption)
+	}
+	profile := p.Profiles[name]
+
+	expanded := make(map[string]string, len(profile.Options)+len(opts))
+	for key, value := range profile.Options {
+		expanded[key] = value
+	}
+	for key, value := range opts {
+		if key != ProfileOption && !profile.overridable(key) {
+			problems.add(key, "can't be set on volumes with profile '%s'", name)
+			continue
+		}
+		expanded[key] = value
+	}
+	expanded[ProfileOption] = name
+	return expanded
+}
+
+// withoutOption copies options leaving out the given key
+func withoutOption(opts map[string]string, key string) map[string]string {
+	copied := make(map[string]string, len(opts))
+	for k, v := range opts {
+		if k != key {
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+// overridable checks if users may set an option on top of the profile
+func (p *Profile) overridable(key string) bool {
+	for _, allowed := range p.Overridable {
+		if allowed == overrideAll || allowed == key || (strings.HasSuffix(allowed, ".") && strings.HasPrefix(key, allowed)) {
+			return true
+		}
+	}
+	return false
+}
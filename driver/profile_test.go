@@ -0,0 +1,126 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testProfiles() *Profiles {
+	return &Profiles{
+		Profiles: map[string]*Profile{
+			"fast": {
+				Options:     map[string]string{"type": "pd-ssd", "sizeGb": "100"},
+				Overridable: []string{"sizeGb", labelOptionPrefix},
+			},
+			"open": {
+				Options:     map[string]string{"type": "pd-standard"},
+				Overridable: []string{overrideAll},
+			},
+		},
+	}
+}
+
+func TestProfilesExpand(t *testing.T) {
+	tests := []struct {
+		name     string
+		profiles *Profiles
+		opts     map[string]string
+		expected map[string]string
+		problems int
+	}{
+		{
+			"no profiles",
+			nil,
+			map[string]string{"type": "pd-ssd"},
+			map[string]string{"type": "pd-ssd"},
+			0,
+		},
+		{
+			"none selected",
+			testProfiles(),
+			map[string]string{"type": "pd-ssd"},
+			map[string]string{"type": "pd-ssd"},
+			0,
+		},
+		{
+			"selected",
+			testProfiles(),
+			map[string]string{ProfileOption: "fast", "sizeGb": "200", "label.team": "a"},
+			map[string]string{ProfileOption: "fast", "type": "pd-ssd", "sizeGb": "200", "label.team": "a"},
+			0,
+		},
+		{
+			"not overridable",
+			testProfiles(),
+			map[string]string{ProfileOption: "fast", "type": "pd-standard"},
+			map[string]string{ProfileOption: "fast", "type": "pd-ssd", "sizeGb": "100"},
+			1,
+		},
+		{
+			"override all",
+			testProfiles(),
+			map[string]string{ProfileOption: "open", "type": "pd-ssd", "sizeGb": "10"},
+			map[string]string{ProfileOption: "open", "type": "pd-ssd", "sizeGb": "10"},
+			0,
+		},
+		{
+			"unknown",
+			testProfiles(),
+			map[string]string{ProfileOption: "slow", "type": "pd-ssd"},
+			map[string]string{"type": "pd-ssd"},
+			1,
+		},
+		{
+			"unknown without profiles",
+			nil,
+			map[string]string{ProfileOption: "fast"},
+			map[string]string{},
+			1,
+		},
+	}
+
+	for _, test := range tests {
+		problems := &OptionsError{}
+		expanded := test.profiles.Expand(test.opts, problems)
+		if !reflect.DeepEqual(expanded, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, expanded)
+		}
+		if len(problems.Problems) != test.problems {
+			t.Errorf("%s: expected %d problems, got %v", test.name, test.problems, problems.Problems)
+		}
+	}
+}
+
+func TestProfilesExpandDefault(t *testing.T) {
+	profiles := testProfiles()
+	profiles.Default = "fast"
+
+	problems := &OptionsError{}
+	expanded := profiles.Expand(map[string]string{}, problems)
+	if expanded[ProfileOption] != "fast" || expanded["type"] != "pd-ssd" || len(problems.Problems) != 0 {
+		t.Errorf("expected the default profile, got %v (%v)", expanded, problems.Problems)
+	}
+
+	// a default doesn't stop users choosing another profile
+	expanded = profiles.Expand(map[string]string{ProfileOption: "open"}, problems)
+	if expanded[ProfileOption] != "open" || expanded["type"] != "pd-standard" {
+		t.Errorf("expected the selected profile, got %v", expanded)
+	}
+}
+
+func TestProfilesExpandRequire(t *testing.T) {
+	profiles := testProfiles()
+	profiles.Require = true
+
+	problems := &OptionsError{}
+	profiles.Expand(map[string]string{"type": "pd-ssd"}, problems)
+	if len(problems.Problems) != 1 {
+		t.Errorf("expected a profile to be required, got %v", problems.Problems)
+	}
+
+	problems = &OptionsError{}
+	profiles.Expand(map[string]string{ProfileOption: "fast"}, problems)
+	if len(problems.Problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems.Problems)
+	}
+}
@@ -0,0 +1,213 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minScheduleInterval is the shortest interval between scheduled snapshots, GCE refuses to
+	// snapshot a disk more often than every 10 minutes
+	minScheduleInterval = 10 * time.Minute
+	// maxScheduleSearch bounds the search for the next time of a cron schedule, e.g. for 31 February
+	maxScheduleSearch = 5 * 366 * 24 * time.Hour
+)
+
+// schedule gives the times at which a job runs
+type schedule interface {
+	// next gets the first time the job runs after t, or the zero time if it never does
+	next(t time.Time) time.Time
+}
+
+// scheduleMacros are shorthands for common cron schedules
+var scheduleMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// parseSchedule parses a five field cron expression in UTC, a macro such as @daily, or an interval
+// such as "6h" or "@every 6h"
+func parseSchedule(spec string) (schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expr, exists := scheduleMacros[spec]; exists {
+		spec = expr
+	}
+
+	if fields := strings.Fields(spec); len(fields) == 5 {
+		return parseCron(fields)
+	}
+
+	interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every")))
+	if err != nil {
+		return nil, fmt.Errorf("expected a cron expression, a macro or an interval, got '%s'", spec)
+	}
+	if interval < minScheduleInterval {
+		return nil, fmt.Errorf("interval %v is shorter than the minimum of %v", interval, minScheduleInterval)
+	}
+	return intervalSchedule(interval), nil
+}
+
+// validateSchedule parses a schedule and checks that a year of its runs are never closer than the
+// minimum interval
+func validateSchedule(spec string) error {
+	s, err := parseSchedule(spec)
+	if err != nil {
+		return err
+	}
+
+	start := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	previous := s.next(start)
+	if previous.IsZero() {
+		return fmt.Errorf("the schedule never runs")
+	}
+
+	for t := s.next(previous); !t.IsZero() && t.Before(start.AddDate(1, 0, 0)); previous, t = t, s.next(t) {
+		if t.Sub(previous) < minScheduleInterval {
+			return fmt.Errorf("the schedule runs more often than every %v", minScheduleInterval)
+		}
+	}
+	return nil
+}
+
+// intervalSchedule runs at fixed intervals, aligned to the unix epoch so that every instance
+// agrees on the times
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) next(t time.Time) time.Time {
+	interval := time.Duration(s)
+	return t.UTC().Truncate(interval).Add(interval)
+}
+
+// cronSchedule runs at the times matching every field of a cron expression, a bit is set for each
+// allowed value of a field
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a '*' day field; when both day fields are restricted a day matching
+	// either runs the job, as in cron
+	domAny, dowAny bool
+}
+
+// cronField is the range of a cron field
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCron parses the five fields of a cron expression
+func parseCron(fields []string) (schedule, error) {
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		if bits[i], err = parseCronField(field, cronFields[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &cronSchedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}
+	if s.dow&(1<<7) != 0 {
+		// 7 is another name for sunday
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps such as "*/15" or "1-5"
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s field '%s'", spec.name, field)
+			}
+			part = part[:i]
+		}
+
+		from, to := spec.min, spec.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid %s field '%s'", spec.name, field)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid %s field '%s'", spec.name, field)
+				}
+			} else if step > 1 {
+				to = spec.max
+			}
+		}
+
+		if from < spec.min || to > spec.max || from > to {
+			return 0, fmt.Errorf("%s field '%s' is outside the range %d-%d", spec.name, field, spec.min, spec.max)
+		}
+		for value := from; value <= to; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxScheduleSearch)
+
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches checks the day of month and day of week fields
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// latestRun gets the latest time a schedule ran at or before now, after the given time, or the
+// zero time if it hasn't run since
+func latestRun(s schedule, after time.Time, now time.Time) time.Time {
+	var latest time.Time
+	for t := s.next(after); !t.IsZero() && !t.After(now); t = s.next(t) {
+		latest = t
+	}
+	return latest
+}
@@ -0,0 +1,140 @@
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+// utc parses a time in RFC 3339 format
+func utc(t *testing.T, value string) time.Time {
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestParseSchedule(t *testing.T) {
+	valid := []string{"0 * * * *", "*/15 0-6 * * 1-5", "30 2 1,15 * *", "0 0 * * 7", "@daily", "6h", "@every 6h", " @hourly "}
+	for _, spec := range valid {
+		if _, err := parseSchedule(spec); err != nil {
+			t.Errorf("%s: unexpected error: %v", spec, err)
+		}
+	}
+
+	invalid := []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"5-1 * * * *", "*/0 * * * *", "a * * * *", "@yearly", "5m", "@every 5m"}
+	for _, spec := range invalid {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestValidateSchedule(t *testing.T) {
+	tests := []struct {
+		spec  string
+		valid bool
+	}{
+		{"*/10 * * * *", true},
+		{"*/5 * * * *", false},
+		{"0,5 * * * *", false},
+		{"0 0 31 2 *", false},
+		{"0 0 29 2 *", true},
+		{"@every 10m", true},
+	}
+	for _, test := range tests {
+		err := validateSchedule(test.spec)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.spec, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: expected an error", test.spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	tests := []struct {
+		spec     string
+		from     string
+		expected string
+	}{
+		// runs strictly after the given time
+		{"0 * * * *", "2017-03-01T10:00:00Z", "2017-03-01T11:00:00Z"},
+		{"0 * * * *", "2017-03-01T10:59:59Z", "2017-03-01T11:00:00Z"},
+		{"*/15 * * * *", "2017-03-01T10:16:00Z", "2017-03-01T10:30:00Z"},
+		{"30 2 * * *", "2017-03-01T03:00:00Z", "2017-03-02T02:30:00Z"},
+		{"@daily", "2017-12-31T12:00:00Z", "2018-01-01T00:00:00Z"},
+		{"@monthly", "2017-01-31T00:00:00Z", "2017-02-01T00:00:00Z"},
+		// 1 March 2017 was a wednesday
+		{"@weekly", "2017-03-01T00:00:00Z", "2017-03-05T00:00:00Z"},
+		{"0 0 * * 7", "2017-03-01T00:00:00Z", "2017-03-05T00:00:00Z"},
+		{"0 9 * * 1-5", "2017-03-03T10:00:00Z", "2017-03-06T09:00:00Z"},
+		// with both day fields restricted either one matching runs the job
+		{"0 0 15 * 1", "2017-03-01T00:00:00Z", "2017-03-06T00:00:00Z"},
+		{"0 0 15 * 1", "2017-03-13T00:00:00Z", "2017-03-15T00:00:00Z"},
+		{"0 0 29 2 *", "2017-03-01T00:00:00Z", "2020-02-29T00:00:00Z"},
+		{"0 0 31 2 *", "2017-03-01T00:00:00Z", ""},
+		// intervals are aligned to the epoch
+		{"6h", "2017-03-01T07:30:00Z", "2017-03-01T12:00:00Z"},
+		{"@every 6h", "2017-03-01T12:00:00Z", "2017-03-01T18:00:00Z"},
+	}
+
+	for _, test := range tests {
+		s, err := parseSchedule(test.spec)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.spec, err)
+		}
+		next := s.next(utc(t, test.from))
+		if test.expected == "" {
+			if !next.IsZero() {
+				t.Errorf("%s from %s: expected no run, got %v", test.spec, test.from, next)
+			}
+		} else if !next.Equal(utc(t, test.expected)) {
+			t.Errorf("%s from %s: expected %s, got %v", test.spec, test.from, test.expected, next)
+		}
+	}
+}
+
+func TestCronNextTimezone(t *testing.T) {
+	s, err := parseSchedule("0 0 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// schedules are in UTC whatever the zone of the given time
+	from := time.Date(2017, 3, 1, 20, 0, 0, 0, time.FixedZone("EST", -5*60*60))
+	if next := s.next(from); !next.Equal(utc(t, "2017-03-03T00:00:00Z")) {
+		t.Errorf("expected midnight UTC, got %v", next)
+	}
+}
+
+func TestLatestRun(t *testing.T) {
+	s, err := parseSchedule("0 */6 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		after    string
+		now      string
+		expected string
+	}{
+		{"2017-03-01T00:00:00Z", "2017-03-01T13:00:00Z", "2017-03-01T12:00:00Z"},
+		{"2017-03-01T00:00:00Z", "2017-03-01T12:00:00Z", "2017-03-01T12:00:00Z"},
+		{"2017-03-01T00:00:00Z", "2017-03-01T05:59:00Z", ""},
+		// a run at the given time doesn't count
+		{"2017-03-01T12:00:00Z", "2017-03-01T17:00:00Z", ""},
+		{"2017-03-01T12:00:00Z", "2017-03-03T01:00:00Z", "2017-03-03T00:00:00Z"},
+	}
+
+	for _, test := range tests {
+		latest := latestRun(s, utc(t, test.after), utc(t, test.now))
+		if test.expected == "" {
+			if !latest.IsZero() {
+				t.Errorf("after %s at %s: expected no run, got %v", test.after, test.now, latest)
+			}
+		} else if !latest.Equal(utc(t, test.expected)) {
+			t.Errorf("after %s at %s: expected %s, got %v", test.after, test.now, test.expected, latest)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package driver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/fs"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+const (
+	// SeedOption is the volume option which fills a new volume from a tar archive, a URL or another volume
+	SeedOption = "seed"
+	// SeedChecksumOption is the sha256 a seed archive must have
+	SeedChecksumOption = "seedChecksum"
+	// SeedOwnerOption is the uid:gid given to every seeded file
+	SeedOwnerOption = "seedOwner"
+
+	seedDownloadTimeout = 30 * time.Minute
+)
+
+// Seed source kinds
+const (
+	seedArchive = "archive"
+	seedURL     = "url"
+	seedVolume  = "volume"
+)
+
+// volumeSeed is what a new volume is filled with once it is formatted and mounted
+type volumeSeed struct {
+	kind string
+	// source is a path on the host, a URL or a volume name
+	source      string
+	compression string
+	checksum    []byte
+	owner       bool
+	uid         int
+	gid         int
+}
+
+// parseSeed parses a seed option: an absolute path to a tar archive on the host, an http or https URL of
+// one, or the name of another volume to copy
+func parseSeed(value string) (*volumeSeed, error) {
+	switch {
+	case strings.HasPrefix(value, "/"):
+		compression, err := archiveCompression(value)
+		if err != nil {
+			return nil, err
+		}
+		return &volumeSeed{kind: seedArchive, source: path.Clean(value), compression: compression}, nil
+
+	case strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://"):
+		u, err := url.Parse(value)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL '%s'", value)
+		}
+		compression, err := archiveCompression(u.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &volumeSeed{kind: seedURL, source: value, compression: compression}, nil
+
+	case value != "" && !strings.Contains(value, "/"):
+		return &volumeSeed{kind: seedVolume, source: value}, nil
+	}
+	return nil, fmt.Errorf("expected an absolute path to a tar archive, a URL or a volume name")
+}
+
+// archiveCompression gets the compression of a tar archive from its name
+func archiveCompression(name string) (string, error) {
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return "", nil
+	case strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tgz"):
+		return fs.CompressionGzip, nil
+	case strings.HasSuffix(name, ".tar.zst") || strings.HasSuffix(name, ".tzst"):
+		return fs.CompressionZstd, nil
+	}
+	return "", fmt.Errorf("'%s' is not a .tar, .tar.gz or .tar.zst archive", name)
+}
+
+// parseSeedChecksum parses a sha256 checksum, optionally prefixed with sha256:
+func parseSeedChecksum(value string) ([]byte, error) {
+	checksum, err := hex.DecodeString(strings.TrimPrefix(value, "sha256:"))
+	if err != nil || len(checksum) != sha256.Size {
+		return nil, fmt.Errorf("expected a sha256 checksum as 64 hex digits")
+	}
+	return checksum, nil
+}
+
+// parseSeedOwner parses a numeric uid:gid
+func parseSeedOwner(value string) (int, int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) == 2 {
+		uid, uidErr := strconv.ParseUint(parts[0], 10, 31)
+		gid, gidErr := strconv.ParseUint(parts[1], 10, 31)
+		if uidErr == nil && gidErr == nil {
+			return int(uid), int(gid), nil
+		}
+	}
+	return 0, 0, fmt.Errorf("expected a numeric uid:gid")
+}
+
+// seedFromArchive unpacks a seed archive into a mounted volume, downloading it first if it is a URL, and
+// checks its checksum if one is given
+func seedFromArchive(ctx context.Context, cfs fs.Filesystem, seed *volumeSeed, mountPoint string) error {
+	archive := seed.source
+	if seed.kind == seedURL {
+		download, err := downloadSeed(ctx, cfs, seed)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(cfs.HostPath(download))
+		archive = download
+	} else if seed.checksum != nil {
+		if err := checkSeedFile(cfs.HostPath(archive), seed.checksum); err != nil {
+			return err
+		}
+	}
+
+	if err := cfs.Extract(ctx, archive, mountPoint, seed.compression); err != nil {
+		return fmt.Errorf("error unpacking seed '%s': %v", seed.source, err)
+	}
+	return nil
+}
+
+// downloadSeed downloads a seed archive to a temporary file on the host, checking it against the seed's
+// checksum as it is written, and returns the host path of the file
+func downloadSeed(ctx context.Context, cfs fs.Filesystem, seed *volumeSeed) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, seedDownloadTimeout)
+	defer cancel()
+
+	logging.FromContext(ctx).WithFields(log.Fields{"url": seed.source}).Info("downloading seed")
+
+	resp, err := ctxhttp.Get(ctx, http.DefaultClient, seed.source)
+	if err != nil {
+		return "", fmt.Errorf("error downloading seed '%s': %v", seed.source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error downloading seed '%s': %s", seed.source, resp.Status)
+	}
+
+	dir := os.TempDir()
+	file, err := ioutil.TempFile(cfs.HostPath(dir), "cloudvol-seed-")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary file for seed: %v", err)
+	}
+	download := path.Join(dir, filepath.Base(file.Name()))
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && seed.checksum != nil && !bytes.Equal(hash.Sum(nil), seed.checksum) {
+		err = checksumError(hash.Sum(nil), seed.checksum)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("error downloading seed '%s': %v", seed.source, err)
+	}
+	return download, nil
+}
+
+// checkSeedFile checks the sha256 of a local seed archive
+func checkSeedFile(name string, checksum []byte) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("error reading seed: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return fmt.Errorf("error reading seed: %v", err)
+	}
+	if !bytes.Equal(hash.Sum(nil), checksum) {
+		return checksumError(hash.Sum(nil), checksum)
+	}
+	return nil
+}
+
+func checksumError(actual []byte, expected []byte) error {
+	return fmt.Errorf("seed checksum is sha256:%x, expected sha256:%x", actual, expected)
+}
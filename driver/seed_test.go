@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stugotech/cloudvol2/fs"
+)
+
+func TestParseSeed(t *testing.T) {
+	tests := []struct {
+		value       string
+		kind        string
+		source      string
+		compression string
+	}{
+		{"/data/seed.tar", seedArchive, "/data/seed.tar", ""},
+		{"/data/../seed.tar.gz", seedArchive, "/seed.tar.gz", fs.CompressionGzip},
+		{"/data/seed.tgz", seedArchive, "/data/seed.tgz", fs.CompressionGzip},
+		{"/data/seed.tar.zst", seedArchive, "/data/seed.tar.zst", fs.CompressionZstd},
+		{"/data/seed.tzst", seedArchive, "/data/seed.tzst", fs.CompressionZstd},
+		{"https://example.com/seed.tar.gz?version=2", seedURL, "https://example.com/seed.tar.gz?version=2", fs.CompressionGzip},
+		{"http://example.com/seed.tar", seedURL, "http://example.com/seed.tar", ""},
+		{"other-volume", seedVolume, "other-volume", ""},
+	}
+
+	for _, test := range tests {
+		seed, err := parseSeed(test.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if seed.kind != test.kind || seed.source != test.source || seed.compression != test.compression {
+			t.Errorf("%s: expected %s '%s' compressed with '%s', got %s '%s' compressed with '%s'", test.value,
+				test.kind, test.source, test.compression, seed.kind, seed.source, seed.compression)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"/data/seed.zip",
+		"/data/seed",
+		"https://example.com/seed.zip",
+		"https://example.com/seed.zip?name=seed.tar",
+		"https:///seed.tar",
+		"ftp://example.com/seed.tar",
+		"relative/seed.tar",
+	}
+	for _, value := range invalid {
+		if seed, err := parseSeed(value); err == nil {
+			t.Errorf("%s: expected an error, got %v", value, seed)
+		}
+	}
+}
+
+func TestParseSeedChecksum(t *testing.T) {
+	hash := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	for _, value := range []string{hash, "sha256:" + hash} {
+		if checksum, err := parseSeedChecksum(value); err != nil || len(checksum) != 32 {
+			t.Errorf("%s: unexpected result %x (%v)", value, checksum, err)
+		}
+	}
+	for _, value := range []string{"", hash[:62], hash + "00", "md5:" + hash, "z" + hash[1:]} {
+		if _, err := parseSeedChecksum(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
+
+func TestParseSeedOwner(t *testing.T) {
+	if uid, gid, err := parseSeedOwner("1000:100"); err != nil || uid != 1000 || gid != 100 {
+		t.Errorf("expected 1000:100, got %d:%d (%v)", uid, gid, err)
+	}
+	for _, value := range []string{"", "1000", "1000:", ":100", "user:group", "-1:0", "1:2:3", "4294967296:0"} {
+		if _, _, err := parseSeedOwner(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+}
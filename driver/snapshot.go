@@ -0,0 +1,13 @@
+package driver
+
+// Snapshot represents a point in time copy of a volume
+type Snapshot struct {
+	Name    string
+	Volume  string
+	SizeGb  int64
+	Created string
+	Status  string
+	// Inconsistent is set on snapshots which weren't captured before their volume was thawed or its post
+	// hook ran, so they aren't application consistent
+	Inconsistent bool
+}
@@ -0,0 +1,622 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/fs"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
+)
+
+const (
+	// DefaultSubdirBackingVolume is the name of the volume sub-directory volumes are created on
+	DefaultSubdirBackingVolume = "cloudvol-subdir"
+
+	// subdirVolumesDir holds a directory for each volume on the backing volume and subdirMetaDir its
+	// metadata file, apart so that no volume name can collide with a metadata file
+	subdirVolumesDir = "volumes"
+	subdirMetaDir    = "meta"
+	subdirMetaSuffix = ".json"
+	subdirDirMode    = 0755
+
+	// subdirFirstProject is the first project ID given to a volume, lower IDs are left to the operator
+	subdirFirstProject = 1000
+)
+
+// subdirNamePattern matches the volume names docker accepts
+var subdirNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// SubdirConfig holds the settings for the sub-directory driver
+type SubdirConfig struct {
+	// BackingVolume is the volume of the backing driver the volumes are created on, DefaultSubdirBackingVolume
+	// if empty
+	BackingVolume string
+	// BackingOptions are the options the backing volume is created with, project quotas are always enabled
+	BackingOptions map[string]string
+	// DefaultSizeGb is the quota of volumes created without a sizeGb option
+	DefaultSizeGb int64
+	// RemoveEmptyBacking deletes the backing volume when its last volume is removed, rather than only
+	// unmounting it
+	RemoveEmptyBacking bool
+	// Policy limits the volumes which can be created, the volumes have no disk type so allowed types
+	// don't apply
+	Policy *Policy
+	// MountDirMode is the mode of the directories volumes are mounted on, DefaultMountDirMode if zero
+	MountDirMode os.FileMode
+}
+
+// subdirDriver creates volumes as directories on a single backing volume, which is attached and mounted
+// once, and bind mounts them. The backing volume's references are the volumes on it: it is created and
+// mounted for the first and unmounted, or deleted, after the last is removed. As the backing volume is
+// attached read-write to one instance, its volumes are only usable on that instance.
+type subdirDriver struct {
+	backing   Driver
+	fs        fs.Filesystem
+	mountPath string
+	config    SubdirConfig
+	// lock serialises changes to the backing volume and the volumes on it
+	lock sync.Mutex
+}
+
+// subdirVolume is the metadata of a volume
+type subdirVolume struct {
+	Project uint32            `json:"project"`
+	SizeGb  int64             `json:"sizeGb"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Created time.Time         `json:"created"`
+}
+
+// NewSubdirDriver creates a driver which makes volumes as directories on a volume of the backing driver
+func NewSubdirDriver(backing Driver, mountPath string, fs fs.Filesystem, config SubdirConfig) (Driver, error) {
+	if config.BackingVolume == "" {
+		config.BackingVolume = DefaultSubdirBackingVolume
+	}
+	if config.DefaultSizeGb <= 0 {
+		config.DefaultSizeGb = defaultVolumeSizeGb
+	}
+	if config.MountDirMode == 0 {
+		config.MountDirMode = DefaultMountDirMode
+	}
+
+	opts := map[string]string{ProjectQuotaOption: "true"}
+	for key, value := range config.BackingOptions {
+		opts[key] = value
+	}
+	if quota, _ := strconv.ParseBool(opts[ProjectQuotaOption]); !quota {
+		return nil, fmt.Errorf("SUBDIR: the backing volume needs project quotas")
+	}
+	config.BackingOptions = opts
+
+	log.WithFields(log.Fields{"backing": config.BackingVolume}).Info("SUBDIR: creating volumes as directories of the backing volume")
+	return &subdirDriver{
+		backing:   backing,
+		fs:        fs,
+		mountPath: mountPath,
+		config:    config,
+	}, nil
+}
+
+// Options gets the schema of the volume options accepted by the sub-directory driver
+func (d *subdirDriver) Options() Schema {
+	return Schema{
+		{Name: "sizeGb", Type: OptionInt, Min: 1, Max: maxDiskSizeGb, Default: strconv.FormatInt(d.config.DefaultSizeGb, 10),
+			Description: "project quota of the volume in GB"},
+		{Name: UIDOption, Type: OptionInt, Max: maxOwnerID,
+			Description: "numeric owner of the volume's root directory"},
+		{Name: GIDOption, Type: OptionInt, Max: maxOwnerID,
+			Description: "numeric group of the volume's root directory"},
+		{Name: RootModeOption, Type: OptionString,
+			Description: "octal permissions of the volume's root directory, e.g. 0775"},
+		{Name: labelOptionPrefix, Prefix: true, Type: OptionString,
+			Description: "label.<key>=<value> adds a label to the volume, which policy quotas can select"},
+	}
+}
+
+// Create makes a new directory on the backing volume, creating the backing volume if needed
+func (d *subdirDriver) Create(ctx context.Context, id string, opts map[string]string) (*Volume, error) {
+	vol, root, err := d.parseOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.checkName(id); err != nil {
+		return nil, err
+	}
+
+	// the rules which only depend on the request are checked before the backing volume is created
+	req := &PolicyRequest{Name: id, SizeGb: vol.SizeGb, Labels: vol.Labels}
+	if err = d.checkPolicy(ctx, req, nil); err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	backing, err := d.mountBacking(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = d.readVolume(backing, id); err == nil {
+		return nil, fmt.Errorf("SUBDIR: volume '%s' already exists", id)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("SUBDIR: error reading volume '%s': %v", id, err)
+	}
+
+	if d.config.Policy.NeedsUsage() {
+		existing, err := d.policyUsage(backing)
+		if err == nil {
+			err = d.checkPolicy(ctx, req, existing)
+		}
+		if err != nil {
+			d.releaseBacking(ctx, backing)
+			return nil, err
+		}
+	}
+
+	err = d.createVolume(ctx, backing, id, vol, root)
+	if err != nil {
+		// the backing volume may have been created for this volume
+		d.releaseBacking(ctx, backing)
+		return nil, err
+	}
+	return d.volume(ctx, backing, id, vol)
+}
+
+// createVolume makes the directory of a volume with its quota, owner and permissions, then its metadata
+func (d *subdirDriver) createVolume(ctx context.Context, backing string, id string, vol *subdirVolume, root volumeRoot) error {
+	project, err := d.nextProject(backing)
+	if err != nil {
+		return fmt.Errorf("SUBDIR: error allocating project for volume '%s': %v", id, err)
+	}
+	vol.Project = project
+	vol.Created = time.Now().UTC()
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"volume":  id,
+		"project": project,
+		"sizeGb":  vol.SizeGb,
+	}).Info("SUBDIR: creating volume")
+
+	dir := d.volumeDir(backing, id)
+	for _, parent := range []string{subdirVolumesDir, subdirMetaDir} {
+		if err = d.fs.CreateDir(ctx, path.Join(backing, parent), false, subdirDirMode); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("SUBDIR: error creating volume '%s': %v", id, err)
+		}
+	}
+	if err = d.fs.CreateDir(ctx, dir, false, subdirDirMode); err != nil {
+		return fmt.Errorf("SUBDIR: error creating volume '%s': %v", id, err)
+	}
+
+	err = d.fs.SetProjectQuota(ctx, backing, dir, project, vol.SizeGb<<20)
+	if err == nil {
+		err = d.fs.Chown(ctx, dir, root.uid, root.gid, false)
+	}
+	if err == nil && root.mode != nil {
+		err = d.fs.Chmod(ctx, dir, *root.mode)
+	}
+	if err == nil {
+		err = d.writeVolume(backing, id, vol)
+	}
+	if err != nil {
+		if removeErr := d.fs.RemoveDir(ctx, dir, true); removeErr != nil {
+			logging.FromContext(ctx).WithError(removeErr).Warn("SUBDIR: error removing directory of failed volume")
+		}
+		return fmt.Errorf("SUBDIR: error creating volume '%s': %v", id, err)
+	}
+	return nil
+}
+
+// Remove deletes the directory of a volume, and releases the backing volume if it was the last
+func (d *subdirDriver) Remove(ctx context.Context, id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	backing, err := d.mountBacking(ctx, false)
+	if err != nil {
+		return err
+	}
+	vol, err := d.getVolume(backing, id)
+	if err != nil {
+		return err
+	}
+
+	target := path.Join(d.mountPath, id)
+	if mounted, err := d.fs.IsMountPoint(ctx, target); err != nil {
+		return fmt.Errorf("SUBDIR: error checking mount of volume '%s': %v", id, err)
+	} else if mounted {
+		return fmt.Errorf("SUBDIR: volume '%s' is mounted on '%s'", id, target)
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{"volume": id}).Info("SUBDIR: removing volume")
+
+	if err = d.fs.RemoveDir(ctx, d.volumeDir(backing, id), true); err != nil {
+		return fmt.Errorf("SUBDIR: error removing volume '%s': %v", id, err)
+	}
+	if err = d.fs.SetProjectQuota(ctx, backing, "", vol.Project, 0); err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("SUBDIR: error removing quota of volume")
+	}
+	if err = os.Remove(d.fs.HostPath(d.metaPath(backing, id))); err != nil {
+		return fmt.Errorf("SUBDIR: error removing volume '%s': %v", id, err)
+	}
+
+	d.releaseBacking(ctx, backing)
+	return nil
+}
+
+// List gets the volumes on the backing volume, none if it doesn't exist
+func (d *subdirDriver) List(ctx context.Context) ([]*Volume, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	backing, err := d.mountBacking(ctx, false)
+	if err != nil || backing == "" {
+		return nil, err
+	}
+	names, err := d.volumeNames(backing)
+	if err != nil {
+		return nil, fmt.Errorf("SUBDIR: error listing volumes: %v", err)
+	}
+
+	volumes := make([]*Volume, 0, len(names))
+	for _, name := range names {
+		volumes = append(volumes, &Volume{Name: name, Status: map[string]interface{}{"backing": d.config.BackingVolume}})
+	}
+	return volumes, nil
+}
+
+// Get gets info about a volume
+func (d *subdirDriver) Get(ctx context.Context, id string) (*Volume, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	backing, err := d.mountBacking(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := d.getVolume(backing, id)
+	if err != nil {
+		return nil, err
+	}
+	return d.volume(ctx, backing, id, vol)
+}
+
+// Mount bind mounts the directory of a volume
+func (d *subdirDriver) Mount(ctx context.Context, id string) (string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	backing, err := d.mountBacking(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	if _, err = d.getVolume(backing, id); err != nil {
+		return "", err
+	}
+
+	target := path.Join(d.mountPath, id)
+	if mounted, err := d.fs.IsMountPoint(ctx, target); err != nil {
+		return "", fmt.Errorf("SUBDIR: error checking mount of volume '%s': %v", id, err)
+	} else if mounted {
+		return target, fmt.Errorf("SUBDIR: volume '%s' already mounted on '%s'", id, target)
+	}
+
+	if err = d.fs.CreateDir(ctx, target, true, d.config.MountDirMode); err != nil {
+		return "", fmt.Errorf("SUBDIR: error creating mount point '%s' for volume '%s': %v", target, id, err)
+	}
+	if err = d.fs.Chmod(ctx, target, d.config.MountDirMode); err != nil {
+		return "", fmt.Errorf("SUBDIR: error setting mode of mount point '%s' for volume '%s': %v", target, id, err)
+	}
+	if err = d.fs.Bind(ctx, d.volumeDir(backing, id), target); err != nil {
+		return "", fmt.Errorf("SUBDIR: error mounting volume '%s' on '%s': %v", id, target, err)
+	}
+	return target, nil
+}
+
+// Unmount removes the bind mount of a volume, the backing volume stays mounted for the other volumes
+func (d *subdirDriver) Unmount(ctx context.Context, id string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	target := path.Join(d.mountPath, id)
+	if mounted, err := d.fs.IsMountPoint(ctx, target); err != nil {
+		return fmt.Errorf("SUBDIR: error checking mount of volume '%s': %v", id, err)
+	} else if !mounted {
+		return fmt.Errorf("SUBDIR: volume '%s' not mounted", id)
+	}
+
+	if err := d.fs.Unmount(ctx, target); err != nil {
+		return fmt.Errorf("SUBDIR: error unmounting volume '%s' from '%s': %v", id, target, err)
+	}
+	if err := d.fs.RemoveDir(ctx, target, false); err != nil {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"name":  id,
+			"mount": target,
+			"err":   err,
+		}).Warn("SUBDIR: error removing mountpoint")
+	}
+	return nil
+}
+
+// RunSchedules runs the backing driver's scheduled jobs, such as snapshots of the backing volume
+func (d *subdirDriver) RunSchedules(ctx context.Context, interval time.Duration) {
+	if scheduler, ok := d.backing.(Scheduler); ok {
+		scheduler.RunSchedules(ctx, interval)
+	}
+}
+
+// mountBacking gets the mount point of the backing volume, mounting it if it isn't mounted. If the backing
+// volume doesn't exist it is created if create is set, otherwise the mount point is empty.
+func (d *subdirDriver) mountBacking(ctx context.Context, create bool) (string, error) {
+	name := d.config.BackingVolume
+
+	volumes, err := d.backing.List(ctx)
+	if err != nil {
+		return "", fmt.Errorf("SUBDIR: error listing backing volumes: %v", err)
+	}
+	if !volumeInList(volumes, name) {
+		if !create {
+			return "", nil
+		}
+
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"backing": name,
+			"opts":    d.config.BackingOptions,
+		}).Info("SUBDIR: creating backing volume")
+
+		vol, err := d.backing.Create(ctx, name, d.config.BackingOptions)
+		if err != nil {
+			return "", fmt.Errorf("SUBDIR: error creating backing volume '%s': %v", name, err)
+		}
+		if vol.Path != "" {
+			return vol.Path, nil
+		}
+	}
+
+	vol, err := d.backing.Get(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("SUBDIR: error getting backing volume '%s': %v", name, err)
+	}
+	if vol.Path != "" {
+		return vol.Path, nil
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{"backing": name}).Info("SUBDIR: mounting backing volume")
+	mountPoint, err := d.backing.Mount(ctx, name)
+	if err != nil {
+		return "", fmt.Errorf("SUBDIR: error mounting backing volume '%s': %v", name, err)
+	}
+	return mountPoint, nil
+}
+
+// releaseBacking unmounts the backing volume, and deletes it if configured, once no volumes are left on it
+func (d *subdirDriver) releaseBacking(ctx context.Context, backing string) {
+	name := d.config.BackingVolume
+	names, err := d.volumeNames(backing)
+	if err != nil || len(names) > 0 {
+		return
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{"backing": name}).Info("SUBDIR: releasing empty backing volume")
+	if err = d.backing.Unmount(ctx, name); err != nil {
+		logging.FromContext(ctx).WithError(err).Warn("SUBDIR: error unmounting backing volume")
+		return
+	}
+	if d.config.RemoveEmptyBacking {
+		if err = d.backing.Remove(ctx, name); err != nil {
+			logging.FromContext(ctx).WithError(err).Warn("SUBDIR: error removing backing volume")
+		}
+	}
+}
+
+// parseOptions parses the volume options into the metadata of a new volume, reporting every invalid option
+func (d *subdirDriver) parseOptions(opts map[string]string) (*subdirVolume, volumeRoot, error) {
+	vol := &subdirVolume{SizeGb: d.config.DefaultSizeGb, Labels: make(map[string]string)}
+	root := volumeRoot{uid: -1, gid: -1}
+
+	problems := &OptionsError{}
+	for _, key := range d.Options().check(opts, problems) {
+		var err error
+		switch {
+		case key == "sizeGb":
+			vol.SizeGb, err = strconv.ParseInt(opts[key], 10, 64)
+		case key == UIDOption:
+			root.uid, err = parseOwnerID(opts[key])
+		case key == GIDOption:
+			root.gid, err = parseOwnerID(opts[key])
+		case key == RootModeOption:
+			var mode os.FileMode
+			if mode, err = fs.ParseMode(opts[key]); err == nil {
+				root.mode = &mode
+			}
+		case strings.HasPrefix(key, labelOptionPrefix):
+			vol.Labels[strings.TrimPrefix(key, labelOptionPrefix)] = opts[key]
+		}
+		if err != nil {
+			problems.add(key, "%v", err)
+		}
+	}
+	return vol, root, problems.orNil()
+}
+
+// checkPolicy returns a PolicyError if a new volume breaks any rule of the policy, only checking the
+// limits which depend on the existing volumes if they are given
+func (d *subdirDriver) checkPolicy(ctx context.Context, req *PolicyRequest, existing []*PolicyRequest) error {
+	var violations []string
+	if existing == nil {
+		violations = d.config.Policy.Check(req)
+	} else {
+		violations = d.config.Policy.CheckUsage(req, existing)
+	}
+
+	if len(violations) > 0 {
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"volume":     req.Name,
+			"violations": violations,
+		}).Warn("SUBDIR: volume refused by policy")
+		return &PolicyError{Volume: req.Name, Violations: violations}
+	}
+	return nil
+}
+
+// policyUsage describes the volumes on the backing volume for the policy
+func (d *subdirDriver) policyUsage(backing string) ([]*PolicyRequest, error) {
+	names, err := d.volumeNames(backing)
+	if err != nil {
+		return nil, fmt.Errorf("SUBDIR: error listing volumes: %v", err)
+	}
+
+	existing := make([]*PolicyRequest, 0, len(names))
+	for _, name := range names {
+		vol, err := d.readVolume(backing, name)
+		if err != nil {
+			return nil, fmt.Errorf("SUBDIR: error reading volume '%s': %v", name, err)
+		}
+		existing = append(existing, &PolicyRequest{Name: name, SizeGb: vol.SizeGb, Labels: vol.Labels})
+	}
+	return existing, nil
+}
+
+// checkName checks a volume name can be used as a directory and mount point
+func (d *subdirDriver) checkName(id string) error {
+	if !subdirNamePattern.MatchString(id) {
+		return fmt.Errorf("SUBDIR: invalid volume name '%s', use letters, digits, '_', '.' and '-'", id)
+	}
+	if id == d.config.BackingVolume {
+		return fmt.Errorf("SUBDIR: '%s' is the name of the backing volume", id)
+	}
+	return nil
+}
+
+// getVolume reads the metadata of a volume, which doesn't exist if the backing volume doesn't
+func (d *subdirDriver) getVolume(backing string, id string) (*subdirVolume, error) {
+	if backing == "" || !subdirNamePattern.MatchString(id) {
+		return nil, fmt.Errorf("SUBDIR: volume '%s' not found", id)
+	}
+	vol, err := d.readVolume(backing, id)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("SUBDIR: volume '%s' not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SUBDIR: error reading volume '%s': %v", id, err)
+	}
+	return vol, nil
+}
+
+// volume gets the info about a volume
+func (d *subdirDriver) volume(ctx context.Context, backing string, id string, vol *subdirVolume) (*Volume, error) {
+	result := &Volume{
+		Name: id,
+		Status: map[string]interface{}{
+			"backing": d.config.BackingVolume,
+			"sizeGb":  vol.SizeGb,
+			"project": vol.Project,
+			"created": vol.Created.Format(time.RFC3339),
+		},
+	}
+	if len(vol.Labels) > 0 {
+		result.Status["labels"] = vol.Labels
+	}
+
+	target := path.Join(d.mountPath, id)
+	mounted, err := d.fs.IsMountPoint(ctx, target)
+	if err != nil {
+		return nil, fmt.Errorf("SUBDIR: error checking mount of volume '%s': %v", id, err)
+	}
+	if mounted {
+		result.Path = target
+		result.Ready = true
+	}
+	return result, nil
+}
+
+// nextProject gets a project ID no volume on the backing volume uses
+func (d *subdirDriver) nextProject(backing string) (uint32, error) {
+	names, err := d.volumeNames(backing)
+	if err != nil {
+		return 0, err
+	}
+
+	next := uint32(subdirFirstProject)
+	for _, name := range names {
+		vol, err := d.readVolume(backing, name)
+		if err != nil {
+			return 0, err
+		}
+		if vol.Project >= next {
+			next = vol.Project + 1
+		}
+	}
+	return next, nil
+}
+
+// volumeNames gets the names of the volumes on the backing volume in order
+func (d *subdirDriver) volumeNames(backing string) ([]string, error) {
+	files, err := ioutil.ReadDir(d.fs.HostPath(path.Join(backing, subdirMetaDir)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), subdirMetaSuffix) {
+			names = append(names, strings.TrimSuffix(file.Name(), subdirMetaSuffix))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readVolume reads the metadata of a volume
+func (d *subdirDriver) readVolume(backing string, id string) (*subdirVolume, error) {
+	data, err := ioutil.ReadFile(d.fs.HostPath(d.metaPath(backing, id)))
+	if err != nil {
+		return nil, err
+	}
+	vol := &subdirVolume{}
+	if err = json.Unmarshal(data, vol); err != nil {
+		return nil, err
+	}
+	return vol, nil
+}
+
+// writeVolume writes the metadata of a volume
+func (d *subdirDriver) writeVolume(backing string, id string, vol *subdirVolume) error {
+	data, err := json.Marshal(vol)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.fs.HostPath(d.metaPath(backing, id)), data, 0644)
+}
+
+// volumeDir gets the directory of a volume on the backing volume
+func (d *subdirDriver) volumeDir(backing string, id string) string {
+	return path.Join(backing, subdirVolumesDir, id)
+}
+
+// metaPath gets the metadata file of a volume on the backing volume
+func (d *subdirDriver) metaPath(backing string, id string) string {
+	return path.Join(backing, subdirMetaDir, id+subdirMetaSuffix)
+}
+
+// volumeInList checks if a list of volumes includes the named volume
+func volumeInList(volumes []*Volume, name string) bool {
+	for _, vol := range volumes {
+		if vol.Name == name {
+			return true
+		}
+	}
+	return false
+}
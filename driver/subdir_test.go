@@ -0,0 +1,304 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stugotech/cloudvol2/fs"
+	"golang.org/x/net/context"
+)
+
+// fakeBacking is a backing driver which mounts its volumes on directories under root, recording its calls
+type fakeBacking struct {
+	root string
+
+	mutex   sync.Mutex
+	calls   []string
+	volumes map[string]string
+}
+
+func (b *fakeBacking) record(call string) {
+	b.calls = append(b.calls, call)
+}
+
+// recorded gets the calls made so far, separated by '; '
+func (b *fakeBacking) recorded() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return strings.Join(b.calls, "; ")
+}
+
+func (b *fakeBacking) Create(ctx context.Context, name string, opts map[string]string) (*Volume, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.record("Create " + name)
+	if _, exists := b.volumes[name]; exists {
+		return nil, fmt.Errorf("volume '%s' already exists", name)
+	}
+	b.volumes[name] = ""
+	return &Volume{Name: name}, nil
+}
+
+func (b *fakeBacking) Remove(ctx context.Context, id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.record("Remove " + id)
+	if b.volumes[id] != "" {
+		return fmt.Errorf("volume '%s' is mounted", id)
+	}
+	delete(b.volumes, id)
+	return os.RemoveAll(path.Join(b.root, id))
+}
+
+func (b *fakeBacking) List(ctx context.Context) ([]*Volume, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var volumes []*Volume
+	for name, mountPoint := range b.volumes {
+		volumes = append(volumes, &Volume{Name: name, Path: mountPoint})
+	}
+	return volumes, nil
+}
+
+func (b *fakeBacking) Get(ctx context.Context, id string) (*Volume, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	mountPoint, exists := b.volumes[id]
+	if !exists {
+		return nil, fmt.Errorf("volume '%s' not found", id)
+	}
+	return &Volume{Name: id, Path: mountPoint}, nil
+}
+
+func (b *fakeBacking) Mount(ctx context.Context, id string) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.record("Mount " + id)
+	if _, exists := b.volumes[id]; !exists {
+		return "", fmt.Errorf("volume '%s' not found", id)
+	}
+	mountPoint := path.Join(b.root, id)
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return "", err
+	}
+	b.volumes[id] = mountPoint
+	return mountPoint, nil
+}
+
+func (b *fakeBacking) Unmount(ctx context.Context, id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.record("Unmount " + id)
+	if b.volumes[id] == "" {
+		return fmt.Errorf("volume '%s' not mounted", id)
+	}
+	b.volumes[id] = ""
+	return nil
+}
+
+// newTestSubdirDriver creates a sub-directory driver on a fake backing driver, with its files under a
+// temporary directory
+func newTestSubdirDriver(t *testing.T, config SubdirConfig) (*subdirDriver, *fakeBacking, *fakeFilesystem, func()) {
+	root, err := ioutil.TempDir("", "subdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing := &fakeBacking{root: path.Join(root, "backing"), volumes: make(map[string]string)}
+	filesystem := newFakeFilesystem()
+	filesystem.Filesystem = fs.NewFilesystem()
+
+	d, err := NewSubdirDriver(backing, path.Join(root, "mnt"), filesystem, config)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	return d.(*subdirDriver), backing, filesystem, func() { os.RemoveAll(root) }
+}
+
+func TestSubdirBackingReferences(t *testing.T) {
+	for _, remove := range []bool{false, true} {
+		d, backing, _, cleanup := newTestSubdirDriver(t, SubdirConfig{RemoveEmptyBacking: remove})
+		ctx := context.Background()
+		name := DefaultSubdirBackingVolume
+
+		// the backing volume is only looked for until the first volume is made
+		if volumes, err := d.List(ctx); err != nil || len(volumes) != 0 || backing.recorded() != "" {
+			t.Errorf("remove %v: expected no volumes or backing calls, got %v, %v, '%s'", remove, volumes, err, backing.recorded())
+		}
+		for _, id := range []string{"a", "b"} {
+			if _, err := d.Create(ctx, id, nil); err != nil {
+				t.Fatalf("remove %v: unexpected error: %v", remove, err)
+			}
+		}
+		expected := "Create " + name + "; Mount " + name
+		if calls := backing.recorded(); calls != expected {
+			t.Errorf("remove %v: expected one backing volume, got '%s'", remove, calls)
+		}
+
+		// the backing volume is released with its last volume
+		if err := d.Remove(ctx, "a"); err != nil {
+			t.Fatalf("remove %v: unexpected error: %v", remove, err)
+		}
+		if calls := backing.recorded(); calls != expected {
+			t.Errorf("remove %v: expected the backing volume to be kept, got '%s'", remove, calls)
+		}
+		if err := d.Remove(ctx, "b"); err != nil {
+			t.Fatalf("remove %v: unexpected error: %v", remove, err)
+		}
+		expected += "; Unmount " + name
+		if remove {
+			expected += "; Remove " + name
+		}
+		if calls := backing.recorded(); calls != expected {
+			t.Errorf("remove %v: expected calls '%s', got '%s'", remove, expected, calls)
+		}
+		cleanup()
+	}
+}
+
+func TestSubdirFailedCreateReleasesBacking(t *testing.T) {
+	d, backing, filesystem, cleanup := newTestSubdirDriver(t, SubdirConfig{})
+	defer cleanup()
+	ctx := context.Background()
+	name := DefaultSubdirBackingVolume
+
+	filesystem.failures["SetProjectQuota"] = errors.New("no quotas")
+	if _, err := d.Create(ctx, "a", nil); err == nil {
+		t.Errorf("expected error")
+	}
+	if calls := backing.recorded(); calls != "Create "+name+"; Mount "+name+"; Unmount "+name {
+		t.Errorf("expected the backing volume to be released, got '%s'", calls)
+	}
+	if _, err := os.Stat(d.volumeDir(path.Join(backing.root, name), "a")); !os.IsNotExist(err) {
+		t.Errorf("expected the directory of the failed volume to be removed, got %v", err)
+	}
+}
+
+func TestSubdirMetadata(t *testing.T) {
+	d, backing, _, cleanup := newTestSubdirDriver(t, SubdirConfig{})
+	defer cleanup()
+	ctx := context.Background()
+
+	// volumes named like the metadata directory or a metadata file don't collide with either
+	for _, id := range []string{subdirMetaDir, "a" + subdirMetaSuffix, "a"} {
+		if _, err := d.Create(ctx, id, map[string]string{"label.team": "web"}); err != nil {
+			t.Fatalf("%s: unexpected error: %v", id, err)
+		}
+	}
+	mountPoint := path.Join(backing.root, DefaultSubdirBackingVolume)
+	if err := os.Mkdir(path.Join(mountPoint, subdirVolumesDir, "stray"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	volumes, err := d.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, vol := range volumes {
+		names = append(names, vol.Name)
+	}
+	// only directories with metadata are volumes
+	if expected := []string{"a", "a.json", "meta"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected volumes %v, got %v", expected, names)
+	}
+
+	vol, err := d.readVolume(mountPoint, subdirMetaDir)
+	if err != nil || vol.SizeGb != defaultVolumeSizeGb || vol.Labels["team"] != "web" || vol.Created.IsZero() {
+		t.Errorf("unexpected metadata %v (%v)", vol, err)
+	}
+	if _, err = os.Stat(path.Join(mountPoint, subdirMetaDir, "a.json"+subdirMetaSuffix)); err != nil {
+		t.Errorf("expected the metadata file of 'a.json': %v", err)
+	}
+
+	if _, err = d.Get(ctx, "stray"); err == nil {
+		t.Errorf("expected a directory without metadata not to be found")
+	}
+	if _, err = d.Create(ctx, "a", nil); err == nil {
+		t.Errorf("expected error creating an existing volume")
+	}
+}
+
+func TestSubdirProjectQuota(t *testing.T) {
+	d, backing, filesystem, cleanup := newTestSubdirDriver(t, SubdirConfig{DefaultSizeGb: 2})
+	defer cleanup()
+	ctx := context.Background()
+	mountPoint := path.Join(backing.root, DefaultSubdirBackingVolume)
+
+	create := func(id string, opts map[string]string) {
+		if _, err := d.Create(ctx, id, opts); err != nil {
+			t.Fatalf("%s: unexpected error: %v", id, err)
+		}
+	}
+	create("a", map[string]string{"sizeGb": "1"})
+	create("b", nil)
+	if err := d.Remove(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	// IDs of removed volumes aren't reused while higher ones are in use
+	create("c", nil)
+
+	calls := filesystem.recorded()
+	for _, call := range []string{
+		fmt.Sprintf("SetProjectQuota %s %s 1000 1048576", mountPoint, d.volumeDir(mountPoint, "a")),
+		fmt.Sprintf("SetProjectQuota %s %s 1001 2097152", mountPoint, d.volumeDir(mountPoint, "b")),
+		fmt.Sprintf("SetProjectQuota %s  1000 0", mountPoint),
+		fmt.Sprintf("SetProjectQuota %s %s 1002 2097152", mountPoint, d.volumeDir(mountPoint, "c")),
+	} {
+		if !strings.Contains(calls, call) {
+			t.Errorf("expected call '%s', got '%s'", call, calls)
+		}
+	}
+
+	for id, project := range map[string]uint32{"b": 1001, "c": 1002} {
+		if vol, err := d.Get(ctx, id); err != nil || vol.Status["project"] != project {
+			t.Errorf("%s: expected project %d, got %v (%v)", id, project, vol, err)
+		}
+	}
+}
+
+func TestSubdirMount(t *testing.T) {
+	d, backing, filesystem, cleanup := newTestSubdirDriver(t, SubdirConfig{MountDirMode: 0750})
+	defer cleanup()
+	ctx := context.Background()
+	if _, err := d.Create(ctx, "a", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := d.Mount(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := d.volumeDir(path.Join(backing.root, DefaultSubdirBackingVolume), "a")
+	for _, call := range []string{"Chmod " + target + " 0750", "Bind " + source + " " + target} {
+		if !strings.Contains(filesystem.recorded(), call) {
+			t.Errorf("expected call '%s', got '%s'", call, filesystem.recorded())
+		}
+	}
+	if vol, err := d.Get(ctx, "a"); err != nil || vol.Path != target {
+		t.Errorf("expected the volume to be mounted on '%s', got %v (%v)", target, vol, err)
+	}
+	if _, err = d.Mount(ctx, "a"); err == nil {
+		t.Errorf("expected error mounting a mounted volume")
+	}
+	if err = d.Remove(ctx, "a"); err == nil {
+		t.Errorf("expected error removing a mounted volume")
+	}
+
+	if err = d.Unmount(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("expected the mount point to be removed, got %v", err)
+	}
+	if err = d.Remove(ctx, "a"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -2,7 +2,8 @@ package driver
 
 // Volume represents a docker volume
 type Volume struct {
-	Name  string
-	Path  string
-	Ready bool
+	Name   string
+	Path   string
+	Ready  bool
+	Status map[string]interface{}
 }
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gordonmleigh/redpill"
+	"github.com/stugotech/cloudvol2/backup"
+	"github.com/stugotech/cloudvol2/config"
+	"github.com/stugotech/cloudvol2/driver"
+	"github.com/stugotech/cloudvol2/fs"
+	"github.com/stugotech/cloudvol2/keys"
+)
+
+const (
+	defaultAdminSock = "/run/cloudvol/admin.sock"
+	// hostRoot is where a privileged container has the host root bind mounted
+	hostRoot = "/host"
+)
+
+// driverFlags are the flags which configure the storage driver
+type driverFlags struct {
+	mode         *string
+	managed      *bool
+	defaultSize  *int64
+	defaultType  *string
+	takeover     *string
+	takeoverWait *time.Duration
+	allZones     *bool
+	managedLabel *string
+	namespace    *string
+	labels       *string
+	kmsKey       *string
+	requireKms   *bool
+	keySource    *string
+	configFile   *string
+	mountDirMode *string
+	subdir       *string
+	subdirOpts   *string
+	subdirRemove *bool
+	maxDisks     *int64
+	detachIdle   *bool
+	allowRemove  *bool
+}
+
+// addDriverFlags registers the storage driver flags
+func addDriverFlags(flags *flag.FlagSet) *driverFlags {
+	return &driverFlags{
+		mode:         flags.String("mode", "fs", "storage mode (fs, gce, aws)"),
+		managed:      flags.Bool("managed", false, "running as a docker managed plugin"),
+		defaultSize:  flags.Int64("default-size", 10, "default volume size in GB"),
+		defaultType:  flags.String("default-type", "", "default disk type"),
+		takeover:     flags.String("takeover", driver.TakeoverFail, "policy for disks attached to another instance (fail, wait, force)"),
+		takeoverWait: flags.Duration("takeover-timeout", time.Minute, "how long the wait takeover policy waits for the other instance"),
+		allZones:     flags.Bool("list-all-zones", false, "list disks in every zone of the region, not just the instance's zone"),
+		managedLabel: flags.String("managed-label", driver.DefaultManagedLabel, "key=value label marking the disks cloudvol manages"),
+		namespace:    flags.String("namespace", "", "only manage disks labelled with this namespace"),
+		labels:       flags.String("default-labels", "", "comma separated key=value labels added to new disks"),
+		kmsKey:       flags.String("default-kms-key", "", "Cloud KMS key for disks created without a kmsKey option"),
+		requireKms:   flags.Bool("require-kms-key", false, "refuse to create disks which aren't encrypted with a Cloud KMS key"),
+		keySource:    flags.String("key-source", "", "keys of encrypted volumes (file:<path>, env:<variable> or a key server URL)"),
+		configFile:   flags.String("config", "", "json config file defining volume profiles and policy"),
+		mountDirMode: flags.String("mount-dir-mode", fs.FormatMode(driver.DefaultMountDirMode), "octal permissions of the directories volumes are mounted on"),
+		subdir:       flags.String("subdir-volume", "", "create volumes as directories with project quotas on this backing volume, rather than a disk each"),
+		subdirOpts:   flags.String("subdir-options", "", "comma separated key=value options the backing volume is created with, e.g. sizeGb=500,fstype=xfs"),
+		subdirRemove: flags.Bool("subdir-remove-empty", false, "delete the backing volume when its last volume is removed, which needs -allow-remove"),
+		maxDisks:     flags.Int64("max-attached-disks", 0, "most disks the instance can have attached, including the boot disk (0 to read it from the machine type)"),
+		detachIdle:   flags.Bool("detach-idle", false, "detach a volume which isn't mounted to make room when the instance has as many disks attached as it can"),
+		allowRemove:  flags.Bool("allow-remove", false, "let removing a volume delete its disk, which also needs to be set for backups from snapshots"),
+	}
+}
+
+// filesystem creates the file system the storage driver and backups use
+func (f *driverFlags) filesystem() fs.Filesystem {
+	return createFilesystem(*f.managed)
+}
+
+// create creates the storage driver
+func (f *driverFlags) create(cfs fs.Filesystem) (driver.Driver, error) {
+	labels, err := driver.ParseLabels(*f.labels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default labels: %v", err)
+	}
+
+	mountDirMode, err := fs.ParseMode(*f.mountDirMode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mount dir mode: %v", err)
+	}
+
+	cfg, err := config.Load(*f.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var keySource keys.Source
+	if *f.keySource != "" {
+		if keySource, err = keys.New(*f.keySource); err != nil {
+			return nil, err
+		}
+	}
+
+	subdirOpts, err := driver.ParseLabels(*f.subdirOpts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subdir options: %v", err)
+	}
+
+	log.WithFields(log.Fields{"mode": *f.mode}).Info("creating storage driver")
+	d, err := createStorageDriver(*f.mode, mountPath, cfs, driver.GceConfig{
+		DefaultSizeGb:   *f.defaultSize,
+		DefaultDiskType: *f.defaultType,
+		Takeover:        *f.takeover,
+		TakeoverTimeout: *f.takeoverWait,
+		ListAllZones:    *f.allZones,
+		ManagedLabel:    *f.managedLabel,
+		Namespace:       *f.namespace,
+		DefaultLabels:   labels,
+		DefaultKmsKey:   *f.kmsKey,
+		RequireKmsKey:   *f.requireKms,
+		Keys:            keySource,
+		Profiles:        &cfg.Profiles,
+		Policy:          cfg.Policy,
+		Hooks:           &cfg.SnapshotHooks,
+		MountDirMode:    mountDirMode,
+
+		MaxAttachedDisks: *f.maxDisks,
+		DetachIdle:       *f.detachIdle,
+		AllowRemove:      *f.allowRemove,
+	})
+	if err != nil || *f.subdir == "" {
+		return d, err
+	}
+	return driver.NewSubdirDriver(d, mountPath, cfs, driver.SubdirConfig{
+		BackingVolume:      *f.subdir,
+		BackingOptions:     subdirOpts,
+		DefaultSizeGb:      *f.defaultSize,
+		RemoveEmptyBacking: *f.subdirRemove,
+		Policy:             cfg.Policy,
+		MountDirMode:       mountDirMode,
+	})
+}
+
+// backupFlags are the flags which configure where backups are stored; S3 credentials are read from the
+// standard AWS environment variables
+type backupFlags struct {
+	target   *string
+	endpoint *string
+	region   *string
+	retain   *int
+	maxAge   *time.Duration
+}
+
+// addBackupFlags registers the backup flags
+func addBackupFlags(flags *flag.FlagSet) *backupFlags {
+	return &backupFlags{
+		target:   flags.String("backup-target", "", "where backups are stored (s3://bucket/prefix or a directory), backups are disabled if empty"),
+		endpoint: flags.String("backup-endpoint", "", "URL of an S3 compatible service, AWS S3 if empty"),
+		region:   flags.String("backup-region", "", "region S3 requests are signed for, us-east-1 if empty"),
+		retain:   flags.Int("backup-retain", 0, "number of backups kept per volume (0 keeps every backup)"),
+		maxAge:   flags.Duration("backup-max-age", 0, "age after which backups are deleted (0 keeps them)"),
+	}
+}
+
+// create creates the backup engine, or nil if no backup target is set
+func (f *backupFlags) create(cfs fs.Filesystem) (*backup.Engine, error) {
+	if *f.target == "" {
+		return nil, nil
+	}
+	if *f.retain < 0 || *f.maxAge < 0 {
+		return nil, fmt.Errorf("backup retention can't be negative")
+	}
+
+	store, err := backup.NewStore(backup.StoreConfig{
+		Target:       *f.target,
+		Endpoint:     *f.endpoint,
+		Region:       *f.region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{"target": *f.target}).Info("backups enabled")
+	return backup.NewEngine(store, cfs, backup.Retention{Count: *f.retain, MaxAge: *f.maxAge}), nil
+}
+
+// tlsFlags are the flags for the TLS material of a server or client
+type tlsFlags struct {
+	cert   *string
+	key    *string
+	caCert *string
+}
+
+// addServerTLSFlags registers the TLS flags of the daemon's TCP listeners
+func addServerTLSFlags(flags *flag.FlagSet) *tlsFlags {
+	return &tlsFlags{
+		cert:   flags.String("tlscert", "", "server certificate for the TCP listener"),
+		key:    flags.String("tlskey", "", "server key for the TCP listener"),
+		caCert: flags.String("tlscacert", "", "CA used to verify client certificates, also written to the spec file for docker to verify the server"),
+	}
+}
+
+// addClientTLSFlags registers the TLS flags used to connect to the admin API over TCP
+func addClientTLSFlags(flags *flag.FlagSet) *tlsFlags {
+	return &tlsFlags{
+		cert:   flags.String("tlscert", "", "client certificate for the admin API"),
+		key:    flags.String("tlskey", "", "client key for the admin API"),
+		caCert: flags.String("tlscacert", "", "CA used to verify the admin API server"),
+	}
+}
+
+// flagsFromEnv sets flags from CLOUDVOL_* environment variables, so that they can be configured
+// with `docker plugin set`; flags given on the command line still take precedence
+func flagsFromEnv(flags *flag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(name); ok && err == nil {
+			if setErr := f.Value.Set(value); setErr != nil {
+				err = fmt.Errorf("%s: %v", name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// createFilesystem creates the file system used to mount volumes. When running as a privileged container
+// the host file system is expected at /host and commands are run in the host mount namespace. A managed
+// plugin, or a container without /host, mounts volumes in its own namespace and docker propagates them
+// to the host.
+func createFilesystem(managed bool) fs.Filesystem {
+	if managed {
+		log.Info("running as managed plugin")
+		return fs.NewFilesystem()
+	}
+
+	c, err := redpill.GetContainerID()
+	if err != nil {
+		log.WithError(err).Warn("can't get container id")
+	}
+
+	if c != "" {
+		if !fs.HostMounted(hostRoot) {
+			log.WithFields(log.Fields{"container": c, "host": hostRoot}).Warn("running in container without the host file system, using the container's mount namespace")
+			return fs.NewFilesystem()
+		}
+		log.WithFields(log.Fields{"container": c}).Info("running in container")
+		return fs.NewFilesystemBasePath(hostRoot)
+	}
+	return fs.NewFilesystem()
+}
+
+func createStorageDriver(name string, mountPath string, cfs fs.Filesystem, gceConfig driver.GceConfig) (driver.Driver, error) {
+	if name == "gce" {
+		return driver.NewGceDriver(mountPath, cfs, gceConfig)
+	}
+	return nil, fmt.Errorf("unknown driver type '%s'", name)
+}
@@ -1,55 +1,145 @@
 package fs
 
 import (
+	"bytes"
 	"fmt"
 	"os/exec"
 
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stugotech/cloudvol2/logging"
+	"golang.org/x/net/context"
 )
 
 const (
 	mountNamespace = "/proc/1/ns/mnt"
+	mapperDir      = "/dev/mapper"
+
+	// magic numbers of the file systems statfs reports
+	ext4Magic = 0xef53
+	xfsMagic  = 0x58465342
+
+	// FsTypeExt4 is the default file system type
+	FsTypeExt4 = "ext4"
+	// FsTypeXfs is the XFS file system type
+	FsTypeXfs = "xfs"
+
+	// CompressionGzip and CompressionZstd are the compressions of tar archives Extract understands
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
 )
 
 // Filesystem represents a file system
 type Filesystem interface {
 	// DirExists checks for existence of directory
-	DirExists(dir string) (bool, error)
+	DirExists(ctx context.Context, dir string) (bool, error)
 
 	// CreateDir creates a new directory
-	CreateDir(dir string, recursive bool, perm os.FileMode) error
+	CreateDir(ctx context.Context, dir string, recursive bool, perm os.FileMode) error
 
 	// RemoveDir deletes a directory
-	RemoveDir(dir string, recursive bool) error
+	RemoveDir(ctx context.Context, dir string, recursive bool) error
 
-	// Mount mounts a block device
-	Mount(device string, target string) error
+	// Mount mounts a block device, with extra mount options if given
+	Mount(ctx context.Context, device string, target string, options ...string) error
 
 	// Unmount unmounts a block device
-	Unmount(target string) error
+	Unmount(ctx context.Context, target string) error
+
+	// Bind bind mounts a directory on another
+	Bind(ctx context.Context, source string, target string) error
+
+	// IsMountPoint checks if a directory is the root of a mount from another file system than its parent
+	IsMountPoint(ctx context.Context, dir string) (bool, error)
+
+	// Format formats a block device with a file system of the given type, ext4 if empty, with support for
+	// project quotas if projectQuota is set
+	Format(ctx context.Context, target string, fsType string, projectQuota bool) error
+
+	// Grow expands the file system on a block device to fill the device, the mount point is needed for
+	// file systems which can only grow while mounted
+	Grow(ctx context.Context, device string, mountPoint string) error
+
+	// FormatLuks formats a block device as a LUKS container protected by the key
+	FormatLuks(ctx context.Context, device string, key []byte) error
+
+	// OpenLuks unlocks a LUKS container as /dev/mapper/<name> and returns the mapper device
+	OpenLuks(ctx context.Context, device string, name string, key []byte, readOnly bool) (string, error)
+
+	// CloseLuks locks an open LUKS container, doing nothing if it isn't open
+	CloseLuks(ctx context.Context, name string) error
+
+	// ResizeLuks grows an open LUKS container to fill its underlying device
+	ResizeLuks(ctx context.Context, name string, key []byte) error
+
+	// Freeze suspends writes to the file system mounted at mountPoint and flushes it to the device
+	Freeze(ctx context.Context, mountPoint string) error
+
+	// Thaw resumes writes to a frozen file system
+	Thaw(ctx context.Context, mountPoint string) error
 
-	// Format formats a block device
-	Format(target string) error
+	// Run runs a command in the host mount namespace with extra environment variables, until it exits or
+	// the context is done, and returns its combined output
+	Run(ctx context.Context, env []string, args ...string) (string, error)
+
+	// Extract unpacks a tar archive with the given compression, none if empty, into a directory and keeps the
+	// numeric owners of its files
+	Extract(ctx context.Context, archive string, target string, compression string) error
+
+	// Copy copies the contents of a directory into another, keeping owners, modes and times
+	Copy(ctx context.Context, source string, target string) error
+
+	// Chown changes the owner of a path, and of everything under it if recursive; a uid or gid of -1 is
+	// left unchanged
+	Chown(ctx context.Context, target string, uid int, gid int, recursive bool) error
+
+	// Chmod changes the permissions of a path
+	Chmod(ctx context.Context, target string, mode os.FileMode) error
+
+	// SetProjectQuota limits the space used by a project on the ext4 or xfs file system mounted at mountPoint,
+	// with project quotas enabled, to limitKb; dir, if given, and everything created under it is made part of
+	// the project first. A limit of 0 removes the limit.
+	SetProjectQuota(ctx context.Context, mountPoint string, dir string, project uint32, limitKb int64) error
+
+	// HostPath gets the path through which this process reaches a path on the host
+	HostPath(p string) string
+}
+
+// MapperDevice gets the path of the device mapper device with the given name
+func MapperDevice(name string) string {
+	return path.Join(mapperDir, name)
 }
 
 type fsInfo struct {
 	root string
 }
 
-// NewFilesystem creates a new file system object
+// HostMounted checks if the host root is bind mounted at root, with the host's /proc through which
+// commands are run in its mount namespace
+func HostMounted(root string) bool {
+	_, err := os.Stat(path.Join(root, mountNamespace))
+	return err == nil
+}
+
+// NewFilesystem creates a new file system object which works in the current mount namespace, i.e. directly
+// on the host or inside a docker managed plugin
 func NewFilesystem() Filesystem {
 	return &fsInfo{}
 }
 
-// NewFilesystemBasePath creates a new file system object with a base path
+// NewFilesystemBasePath creates a new file system object with a base path, for use in a container which has
+// the host root bind mounted at the base path; commands are run in the host mount namespace
 func NewFilesystemBasePath(root string) Filesystem {
 	return &fsInfo{root: strings.TrimSuffix(root, "/")}
 }
 
 // DirExists checks for existence of directory
-func (fs *fsInfo) DirExists(dir string) (bool, error) {
+func (fs *fsInfo) DirExists(ctx context.Context, dir string) (bool, error) {
 	dir = fs.resolve(dir)
 	stat, err := os.Stat(dir)
 
@@ -63,7 +153,7 @@ func (fs *fsInfo) DirExists(dir string) (bool, error) {
 }
 
 // CreateDir creates a new directory
-func (fs *fsInfo) CreateDir(dir string, recursive bool, perm os.FileMode) error {
+func (fs *fsInfo) CreateDir(ctx context.Context, dir string, recursive bool, perm os.FileMode) error {
 	dir = fs.resolve(dir)
 	if recursive {
 		return os.MkdirAll(dir, perm)
@@ -72,7 +162,7 @@ func (fs *fsInfo) CreateDir(dir string, recursive bool, perm os.FileMode) error
 }
 
 // RemoveDir deletes a directory
-func (fs *fsInfo) RemoveDir(dir string, recursive bool) error {
+func (fs *fsInfo) RemoveDir(ctx context.Context, dir string, recursive bool) error {
 	dir = fs.resolve(dir)
 	if recursive {
 		return os.RemoveAll(dir)
@@ -80,23 +170,264 @@ func (fs *fsInfo) RemoveDir(dir string, recursive bool) error {
 	return os.Remove(dir)
 }
 
-// Mount mounts a block device
-func (fs *fsInfo) Mount(device string, target string) error {
+// Mount mounts a block device, with extra mount options if given
+func (fs *fsInfo) Mount(ctx context.Context, device string, target string, options ...string) error {
 	device = fs.resolve(device)
 	target = fs.resolve(target)
-	return fs.osExec("mount", "-o", "defaults,discard", device, target)
+	opts := strings.Join(append([]string{"defaults", "discard"}, options...), ",")
+	return fs.osExec(ctx, "mount", "-o", opts, device, target)
 }
 
 // Unmount unmounts a block device
-func (fs *fsInfo) Unmount(target string) error {
+func (fs *fsInfo) Unmount(ctx context.Context, target string) error {
 	target = fs.resolve(target)
-	return fs.osExec("umount", target)
+	return fs.osExec(ctx, "umount", target)
+}
+
+// Bind bind mounts a directory on another
+func (fs *fsInfo) Bind(ctx context.Context, source string, target string) error {
+	return fs.osExec(ctx, "mount", "--bind", fs.resolve(source), fs.resolve(target))
+}
+
+// IsMountPoint checks if a directory is the root of a mount from another file system than its parent
+func (fs *fsInfo) IsMountPoint(ctx context.Context, dir string) (bool, error) {
+	dir = fs.resolve(dir)
+	var stat, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &stat); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := syscall.Stat(path.Dir(dir), &parent); err != nil {
+		return false, err
+	}
+	return stat.Dev != parent.Dev || stat.Ino == parent.Ino, nil
 }
 
-// Format formats a block device
-func (fs *fsInfo) Format(target string) error {
+// Format formats a block device with a file system of the given type, ext4 if empty, with support for
+// project quotas if projectQuota is set
+func (fs *fsInfo) Format(ctx context.Context, target string, fsType string, projectQuota bool) error {
 	target = fs.resolve(target)
-	return fs.osExec("mkfs.ext4", target)
+	switch fsType {
+	case "", FsTypeExt4:
+		if projectQuota {
+			return fs.osExec(ctx, "mkfs.ext4", "-O", "quota,project", target)
+		}
+		return fs.osExec(ctx, "mkfs.ext4", target)
+	case FsTypeXfs:
+		// xfs tracks project quotas when mounted with prjquota
+		return fs.osExec(ctx, "mkfs.xfs", target)
+	}
+	return fmt.Errorf("unsupported file system type '%s'", fsType)
+}
+
+// Grow expands the file system on a block device to fill the device, the mount point is needed for
+// file systems which can only grow while mounted
+func (fs *fsInfo) Grow(ctx context.Context, device string, mountPoint string) error {
+	device = fs.resolve(device)
+	output, err := fs.osOutput(ctx, "blkid", "-o", "value", "-s", "TYPE", device)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(output) == FsTypeXfs {
+		return fs.osExec(ctx, "xfs_growfs", fs.resolve(mountPoint))
+	}
+	return fs.osExec(ctx, "resize2fs", device)
+}
+
+// FormatLuks formats a block device as a LUKS container protected by the key
+func (fs *fsInfo) FormatLuks(ctx context.Context, device string, key []byte) error {
+	device = fs.resolve(device)
+	return fs.osExecInput(ctx, key, "cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file=-", device)
+}
+
+// OpenLuks unlocks a LUKS container as /dev/mapper/<name> and returns the mapper device
+func (fs *fsInfo) OpenLuks(ctx context.Context, device string, name string, key []byte, readOnly bool) (string, error) {
+	args := []string{"cryptsetup", "open", "--type", "luks", "--key-file=-"}
+	if readOnly {
+		args = append(args, "--readonly")
+	} else {
+		args = append(args, "--allow-discards")
+	}
+	args = append(args, fs.resolve(device), name)
+
+	if err := fs.osExecInput(ctx, key, args...); err != nil {
+		return "", err
+	}
+	return MapperDevice(name), nil
+}
+
+// CloseLuks locks an open LUKS container, doing nothing if it isn't open
+func (fs *fsInfo) CloseLuks(ctx context.Context, name string) error {
+	if _, err := os.Stat(fs.resolve(MapperDevice(name))); os.IsNotExist(err) {
+		return nil
+	}
+	return fs.osExec(ctx, "cryptsetup", "close", name)
+}
+
+// ResizeLuks grows an open LUKS container to fill its underlying device
+func (fs *fsInfo) ResizeLuks(ctx context.Context, name string, key []byte) error {
+	return fs.osExecInput(ctx, key, "cryptsetup", "resize", "--key-file=-", name)
+}
+
+// Freeze suspends writes to the file system mounted at mountPoint and flushes it to the device
+func (fs *fsInfo) Freeze(ctx context.Context, mountPoint string) error {
+	_, err := fs.Run(ctx, nil, "fsfreeze", "--freeze", mountPoint)
+	return err
+}
+
+// Thaw resumes writes to a frozen file system
+func (fs *fsInfo) Thaw(ctx context.Context, mountPoint string) error {
+	_, err := fs.Run(ctx, nil, "fsfreeze", "--unfreeze", mountPoint)
+	return err
+}
+
+// Run runs a command in the host mount namespace with extra environment variables, until it exits or
+// the context is done, and returns its combined output
+func (fs *fsInfo) Run(ctx context.Context, env []string, args ...string) (string, error) {
+	args = fs.nsEnter(args...)
+	command := exec.CommandContext(ctx, args[0], args[1:]...)
+	command.Env = append(os.Environ(), env...)
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"command": args[0],
+		"args":    args[1:],
+	}).Debug("fs: running command")
+
+	output, err := command.CombinedOutput()
+	if ctx.Err() != nil {
+		return string(output), fmt.Errorf("%s didn't finish in time, arguments: %v", args[0], args[1:])
+	}
+	if err != nil {
+		return string(output), fmt.Errorf("%s failed, arguments: %v: %v\noutput: %s", args[0], args[1:], err, string(output))
+	}
+	return string(output), nil
+}
+
+// Extract unpacks a tar archive with the given compression, none if empty, into a directory and keeps the
+// numeric owners of its files
+func (fs *fsInfo) Extract(ctx context.Context, archive string, target string, compression string) error {
+	args := []string{"tar", "-x", "--numeric-owner", "-f", archive, "-C", target}
+	switch compression {
+	case "":
+	case CompressionGzip:
+		args = append(args, "-z")
+	case CompressionZstd:
+		args = append(args, "--use-compress-program=zstd")
+	default:
+		return fmt.Errorf("unsupported compression '%s'", compression)
+	}
+	_, err := fs.Run(ctx, nil, args...)
+	return err
+}
+
+// Copy copies the contents of a directory into another, keeping owners, modes and times
+func (fs *fsInfo) Copy(ctx context.Context, source string, target string) error {
+	_, err := fs.Run(ctx, nil, "cp", "-a", strings.TrimSuffix(source, "/")+"/.", target)
+	return err
+}
+
+// Chown changes the owner of a path, and of everything under it if recursive; a uid or gid of -1 is
+// left unchanged
+func (fs *fsInfo) Chown(ctx context.Context, target string, uid int, gid int, recursive bool) error {
+	var owner string
+	if uid >= 0 {
+		owner = strconv.Itoa(uid)
+	}
+	if gid >= 0 {
+		owner += ":" + strconv.Itoa(gid)
+	}
+	if owner == "" {
+		return nil
+	}
+
+	args := []string{"chown"}
+	if recursive {
+		args = append(args, "-R")
+	}
+	_, err := fs.Run(ctx, nil, append(args, owner, target)...)
+	return err
+}
+
+// Chmod changes the permissions of a path
+func (fs *fsInfo) Chmod(ctx context.Context, target string, mode os.FileMode) error {
+	_, err := fs.Run(ctx, nil, "chmod", FormatMode(mode), target)
+	return err
+}
+
+// SetProjectQuota limits the space used by a project on the ext4 or xfs file system mounted at mountPoint,
+// with project quotas enabled, to limitKb; dir, if given, and everything created under it is made part of
+// the project first. A limit of 0 removes the limit.
+func (fs *fsInfo) SetProjectQuota(ctx context.Context, mountPoint string, dir string, project uint32, limitKb int64) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(fs.resolve(mountPoint), &stat); err != nil {
+		return err
+	}
+	id := strconv.FormatUint(uint64(project), 10)
+
+	switch int64(stat.Type) {
+	case xfsMagic:
+		if dir != "" {
+			if _, err := fs.Run(ctx, nil, "xfs_quota", "-x", "-c", fmt.Sprintf("project -s -p %s %s", dir, id), mountPoint); err != nil {
+				return err
+			}
+		}
+		_, err := fs.Run(ctx, nil, "xfs_quota", "-x", "-c", fmt.Sprintf("limit -p bhard=%dk %s", limitKb, id), mountPoint)
+		return err
+
+	case ext4Magic:
+		if dir != "" {
+			// +P makes new files inherit the project
+			if _, err := fs.Run(ctx, nil, "chattr", "+P", "-p", id, dir); err != nil {
+				return err
+			}
+		}
+		_, err := fs.Run(ctx, nil, "setquota", "-P", id, "0", strconv.FormatInt(limitKb, 10), "0", "0", mountPoint)
+		return err
+	}
+	return fmt.Errorf("project quotas need an ext4 or xfs file system, '%s' is neither", mountPoint)
+}
+
+// ParseMode parses octal permissions such as 0755, which may include the setuid, setgid and sticky bits
+func ParseMode(value string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || bits > 07777 {
+		return 0, fmt.Errorf("expected octal permissions such as 0755, got '%s'", value)
+	}
+
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// FormatMode formats permissions in octal as chmod takes them
+func FormatMode(mode os.FileMode) string {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return fmt.Sprintf("%04o", bits)
+}
+
+// HostPath gets the path through which this process reaches a path on the host
+func (fs *fsInfo) HostPath(p string) string {
+	return fs.resolve(p)
 }
 
 // nsEnter prepends an nsEnter command to the given commnd
@@ -121,10 +452,40 @@ func (fs *fsInfo) resolve(p string) string {
 }
 
 // osExec runs a shell command
-func (fs *fsInfo) osExec(args ...string) error {
+func (fs *fsInfo) osExec(ctx context.Context, args ...string) error {
+	return fs.osExecInput(ctx, nil, args...)
+}
+
+// osOutput runs a shell command and returns its standard output
+func (fs *fsInfo) osOutput(ctx context.Context, args ...string) (string, error) {
+	cmd := args[0]
+	args = args[1:]
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"command": cmd,
+		"args":    args,
+	}).Debug("fs: running command")
+
+	output, err := exec.Command(cmd, args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed, arguments: %v: %v", cmd, args, err)
+	}
+	return string(output), nil
+}
+
+// osExecInput runs a shell command with the given standard input, which isn't logged
+func (fs *fsInfo) osExecInput(ctx context.Context, input []byte, args ...string) error {
 	cmd := args[0]
 	args = args[1:]
 	command := exec.Command(cmd, args...)
+	if input != nil {
+		command.Stdin = bytes.NewReader(input)
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"command": cmd,
+		"args":    args,
+	}).Debug("fs: running command")
 
 	if output, err := command.CombinedOutput(); err != nil {
 		return fmt.Errorf("%s failed, arguments: %v\noutput: %s", cmd, args, string(output))
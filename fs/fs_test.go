@@ -0,0 +1,86 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected os.FileMode
+	}{
+		{"0755", 0755},
+		{"755", 0755},
+		{"0", 0},
+		{"4755", os.ModeSetuid | 0755},
+		{"2770", os.ModeSetgid | 0770},
+		{"1777", os.ModeSticky | 0777},
+		{"7000", os.ModeSetuid | os.ModeSetgid | os.ModeSticky},
+	}
+
+	for _, test := range tests {
+		mode, err := ParseMode(test.value)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.value, err)
+			continue
+		}
+		if mode != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.value, test.expected, mode)
+		}
+	}
+
+	for _, value := range []string{"", "rwx", "0789", "10000", "-755", "0x1ff"} {
+		if mode, err := ParseMode(value); err == nil {
+			t.Errorf("%s: expected an error, got %v", value, mode)
+		}
+	}
+}
+
+func TestFormatMode(t *testing.T) {
+	tests := []struct {
+		mode     os.FileMode
+		expected string
+	}{
+		{0755, "0755"},
+		{0, "0000"},
+		{os.ModeDir | 0700, "0700"},
+		{os.ModeSetuid | 0755, "4755"},
+		{os.ModeSetgid | os.ModeSticky | 0775, "3775"},
+	}
+
+	for _, test := range tests {
+		if formatted := FormatMode(test.mode); formatted != test.expected {
+			t.Errorf("%v: expected '%s', got '%s'", test.mode, test.expected, formatted)
+		}
+		if test.mode&os.ModeDir != 0 {
+			continue
+		}
+		if parsed, err := ParseMode(FormatMode(test.mode)); err != nil || parsed != test.mode {
+			t.Errorf("%v: parsed back as %v (%v)", test.mode, parsed, err)
+		}
+	}
+}
+
+func TestHostMounted(t *testing.T) {
+	root, err := ioutil.TempDir("", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if HostMounted(root) {
+		t.Errorf("expected an empty directory not to be the host root")
+	}
+	if err = os.MkdirAll(path.Join(root, path.Dir(mountNamespace)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path.Join(root, mountNamespace), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !HostMounted(root) {
+		t.Errorf("expected the host root to be found")
+	}
+}
@@ -0,0 +1,31 @@
+package keys
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+type envSource struct {
+	name string
+}
+
+// NewEnvSource creates a key source which reads the environment variable <name>_<VOLUME>, with the volume
+// name upper cased and '-' and '.' replaced by '_', falling back to <name> as the key of every volume
+func NewEnvSource(name string) Source {
+	return &envSource{name: name}
+}
+
+// Key gets the key of a volume
+func (s *envSource) Key(ctx context.Context, volume string) ([]byte, error) {
+	suffix := strings.NewReplacer("-", "_", ".", "_").Replace(strings.ToUpper(volume))
+
+	for _, name := range []string{s.name + "_" + suffix, s.name} {
+		if key, exists := os.LookupEnv(name); exists {
+			return checkKey(volume, []byte(key))
+		}
+	}
+	return nil, fmt.Errorf("no key for volume '%s' in environment variable %s", volume, s.name)
+}
@@ -0,0 +1,49 @@
+package keys
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestEnvSource(t *testing.T) {
+	env := map[string]string{
+		"CLOUDVOL_TEST_KEY":             "0123456789abcdef-default",
+		"CLOUDVOL_TEST_KEY_WEB_DATA_V1": "0123456789abcdef-web",
+		"CLOUDVOL_TEST_KEY_SHORT":       "short",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	tests := []struct {
+		volume string
+		key    string
+	}{
+		{"web-data.v1", "0123456789abcdef-web"},
+		{"other", "0123456789abcdef-default"},
+		{"short", ""},
+	}
+
+	source := NewEnvSource("CLOUDVOL_TEST_KEY")
+	for _, test := range tests {
+		key, err := source.Key(context.Background(), test.volume)
+		if test.key == "" {
+			if err == nil {
+				t.Errorf("%s: expected error, got '%s'", test.volume, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.volume, err)
+		} else if string(key) != test.key {
+			t.Errorf("%s: expected '%s', got '%s'", test.volume, test.key, key)
+		}
+	}
+
+	if _, err := NewEnvSource("CLOUDVOL_TEST_UNSET").Key(context.Background(), "data"); err == nil {
+		t.Errorf("expected error for an unset variable")
+	}
+}
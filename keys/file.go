@@ -0,0 +1,42 @@
+package keys
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+const keyFileExtension = ".key"
+
+type fileSource struct {
+	path string
+}
+
+// NewFileSource creates a key source which reads <path>/<volume>.key if path is a directory,
+// or uses the contents of path as the key of every volume
+func NewFileSource(path string) Source {
+	return &fileSource{path: path}
+}
+
+// Key gets the key of a volume
+func (s *fileSource) Key(ctx context.Context, volume string) ([]byte, error) {
+	stat, err := os.Stat(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key for volume '%s': %v", volume, err)
+	}
+
+	file := s.path
+	if stat.IsDir() {
+		file = filepath.Join(s.path, filepath.Base(volume)+keyFileExtension)
+	}
+
+	key, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key for volume '%s': %v", volume, err)
+	}
+	return checkKey(volume, bytes.TrimRight(key, "\r\n"))
+}
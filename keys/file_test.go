@@ -0,0 +1,60 @@
+package keys
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cloudvol-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"data.key":   "0123456789abcdef-data\n",
+		"crlf.key":   "0123456789abcdef-crlf\r\n",
+		"short.key":  "short",
+		"single.txt": "0123456789abcdef-single",
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path   string
+		volume string
+		key    string
+	}{
+		{dir, "data", "0123456789abcdef-data"},
+		{dir, "crlf", "0123456789abcdef-crlf"},
+		{dir, "short", ""},
+		{dir, "missing", ""},
+		// volume names can't reach outside the key directory
+		{dir, "../" + filepath.Base(dir) + "/data", "0123456789abcdef-data"},
+		{filepath.Join(dir, "single.txt"), "anything", "0123456789abcdef-single"},
+		{filepath.Join(dir, "nothing"), "data", ""},
+	}
+
+	for _, test := range tests {
+		key, err := NewFileSource(test.path).Key(context.Background(), test.volume)
+		if test.key == "" {
+			if err == nil {
+				t.Errorf("%s %s: expected error, got '%s'", test.path, test.volume, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", test.path, test.volume, err)
+		} else if string(key) != test.key {
+			t.Errorf("%s %s: expected '%s', got '%s'", test.path, test.volume, test.key, key)
+		}
+	}
+}
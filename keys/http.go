@@ -0,0 +1,55 @@
+package keys
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	httpTimeout    = 10 * time.Second
+	maxKeyResponse = 4096
+)
+
+type httpSource struct {
+	base   string
+	client *http.Client
+}
+
+// NewHTTPSource creates a key source which gets the key of a volume from <base>/<volume> on a local key server
+func NewHTTPSource(base string) Source {
+	return &httpSource{
+		base:   strings.TrimSuffix(base, "/"),
+		client: &http.Client{Timeout: httpTimeout},
+	}
+}
+
+// Key gets the key of a volume
+func (s *httpSource) Key(ctx context.Context, volume string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, s.base+"/"+url.PathEscape(volume), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error contacting key server for volume '%s': %v", volume, err)
+	}
+
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error contacting key server for volume '%s': %v", volume, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("key server returned %s for volume '%s'", res.Status, volume)
+	}
+
+	key, err := ioutil.ReadAll(io.LimitReader(res.Body, maxKeyResponse))
+	if err != nil {
+		return nil, fmt.Errorf("error reading key for volume '%s': %v", volume, err)
+	}
+	return checkKey(volume, key)
+}
@@ -0,0 +1,81 @@
+package keys
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestHTTPSource(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		switch strings.TrimPrefix(r.URL.Path, "/keys/") {
+		case "data", "with space":
+			w.Write([]byte("0123456789abcdef"))
+		case "short":
+			w.Write([]byte("short"))
+		case "large":
+			w.Write([]byte(strings.Repeat("k", maxKeyResponse*2)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		volume string
+		length int
+	}{
+		{"data", 16},
+		{"with space", 16},
+		{"short", 0},
+		{"missing", 0},
+		// responses are cut off rather than read in full
+		{"large", maxKeyResponse},
+	}
+
+	source := NewHTTPSource(server.URL + "/keys/")
+	for _, test := range tests {
+		key, err := source.Key(context.Background(), test.volume)
+		if test.length == 0 {
+			if err == nil {
+				t.Errorf("%s: expected error, got '%s'", test.volume, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.volume, err)
+		} else if len(key) != test.length {
+			t.Errorf("%s: expected a key of %d bytes, got %d", test.volume, test.length, len(key))
+		}
+	}
+
+	if paths[0] != "/keys/data" || paths[1] != "/keys/with%20space" {
+		t.Errorf("unexpected request paths %v", paths)
+	}
+}
+
+func TestHTTPSourceCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := NewHTTPSource(server.URL).Key(ctx, "data"); err == nil {
+		t.Errorf("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > httpTimeout/2 {
+		t.Errorf("expected the request to end with its context, took %v", elapsed)
+	}
+}
@@ -0,0 +1,38 @@
+package keys
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// minKeyLength is the shortest key accepted from a source
+const minKeyLength = 16
+
+// Source provides the keys of encrypted volumes
+type Source interface {
+	// Key gets the key of a volume
+	Key(ctx context.Context, volume string) ([]byte, error)
+}
+
+// New creates a key source from a spec of the form file:<path>, env:<variable> or an http(s) URL
+func New(spec string) (Source, error) {
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		return NewFileSource(strings.TrimPrefix(spec, "file:")), nil
+	case strings.HasPrefix(spec, "env:"):
+		return NewEnvSource(strings.TrimPrefix(spec, "env:")), nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return NewHTTPSource(spec), nil
+	}
+	return nil, fmt.Errorf("unknown key source '%s', expected file:<path>, env:<variable> or a URL", spec)
+}
+
+// checkKey rejects keys which are too short to be safe
+func checkKey(volume string, key []byte) ([]byte, error) {
+	if len(key) < minKeyLength {
+		return nil, fmt.Errorf("key for volume '%s' is shorter than %d bytes", volume, minKeyLength)
+	}
+	return key, nil
+}
@@ -0,0 +1,60 @@
+package keys
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		spec   string
+		source Source
+	}{
+		{"file:/etc/cloudvol/keys", &fileSource{path: "/etc/cloudvol/keys"}},
+		{"env:CLOUDVOL_KEY", &envSource{name: "CLOUDVOL_KEY"}},
+		{"http://127.0.0.1:8200/keys/", &httpSource{base: "http://127.0.0.1:8200/keys"}},
+		{"https://keys.internal/v1", &httpSource{base: "https://keys.internal/v1"}},
+		{"/etc/cloudvol/keys", nil},
+		{"vault:secret/keys", nil},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		source, err := New(test.spec)
+		if test.source == nil {
+			if err == nil {
+				t.Errorf("'%s': expected error", test.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("'%s': unexpected error: %v", test.spec, err)
+			continue
+		}
+
+		switch expected := test.source.(type) {
+		case *fileSource:
+			if actual, ok := source.(*fileSource); !ok || actual.path != expected.path {
+				t.Errorf("'%s': expected file source %s, got %#v", test.spec, expected.path, source)
+			}
+		case *envSource:
+			if actual, ok := source.(*envSource); !ok || actual.name != expected.name {
+				t.Errorf("'%s': expected env source %s, got %#v", test.spec, expected.name, source)
+			}
+		case *httpSource:
+			if actual, ok := source.(*httpSource); !ok || actual.base != expected.base || actual.client == nil {
+				t.Errorf("'%s': expected http source %s, got %#v", test.spec, expected.base, source)
+			}
+		}
+	}
+}
+
+func TestCheckKey(t *testing.T) {
+	if _, err := checkKey("data", []byte(strings.Repeat("k", minKeyLength-1))); err == nil {
+		t.Errorf("expected a short key to be refused")
+	}
+	key := []byte(strings.Repeat("k", minKeyLength))
+	if checked, err := checkKey("data", key); err != nil || string(checked) != string(key) {
+		t.Errorf("expected key to be accepted, got '%s', %v", checked, err)
+	}
+}
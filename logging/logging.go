@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Configure sets the level and output format (text or json) of the standard logger and installs the
+// hook which redacts sensitive fields
+func Configure(level string, format string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+
+	log.SetLevel(lvl)
+	log.AddHook(&redactHook{})
+	return nil
+}
@@ -0,0 +1,126 @@
+package logging
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	redacted = "[redacted]"
+)
+
+// sensitiveFields are the words of field names whose values must never be logged
+var sensitiveFields = []string{
+	"credential",
+	"credentials",
+	"key",
+	"password",
+	"secret",
+	"signature",
+	"token",
+}
+
+// redactHook replaces the values of sensitive fields before an entry is written, and removes the
+// credentials from URLs in any other field
+type redactHook struct{}
+
+// Levels gets the levels the hook fires for
+func (h *redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire redacts the sensitive fields of the entry
+func (h *redactHook) Fire(entry *log.Entry) error {
+	for field, value := range entry.Data {
+		if IsSensitive(field) {
+			entry.Data[field] = redacted
+		} else if s, ok := value.(string); ok {
+			entry.Data[field] = RedactURL(s)
+		}
+	}
+	return nil
+}
+
+// IsSensitive checks if the named field holds a secret or the location of one, i.e. if one of the
+// words of its name, e.g. kms and key in kmsKey or KMS_KEY, is sensitive
+func IsSensitive(field string) bool {
+	for _, word := range fieldWords(field) {
+		for _, sensitive := range sensitiveFields {
+			if word == sensitive {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RedactOptions copies a set of options for logging, redacting the values of sensitive options and the
+// credentials in URLs
+func RedactOptions(opts map[string]string) map[string]string {
+	result := make(map[string]string, len(opts))
+	for key, value := range opts {
+		if IsSensitive(key) {
+			result[key] = redacted
+		} else {
+			result[key] = RedactURL(value)
+		}
+	}
+	return result
+}
+
+// RedactURL removes the user info from a URL and redacts its sensitive query parameters, e.g. the
+// signature of a signed URL; other values are returned unchanged
+func RedactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" {
+		return value
+	}
+
+	u.User = nil
+	if u.RawQuery != "" {
+		query := u.Query()
+		for param := range query {
+			if IsSensitive(param) {
+				query.Set(param, redacted)
+			}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// fieldWords splits a field name into lowercase words at punctuation and where camel case starts a
+// new word
+func fieldWords(field string) []string {
+	var words []string
+	var word []rune
+	runes := []rune(field)
+
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			if len(word) > 0 {
+				words = append(words, string(word))
+				word = nil
+			}
+			continue
+		}
+		// a capital after a lowercase letter starts a word, as does the last capital of an acronym
+		// followed by a lowercase letter, e.g. the K of KMSKey
+		if unicode.IsUpper(r) && len(word) > 0 && i > 0 &&
+			(unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			words = append(words, string(word))
+			word = nil
+		}
+		word = append(word, unicode.ToLower(r))
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+	return words
+}
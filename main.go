@@ -1,73 +1,67 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
-
-	log "github.com/Sirupsen/logrus"
-	"github.com/docker/go-plugins-helpers/volume"
-	"github.com/gordonmleigh/redpill"
-	"github.com/stugotech/cloudvol2/driver"
-	"github.com/stugotech/cloudvol2/fs"
-	"github.com/stugotech/cloudvol2/plugin"
+	"strings"
 )
 
 const (
 	driverName = "cloudvol"
 	mountPath  = "/mnt"
+	envPrefix  = "CLOUDVOL_"
 )
 
-func main() {
-	log.WithFields(log.Fields{"pid": os.Getpid()}).Info("*** STARTED cloudvol volume driver ***")
+// command is a cloudvol subcommand
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(cmd *command, args []string) error
+}
 
-	mode := flag.String("mode", "fs", "storage mode (fs, gce, aws)")
-	port := flag.Int("port", 8080, "port to listen on (ignored if sock is set)")
-	sock := flag.Bool("sock", false, "listen on a unix socket")
-	flag.Parse()
+func main() {
+	args := os.Args[1:]
 
-	var cfs fs.Filesystem
-	c, err := redpill.GetContainerID()
-	if err != nil {
-		log.WithError(err).Warn("can't get container id")
+	// without a subcommand run the daemon, as earlier versions did
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		runServe(findCommand("serve"), args)
+		return
 	}
 
-	if c != "" {
-		log.WithFields(log.Fields{"container": c}).Info("running in container")
-		cfs = fs.NewFilesystemBasePath("/host")
-	} else {
-		cfs = fs.NewFilesystem()
+	if args[0] == "help" {
+		usage()
+		return
 	}
 
-	log.WithFields(log.Fields{"mode": *mode}).Info("creating storage driver")
-	d, err := createStorageDriver(*mode, mountPath, cfs)
-
-	if err != nil {
-		log.WithError(err).Fatal("stopping due to last error")
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n", args[0])
+		usage()
+		os.Exit(2)
 	}
 
-	plugin := plugin.NewCloudvolPlugin(d)
-	handler := volume.NewHandler(plugin)
-
-	if !*sock {
-		log.WithFields(log.Fields{"port": *port}).Infof("listening on port %d", *port)
-		addr := fmt.Sprintf(":%d", *port)
-		err = handler.ServeTCP(driverName, addr, nil)
-	} else {
-		log.Infof("listening on socket file")
-		err = handler.ServeUnix(driverName, 0)
+	if err := cmd.run(cmd, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
 	}
+}
 
-	if err != nil {
-		log.Fatal(err)
-	} else {
-		log.Info("Started.")
+// findCommand gets a subcommand by name
+func findCommand(name string) *command {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd
+		}
 	}
+	return nil
 }
 
-func createStorageDriver(name string, mountPath string, cfs fs.Filesystem) (driver.Driver, error) {
-	if name == "gce" {
-		return driver.NewGceDriver(mountPath, cfs)
+// usage prints the list of subcommands
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] [args]\n\ncommands:\n", driverName)
+	for _, cmd := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-36s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
 	}
-	return nil, fmt.Errorf("unknown driver type '%s'", name)
+	fmt.Fprintf(os.Stderr, "\nrun '%s <command> -h' for the flags of a command\n", driverName)
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stugotech/cloudvol2/admin"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// printJSON writes a value as indented json
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// printTable writes rows aligned in columns
+func printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// printVolumes writes a list of volumes
+func printVolumes(format string, vols []*admin.Volume) error {
+	if format == formatJSON {
+		return printJSON(vols)
+	}
+
+	rows := make([][]string, 0, len(vols))
+	for _, vol := range vols {
+		rows = append(rows, []string{vol.Name, volumeLocation(vol), fmt.Sprint(vol.Ready), vol.Path})
+	}
+	return printTable([]string{"NAME", "LOCATION", "READY", "MOUNTPOINT"}, rows)
+}
+
+// volumeLocation gets the zone or region of a volume from its status, if the driver reports one
+func volumeLocation(vol *admin.Volume) string {
+	for _, key := range []string{"zone", "region"} {
+		if location, ok := vol.Status[key].(string); ok {
+			return location
+		}
+	}
+	return ""
+}
+
+// printOptions writes the volume options of a driver
+func printOptions(format string, opts []*admin.Option) error {
+	if format == formatJSON {
+		return printJSON(opts)
+	}
+
+	rows := make([][]string, 0, len(opts))
+	for _, opt := range opts {
+		name := opt.Name
+		if opt.Prefix {
+			name += "<key>"
+		}
+
+		kind := opt.Type
+		switch {
+		case len(opt.Values) > 0:
+			kind = strings.Join(opt.Values, "|")
+		case opt.Min != 0 && opt.Max != 0:
+			kind = fmt.Sprintf("%s %d-%d", opt.Type, opt.Min, opt.Max)
+		case opt.Min != 0:
+			kind = fmt.Sprintf("%s >= %d", opt.Type, opt.Min)
+		}
+
+		rows = append(rows, []string{name, kind, opt.Default, opt.Description})
+	}
+	return printTable([]string{"OPTION", "TYPE", "DEFAULT", "DESCRIPTION"}, rows)
+}
+
+// printVolume writes the details of a volume
+func printVolume(format string, vol *admin.Volume) error {
+	if format == formatJSON {
+		return printJSON(vol)
+	}
+
+	rows := [][]string{
+		{"Name", vol.Name},
+		{"Ready", fmt.Sprint(vol.Ready)},
+		{"Mountpoint", vol.Path},
+	}
+
+	keys := make([]string, 0, len(vol.Status))
+	for key := range vol.Status {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		rows = append(rows, []string{key, formatValue(vol.Status[key])})
+	}
+	return printTable([]string{"FIELD", "VALUE"}, rows)
+}
+
+// printOperation writes the state of an operation
+func printOperation(format string, op *admin.Operation) error {
+	if format == formatJSON {
+		return printJSON(op)
+	}
+
+	row := []string{op.ID, op.Type, op.Volume, op.State, op.Error}
+	if op.Result != nil {
+		row = append(row, formatValue(op.Result))
+	}
+	return printTable([]string{"ID", "TYPE", "VOLUME", "STATE", "ERROR", "RESULT"}, [][]string{row})
+}
+
+// printReconcile writes the result of a reconcile
+func printReconcile(format string, result *admin.ReconcileResult) error {
+	if format == formatJSON {
+		return printJSON(result)
+	}
+
+	rows := make([][]string, 0, len(result.Actions))
+	for _, action := range result.Actions {
+		rows = append(rows, []string{action.Volume, action.Action, action.Reason, action.Error})
+	}
+	return printTable([]string{"VOLUME", "ACTION", "REASON", "ERROR"}, rows)
+}
+
+// printBackups writes a list of backups
+func printBackups(format string, backups []*admin.Backup) error {
+	if format == formatJSON {
+		return printJSON(backups)
+	}
+
+	rows := make([][]string, 0, len(backups))
+	for _, b := range backups {
+		rows = append(rows, []string{
+			b.Volume,
+			b.ID,
+			b.Created.Format(time.RFC3339),
+			b.Source,
+			fmt.Sprint(b.Files),
+			formatBytes(b.Size),
+			formatBytes(b.Stored),
+		})
+	}
+	return printTable([]string{"VOLUME", "ID", "CREATED", "SOURCE", "FILES", "SIZE", "STORED"}, rows)
+}
+
+// formatBytes formats a size in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatValue formats a status value for a table cell
+func formatValue(v interface{}) string {
+	switch v.(type) {
+	case string, bool, int, int64, float64:
+		return fmt.Sprint(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
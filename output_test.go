@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stugotech/cloudvol2/admin"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n        int64
+		expected string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{10 << 20, "10.0MiB"},
+		{3 << 30, "3.0GiB"},
+		{5 << 40, "5.0TiB"},
+	}
+	for _, test := range tests {
+		if formatted := formatBytes(test.n); formatted != test.expected {
+			t.Errorf("%d: expected '%s', got '%s'", test.n, test.expected, formatted)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{"text", "text"},
+		{true, "true"},
+		{int64(10), "10"},
+		{float64(1.5), "1.5"},
+		{[]string{"a", "b"}, `["a","b"]`},
+		{map[string]interface{}{"team": "a"}, `{"team":"a"}`},
+	}
+	for _, test := range tests {
+		if formatted := formatValue(test.value); formatted != test.expected {
+			t.Errorf("%v: expected '%s', got '%s'", test.value, test.expected, formatted)
+		}
+	}
+}
+
+func TestVolumeLocation(t *testing.T) {
+	tests := []struct {
+		status   map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"zone": "europe-west1-b"}, "europe-west1-b"},
+		{map[string]interface{}{"region": "europe-west1"}, "europe-west1"},
+		{map[string]interface{}{}, ""},
+		{nil, ""},
+	}
+	for _, test := range tests {
+		if location := volumeLocation(&admin.Volume{Status: test.status}); location != test.expected {
+			t.Errorf("%v: expected '%s', got '%s'", test.status, test.expected, location)
+		}
+	}
+}
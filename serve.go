@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/stugotech/cloudvol2/admin"
+	"github.com/stugotech/cloudvol2/driver"
+	"github.com/stugotech/cloudvol2/logging"
+	"github.com/stugotech/cloudvol2/plugin"
+	"golang.org/x/net/context"
+)
+
+// runServe runs the volume plugin daemon
+func runServe(cmd *command, args []string) error {
+	flags := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	port := flags.Int("port", 8080, "port to listen on (ignored if sock is set)")
+	host := flags.String("host", "", "address to listen on (ignored if sock is set)")
+	sock := flags.Bool("sock", false, "listen on a unix socket")
+	tls := addServerTLSFlags(flags)
+	tlsClientCert := flags.String("tlsclientcert", "", "client certificate docker presents, written to the spec file")
+	tlsClientKey := flags.String("tlsclientkey", "", "client key docker presents, written to the spec file")
+	specDir := flags.String("spec-dir", "/etc/docker/plugins", "directory to write the plugin spec file to")
+	drv := addDriverFlags(flags)
+	bak := addBackupFlags(flags)
+	logLevel := flags.String("log-level", "info", "log level (debug, info, warn, error)")
+	logFormat := flags.String("log-format", "text", "log format (text, json)")
+	adminSock := flags.String("admin-sock", defaultAdminSock, "unix socket for the admin API (empty to disable)")
+	adminAddr := flags.String("admin-addr", "", "TCP address for the admin API, requires tlscert, tlskey and tlscacert")
+	scheduleInterval := flags.Duration("schedule-interval", time.Minute, "how often to check for scheduled snapshots which are due (0 to disable)")
+
+	if err := flagsFromEnv(flags); err != nil {
+		log.WithError(err).Fatal("invalid flag value in environment")
+	}
+	flags.Parse(args)
+
+	if err := logging.Configure(*logLevel, *logFormat); err != nil {
+		log.WithError(err).Fatal("invalid logging configuration")
+	}
+	if !*sock {
+		if err := checkPluginTLS(tls, *tlsClientCert, *tlsClientKey); err != nil {
+			log.WithError(err).Fatal("incomplete TLS configuration")
+		}
+	}
+
+	log.WithFields(log.Fields{"pid": os.Getpid()}).Info("*** STARTED cloudvol volume driver ***")
+
+	cfs := drv.filesystem()
+	d, err := drv.create(cfs)
+	if err != nil {
+		log.WithError(err).Fatal("stopping due to last error")
+	}
+	backups, err := bak.create(cfs)
+	if err != nil {
+		log.WithError(err).Fatal("invalid backup configuration")
+	}
+
+	startAdmin(admin.NewService(d, backups), *adminSock, *adminAddr, tls)
+	startSchedules(d, *scheduleInterval)
+
+	plugin := plugin.NewCloudvolPlugin(d)
+	handler := volume.NewHandler(plugin)
+
+	if !*sock && *tls.cert != "" {
+		addr := fmt.Sprintf("%s:%d", *host, *port)
+		err = serveTLS(handler, addr, *specDir, tls, *tlsClientCert, *tlsClientKey)
+	} else if !*sock {
+		log.WithFields(log.Fields{"port": *port}).Warn("TCP listener has no TLS configured, any client on the network can manage volumes")
+		log.WithFields(log.Fields{"port": *port}).Infof("listening on port %d", *port)
+		addr := fmt.Sprintf("%s:%d", *host, *port)
+		err = handler.ServeTCP(driverName, addr, nil)
+	} else {
+		log.Infof("listening on socket file")
+		err = handler.ServeUnix(driverName, 0)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	} else {
+		log.Info("Started.")
+	}
+	return nil
+}
+
+// startAdmin serves the admin API in the background
+func startAdmin(service admin.API, sock string, addr string, tls *tlsFlags) {
+	server := admin.NewServer(service)
+
+	if sock != "" {
+		go func() {
+			log.WithError(server.ServeUnix(sock)).Error("admin API socket listener stopped")
+		}()
+	}
+
+	if addr != "" {
+		config, err := newServerTLSConfig(*tls.cert, *tls.key, *tls.caCert)
+		if err != nil {
+			log.WithError(err).Fatal("admin API requires TLS on TCP")
+		}
+		go func() {
+			log.WithError(server.ServeTCP(addr, config)).Error("admin API TCP listener stopped")
+		}()
+	}
+}
+
+// startSchedules runs the driver's scheduled jobs in the background
+func startSchedules(d driver.Driver, interval time.Duration) {
+	scheduler, ok := d.(driver.Scheduler)
+	if !ok || interval <= 0 {
+		return
+	}
+	go scheduler.RunSchedules(context.Background(), interval)
+}
+
+// checkPluginTLS makes sure the TLS flags of the plugin's TCP listener are all set or all empty, so that
+// a partial configuration neither falls back to plaintext nor leaves docker unable to connect
+func checkPluginTLS(tls *tlsFlags, clientCert string, clientKey string) error {
+	flags := []struct {
+		name  string
+		value string
+	}{
+		{"tlscert", *tls.cert},
+		{"tlskey", *tls.key},
+		{"tlscacert", *tls.caCert},
+		{"tlsclientcert", clientCert},
+		{"tlsclientkey", clientKey},
+	}
+
+	var set, missing []string
+	for _, f := range flags {
+		if f.value == "" {
+			missing = append(missing, "-"+f.name)
+		} else {
+			set = append(set, "-"+f.name)
+		}
+	}
+	if len(set) > 0 && len(missing) > 0 {
+		return fmt.Errorf("%s set without %s", strings.Join(set, ", "), strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// serveTLS serves the plugin API over mutual TLS and writes an https spec file for docker
+func serveTLS(handler *volume.Handler, addr string, specDir string, tls *tlsFlags, clientCert string, clientKey string) error {
+	config, err := newServerTLSConfig(*tls.cert, *tls.key, *tls.caCert)
+	if err != nil {
+		return err
+	}
+
+	l, err := listenTLS(addr, config)
+	if err != nil {
+		return err
+	}
+
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	url := fmt.Sprintf("https://%s", net.JoinHostPort(host, port))
+
+	if clientCert == "" || clientKey == "" {
+		return fmt.Errorf("no client certificate configured for the spec file, docker would not be able to connect")
+	}
+
+	spec, err := writeSpecFile(specDir, driverName, url, &pluginSpecTLS{
+		CAFile:   *tls.caCert,
+		CertFile: clientCert,
+		KeyFile:  clientKey,
+	})
+	if err != nil {
+		return fmt.Errorf("error writing spec file: %v", err)
+	}
+	defer os.Remove(spec)
+
+	log.WithFields(log.Fields{"url": url, "spec": spec}).Info("listening with mutual TLS")
+	return handler.Serve(l)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// pluginSpec is the json plugin discovery file read by docker
+type pluginSpec struct {
+	Name      string
+	Addr      string
+	TLSConfig *pluginSpecTLS `json:",omitempty"`
+}
+
+// pluginSpecTLS is the TLS configuration docker uses to connect to the plugin
+type pluginSpecTLS struct {
+	InsecureSkipVerify bool
+	CAFile             string `json:",omitempty"`
+	CertFile           string `json:",omitempty"`
+	KeyFile            string `json:",omitempty"`
+}
+
+// newServerTLSConfig creates a TLS config which only accepts clients presenting a certificate signed by the given CA
+func newServerTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, fmt.Errorf("TLS requires a certificate, a key and a client CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading server certificate: %v", err)
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client CA '%s': %v", caFile, err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in client CA '%s'", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// listenTLS opens a TCP listener which performs a mutual TLS handshake on every connection
+func listenTLS(addr string, config *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, config), nil
+}
+
+// writeSpecFile writes a json spec file so that docker can find the plugin at the given url
+func writeSpecFile(dir string, name string, url string, tlsConfig *pluginSpecTLS) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	data, err := json.MarshalIndent(&pluginSpec{Name: name, Addr: url, TLSConfig: tlsConfig}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	spec := filepath.Join(dir, name+".json")
+	if err := ioutil.WriteFile(spec, data, 0644); err != nil {
+		return "", err
+	}
+	return spec, nil
+}
+
+// newClientTLSConfig creates a TLS config which presents a client certificate and verifies the server with the given CA
+func newClientTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, fmt.Errorf("TLS requires a client certificate, a key and a CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading client certificate: %v", err)
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA '%s': %v", caFile, err)
+	}
+
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in CA '%s'", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      rootCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}